@@ -134,6 +134,7 @@ make_bigquery() {
     else
         echo "Creating BigQuery table ${datatable}..."
         bq --project_id "${project}" mk --table --description "${desc}" \
+            --time_partitioning_field date --clustering_fields service,slo \
             "${datatable}" bq_schema.json
     fi
 
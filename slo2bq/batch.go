@@ -0,0 +1,115 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+
+	"slo2bq/clients"
+)
+
+// tableKey identifies a BigQuery table that rows are written to.
+type tableKey struct {
+	dataset, table string
+}
+
+// tableBatch contains rows of a table that have not been written yet.
+type tableBatch struct {
+	key  tableKey
+	rows []*clients.BQRow
+}
+
+// batchWriter accumulates rows per target table, and writes the rows of a table once there are batchSize
+// of them. Tables are flushed independently, in the order they were first written to.
+type batchWriter struct {
+	cfg       *Config
+	batchSize int
+	write     func(ctx context.Context, dataset, table string, rows []*clients.BQRow) error
+	batches   []*tableBatch
+	// last is the batch rows were last added to. Syncs mostly write to a single table, so rows are
+	// usually added to it without looking up the table.
+	last *tableBatch
+}
+
+// newBatchWriter returns a batchWriter writing batches of batchSize rows using write.
+func newBatchWriter(cfg *Config, batchSize int, write func(ctx context.Context, dataset, table string, rows []*clients.BQRow) error) *batchWriter {
+	return &batchWriter{cfg: cfg, batchSize: batchSize, write: write}
+}
+
+// batch returns the batch of a given table, creating it if needed.
+func (w *batchWriter) batch(dataset, table string) *tableBatch {
+	key := tableKey{dataset, table}
+	if w.last != nil && w.last.key == key {
+		return w.last
+	}
+	for _, b := range w.batches {
+		if b.key == key {
+			w.last = b
+			return b
+		}
+	}
+	w.last = &tableBatch{key: key}
+	w.batches = append(w.batches, w.last)
+	return w.last
+}
+
+// add adds a row to be written to a given table, writing all rows of the table if the batch is full.
+func (w *batchWriter) add(ctx context.Context, dataset, table string, row *clients.BQRow) error {
+	b := w.batch(dataset, table)
+	b.rows = append(b.rows, row)
+	if len(b.rows) >= w.batchSize {
+		logEntry(w.cfg, severityInfo, logFields{"count": len(b.rows), "table": table}, "Flushing %d rows to BigQuery table %s", len(b.rows), table)
+		return w.flushBatch(ctx, b)
+	}
+	return nil
+}
+
+// pendingRows returns rows of all tables that have not been written yet.
+func (w *batchWriter) pendingRows() []*clients.BQRow {
+	var rows []*clients.BQRow
+	for _, b := range w.batches {
+		rows = append(rows, b.rows...)
+	}
+	return rows
+}
+
+// pendingCount returns the number of rows of all tables that have not been written yet.
+func (w *batchWriter) pendingCount() int {
+	n := 0
+	for _, b := range w.batches {
+		n += len(b.rows)
+	}
+	return n
+}
+
+// flushBatch writes the rows of a batch.
+func (w *batchWriter) flushBatch(ctx context.Context, b *tableBatch) error {
+	if err := w.write(ctx, b.key.dataset, b.key.table, b.rows); err != nil {
+		return err
+	}
+	b.rows = nil
+	return nil
+}
+
+// flush writes the rows of all tables that have not been written yet. Tables rows have been added to
+// before are written to even if all of their rows have already been written.
+func (w *batchWriter) flush(ctx context.Context) error {
+	for _, b := range w.batches {
+		if err := w.flushBatch(ctx, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"slo2bq/clients"
+)
+
+// recordingWrite returns a write function for batchWriter that records the SLO names of written rows
+// as "dataset.table:slo1,slo2".
+func recordingWrite(writes *[]string) func(context.Context, string, string, []*clients.BQRow) error {
+	return func(_ context.Context, dataset, table string, rows []*clients.BQRow) error {
+		var names []string
+		for _, r := range rows {
+			names = append(names, r.SLO)
+		}
+		*writes = append(*writes, fmt.Sprintf("%s.%s:%s", dataset, table, strings.Join(names, ",")))
+		return nil
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	var writes []string
+	w := newBatchWriter(&Config{}, 2, recordingWrite(&writes))
+	ctx := context.Background()
+	for _, a := range []struct{ dataset, table, slo string }{
+		{"ds", "data", "a1"},
+		{"ds", "period_to_date", "b1"},
+		{"other", "data", "c1"},
+		{"ds", "data", "a2"},
+		{"ds", "period_to_date", "b2"},
+		{"ds", "data", "a3"},
+	} {
+		if err := w.add(ctx, a.dataset, a.table, &clients.BQRow{SLO: a.slo}); err != nil {
+			t.Fatalf("add() unexpected error: %v", err)
+		}
+	}
+	// Each table is written once it has two rows of its own.
+	want := []string{"ds.data:a1,a2", "ds.period_to_date:b1,b2"}
+	if !reflect.DeepEqual(writes, want) {
+		t.Errorf("writes after add() = %q; want %q", writes, want)
+	}
+	if got := w.pendingCount(); got != 2 {
+		t.Errorf("pendingCount() = %d; want 2", got)
+	}
+	var pending []string
+	for _, r := range w.pendingRows() {
+		pending = append(pending, r.SLO)
+	}
+	if want := []string{"a3", "c1"}; !reflect.DeepEqual(pending, want) {
+		t.Errorf("pendingRows() returned SLOs %q; want %q", pending, want)
+	}
+
+	writes = nil
+	if err := w.flush(ctx); err != nil {
+		t.Fatalf("flush() unexpected error: %v", err)
+	}
+	// Tables are flushed in the order they were first written to, including ones without pending rows.
+	want = []string{"ds.data:a3", "ds.period_to_date:", "other.data:c1"}
+	if !reflect.DeepEqual(writes, want) {
+		t.Errorf("writes after flush() = %q; want %q", writes, want)
+	}
+	if got := w.pendingCount(); got != 0 {
+		t.Errorf("pendingCount() after flush() = %d; want 0", got)
+	}
+}
+
+func TestBatchWriterError(t *testing.T) {
+	var writes []string
+	record := recordingWrite(&writes)
+	w := newBatchWriter(&Config{}, 10, func(ctx context.Context, dataset, table string, rows []*clients.BQRow) error {
+		if table == "broken" {
+			return fmt.Errorf("write failed")
+		}
+		return record(ctx, dataset, table, rows)
+	})
+	ctx := context.Background()
+	w.add(ctx, "ds", "broken", &clients.BQRow{SLO: "a1"})
+	w.add(ctx, "ds", "data", &clients.BQRow{SLO: "b1"})
+	if err := w.flush(ctx); err == nil || !strings.Contains(err.Error(), "write failed") {
+		t.Errorf("flush() expected error to contain 'write failed'; got %v", err)
+	}
+	// Rows that could not be written are kept, and later tables are not written.
+	if got := w.pendingCount(); got != 2 {
+		t.Errorf("pendingCount() = %d; want 2", got)
+	}
+	if len(writes) != 0 {
+		t.Errorf("expected no writes; got %q", writes)
+	}
+}
@@ -16,52 +16,355 @@ package slo2bq
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
+	"log"
 	"strconv"
+	"sync"
 
 	"slo2bq/clients"
 )
 
 const bqLeaseLabelName = "slo2bq_lease_expiration"
 
+// maxLeaseOwnerLength keeps lease label values within the 63 character limit BigQuery has for label
+// values, leaving room for the expiration timestamp and a separator.
+const maxLeaseOwnerLength = 50
+
+// leaseReleaseTimeout limits the duration of releasing a lease once the sync is over.
+const leaseReleaseTimeout = 30 * time.Second
+
+// lastSuccessLabelName is the dataset label storing the time (as a Unix timestamp) when the last
+// successful sync finished.
+const lastSuccessLabelName = "slo2bq_last_success"
+
+// leaseAttempts is the number of times reading and writing lease metadata is attempted when it fails with
+// a transient error.
+var leaseAttempts = 4
+
+// leaseRetryDelay is the delay before the first retry of a lease operation. It is doubled after every attempt.
+var leaseRetryDelay = time.Second
+
 // BqLease provides a simple lease mechanism that uses BigQuery dataset metadata as a key/value store.
 type bqLease struct {
 	bq      clients.BigQueryClient
 	dataset string
+
+	// owner identifies the process holding the lease.
+	owner string
+
+	mu sync.Mutex
+	// value is the label value written by this process, used to detect whether the lease is still ours.
+	value string
+	// isLost is set when another process is found to hold the lease, or the lease has expired.
+	isLost bool
+
+	// stop and done are used to terminate the background renewal goroutine, if one is running.
+	stop chan struct{}
+	done chan struct{}
 }
 
-// NewBqLease tries to obtain a new lease valid until `expiration` timestamp.
+// NewBqLease tries to obtain a new lease valid until `expiration` timestamp on behalf of `owner`, which
+// is stored alongside the expiration time to help diagnosing runs skipped because of an existing lease.
 // An error is returned if there is an existing lease with expiration time in the future, or
 // if another process manages to update lease information concurrently with this function.
-func newBqLease(ctx context.Context, client clients.BigQueryClient, dataset string, expiration time.Time) (*bqLease, error) {
-	exp, etag, err := client.ReadDatasetMetadataLabel(ctx, dataset, bqLeaseLabelName)
+func newBqLease(ctx context.Context, client clients.BigQueryClient, dataset, owner string, expiration time.Time) (*bqLease, error) {
+	var exp, etag string
+	err := retryTransient(ctx, "Reading BQ lease", func() error {
+		var err error
+		exp, etag, err = client.ReadDatasetMetadataLabel(ctx, dataset, bqLeaseLabelName)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	if exp != "" {
-		// Label value is expiration time as a Unix timestamp (stored as a string).
-		// I wish we could use time.RFC3339 here, but it violates allowed character set for label values.
-		ts, err := strconv.ParseInt(exp, 10, 64)
+		t, holder, err := parseLeaseValue(exp)
 		if err != nil {
-			return nil, fmt.Errorf("Could not parse BQ lease expiration time %v: %v", exp, err)
+			return nil, err
 		}
-		if t := time.Unix(ts, 0); t.After(time.Now()) {
-			return nil, fmt.Errorf("Could not obtain BQ lease: existing lease is still valid until %v", t)
+		if t.After(time.Now()) {
+			if holder == "" {
+				holder = "unknown owner"
+			}
+			return nil, fmt.Errorf("Could not obtain BQ lease: existing lease is still valid until %v (held by %s)", t, holder)
 		}
 	}
 
-	value := strconv.FormatInt(expiration.Unix(), 10)
-	if err := client.WriteDatasetMetadataLabel(ctx, dataset, bqLeaseLabelName, value, etag); err != nil {
+	owner = sanitizeLeaseOwner(owner)
+	value := formatLeaseValue(expiration, owner)
+	var retried bool
+	err = retryTransient(ctx, "Writing BQ lease", func() error {
 		// Passing `etag` ensures that an update will fail if metadata has been modified by someone else.
+		err := client.WriteDatasetMetadataLabel(ctx, dataset, bqLeaseLabelName, value, etag)
+		if err != nil && retried && !clients.IsTransient(err) {
+			// A previous attempt might have updated metadata despite returning an error, in which case
+			// the etag no longer matches, but the lease is ours.
+			if v, _, rerr := client.ReadDatasetMetadataLabel(ctx, dataset, bqLeaseLabelName); rerr == nil && v == value {
+				return nil
+			}
+		}
+		retried = true
+		return err
+	})
+	if err != nil {
 		return nil, fmt.Errorf("Could not update BQ lease: %v", err)
 	}
-	return &bqLease{bq: client, dataset: dataset}, nil
+	return &bqLease{bq: client, dataset: dataset, owner: owner, value: value}, nil
+}
+
+// formatLeaseValue returns the lease label value for a given expiration time and owner.
+// Label value is expiration time as a Unix timestamp (stored as a string), followed by an underscore
+// and the owner if it's known. I wish we could use time.RFC3339 here, but it violates allowed character
+// set for label values.
+func formatLeaseValue(expiration time.Time, owner string) string {
+	value := strconv.FormatInt(expiration.Unix(), 10)
+	if owner != "" {
+		value += "_" + owner
+	}
+	return value
+}
+
+// parseLeaseValue parses a lease label value written by formatLeaseValue. Values written by older
+// versions only contain the expiration timestamp, in which case the returned owner is empty.
+func parseLeaseValue(v string) (time.Time, string, error) {
+	exp, owner := v, ""
+	if i := strings.IndexByte(v, '_'); i >= 0 {
+		exp, owner = v[:i], v[i+1:]
+	}
+	ts, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("Could not parse BQ lease expiration time %v: %v", v, err)
+	}
+	return time.Unix(ts, 0), owner, nil
+}
+
+// sanitizeLeaseOwner converts an owner identifier to the character set allowed in label values
+// (lowercase letters, digits, dashes and underscores) and truncates it to maxLeaseOwnerLength.
+func sanitizeLeaseOwner(owner string) string {
+	owner = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, owner)
+	if len(owner) > maxLeaseOwnerLength {
+		owner = owner[:maxLeaseOwnerLength]
+	}
+	return owner
+}
+
+// leaseOwner returns an identifier of this process, consisting of the host name and a random suffix
+// that distinguishes several processes running on the same host.
+func leaseOwner() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	suffix := hex.EncodeToString(b)
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return suffix
+	}
+	// The suffix is kept when a long host name gets truncated.
+	if len(host) > maxLeaseOwnerLength-len(suffix)-1 {
+		host = host[:maxLeaseOwnerLength-len(suffix)-1]
+	}
+	return host + "-" + suffix
 }
 
-// Close releases the obtained lease by clearing the expiration time.
+// retryTransient calls f until it succeeds or returns an error that is not transient, up to leaseAttempts
+// times, with exponential backoff. The last error is returned.
+func retryTransient(ctx context.Context, op string, f func() error) error {
+	delay := leaseRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !clients.IsTransient(err) || attempt >= leaseAttempts {
+			return err
+		}
+		log.Printf("%s failed: %v; retrying in %v", op, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// BreakLease unconditionally clears an existing lease, regardless of its expiration time. It should
+// only be used to recover from a stuck lease, since it allows several processes to run concurrently.
+func BreakLease(ctx context.Context, client clients.BigQueryClient, dataset string) error {
+	exp, _, err := client.ReadDatasetMetadataLabel(ctx, dataset, bqLeaseLabelName)
+	if err != nil {
+		return err
+	}
+	if exp == "" {
+		return nil
+	}
+	log.Printf("WARNING: forcibly breaking BQ lease on dataset %s with expiration %q", dataset, exp)
+	return client.WriteDatasetMetadataLabel(ctx, dataset, bqLeaseLabelName, "", "")
+}
+
+// Renew extends the lease until `expiration`. Transient errors are retried. An error is returned if the
+// lease is now held by another process, or if lease information has been updated concurrently with this
+// function, in both cases marking the lease as lost.
+func (l *bqLease) Renew(ctx context.Context, expiration time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	value := formatLeaseValue(expiration, l.owner)
+	err := retryTransient(ctx, "Renewing BQ lease", func() error {
+		exp, etag, err := l.bq.ReadDatasetMetadataLabel(ctx, l.dataset, bqLeaseLabelName)
+		if err != nil {
+			return err
+		}
+		if exp == value {
+			// A previous attempt has updated metadata despite returning an error.
+			return nil
+		}
+		if exp != l.value {
+			l.isLost = true
+			return fmt.Errorf("expected lease expiration %q; got %q", l.value, exp)
+		}
+		return l.bq.WriteDatasetMetadataLabel(ctx, l.dataset, bqLeaseLabelName, value, etag)
+	})
+	if err != nil {
+		if clients.IsPreconditionFailed(err) {
+			l.isLost = true
+		}
+		return fmt.Errorf("Could not renew BQ lease: %v", err)
+	}
+	l.value = value
+	return nil
+}
+
+// renewInBackground starts a goroutine that renews the lease for `duration` every `duration/2` until
+// the lease is closed, computing expiration times using `now`. The returned context is cancelled if the lease is lost, or if it expires
+// because renewal keeps failing.
+func (l *bqLease) renewInBackground(ctx context.Context, duration time.Duration, now func() time.Time) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		defer cancel()
+		t := time.NewTicker(duration / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				err := l.Renew(ctx, now().Add(duration))
+				if err == nil {
+					continue
+				}
+				l.mu.Lock()
+				exp, _, _ := parseLeaseValue(l.value)
+				if !exp.After(now()) {
+					// Another process may obtain an expired lease at any time.
+					l.isLost = true
+				}
+				lost := l.isLost
+				l.mu.Unlock()
+				if lost {
+					log.Printf("Cancelling sync: %v", err)
+					return
+				}
+				log.Printf("%v; will retry until the lease expires at %v", err, exp)
+			}
+		}
+	}()
+	return ctx
+}
+
+// Close releases the obtained lease by clearing the expiration time. A lease that has been taken
+// over by another process is left intact.
 func (l *bqLease) Close(ctx context.Context) error {
-	return l.bq.WriteDatasetMetadataLabel(ctx, l.dataset, bqLeaseLabelName, "", "")
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isLost {
+		return fmt.Errorf("BQ lease is held by another process")
+	}
+	var exp, etag string
+	err := retryTransient(ctx, "Reading BQ lease", func() error {
+		var err error
+		exp, etag, err = l.bq.ReadDatasetMetadataLabel(ctx, l.dataset, bqLeaseLabelName)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if exp != l.value {
+		l.isLost = true
+		return fmt.Errorf("BQ lease is held by another process: expected lease expiration %q; got %q", l.value, exp)
+	}
+	var retried bool
+	return retryTransient(ctx, "Clearing BQ lease", func() error {
+		// Passing `etag` ensures that a lease obtained by someone else in the meantime is not cleared.
+		err := l.bq.WriteDatasetMetadataLabel(ctx, l.dataset, bqLeaseLabelName, "", etag)
+		if err != nil && retried && !clients.IsTransient(err) {
+			// A previous attempt might have cleared the lease despite returning an error.
+			if v, _, rerr := l.bq.ReadDatasetMetadataLabel(ctx, l.dataset, bqLeaseLabelName); rerr == nil && v == "" {
+				return nil
+			}
+		}
+		retried = true
+		return err
+	})
+}
+
+// Release closes the lease using a context that is not derived from the sync context, so that the lease
+// is released even if the sync has been cancelled (e.g. on shutdown) or has timed out. Errors are logged.
+func (l *bqLease) Release() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+	defer cancel()
+	if err := l.Close(ctx); err != nil {
+		log.Printf("Could not release BQ lease: %v", err)
+	}
+}
+
+// lost returns whether the lease is held by another process or has expired, in which case nothing should
+// be written anymore. A nil lease, used by dry runs, is never lost.
+func (l *bqLease) lost() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.isLost
+}
+
+// lastSuccess returns the time when the last successful sync of a dataset finished, or zero time if
+// it's not known.
+func lastSuccess(ctx context.Context, client clients.BigQueryClient, dataset string) (time.Time, error) {
+	v, _, err := client.ReadDatasetMetadataLabel(ctx, dataset, lastSuccessLabelName)
+	if err != nil || v == "" {
+		return time.Time{}, err
+	}
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Could not parse last success time %v: %v", v, err)
+	}
+	return time.Unix(ts, 0), nil
+}
+
+// recordSuccess records that a successful sync of a dataset finished at a given time.
+func recordSuccess(ctx context.Context, client clients.BigQueryClient, dataset string, t time.Time) error {
+	return client.WriteDatasetMetadataLabel(ctx, dataset, lastSuccessLabelName, strconv.FormatInt(t.Unix(), 10), "")
 }
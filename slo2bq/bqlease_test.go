@@ -17,6 +17,7 @@ package slo2bq
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"slo2bq/clients/mocks"
 	"strconv"
 	"strings"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"google.golang.org/api/googleapi"
 )
 
 func TestBQLease(t *testing.T) {
@@ -33,6 +35,7 @@ func TestBQLease(t *testing.T) {
 	}{
 		{"no lease exists", ""},
 		{"lease in the past", "123"},
+		{"lease in the past with owner", "123_host1-abcd"},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.Background()
@@ -42,13 +45,16 @@ func TestBQLease(t *testing.T) {
 			mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(tt.existingLease, "etag1", nil)
 			mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag1").Return(nil)
 
-			l, err := newBqLease(ctx, mock, "dsname", time.Unix(1337, 0))
+			l, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0))
 			if err != nil {
 				t.Errorf("newBqLease() unexpected error: %v", err)
 			}
 
-			mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "").Return(nil)
-			l.Close(ctx)
+			mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("1337", "etag2", nil)
+			mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "etag2").Return(nil)
+			if err := l.Close(ctx); err != nil {
+				t.Errorf("Close() unexpected error: %v", err)
+			}
 		})
 	}
 }
@@ -62,6 +68,9 @@ func TestBQLeaseErrors(t *testing.T) {
 		wantErr       string
 	}{
 		{"lease in the future", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10), nil, nil, "lease is still valid"},
+		{"lease in the future without owner", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10), nil, nil, "(held by unknown owner)"},
+		{"lease in the future with owner", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10) + "_host1-abcd", nil, nil, "(held by host1-abcd)"},
+		{"incorrect lease value with owner", "bogus_host1", nil, nil, "Could not parse BQ lease expiration"},
 		{"incorrect lease value", "bogus", nil, nil, "Could not parse BQ lease expiration"},
 		{"reading metadata returns error", "123", fmt.Errorf("error1"), nil, "error1"},
 		{"writing metadata returns error", "123", nil, fmt.Errorf("error2"), "error2"},
@@ -74,10 +83,500 @@ func TestBQLeaseErrors(t *testing.T) {
 			mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(tt.existingLease, "etag1", tt.readLabelErr)
 			mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag1").AnyTimes().Return(tt.writeLabelErr)
 
-			_, err := newBqLease(ctx, mock, "dsname", time.Unix(1337, 0))
+			_, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0))
 			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
 				t.Errorf("newBqLease() expected error to contain '%s'; got %v", tt.wantErr, err)
 			}
 		})
 	}
 }
+
+func TestBQLeaseOwner(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	// Owner is converted to characters allowed in label values.
+	gomock.InOrder(
+		mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("", "etag1", nil),
+		mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337_host1-example-com", "etag1").Return(nil),
+		mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("1337_host1-example-com", "etag2", nil),
+		mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "2000_host1-example-com", "etag2").Return(nil),
+	)
+
+	l, err := newBqLease(ctx, mock, "dsname", "Host1.example.com", time.Unix(1337, 0))
+	if err != nil {
+		t.Fatalf("newBqLease() unexpected error: %v", err)
+	}
+	if err := l.Renew(ctx, time.Unix(2000, 0)); err != nil {
+		t.Errorf("Renew() unexpected error: %v", err)
+	}
+}
+
+func TestParseLeaseValue(t *testing.T) {
+	for _, tt := range []struct {
+		value     string
+		wantTime  time.Time
+		wantOwner string
+	}{
+		{"1337", time.Unix(1337, 0), ""},
+		{"1337_host1-abcd", time.Unix(1337, 0), "host1-abcd"},
+		{"1337_host_1", time.Unix(1337, 0), "host_1"},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			gotTime, gotOwner, err := parseLeaseValue(tt.value)
+			if err != nil {
+				t.Fatalf("parseLeaseValue(%q) unexpected error: %v", tt.value, err)
+			}
+			if !gotTime.Equal(tt.wantTime) || gotOwner != tt.wantOwner {
+				t.Errorf("parseLeaseValue(%q) = %v, %q; want %v, %q", tt.value, gotTime, gotOwner, tt.wantTime, tt.wantOwner)
+			}
+			if got := formatLeaseValue(gotTime, gotOwner); got != tt.value {
+				t.Errorf("formatLeaseValue(%v, %q) = %q; want %q", gotTime, gotOwner, got, tt.value)
+			}
+		})
+	}
+}
+
+func TestLeaseOwner(t *testing.T) {
+	owner := leaseOwner()
+	if owner == "" || len(owner) > maxLeaseOwnerLength {
+		t.Errorf("leaseOwner() returned %q; expected a non-empty string of at most %d characters", owner, maxLeaseOwnerLength)
+	}
+	if other := leaseOwner(); other == owner {
+		t.Errorf("leaseOwner() expected to return different values; got %q twice", owner)
+	}
+}
+
+func TestBQLeaseTransientErrors(t *testing.T) {
+	defer func(d time.Duration) { leaseRetryDelay = d }(leaseRetryDelay)
+	leaseRetryDelay = 0
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	conflict := &googleapi.Error{Code: http.StatusPreconditionFailed}
+
+	type read struct {
+		value string
+		err   error
+	}
+	for _, tt := range []struct {
+		name   string
+		reads  []read
+		writes []error
+		// wantErr is empty if the lease should be obtained.
+		wantErr string
+	}{
+		{"read retried", []read{{"", unavailable}, {"", nil}}, []error{nil}, ""},
+		{"write retried", []read{{"", nil}}, []error{unavailable, nil}, ""},
+		{"read fails persistently", []read{{"", unavailable}, {"", unavailable}, {"", unavailable}, {"", unavailable}}, nil, "503"},
+		{"write fails persistently", []read{{"", nil}}, []error{unavailable, unavailable, unavailable, unavailable}, "Could not update BQ lease"},
+		// A conflict means that someone else has updated the lease, so it's not retried.
+		{"conflict", []read{{"", nil}}, []error{conflict}, "Could not update BQ lease"},
+		{"other error", []read{{"", nil}}, []error{fmt.Errorf("permission denied")}, "permission denied"},
+		// A conflict after a transient error might be caused by the first write having succeeded.
+		{"conflict after successful write", []read{{"", nil}, {"1337", nil}}, []error{unavailable, conflict}, ""},
+		{"conflict after write by someone else", []read{{"", nil}, {"2000", nil}}, []error{unavailable, conflict}, "Could not update BQ lease"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			for _, r := range tt.reads {
+				mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(r.value, "etag1", r.err)
+			}
+			for _, err := range tt.writes {
+				mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag1").Return(err)
+			}
+
+			l, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("newBqLease() unexpected error: %v", err)
+				}
+				if l.value != "1337" {
+					t.Errorf("expected lease value 1337; got %s", l.value)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newBqLease() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBQLeaseRenew(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		currentLease  string
+		writeLabelErr error
+		wantErr       string
+		wantLost      bool
+	}{
+		{"lease renewed", "1337", nil, "", false},
+		{"write error", "1337", fmt.Errorf("permission denied"), "permission denied", false},
+		{"conflicting etag", "1337", &googleapi.Error{Code: http.StatusPreconditionFailed}, "412", true},
+		{"lease stolen", "2000", nil, "expected lease expiration", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("", "etag1", nil)
+			mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag1").Return(nil)
+			l, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0))
+			if err != nil {
+				t.Fatalf("newBqLease() unexpected error: %v", err)
+			}
+
+			mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(tt.currentLease, "etag2", nil)
+			if tt.currentLease == "1337" {
+				mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1400", "etag2").Return(tt.writeLabelErr)
+			}
+			err = l.Renew(ctx, time.Unix(1400, 0))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Renew() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Renew() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+
+			// A lease held by another process should not be cleared.
+			if !tt.wantLost {
+				mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(l.value, "etag3", nil)
+				mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "etag3").Return(nil)
+			}
+			if err := l.Close(ctx); (err != nil) != tt.wantLost {
+				t.Errorf("Close() unexpected result: %v", err)
+			}
+		})
+	}
+}
+
+func TestBQLeaseRenewTransientErrors(t *testing.T) {
+	defer func(d time.Duration) { leaseRetryDelay = d }(leaseRetryDelay)
+	leaseRetryDelay = 0
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	conflict := &googleapi.Error{Code: http.StatusPreconditionFailed}
+
+	type read struct {
+		value string
+		err   error
+	}
+	for _, tt := range []struct {
+		name     string
+		reads    []read
+		writes   []error
+		wantErr  string
+		wantLost bool
+	}{
+		{"read retried", []read{{"1337", unavailable}, {"1337", nil}}, []error{nil}, "", false},
+		{"write retried", []read{{"1337", nil}, {"1337", nil}}, []error{unavailable, nil}, "", false},
+		// The first write has succeeded despite returning an error.
+		{"write succeeded", []read{{"1337", nil}, {"1400", nil}}, []error{unavailable}, "", false},
+		{"fails persistently", []read{{"1337", unavailable}, {"1337", unavailable}, {"1337", unavailable}, {"1337", unavailable}}, nil, "503", false},
+		{"conflict after transient error", []read{{"1337", nil}, {"1337", nil}}, []error{unavailable, conflict}, "412", true},
+		{"stolen after transient error", []read{{"1337", nil}, {"2000", nil}}, []error{unavailable}, "expected lease expiration", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			l := &bqLease{bq: mock, dataset: "dsname", value: "1337"}
+			var calls []*gomock.Call
+			for _, r := range tt.reads {
+				calls = append(calls, mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(r.value, "etag1", r.err))
+			}
+			for _, err := range tt.writes {
+				calls = append(calls, mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1400", "etag1").Return(err))
+			}
+
+			err := l.Renew(ctx, time.Unix(1400, 0))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Renew() unexpected error: %v", err)
+				}
+				if l.value != "1400" {
+					t.Errorf("expected lease value 1400; got %s", l.value)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Renew() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+			if l.isLost != tt.wantLost {
+				t.Errorf("expected isLost to be %v; got %v", tt.wantLost, l.isLost)
+			}
+		})
+	}
+}
+
+func TestBQLeaseClose(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		currentLease  string
+		writeLabelErr error
+		wantErr       string
+	}{
+		{"lease cleared", "1337", nil, ""},
+		{"lease stolen", "2000_host2", nil, "held by another process"},
+		{"cleared lease", "", nil, "held by another process"},
+		{"conflicting etag", "1337", &googleapi.Error{Code: http.StatusPreconditionFailed}, "412"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			l := &bqLease{bq: mock, dataset: "dsname", value: "1337"}
+
+			mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(tt.currentLease, "etag2", nil)
+			// A lease held by another process should be left intact.
+			if tt.currentLease == "1337" {
+				mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "etag2").Return(tt.writeLabelErr)
+			}
+			err := l.Close(ctx)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Close() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Close() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBQLeaseRenewInBackground(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("", "etag1", nil)
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag1").Return(nil)
+	l, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0))
+	if err != nil {
+		t.Fatalf("newBqLease() unexpected error: %v", err)
+	}
+
+	// The lease is held by this process, so it should be renewed repeatedly.
+	renewed := make(chan string, 1)
+	mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).MinTimes(2).DoAndReturn(
+		func(context.Context, string, string) (string, string, error) { return l.value, "etag2", nil })
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, gomock.Not(""), "etag2").MinTimes(2).DoAndReturn(
+		func(_ context.Context, _, _, value, _ string) error {
+			select {
+			case renewed <- value:
+			default:
+			}
+			return nil
+		})
+	renewCtx := l.renewInBackground(ctx, 10*time.Millisecond, time.Now)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-renewed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected lease to be renewed")
+		}
+	}
+
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "etag2").Return(nil)
+	if err := l.Close(ctx); err != nil {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+	if renewCtx.Err() == nil {
+		t.Errorf("expected context to be cancelled after the lease is closed")
+	}
+}
+
+func TestBQLeaseRenewInBackgroundLost(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("", "etag1", nil)
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag1").Return(nil)
+	l, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0))
+	if err != nil {
+		t.Fatalf("newBqLease() unexpected error: %v", err)
+	}
+
+	// Another process has taken over the lease, so the first renewal attempt should cancel the context.
+	mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("2000", "etag2", nil)
+	renewCtx := l.renewInBackground(ctx, 10*time.Millisecond, time.Now)
+	select {
+	case <-renewCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected context to be cancelled after lease renewal failure")
+	}
+	if !l.lost() {
+		t.Errorf("lost() = false; expected the lease to be lost")
+	}
+
+	if err := l.Close(ctx); err == nil {
+		t.Errorf("Close() expected error for a lost lease")
+	}
+}
+
+func TestBQLeaseRenewInBackgroundTransientError(t *testing.T) {
+	defer func(n int) { leaseAttempts = n }(leaseAttempts)
+	leaseAttempts = 1
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	l := &bqLease{bq: mock, dataset: "dsname", value: formatLeaseValue(time.Now().Add(time.Hour), "")}
+
+	// A transient error should not cancel the sync while the lease is still valid.
+	renewed := make(chan struct{}, 1)
+	gomock.InOrder(
+		mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("", "", &googleapi.Error{Code: http.StatusServiceUnavailable}),
+		mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).DoAndReturn(
+			func(context.Context, string, string) (string, string, error) { return l.value, "etag2", nil }).AnyTimes(),
+	)
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, gomock.Not(""), "etag2").MinTimes(1).DoAndReturn(
+		func(_ context.Context, _, _, _, _ string) error {
+			select {
+			case renewed <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+	renewCtx := l.renewInBackground(ctx, 10*time.Millisecond, time.Now)
+	select {
+	case <-renewed:
+	case <-renewCtx.Done():
+		t.Fatalf("expected context not to be cancelled after a transient error")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected lease to be renewed")
+	}
+	close(l.stop)
+	<-l.done
+}
+
+func TestBQLeaseRenewInBackgroundClock(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	now := time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC)
+	l := &bqLease{bq: mock, dataset: "dsname", value: formatLeaseValue(now.Add(time.Minute), "")}
+
+	// Expiration times are computed using the given clock rather than the system time.
+	renewed := make(chan string, 1)
+	mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).MinTimes(1).DoAndReturn(
+		func(context.Context, string, string) (string, string, error) { return l.value, "etag2", nil })
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, gomock.Any(), "etag2").MinTimes(1).DoAndReturn(
+		func(_ context.Context, _, _, value, _ string) error {
+			select {
+			case renewed <- value:
+			default:
+			}
+			return nil
+		})
+	l.renewInBackground(ctx, 10*time.Millisecond, fixedClock(now))
+	select {
+	case got := <-renewed:
+		if want := formatLeaseValue(now.Add(10*time.Millisecond), ""); got != want {
+			t.Errorf("expected lease to be renewed with value %s; got %s", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected lease to be renewed")
+	}
+	close(l.stop)
+	<-l.done
+}
+
+func TestBQLeaseReleaseAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("", "etag1", nil)
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag1").Return(nil)
+	l, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0))
+	if err != nil {
+		t.Fatalf("newBqLease() unexpected error: %v", err)
+	}
+	l.renewInBackground(ctx, time.Hour, time.Now)
+
+	// The sync gets cancelled (e.g. on shutdown), but the lease should still be released.
+	cancel()
+	released := false
+	mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("1337", "etag2", nil)
+	mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "etag2").DoAndReturn(
+		func(ctx context.Context, _, _, _, _ string) error {
+			if ctx.Err() != nil {
+				t.Errorf("expected lease to be released using a context that is not cancelled; got %v", ctx.Err())
+			}
+			released = true
+			return nil
+		})
+	l.Release()
+	if !released {
+		t.Errorf("expected lease to be released")
+	}
+}
+
+func TestBreakLease(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		existingLease string
+		readLabelErr  error
+		wantWrite     bool
+		wantErr       string
+	}{
+		{"no lease exists", "", nil, false, ""},
+		{"valid lease", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10), nil, true, ""},
+		{"bogus lease", "bogus", nil, true, ""},
+		{"reading metadata returns error", "", fmt.Errorf("error1"), false, "error1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(tt.existingLease, "etag1", tt.readLabelErr)
+			if tt.wantWrite {
+				// The lease should be cleared without checking etag.
+				mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "").Return(nil)
+			}
+
+			err := BreakLease(ctx, mock, "dsname")
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("BreakLease() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("BreakLease() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBQLeaseAfterBreak(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	gomock.InOrder(
+		mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return(future, "etag1", nil),
+		mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "", "").Return(nil),
+		mock.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName).Return("", "etag2", nil),
+		mock.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", bqLeaseLabelName, "1337", "etag2").Return(nil),
+	)
+
+	if err := BreakLease(ctx, mock, "dsname"); err != nil {
+		t.Fatalf("BreakLease() unexpected error: %v", err)
+	}
+	if _, err := newBqLease(ctx, mock, "dsname", "", time.Unix(1337, 0)); err != nil {
+		t.Errorf("newBqLease() unexpected error after breaking a lease: %v", err)
+	}
+}
+
+func TestRecordSuccess(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "dsname", lastSuccessLabelName, "1337", "").Return(nil)
+	if err := recordSuccess(context.Background(), bq, "dsname", time.Unix(1337, 0)); err != nil {
+		t.Errorf("recordSuccess() unexpected error: %v", err)
+	}
+}
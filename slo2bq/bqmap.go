@@ -15,48 +15,303 @@
 package slo2bq
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"regexp"
 	"slo2bq/clients"
+	"strings"
+	"text/template"
 	"time"
 )
 
-// bqMap can be used to easily check whether data for a given Service+SLO+Date exists in BigQuery.
-type bqMap map[bqMapKey]bool
-type bqMapKey struct{ Service, SLO, Date string }
+// bqMap can be used to easily check whether data for a given Project+Service+SLO+Date(+Hour) exists in BigQuery.
+// A single bqMap only contains rows of one granularity, so Hour is 0 for all daily rows. Services and SLOs
+// are identified by their IDs, or by their names for rows written before ID columns were added.
+type bqMap map[bqMapKey]bqMapValue
+type bqMapKey struct {
+	Project, Service, SLO, Date string
+	Hour                        int64
+}
+type bqMapValue struct {
+	Good, Total int64
+	Target      float64
+	// Partial is set if the row only covers part of the day, see Config.IncludeToday.
+	Partial bool
+}
+
+// keyOf returns the bqMap key of a given row.
+func keyOf(r *clients.BQRow) bqMapKey {
+	if r.ServiceID == "" || r.SLOID == "" {
+		return nameKeyOf(r)
+	}
+	return bqMapKey{r.Project, r.ServiceID, r.SLOID, r.Date, r.Hour.Int64}
+}
+
+// nameKeyOf returns the key of a given row based on service and SLO names. It matches rows
+// written before ID columns were added.
+func nameKeyOf(r *clients.BQRow) bqMapKey {
+	return bqMapKey{r.Project, r.Service, r.SLO, r.Date, r.Hour.Int64}
+}
+
+// Add adds a row to the map. If there are several rows for the same key, complete rows are preferred
+// over partial ones, and then the one with the largest number of total events is kept.
+func (b bqMap) Add(r *clients.BQRow) {
+	k := keyOf(r)
+	if v, ok := b[k]; !ok || (v.Partial && !r.Partial) || (v.Partial == r.Partial && r.Total > v.Total) {
+		b[k] = bqMapValue{r.Good, r.Total, r.Target, r.Partial}
+	}
+}
+
+// Check returns whether a row with the same key as a given row exists.
+func (b bqMap) Check(r *clients.BQRow) bool {
+	_, ok := b.Get(r)
+	return ok
+}
+
+// Get returns good and total event counts of a row with the same key as a given row. Rows
+// written before ID columns were added are matched by service and SLO names.
+func (b bqMap) Get(r *clients.BQRow) (bqMapValue, bool) {
+	if v, ok := b[keyOf(r)]; ok {
+		return v, true
+	}
+	v, ok := b[nameKeyOf(r)]
+	return v, ok
+}
+
+// sloTarget is the target stored in the most recent row of an SLO.
+type sloTarget struct {
+	Date   string
+	Hour   int64
+	Target float64
+}
+
+// latestTargets returns targets of the most recent row of each SLO in the map. Keys have an empty
+// Date and zero Hour.
+func (b bqMap) latestTargets() map[bqMapKey]sloTarget {
+	result := make(map[bqMapKey]sloTarget)
+	for k, v := range b {
+		sloKey := bqMapKey{Project: k.Project, Service: k.Service, SLO: k.SLO}
+		t, ok := result[sloKey]
+		if !ok || k.Date > t.Date || (k.Date == t.Date && k.Hour > t.Hour) {
+			result[sloKey] = sloTarget{k.Date, k.Hour, v.Target}
+		}
+	}
+	return result
+}
 
-// Add adds a service+slo+date to the map.
-func (b bqMap) Add(service, slo, date string) {
-	b[bqMapKey{service, slo, date}] = true
+// hourCondition returns a condition on the hour column matching rows of the configured granularity.
+// Daily rows have no hour set.
+func hourCondition(cfg *Config) string {
+	if cfg.hourly() {
+		return "IS NOT NULL"
+	}
+	return "IS NULL"
 }
 
-// Check returns whether a given service+slo+date exist.
-func (b bqMap) Check(service, slo, date string) bool {
-	return b[bqMapKey{service, slo, date}]
+// defaultExistingDataQueryTemplate is the query used to read existing rows unless
+// Config.ExistingDataQueryTemplate is set. The data table is partitioned by date, so filtering on a constant
+// date only scans recent partitions. Rows written before the project column was added are attributed to
+// the configured project.
+// NULL names and dates are returned as empty strings, since they can not be read into BQRow; see
+// Config.SkipMalformedExistingRows.
+const defaultExistingDataQueryTemplate = "SELECT IFNULL(project, '{{.Project}}') as project, IFNULL(service, '') as service, " +
+	"IFNULL(slo, '') as slo, IFNULL(serviceid, '') as serviceid, IFNULL(sloid, '') as sloid, " +
+	"IFNULL(FORMAT_DATE('%F', `date`), '') as date, hour, " +
+	"good, total, target, IFNULL(partial, FALSE) as partial FROM `{{.Dataset}}.{{.Table}}` " +
+	"WHERE date >= DATE '{{.StartDate}}' AND IFNULL(project, '{{.Project}}') = '{{.Project}}' AND hour {{.HourCondition}};"
+
+// shardedExistingDataQueryTemplate reads existing rows from date-sharded tables (see Config.ShardByDate) using
+// a wildcard table. Only shards since StartDate are scanned; the upper bound excludes other tables whose
+// names start with the same prefix (e.g. data_prod), since letters sort after digits.
+const shardedExistingDataQueryTemplate = "SELECT IFNULL(project, '{{.Project}}') as project, IFNULL(service, '') as service, " +
+	"IFNULL(slo, '') as slo, IFNULL(serviceid, '') as serviceid, IFNULL(sloid, '') as sloid, " +
+	"IFNULL(FORMAT_DATE('%F', `date`), '') as date, hour, " +
+	"good, total, target, IFNULL(partial, FALSE) as partial FROM `{{.Dataset}}.{{.Table}}_*` " +
+	"WHERE _TABLE_SUFFIX BETWEEN '{{.StartShard}}' AND '99999999' " +
+	"AND IFNULL(project, '{{.Project}}') = '{{.Project}}' AND hour {{.HourCondition}};"
+
+// existingDataColumns are the columns which the query reading existing rows needs to return.
+var existingDataColumns = []string{"project", "service", "slo", "serviceid", "sloid", "date", "hour", "good", "total", "target", "partial"}
+
+// existingDataQueryParams are the values available to Config.ExistingDataQueryTemplate.
+type existingDataQueryParams struct {
+	Project, Dataset, Table string
+	// StartDate is the first date (formatted as YYYY-MM-DD) that needs to be read.
+	StartDate string
+	// StartShard is StartDate formatted as the suffix of a date-sharded table (YYYYMMDD).
+	StartShard string
+	// HourCondition is a condition on the hour column matching rows of the configured granularity, e.g. "IS NULL".
+	HourCondition string
 }
 
-// readBqMap reads recent SLO data from BigQuery and returns a bqMap.
-func readBQMap(ctx context.Context, client clients.BigQueryClient, cfg *Config) (bqMap, error) {
+// existingDataQuery returns the query reading existing rows of cfg.Project since a given date. An error is
+// returned if the template can't be rendered, or if the query does not mention all existingDataColumns.
+func existingDataQuery(cfg *Config, startDate string) (string, error) {
+	text := cfg.ExistingDataQueryTemplate
+	if text == "" {
+		text = defaultExistingDataQueryTemplate
+		if cfg.ShardByDate {
+			text = shardedExistingDataQueryTemplate
+		}
+	}
+	tmpl, err := template.New("query").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("could not parse ExistingDataQueryTemplate: %v", err)
+	}
+	var buf bytes.Buffer
+	params := existingDataQueryParams{cfg.Project, cfg.qualifiedDataset(), cfg.table(), startDate, strings.Replace(startDate, "-", "", -1), hourCondition(cfg)}
+	if err := tmpl.Execute(&buf, params); err != nil {
+		return "", fmt.Errorf("could not render ExistingDataQueryTemplate: %v", err)
+	}
+	q := buf.String()
+	// Columns missing from the result would be left empty, so e.g. a missing sloid column would make all
+	// rows look new. The query can't be checked without running it, so this only catches obvious mistakes.
+	var missing []string
+	for _, c := range existingDataColumns {
+		if !regexp.MustCompile(`(?i)\b` + c + `\b`).MatchString(q) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("ExistingDataQueryTemplate should select columns %s; got %q", strings.Join(missing, ", "), q)
+	}
+	return q, nil
+}
+
+// existingDataSource reads rows synced before, which decide the days (or hours) of each SLO that need to be
+// synced.
+type existingDataSource interface {
+	// readExisting returns recent rows of cfg.Project as a bqMap, along with the number of rows that have
+	// been skipped because Service, SLO or Date is not set (see Config.SkipMalformedExistingRows).
+	readExisting(ctx context.Context, cfg *Config) (bqMap, int, error)
+}
+
+// bqExistingData reads existing rows from the data table in BigQuery.
+type bqExistingData struct {
+	client clients.BigQueryClient
+}
+
+func (s *bqExistingData) readExisting(ctx context.Context, cfg *Config) (bqMap, int, error) {
+	return readBQMap(ctx, s.client, cfg)
+}
+
+// fileExistingData reads existing rows from a local newline-delimited JSON file, see Config.ExistingDataFile.
+type fileExistingData struct {
+	path string
+}
+
+func (s *fileExistingData) readExisting(ctx context.Context, cfg *Config) (bqMap, int, error) {
+	startDate, err := existingStartDate(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	rows, err := clients.ReadNDJSON(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read %s: %v", s.path, err)
+	}
+	// Rows are filtered like defaultExistingDataQueryTemplate does.
+	var recent []*clients.BQRow
+	for _, r := range rows {
+		if r.Project == "" {
+			r.Project = cfg.Project
+		}
+		if r.Project == cfg.Project && r.Date >= startDate && r.Hour.Valid == cfg.hourly() {
+			recent = append(recent, r)
+		}
+	}
+	return newBQMap(cfg, recent)
+}
+
+// newExistingDataSource returns the source of existing rows configured by cfg. It's a variable to allow
+// mocking in tests.
+var newExistingDataSource = func(cfg *Config, bq clients.BigQueryClient) existingDataSource {
+	if cfg.ExistingDataFile != "" {
+		return &fileExistingData{cfg.ExistingDataFile}
+	}
+	return &bqExistingData{bq}
+}
+
+// existingStartDate returns the first date (formatted as YYYY-MM-DD) of existing rows that need to be read.
+func existingStartDate(cfg *Config) (string, error) {
 	loc, err := time.LoadLocation(cfg.TimeZone)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	startDate := daysAgoMidnightTimestamp(time.Now(), loc, backfillDays).Format("2006-01-02")
+	startDate := daysAgoMidnightTimestamp(cfg.now(), loc, cfg.backfillDays()).Format("2006-01-02")
+	// Days of SLOs with their own time zone may start on an earlier date.
+	for _, tz := range cfg.SLOTimeZones {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return "", err
+		}
+		if d := daysAgoMidnightTimestamp(cfg.now(), l, cfg.backfillDays()).Format("2006-01-02"); d < startDate {
+			startDate = d
+		}
+	}
+	return startDate, nil
+}
 
-	q := fmt.Sprintf(
-		"SELECT service, slo, FORMAT_DATE('%%F', `date`) as date FROM `%s.%s` WHERE date >= '%s';",
-		cfg.Dataset, tableName, startDate)
+// readBqMap reads recent SLO data from BigQuery and returns a bqMap, along with the number of rows that have
+// been skipped because Service, SLO or Date is not set (see Config.SkipMalformedExistingRows).
+func readBQMap(ctx context.Context, client clients.BigQueryClient, cfg *Config) (bqMap, int, error) {
+	startDate, err := existingStartDate(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	q, err := existingDataQuery(cfg, startDate)
+	if err != nil {
+		return nil, 0, err
+	}
 	rows, err := client.Query(ctx, q)
+	// Date-sharded tables are only created when rows are written, so there might be none yet.
+	if cfg.ShardByDate && clients.IsNotFound(err) {
+		logEntry(cfg, severityInfo, logFields{"table": cfg.table() + "_*"}, "No tables matching %s_* yet", cfg.table())
+		rows, err = nil, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	return newBQMap(cfg, rows)
+}
 
+// newBQMap returns a bqMap of given rows, along with the number of rows that have been skipped because Service,
+// SLO or Date is not set. Such rows are an error unless cfg.SkipMalformedExistingRows is set.
+func newBQMap(cfg *Config, rows []*clients.BQRow) (bqMap, int, error) {
 	result := make(bqMap)
+	skipped := 0
 	for _, row := range rows {
 		if row.Service == "" || row.SLO == "" || row.Date == "" {
-			return nil, fmt.Errorf("Expected Service, SLO and Date to be set in BQ row; got %v", row)
+			if !cfg.SkipMalformedExistingRows {
+				return nil, 0, fmt.Errorf("Expected Service, SLO and Date to be set in BQ row; got %v "+
+					"(set SkipMalformedExistingRows to ignore such rows)", row)
+			}
+			logEntry(cfg, severityWarning, logFields{"service": row.Service, "slo": row.SLO, "date": row.Date},
+				"Skipping existing row without Service, SLO or Date: %v", row)
+			skipped++
+			continue
 		}
-		result.Add(row.Service, row.SLO, row.Date)
+		result.Add(row)
+	}
+	return result, skipped, nil
+}
+
+// readKnownSLOs returns the set of (service ID, SLO ID) pairs of cfg.Project SLOs that have already been
+// backfilled, see Config.FastPathDays.
+func readKnownSLOs(ctx context.Context, client clients.BigQueryClient, cfg *Config) (map[[2]string]bool, error) {
+	slos, err := client.ReadKnownSLOs(ctx, cfg.Dataset, knownSLOsTableName, cfg.Project)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[[2]string]bool, len(slos))
+	for _, k := range slos {
+		known[[2]string{k.ServiceID, k.SLOID}] = true
 	}
-	return result, nil
+	return known, nil
 }
@@ -17,11 +17,17 @@ package slo2bq
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"slo2bq/clients"
 	"slo2bq/clients/mocks"
 	"strings"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/golang/mock/gomock"
 )
 
@@ -30,15 +36,19 @@ func TestReadBQMap(t *testing.T) {
 		name     string
 		rows     []*clients.BQRow
 		wantLen  int
-		wantKeys []*bqMapKey
+		wantKeys []*clients.BQRow
 	}{
-		{"one row", []*clients.BQRow{&clients.BQRow{Service: "svc1", SLO: "slo1", Date: "2015-01-01"}}, 1,
-			[]*bqMapKey{&bqMapKey{"svc1", "slo1", "2015-01-01"}}},
+		{"one row", []*clients.BQRow{&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01"}}, 1,
+			[]*clients.BQRow{&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01"}}},
 		{"two rows", []*clients.BQRow{
-			&clients.BQRow{Service: "svc1", SLO: "slo1", Date: "2015-01-01"},
-			&clients.BQRow{Service: "svc2", SLO: "slo2", Date: "2015-01-01"},
-		}, 2, []*bqMapKey{&bqMapKey{"svc1", "slo1", "2015-01-01"}, &bqMapKey{"svc2", "slo2", "2015-01-01"}}},
-		{"no rows", []*clients.BQRow{}, 0, []*bqMapKey{}},
+			&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01"},
+			&clients.BQRow{Project: "p1", Service: "svc2", SLO: "slo2", Date: "2015-01-01"},
+		}, 2, []*clients.BQRow{&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01"}, &clients.BQRow{Project: "p1", Service: "svc2", SLO: "slo2", Date: "2015-01-01"}}},
+		{"two projects", []*clients.BQRow{
+			&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01"},
+			&clients.BQRow{Project: "p2", Service: "svc1", SLO: "slo1", Date: "2015-01-01"},
+		}, 2, []*clients.BQRow{&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01"}, &clients.BQRow{Project: "p2", Service: "svc1", SLO: "slo1", Date: "2015-01-01"}}},
+		{"no rows", []*clients.BQRow{}, 0, []*clients.BQRow{}},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			mockCtrl := gomock.NewController(t)
@@ -46,7 +56,7 @@ func TestReadBQMap(t *testing.T) {
 			mock := mocks.NewMockBigQueryClient(mockCtrl)
 			mock.EXPECT().Query(gomock.Any(), gomock.Any()).Return(tt.rows, nil)
 
-			m, err := readBQMap(context.Background(), mock, &Config{})
+			m, _, err := readBQMap(context.Background(), mock, &Config{})
 			if err != nil {
 				t.Errorf("readBQMap() unexpected error: %v", err)
 			}
@@ -54,14 +64,181 @@ func TestReadBQMap(t *testing.T) {
 				t.Errorf("unexpected size of BQMap: %d; want %d", len(m), tt.wantLen)
 			}
 			for _, r := range tt.wantKeys {
-				if !m.Check(r.Service, r.SLO, r.Date) {
-					t.Errorf("expected bqMap to have key %q", r)
+				if !m.Check(r) {
+					t.Errorf("expected bqMap to have key %v", keyOf(r))
 				}
 			}
 		})
 	}
 }
 
+// queryContains is a gomock matcher for queries containing a given string.
+type queryContains string
+
+func (q queryContains) Matches(x interface{}) bool {
+	s, ok := x.(string)
+	return ok && strings.Contains(s, string(q))
+}
+
+func (q queryContains) String() string { return fmt.Sprintf("contains %q", string(q)) }
+
+func TestReadBQMapProjectFilter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	mock.EXPECT().Query(gomock.Any(), queryContains("IFNULL(project, 'p1') = 'p1'")).Return([]*clients.BQRow{}, nil)
+
+	if _, _, err := readBQMap(context.Background(), mock, &Config{Project: "p1", Dataset: "ds"}); err != nil {
+		t.Errorf("readBQMap() unexpected error: %v", err)
+	}
+}
+
+func TestReadBQMapClock(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	mock.EXPECT().Query(gomock.Any(), queryContains("WHERE date >= DATE '2015-04-28'")).Return([]*clients.BQRow{}, nil)
+
+	cfg := &Config{Project: "p1", Dataset: "ds", BackfillDays: 3, clock: fixedClock(time.Date(2015, 5, 1, 10, 0, 0, 0, time.UTC))}
+	if _, _, err := readBQMap(context.Background(), mock, cfg); err != nil {
+		t.Errorf("readBQMap() unexpected error: %v", err)
+	}
+}
+
+func TestReadBQMapSLOTimeZones(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	// It is still April 30 in Honolulu, so rows of the SLO in that time zone start a day earlier.
+	mock.EXPECT().Query(gomock.Any(), queryContains("WHERE date >= DATE '2015-04-27'")).Return([]*clients.BQRow{}, nil)
+
+	cfg := &Config{Project: "p1", Dataset: "ds", BackfillDays: 3, TimeZone: "Asia/Tokyo", SLOTimeZones: map[string]string{"svc/slo": "Pacific/Honolulu"},
+		clock: fixedClock(time.Date(2015, 5, 1, 8, 0, 0, 0, time.UTC))}
+	if _, _, err := readBQMap(context.Background(), mock, cfg); err != nil {
+		t.Errorf("readBQMap() unexpected error: %v", err)
+	}
+}
+
+func TestReadBQMapShardsNotFound(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		sharded bool
+		wantErr bool
+	}{
+		{"sharded", true, false},
+		{"single table", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			mock.EXPECT().Query(gomock.Any(), gomock.Any()).Return(nil, &bigquery.Error{Reason: "notFound", Message: "Table ds.data_* does not match any table."})
+
+			m, _, err := readBQMap(context.Background(), mock, &Config{Project: "p1", Dataset: "ds", ShardByDate: tt.sharded})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readBQMap() = %v; want error: %v", err, tt.wantErr)
+			}
+			if err == nil && len(m) != 0 {
+				t.Errorf("readBQMap() = %v; want no rows", m)
+			}
+		})
+	}
+}
+
+func TestReadBQMapQueryTemplate(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	mock.EXPECT().Query(gomock.Any(), queryContains("FROM `ds.slo_view` WHERE day >= DATE '")).Return([]*clients.BQRow{}, nil)
+
+	cfg := &Config{Project: "p1", Dataset: "ds", ExistingDataQueryTemplate: "SELECT project, service, slo, serviceid, sloid, " +
+		"FORMAT_DATE('%F', day) AS date, hour, good, total, target, partial FROM `{{.Dataset}}.slo_view` WHERE day >= DATE '{{.StartDate}}'"}
+	if _, _, err := readBQMap(context.Background(), mock, cfg); err != nil {
+		t.Errorf("readBQMap() unexpected error: %v", err)
+	}
+}
+
+func TestExistingDataQuery(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		template string
+		sharded  bool
+		want     string
+		wantErr  string
+	}{
+		{"default", "", false, "SELECT IFNULL(project, 'p1') as project, IFNULL(service, '') as service, IFNULL(slo, '') as slo, " +
+			"IFNULL(serviceid, '') as serviceid, IFNULL(sloid, '') as sloid, IFNULL(FORMAT_DATE('%F', `date`), '') as date, " +
+			"hour, good, total, target, IFNULL(partial, FALSE) as partial FROM `ds.data` " +
+			"WHERE date >= DATE '2015-05-01' AND IFNULL(project, 'p1') = 'p1' AND hour IS NULL;", ""},
+		{"sharded", "", true, "SELECT IFNULL(project, 'p1') as project, IFNULL(service, '') as service, IFNULL(slo, '') as slo, " +
+			"IFNULL(serviceid, '') as serviceid, IFNULL(sloid, '') as sloid, IFNULL(FORMAT_DATE('%F', `date`), '') as date, " +
+			"hour, good, total, target, IFNULL(partial, FALSE) as partial FROM `ds.data_*` " +
+			"WHERE _TABLE_SUFFIX BETWEEN '20150501' AND '99999999' AND IFNULL(project, 'p1') = 'p1' AND hour IS NULL;", ""},
+		{"custom", "SELECT project, service, slo, serviceid, sloid, FORMAT_DATE('%F', day) AS date, hour, good, total, target, partial " +
+			"FROM `{{.Dataset}}.{{.Table}}_*` WHERE day >= '{{.StartDate}}' AND project = '{{.Project}}' AND hour {{.HourCondition}}", false,
+			"SELECT project, service, slo, serviceid, sloid, FORMAT_DATE('%F', day) AS date, hour, good, total, target, partial " +
+				"FROM `ds.data_*` WHERE day >= '2015-05-01' AND project = 'p1' AND hour IS NULL", ""},
+		{"custom sharded", "SELECT project, service, slo, serviceid, sloid, date, hour, good, total, target, partial " +
+			"FROM `{{.Dataset}}.{{.Table}}_*` WHERE _TABLE_SUFFIX >= '{{.StartShard}}'", true,
+			"SELECT project, service, slo, serviceid, sloid, date, hour, good, total, target, partial " +
+				"FROM `ds.data_*` WHERE _TABLE_SUFFIX >= '20150501'", ""},
+		{"malformed template", "SELECT {{.Dataset", false, "", "could not parse ExistingDataQueryTemplate"},
+		{"unknown field", "SELECT {{.Region}}", false, "", "could not render ExistingDataQueryTemplate"},
+		{"missing columns", "SELECT project, service, slo, date, good, total FROM `{{.Dataset}}.{{.Table}}`", false, "",
+			"ExistingDataQueryTemplate should select columns serviceid, sloid, hour, target, partial"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Project: "p1", Dataset: "ds", ExistingDataQueryTemplate: tt.template, ShardByDate: tt.sharded}
+			got, err := existingDataQuery(cfg, "2015-05-01")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("existingDataQuery() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("existingDataQuery() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("existingDataQuery() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExistingDataQueryBillingProject(t *testing.T) {
+	cfg := &Config{Project: "p2", BillingProject: "analytics", Dataset: "ds", datasetProject: "p1"}
+	q, err := existingDataQuery(cfg, "2015-05-01")
+	if err != nil {
+		t.Fatalf("existingDataQuery() unexpected error: %v", err)
+	}
+	if !strings.Contains(q, "FROM `p1.ds.data` ") || !strings.Contains(q, "IFNULL(project, 'p2') = 'p2'") {
+		t.Errorf("existingDataQuery() = %q; expected rows of p2 to be read from p1.ds.data", q)
+	}
+}
+
+func TestReadBQMapGranularity(t *testing.T) {
+	for _, tt := range []struct {
+		granularity string
+		want        string
+	}{
+		{"", "hour IS NULL"},
+		{"daily", "hour IS NULL"},
+		{"hourly", "hour IS NOT NULL"},
+	} {
+		t.Run(tt.granularity, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			mock.EXPECT().Query(gomock.Any(), queryContains(tt.want)).Return([]*clients.BQRow{}, nil)
+
+			if _, _, err := readBQMap(context.Background(), mock, &Config{Granularity: tt.granularity}); err != nil {
+				t.Errorf("readBQMap() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 func TestReadBQMapErrors(t *testing.T) {
 	for _, tt := range []struct {
 		name    string
@@ -78,7 +255,7 @@ func TestReadBQMapErrors(t *testing.T) {
 			mock := mocks.NewMockBigQueryClient(mockCtrl)
 			mock.EXPECT().Query(gomock.Any(), gomock.Any()).Return(tt.rows, tt.err)
 
-			_, err := readBQMap(context.Background(), mock, &Config{})
+			_, _, err := readBQMap(context.Background(), mock, &Config{})
 			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
 				t.Errorf("readBQMap() expected error to contain '%s'; got %v", tt.wantErr, err)
 			}
@@ -86,3 +263,178 @@ func TestReadBQMapErrors(t *testing.T) {
 	}
 
 }
+
+func TestReadBQMapSkipMalformedRows(t *testing.T) {
+	rows := []*clients.BQRow{
+		&clients.BQRow{Service: "svc1", SLO: "slo1", Date: "2015-01-01", Total: 10},
+		// A row with a NULL date, as returned by the default query.
+		&clients.BQRow{Service: "svc1", SLO: "slo1", Date: ""},
+		&clients.BQRow{Service: "", SLO: "slo2", Date: "2015-01-02"},
+	}
+	for _, tt := range []struct {
+		name        string
+		skip        bool
+		wantSkipped int
+		wantErr     string
+	}{
+		{"error by default", false, 0, "Expected Service, SLO and Date to be set in BQ row"},
+		{"skipped", true, 2, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockBigQueryClient(mockCtrl)
+			mock.EXPECT().Query(gomock.Any(), gomock.Any()).Return(rows, nil)
+
+			m, skipped, err := readBQMap(context.Background(), mock, &Config{SkipMalformedExistingRows: tt.skip})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("readBQMap() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readBQMap() unexpected error: %v", err)
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("readBQMap() skipped %d rows; want %d", skipped, tt.wantSkipped)
+			}
+			if len(m) != 1 {
+				t.Errorf("expected a single row to be read; got %v", m)
+			}
+		})
+	}
+}
+
+func TestFileExistingData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slo2bq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rows.json")
+	content := `{"project":"p1","service":"svc1","slo":"slo1","date":"2015-05-09","total":"10","good":"9"}
+{"project":"","service":"svc1","slo":"slo2","date":"2015-05-09","total":10,"good":9}
+{"project":"p2","service":"svc1","slo":"slo1","date":"2015-05-09"}
+{"project":"p1","service":"svc1","slo":"slo1","date":"2015-05-01"}
+{"project":"p1","service":"svc1","slo":"slo1","date":"2015-05-09","hour":3}
+{"project":"p1","service":"","slo":"slo1","date":"2015-05-09"}
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{clock: fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC)), Project: "p1", TimeZone: "UTC",
+		BackfillDays: 3, SkipMalformedExistingRows: true}
+	m, skipped, err := (&fileExistingData{path}).readExisting(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("readExisting() unexpected error: %v", err)
+	}
+	// Rows of other projects, older dates and other granularities are ignored, while rows without a
+	// project are attributed to the synced one.
+	want := bqMap{
+		bqMapKey{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-05-09"}: bqMapValue{Good: 9, Total: 10},
+		bqMapKey{Project: "p1", Service: "svc1", SLO: "slo2", Date: "2015-05-09"}: bqMapValue{Good: 9, Total: 10},
+	}
+	if !reflect.DeepEqual(m, want) || skipped != 1 {
+		t.Errorf("readExisting() = %v, %d skipped; want %v, 1 skipped", m, skipped, want)
+	}
+
+	if _, _, err := (&fileExistingData{filepath.Join(dir, "missing.json")}).readExisting(context.Background(), cfg); err == nil {
+		t.Errorf("readExisting() expected error for a missing file")
+	}
+}
+
+func TestBQMapAdd(t *testing.T) {
+	m := make(bqMap)
+	row := func(good, total int64) *clients.BQRow {
+		return &clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01", Good: good, Total: total}
+	}
+	m.Add(row(0, 0))
+	m.Add(row(90, 100))
+	m.Add(row(0, 0))
+
+	v, ok := m.Get(row(0, 0))
+	if !ok || v.Good != 90 || v.Total != 100 {
+		t.Errorf("expected the row with most events to be kept; got %+v", v)
+	}
+	if _, ok := m.Get(&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-02"}); ok {
+		t.Errorf("expected no value for a missing key")
+	}
+
+	// Complete rows are preferred over partial ones, even if they have fewer events.
+	partial := row(200, 300)
+	partial.Partial = true
+	m.Add(partial)
+	if v, _ := m.Get(row(0, 0)); v.Total != 100 || v.Partial {
+		t.Errorf("expected the complete row to be kept; got %+v", v)
+	}
+	partial.Date = "2015-01-02"
+	m.Add(partial)
+	complete := row(0, 0)
+	complete.Date = "2015-01-02"
+	m.Add(complete)
+	if v, _ := m.Get(partial); v.Total != 0 || v.Partial {
+		t.Errorf("expected the partial row to be replaced by a complete one; got %+v", v)
+	}
+}
+
+func TestBQMapStableIDs(t *testing.T) {
+	m := make(bqMap)
+	m.Add(&clients.BQRow{Project: "p1", Service: "old name", SLO: "slo1", ServiceID: "svc1", SLOID: "slo1", Date: "2015-01-01"})
+	m.Add(&clients.BQRow{Project: "p1", Service: "legacy", SLO: "slo2", Date: "2015-01-01"})
+
+	for _, tt := range []struct {
+		name string
+		row  *clients.BQRow
+		want bool
+	}{
+		{"renamed service", &clients.BQRow{Project: "p1", Service: "new name", SLO: "slo1", ServiceID: "svc1", SLOID: "slo1", Date: "2015-01-01"}, true},
+		{"same name, different ID", &clients.BQRow{Project: "p1", Service: "old name", SLO: "slo1", ServiceID: "svc2", SLOID: "slo1", Date: "2015-01-01"}, false},
+		{"legacy row without IDs", &clients.BQRow{Project: "p1", Service: "legacy", SLO: "slo2", ServiceID: "svc3", SLOID: "slo2", Date: "2015-01-01"}, true},
+		{"different date", &clients.BQRow{Project: "p1", Service: "new name", SLO: "slo1", ServiceID: "svc1", SLOID: "slo1", Date: "2015-01-02"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Check(tt.row); got != tt.want {
+				t.Errorf("Check(%+v) = %v; want %v", tt.row, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadBQMapStableIDs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockBigQueryClient(mockCtrl)
+	mock.EXPECT().Query(gomock.Any(), queryContains("IFNULL(serviceid, '') as serviceid, IFNULL(sloid, '') as sloid")).Return([]*clients.BQRow{
+		&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-01-01"},
+	}, nil)
+
+	m, _, err := readBQMap(context.Background(), mock, &Config{Project: "p1"})
+	if err != nil {
+		t.Fatalf("readBQMap() unexpected error: %v", err)
+	}
+	if !m.Check(&clients.BQRow{Project: "p1", Service: "renamed", SLO: "renamed", ServiceID: "s1", SLOID: "o1", Date: "2015-01-01"}) {
+		t.Errorf("expected rows to be matched by service and SLO IDs")
+	}
+}
+
+func TestBQMapLatestTargets(t *testing.T) {
+	m := make(bqMap)
+	for _, r := range []*clients.BQRow{
+		&clients.BQRow{Project: "p1", ServiceID: "svc1", SLOID: "slo1", Service: "svc1", SLO: "slo1", Date: "2015-01-01", Target: 0.9},
+		&clients.BQRow{Project: "p1", ServiceID: "svc1", SLOID: "slo1", Service: "svc1", SLO: "slo1", Date: "2015-01-03", Target: 0.99},
+		&clients.BQRow{Project: "p1", ServiceID: "svc1", SLOID: "slo1", Service: "svc1", SLO: "slo1", Date: "2015-01-02", Target: 0.95},
+		&clients.BQRow{Project: "p1", ServiceID: "svc1", SLOID: "slo2", Service: "svc1", SLO: "slo2", Date: "2015-01-01", Target: 0.5},
+	} {
+		m.Add(r)
+	}
+
+	want := map[bqMapKey]sloTarget{
+		bqMapKey{Project: "p1", Service: "svc1", SLO: "slo1"}: sloTarget{Date: "2015-01-03", Target: 0.99},
+		bqMapKey{Project: "p1", Service: "svc1", SLO: "slo2"}: sloTarget{Date: "2015-01-01", Target: 0.5},
+	}
+	if got := m.latestTargets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("latestTargets() = %+v; want %+v", got, want)
+	}
+}
@@ -17,54 +17,458 @@
 package clients
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 // BQRow represents data in a single BigQuery row.
 type BQRow struct {
+	Project            string
 	Service, SLO, Date string
-	Total, Good        int64
-	Target             float64
+	// ServiceID and SLOID are immutable IDs of the service and SLO, while Service and SLO are
+	// human-readable names that change when a display name is edited. They are empty for rows written
+	// before these columns were added.
+	ServiceID, SLOID string
+	// Hour is the number of hours since local midnight for hourly rows, and NULL for daily rows.
+	Hour        bigquery.NullInt64
+	Total, Good int64
+	Target      float64
+	// ErrorBudget is the number of bad events allowed by Target: Total*(1-Target).
+	ErrorBudget float64
+	// BadEvents is the number of bad events: Total-Good.
+	BadEvents int64
+	// Period is the compliance period of the SLO, as returned by SLO.Period.
+	Period string
+	// IntervalStart and IntervalEnd are the boundaries of the interval that was queried for this row, e.g.
+	// a 25-hour day when clocks go back. They are not part of the row key, and are NULL if zero.
+	IntervalStart, IntervalEnd time.Time
+	// Partial is set for rows of the current day, which only cover the day until the time of the sync
+	// and are replaced by later syncs.
+	Partial bool
+	// ValueType is the value type of time series the row was computed from (e.g. INT64 or DISTRIBUTION),
+	// with several types separated by commas. It helps debugging misconfigured SLIs, and is not part
+	// of the row key.
+	ValueType string
+	// EmptyCompliance is the compliance assumed for rows with zero total events (1 or 0), as configured
+	// by the caller. It is NULL for other rows, and when compliance of empty rows is left undefined.
+	EmptyCompliance bigquery.NullFloat64
+	// PeriodStart is the start of the calendar period of period-to-date rows, which cover the current
+	// compliance period of a calendar-period SLO up to the time of the sync. It's NULL for other rows.
+	PeriodStart time.Time
+	// Labels are user labels of the SLO selected by the caller. They are written to the labels column as
+	// a JSON object, which is NULL if there are no labels.
+	Labels map[string]string
 }
 
-// Save implements the ValueSaver interface.
+// Save implements the ValueSaver interface. A deterministic insertID is returned to let BigQuery
+// deduplicate rows inserted by retried syncs.
 func (r *BQRow) Save() (map[string]bigquery.Value, string, error) {
 	return map[string]bigquery.Value{
-		"Service": r.Service,
-		"SLO":     r.SLO,
-		"Date":    r.Date,
-		"Total":   r.Total,
-		"Good":    r.Good,
-		"Target":  r.Target,
+		"Project":         r.Project,
+		"Service":         r.Service,
+		"SLO":             r.SLO,
+		"ServiceID":       r.ServiceID,
+		"SLOID":           r.SLOID,
+		"Date":            r.Date,
+		"Hour":            r.hour(),
+		"Total":           r.Total,
+		"Good":            r.Good,
+		"Target":          r.Target,
+		"ErrorBudget":     r.ErrorBudget,
+		"BadEvents":       r.BadEvents,
+		"Period":          r.Period,
+		"IntervalStart":   timestamp(r.IntervalStart),
+		"IntervalEnd":     timestamp(r.IntervalEnd),
+		"Partial":         r.Partial,
+		"ValueType":       r.ValueType,
+		"EmptyCompliance": r.emptyCompliance(),
+		"PeriodStart":     timestamp(r.PeriodStart),
+		"Labels":          r.labels(),
+	}, r.insertID(), nil
+}
+
+// timestamp returns the value of a nullable timestamp column, which is NULL for zero time.
+func timestamp(t time.Time) bigquery.Value {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// hour returns the value of the hour column, which is NULL for daily rows.
+func (r *BQRow) hour() bigquery.Value {
+	if !r.Hour.Valid {
+		return nil
+	}
+	return r.Hour.Int64
+}
+
+// emptyCompliance returns the value of the emptycompliance column, which is NULL unless set.
+func (r *BQRow) emptyCompliance() bigquery.Value {
+	if !r.EmptyCompliance.Valid {
+		return nil
+	}
+	return r.EmptyCompliance.Float64
+}
+
+// labels returns the value of the labels column: a JSON object with keys in sorted order, or NULL if
+// there are no labels.
+func (r *BQRow) labels() bigquery.Value {
+	if len(r.Labels) == 0 {
+		return nil
+	}
+	// Marshalling a map of strings can't fail.
+	b, _ := json.Marshal(r.Labels)
+	return string(b)
+}
+
+// insertID returns an ID that uniquely identifies the row within the table. It's a hex-encoded SHA-256
+// hash of the row key, so its length (64 characters) is within the limit of 128 characters set by BigQuery.
+// Service and SLO are identified by their IDs, since display names don't have to be unique; names are only
+// used for rows that have no IDs.
+func (r *BQRow) insertID() string {
+	hour := ""
+	if r.Hour.Valid {
+		hour = fmt.Sprint(r.Hour.Int64)
+	}
+	service, slo := r.ServiceID, r.SLOID
+	if service == "" {
+		service = r.Service
+	}
+	if slo == "" {
+		slo = r.SLO
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%q/%q/%q/%q/%q", r.Project, service, slo, r.Date, hour)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dataTableSchema is the schema of the table storing BQRows. It should be kept in sync with
+// bq_schema.json in the repository root.
+var dataTableSchema = bigquery.Schema{
+	{Name: "service", Type: bigquery.StringFieldType, Required: true},
+	{Name: "slo", Type: bigquery.StringFieldType, Required: true},
+	{Name: "date", Type: bigquery.DateFieldType, Required: true},
+	{Name: "total", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "good", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "target", Type: bigquery.FloatFieldType, Required: true},
+	// Columns added after the initial release are nullable, so that they can be added to existing tables.
+	{Name: "errorbudget", Type: bigquery.FloatFieldType},
+	{Name: "badevents", Type: bigquery.IntegerFieldType},
+	{Name: "project", Type: bigquery.StringFieldType},
+	{Name: "hour", Type: bigquery.IntegerFieldType},
+	{Name: "period", Type: bigquery.StringFieldType},
+	{Name: "serviceid", Type: bigquery.StringFieldType},
+	{Name: "sloid", Type: bigquery.StringFieldType},
+	{Name: "intervalstart", Type: bigquery.TimestampFieldType},
+	{Name: "intervalend", Type: bigquery.TimestampFieldType},
+	{Name: "partial", Type: bigquery.BooleanFieldType},
+	{Name: "valuetype", Type: bigquery.StringFieldType},
+	{Name: "emptycompliance", Type: bigquery.FloatFieldType},
+	{Name: "periodstart", Type: bigquery.TimestampFieldType},
+	{Name: "labels", Type: bigquery.StringFieldType},
+}
+
+// GoalChange records a change of an SLO goal, detected when the goal of an SLO differs from the
+// target stored in its most recent row.
+type GoalChange struct {
+	Project          string
+	Service, SLO     string
+	ServiceID, SLOID string
+	// Date is the date (in the configured time zone) when the change was observed.
+	Date                 string
+	OldTarget, NewTarget float64
+}
+
+// Save implements the ValueSaver interface.
+func (c *GoalChange) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{
+		"Project":   c.Project,
+		"Service":   c.Service,
+		"SLO":       c.SLO,
+		"ServiceID": c.ServiceID,
+		"SLOID":     c.SLOID,
+		"Date":      c.Date,
+		"OldTarget": c.OldTarget,
+		"NewTarget": c.NewTarget,
+	}, "", nil
+}
+
+// goalChangesTableSchema is the schema of the table storing GoalChanges.
+var goalChangesTableSchema = bigquery.Schema{
+	{Name: "project", Type: bigquery.StringFieldType, Required: true},
+	{Name: "service", Type: bigquery.StringFieldType, Required: true},
+	{Name: "slo", Type: bigquery.StringFieldType, Required: true},
+	{Name: "serviceid", Type: bigquery.StringFieldType, Required: true},
+	{Name: "sloid", Type: bigquery.StringFieldType, Required: true},
+	{Name: "date", Type: bigquery.DateFieldType, Required: true},
+	{Name: "oldtarget", Type: bigquery.FloatFieldType, Required: true},
+	{Name: "newtarget", Type: bigquery.FloatFieldType, Required: true},
+}
+
+// KnownSLO records that rows of an SLO have been backfilled, so that later syncs only need to update
+// recent days of it.
+type KnownSLO struct {
+	Project          string
+	Service, SLO     string
+	ServiceID, SLOID string
+	// FirstSeen is the time of the sync which backfilled the SLO.
+	FirstSeen time.Time
+}
+
+// Save implements the ValueSaver interface.
+func (k *KnownSLO) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{
+		"Project":   k.Project,
+		"Service":   k.Service,
+		"SLO":       k.SLO,
+		"ServiceID": k.ServiceID,
+		"SLOID":     k.SLOID,
+		"FirstSeen": timestamp(k.FirstSeen),
+	}, "", nil
+}
+
+// knownSLOsTableSchema is the schema of the table storing KnownSLOs.
+var knownSLOsTableSchema = bigquery.Schema{
+	{Name: "project", Type: bigquery.StringFieldType, Required: true},
+	{Name: "service", Type: bigquery.StringFieldType, Required: true},
+	{Name: "slo", Type: bigquery.StringFieldType, Required: true},
+	{Name: "serviceid", Type: bigquery.StringFieldType, Required: true},
+	{Name: "sloid", Type: bigquery.StringFieldType, Required: true},
+	{Name: "firstseen", Type: bigquery.TimestampFieldType},
+}
+
+// SLOState records that an SLO has been deleted, or has reappeared after being deleted. Deletions are
+// detected by comparing SLOs returned by the Service Monitoring API to recent rows of the data table.
+type SLOState struct {
+	Project string
+	// Service and SLO identify the SLO like keys of rows of the data table: by their IDs, or by their
+	// names for rows written before ID columns were added.
+	Service, SLO string
+	// Date is the date (in the configured time zone) as of which the state applies.
+	Date    string
+	Deleted bool
+	// Recorded is the time of the sync which detected the state.
+	Recorded time.Time
+}
+
+// Save implements the ValueSaver interface.
+func (s *SLOState) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{
+		"Project":  s.Project,
+		"Service":  s.Service,
+		"SLO":      s.SLO,
+		"Date":     s.Date,
+		"Deleted":  s.Deleted,
+		"Recorded": timestamp(s.Recorded),
+	}, "", nil
+}
+
+// sloStateTableSchema is the schema of the table storing SLOStates.
+var sloStateTableSchema = bigquery.Schema{
+	{Name: "project", Type: bigquery.StringFieldType, Required: true},
+	{Name: "service", Type: bigquery.StringFieldType, Required: true},
+	{Name: "slo", Type: bigquery.StringFieldType, Required: true},
+	{Name: "date", Type: bigquery.DateFieldType, Required: true},
+	{Name: "deleted", Type: bigquery.BooleanFieldType, Required: true},
+	{Name: "recorded", Type: bigquery.TimestampFieldType},
+}
+
+// SLODefinition records the full definition of an SLO as of a given sync, so that it's possible to tell
+// how an SLO was defined when its rows were computed.
+type SLODefinition struct {
+	Project          string
+	Service, SLO     string
+	ServiceID, SLOID string
+	// Date is the date (in the configured time zone) of the sync.
+	Date string
+	Goal float64
+	// Definition is the SLO object as returned by the Service Monitoring API, encoded as JSON.
+	Definition string
+}
+
+// Save implements the ValueSaver interface.
+func (d *SLODefinition) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{
+		"Project":    d.Project,
+		"Service":    d.Service,
+		"SLO":        d.SLO,
+		"ServiceID":  d.ServiceID,
+		"SLOID":      d.SLOID,
+		"Date":       d.Date,
+		"Goal":       d.Goal,
+		"Definition": d.Definition,
+	}, "", nil
+}
+
+// sloDefinitionsTableSchema is the schema of the table storing SLODefinitions.
+var sloDefinitionsTableSchema = bigquery.Schema{
+	{Name: "project", Type: bigquery.StringFieldType, Required: true},
+	{Name: "service", Type: bigquery.StringFieldType, Required: true},
+	{Name: "slo", Type: bigquery.StringFieldType, Required: true},
+	{Name: "serviceid", Type: bigquery.StringFieldType, Required: true},
+	{Name: "sloid", Type: bigquery.StringFieldType, Required: true},
+	{Name: "date", Type: bigquery.DateFieldType, Required: true},
+	{Name: "goal", Type: bigquery.FloatFieldType, Required: true},
+	{Name: "definition", Type: bigquery.StringFieldType, Required: true},
+}
+
+// RunManifest summarizes a single sync, so that the history of syncs can be queried.
+type RunManifest struct {
+	// Project is the project hosting the dataset.
+	Project    string
+	Start, End time.Time
+	Success    bool
+	// Error is the error of a failed sync.
+	Error                                   string
+	ServicesSeen, SLOsProcessed, SLOsFailed int
+	// Skipped is the number of services and SLOs that have not been synced.
+	Skipped     int
+	RowsWritten int
+	// ConfigHash identifies the configuration of the sync, so that syncs can be grouped by configuration.
+	ConfigHash string
+}
+
+// Save implements the ValueSaver interface.
+func (m *RunManifest) Save() (map[string]bigquery.Value, string, error) {
+	var errValue bigquery.Value
+	if m.Error != "" {
+		errValue = m.Error
+	}
+	return map[string]bigquery.Value{
+		"Project":       m.Project,
+		"Start":         timestamp(m.Start),
+		"End":           timestamp(m.End),
+		"Success":       m.Success,
+		"Error":         errValue,
+		"ServicesSeen":  m.ServicesSeen,
+		"SLOsProcessed": m.SLOsProcessed,
+		"SLOsFailed":    m.SLOsFailed,
+		"Skipped":       m.Skipped,
+		"RowsWritten":   m.RowsWritten,
+		"ConfigHash":    m.ConfigHash,
 	}, "", nil
 }
 
+// runsTableSchema is the schema of the table storing RunManifests.
+var runsTableSchema = bigquery.Schema{
+	{Name: "project", Type: bigquery.StringFieldType, Required: true},
+	{Name: "start", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "end", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "success", Type: bigquery.BooleanFieldType, Required: true},
+	{Name: "error", Type: bigquery.StringFieldType},
+	{Name: "servicesseen", Type: bigquery.IntegerFieldType},
+	{Name: "slosprocessed", Type: bigquery.IntegerFieldType},
+	{Name: "slosfailed", Type: bigquery.IntegerFieldType},
+	{Name: "skipped", Type: bigquery.IntegerFieldType},
+	{Name: "rowswritten", Type: bigquery.IntegerFieldType},
+	{Name: "confighash", Type: bigquery.StringFieldType},
+}
+
+// dataTableMetadata returns metadata for the table storing BQRows. The table is partitioned by date,
+// so that queries for recent data only scan recent partitions, and clustered by service and SLO.
+func dataTableMetadata() *bigquery.TableMetadata {
+	return &bigquery.TableMetadata{
+		Description:      "SLO performance daily aggregates imported by slo2bq",
+		Schema:           dataTableSchema,
+		TimePartitioning: &bigquery.TimePartitioning{Field: "date"},
+		Clustering:       &bigquery.Clustering{Fields: []string{"service", "slo"}},
+	}
+}
+
 //go:generate mockgen -destination=mocks/mock_bq_client.go -package mocks slo2bq/clients BigQueryClient
 
 // BigQueryClient is the interface implemented by this BQ client.
 type BigQueryClient interface {
 	Query(context.Context, string) ([]*BQRow, error)
 	Put(context.Context, string, string, []*BQRow) error
+	WriteGoalChanges(context.Context, string, string, []*GoalChange) error
+	ReadKnownSLOs(context.Context, string, string, string) ([]*KnownSLO, error)
+	WriteKnownSLOs(context.Context, string, string, []*KnownSLO) error
+	WriteSLODefinitions(context.Context, string, string, []*SLODefinition) error
+	ReadSLOStates(context.Context, string, string, string) ([]*SLOState, error)
+	WriteSLOStates(context.Context, string, string, []*SLOState) error
+	WriteRunManifest(context.Context, string, string, *RunManifest) error
+	Load(context.Context, string, string, []*BQRow) error
+	DeleteRows(context.Context, string, string, string) error
+	PruneOldRows(context.Context, string, string, time.Time) error
 	ReadDatasetMetadataLabel(context.Context, string, string) (string, string, error)
 	WriteDatasetMetadataLabel(context.Context, string, string, string, string) error
+	DatasetExists(context.Context, string) (bool, error)
+	CreateDataset(context.Context, string) error
+	EnsureTable(context.Context, string, string) error
+	VerifySchema(context.Context, string, string) error
+	CreateOrReplaceView(context.Context, string, string, string) error
 	Close() error
 }
 
 // BQClient is a simple client reading and writing BQRows to BigQuery.
 type BQClient struct {
 	bq *bigquery.Client
+	// location is the location of datasets used by this client, e.g. "asia-northeast1". Jobs need to
+	// run in the same location as the data they use; if empty, BigQuery infers the location.
+	location string
+	// project is the project hosting datasets used by this client, if it's not the project of bq (which
+	// jobs run in and are billed to). Empty if they are the same.
+	project string
 }
 
-// NewBQClient returns a BQClient for a given project name.
-func NewBQClient(ctx context.Context, project string) (*BQClient, error) {
-	bq, err := bigquery.NewClient(ctx, project)
+// NewBQClient returns a BQClient for datasets of a given project name, running jobs in a given location.
+// Jobs are billed to billingProject, or to the project hosting the datasets if it's empty. Application
+// default credentials are used unless opts specify otherwise.
+func NewBQClient(ctx context.Context, project, billingProject, location string, opts ...option.ClientOption) (*BQClient, error) {
+	c := &BQClient{location: location}
+	if billingProject == "" || billingProject == project {
+		billingProject = project
+	} else {
+		c.project = project
+	}
+	bq, err := bigquery.NewClient(ctx, billingProject, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return &BQClient{bq}, nil
+	bq.Location = location
+	c.bq = bq
+	return c, nil
+}
+
+// dataset returns a reference to a dataset used by this client.
+func (c *BQClient) dataset(name string) *bigquery.Dataset {
+	if c.project == "" {
+		return c.bq.Dataset(name)
+	}
+	return c.bq.DatasetInProject(c.project, name)
+}
+
+// qualified returns the name of a dataset to use in queries. Unqualified names are resolved in the project
+// jobs run in, so datasets hosted in another project are qualified with its name.
+func (c *BQClient) qualified(dataset string) string {
+	if c.project == "" {
+		return dataset
+	}
+	return c.project + "." + dataset
+}
+
+// newQuery returns a query job running in the location of the client.
+func (c *BQClient) newQuery(query string) *bigquery.Query {
+	q := c.bq.Query(query)
+	q.Location = c.location
+	return q
 }
 
 // Close closes the enclosed BigQuery client.
@@ -74,7 +478,7 @@ func (c *BQClient) Close() error {
 
 // Query runs a given SQL query and returns a slice of BQRows.
 func (c *BQClient) Query(ctx context.Context, query string) ([]*BQRow, error) {
-	q := c.bq.Query(query)
+	q := c.newQuery(query)
 	job, err := q.Run(ctx)
 	if err != nil {
 		return nil, err
@@ -103,15 +507,515 @@ func (c *BQClient) Query(ctx context.Context, query string) ([]*BQRow, error) {
 	return result, nil
 }
 
-// Put writes several BQRows to BigQuery.
+// Put writes several BQRows to BigQuery. Streaming inserts failing because of quotas or rate limits are
+// retried with exponential backoff, see putWithRetry.
 func (c *BQClient) Put(ctx context.Context, dataset, table string, rows []*BQRow) error {
-	return c.bq.Dataset(dataset).Table(table).Uploader().Put(ctx, rows)
+	return putWithRetry(ctx, c.dataset(dataset).Table(table).Uploader(), rows)
+}
+
+// rowUploader writes rows using streaming inserts. It's implemented by bigquery.Uploader, and allows
+// faking it in tests.
+type rowUploader interface {
+	Put(ctx context.Context, src interface{}) error
+}
+
+// retryablePutReasons are reasons of streaming insert errors that can be retried.
+var retryablePutReasons = map[string]bool{"quotaExceeded": true, "rateLimitExceeded": true, "backendError": true}
+
+// putWithRetry writes rows using `u`, and retries writes failing with a retryable error up to maxAttempts
+// times. If the error is a bigquery.PutMultiError, only the failed rows are written again. Waits between
+// retries start at retryDelay, are doubled after every attempt, and are aborted once ctx is done.
+func putWithRetry(ctx context.Context, u rowUploader, rows []*BQRow) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := u.Put(ctx, rows)
+		if err == nil {
+			return nil
+		}
+		failed, ok := retryableRows(rows, err)
+		if !ok || attempt >= maxAttempts {
+			return err
+		}
+		log.Printf("Writing %d rows failed: %v; retrying %d rows in %v", len(rows), err, len(failed), delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		rows = failed
+		delay *= 2
+	}
+}
+
+// retryableRows returns the rows that have not been written because of an error returned by a streaming
+// insert of `rows`, and false if the error can't be retried. Rows of a bigquery.PutMultiError can only be
+// retried if all of their errors are retryable, since other rows of a request are rejected along with
+// invalid ones.
+func retryableRows(rows []*BQRow, err error) ([]*BQRow, bool) {
+	switch e := err.(type) {
+	case bigquery.PutMultiError:
+		var failed []*BQRow
+		for _, re := range e {
+			if re.RowIndex < 0 || re.RowIndex >= len(rows) {
+				return nil, false
+			}
+			for _, ie := range re.Errors {
+				if !isRetryablePutError(ie) {
+					return nil, false
+				}
+			}
+			failed = append(failed, rows[re.RowIndex])
+		}
+		return failed, len(failed) > 0
+	case *googleapi.Error:
+		if isRetryableStatus(e.Code) {
+			return rows, true
+		}
+		for _, item := range e.Errors {
+			if retryablePutReasons[item.Reason] {
+				return rows, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// isRetryablePutError returns whether an error of an individual row of a streaming insert can be retried.
+func isRetryablePutError(err error) bool {
+	switch e := err.(type) {
+	case *bigquery.Error:
+		return retryablePutReasons[e.Reason]
+	case bigquery.Error:
+		return retryablePutReasons[e.Reason]
+	}
+	return false
+}
+
+// WriteGoalChanges writes several GoalChanges to BigQuery, creating the table if it does not exist.
+// A load job is used, since streaming inserts into a newly created table can fail for a few minutes,
+// and changes are only detected once.
+func (c *BQClient) WriteGoalChanges(ctx context.Context, dataset, table string, changes []*GoalChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	savers := make([]bigquery.ValueSaver, len(changes))
+	for i, ch := range changes {
+		savers[i] = ch
+	}
+	return c.loadValues(ctx, dataset, table, goalChangesTableSchema, savers)
+}
+
+// ReadKnownSLOs returns KnownSLOs of a given project. No error is returned if the table does not exist yet.
+func (c *BQClient) ReadKnownSLOs(ctx context.Context, dataset, table, project string) ([]*KnownSLO, error) {
+	if _, err := c.dataset(dataset).Table(table).Metadata(ctx); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	q := c.newQuery(fmt.Sprintf("SELECT * FROM `%s.%s` WHERE project = '%s'", c.qualified(dataset), table, project))
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []*KnownSLO
+	for {
+		var k KnownSLO
+		err := it.Next(&k)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &k)
+	}
+	return result, nil
+}
+
+// WriteKnownSLOs writes several KnownSLOs to BigQuery, creating the table if it does not exist. Similarly
+// to WriteGoalChanges, a load job is used.
+func (c *BQClient) WriteKnownSLOs(ctx context.Context, dataset, table string, slos []*KnownSLO) error {
+	if len(slos) == 0 {
+		return nil
+	}
+	savers := make([]bigquery.ValueSaver, len(slos))
+	for i, k := range slos {
+		savers[i] = k
+	}
+	return c.loadValues(ctx, dataset, table, knownSLOsTableSchema, savers)
+}
+
+// WriteSLODefinitions writes several SLODefinitions to BigQuery, creating the table if it does not exist.
+// Similarly to WriteGoalChanges, a load job is used.
+func (c *BQClient) WriteSLODefinitions(ctx context.Context, dataset, table string, defs []*SLODefinition) error {
+	if len(defs) == 0 {
+		return nil
+	}
+	savers := make([]bigquery.ValueSaver, len(defs))
+	for i, d := range defs {
+		savers[i] = d
+	}
+	return c.loadValues(ctx, dataset, table, sloDefinitionsTableSchema, savers)
+}
+
+// ReadSLOStates returns SLOStates of a given project. No error is returned if the table does not exist yet.
+func (c *BQClient) ReadSLOStates(ctx context.Context, dataset, table, project string) ([]*SLOState, error) {
+	if _, err := c.dataset(dataset).Table(table).Metadata(ctx); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	q := c.newQuery(fmt.Sprintf("SELECT project, service, slo, FORMAT_DATE('%%F', date) AS date, deleted, recorded "+
+		"FROM `%s.%s` WHERE project = '%s'", c.qualified(dataset), table, project))
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []*SLOState
+	for {
+		var s SLOState
+		err := it.Next(&s)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &s)
+	}
+	return result, nil
+}
+
+// WriteSLOStates writes several SLOStates to BigQuery, creating the table if it does not exist. Similarly
+// to WriteGoalChanges, a load job is used.
+func (c *BQClient) WriteSLOStates(ctx context.Context, dataset, table string, states []*SLOState) error {
+	if len(states) == 0 {
+		return nil
+	}
+	savers := make([]bigquery.ValueSaver, len(states))
+	for i, s := range states {
+		savers[i] = s
+	}
+	return c.loadValues(ctx, dataset, table, sloStateTableSchema, savers)
+}
+
+// WriteRunManifest writes a RunManifest to BigQuery, creating the table partitioned by start time if it
+// does not exist. Unlike WriteGoalChanges, a streaming insert is used, since syncs can run more often
+// than the daily limit of load jobs per table allows.
+func (c *BQClient) WriteRunManifest(ctx context.Context, dataset, table string, m *RunManifest) error {
+	t := c.dataset(dataset).Table(table)
+	if _, err := t.Metadata(ctx); err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		md := &bigquery.TableMetadata{
+			Description:      "Syncs of SLO performance data by slo2bq",
+			Schema:           runsTableSchema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "start"},
+		}
+		if err := t.Create(ctx, md); err != nil {
+			return err
+		}
+	}
+	return t.Uploader().Put(ctx, m)
+}
+
+// loadValues appends values of given ValueSavers to a table using a load job, creating the table with a
+// given schema if it does not exist.
+func (c *BQClient) loadValues(ctx context.Context, dataset, table string, schema bigquery.Schema, savers []bigquery.ValueSaver) error {
+	buf, err := encodeValues(savers)
+	if err != nil {
+		return err
+	}
+
+	src := bigquery.NewReaderSource(buf)
+	src.SourceFormat = bigquery.JSON
+	src.Schema = schema
+	loader := c.dataset(dataset).Table(table).LoaderFrom(src)
+	loader.CreateDisposition = bigquery.CreateIfNeeded
+	loader.WriteDisposition = bigquery.WriteAppend
+	loader.Location = c.location
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// Load writes several BQRows to BigQuery using a load job. Unlike Put, it does not use the streaming buffer,
+// which makes it cheaper and faster for a large number of rows, but BigQuery limits the number of load
+// jobs per table per day.
+func (c *BQClient) Load(ctx context.Context, dataset, table string, rows []*BQRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	buf, err := encodeNDJSON(rows)
+	if err != nil {
+		return err
+	}
+
+	src := bigquery.NewReaderSource(buf)
+	src.SourceFormat = bigquery.JSON
+	loader := c.dataset(dataset).Table(table).LoaderFrom(src)
+	loader.CreateDisposition = bigquery.CreateNever
+	loader.WriteDisposition = bigquery.WriteAppend
+	loader.Location = c.location
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// DeleteRows deletes rows matching a given condition using a DML statement. BigQuery does not allow
+// deleting rows that are still in the streaming buffer (i.e. have been written within the last hour or so
+// using Put).
+func (c *BQClient) DeleteRows(ctx context.Context, dataset, table, where string) error {
+	return c.runDML(ctx, fmt.Sprintf("DELETE FROM `%s.%s` WHERE %s", c.qualified(dataset), table, where))
+}
+
+// PruneOldRows deletes rows of all projects with a date before the date of olderThan (in its location).
+func (c *BQClient) PruneOldRows(ctx context.Context, dataset, table string, olderThan time.Time) error {
+	return c.runDML(ctx, pruneQuery(c.qualified(dataset), table, olderThan))
+}
+
+// pruneQuery returns the DML statement used by PruneOldRows.
+func pruneQuery(dataset, table string, olderThan time.Time) string {
+	return fmt.Sprintf("DELETE FROM `%s.%s` WHERE date < DATE '%s'", dataset, table, olderThan.Format("2006-01-02"))
+}
+
+// runDML runs a DML statement and waits for it to complete.
+func (c *BQClient) runDML(ctx context.Context, query string) error {
+	job, err := c.newQuery(query).Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// encodeNDJSON returns BQRows encoded as newline-delimited JSON, suitable for a load job.
+func encodeNDJSON(rows []*BQRow) (*bytes.Buffer, error) {
+	savers := make([]bigquery.ValueSaver, len(rows))
+	for i, r := range rows {
+		savers[i] = r
+	}
+	return encodeValues(savers)
+}
+
+// encodeValues returns values of given ValueSavers encoded as newline-delimited JSON.
+func encodeValues(savers []bigquery.ValueSaver) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range savers {
+		values, _, err := r.Save()
+		if err != nil {
+			return nil, err
+		}
+		// Column names in the schema are lowercase.
+		row := make(map[string]bigquery.Value, len(values))
+		for k, v := range values {
+			row[strings.ToLower(k)] = v
+		}
+		if err := enc.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+	return &buf, nil
+}
+
+// ndjsonRow is a row decoded by ReadNDJSON. Keys are matched case-insensitively, and numbers are decoded
+// from either JSON numbers or strings, since BigQuery extract jobs write INTEGER columns as strings.
+type ndjsonRow struct {
+	Project, Service, SLO, ServiceID, SLOID, Date string
+	Hour, Total, Good, Target                     json.Number
+	Partial                                       bool
+}
+
+// ReadNDJSON reads BQRows from newline-delimited JSON with the schema of tables written by BQClient, e.g. as
+// written by StorageClient.WriteRows or a BigQuery extract job. Only columns identifying a row and its
+// event counts, target and partial flag are read.
+func ReadNDJSON(r io.Reader) ([]*BQRow, error) {
+	dec := json.NewDecoder(r)
+	var rows []*BQRow
+	for {
+		var v ndjsonRow
+		if err := dec.Decode(&v); err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not decode row %d: %v", len(rows)+1, err)
+		}
+		row := &BQRow{Project: v.Project, Service: v.Service, SLO: v.SLO, ServiceID: v.ServiceID, SLOID: v.SLOID,
+			Date: v.Date, Partial: v.Partial}
+		var err error
+		if v.Hour != "" {
+			row.Hour.Valid = true
+			row.Hour.Int64, err = v.Hour.Int64()
+		}
+		if err == nil && v.Total != "" {
+			row.Total, err = v.Total.Int64()
+		}
+		if err == nil && v.Good != "" {
+			row.Good, err = v.Good.Int64()
+		}
+		if err == nil && v.Target != "" {
+			row.Target, err = v.Target.Float64()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode row %d: %v", len(rows)+1, err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// DatasetExists returns whether a given dataset exists.
+func (c *BQClient) DatasetExists(ctx context.Context, dataset string) (bool, error) {
+	_, err := c.dataset(dataset).Metadata(ctx)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreateDataset creates a dataset in the location of the client (or the default location, if unset).
+func (c *BQClient) CreateDataset(ctx context.Context, dataset string) error {
+	return c.dataset(dataset).Create(ctx, &bigquery.DatasetMetadata{Location: c.location})
+}
+
+// EnsureTable creates a date-partitioned table for BQRows in a given dataset, unless the table already exists.
+// Existing tables are not modified, since BigQuery does not allow partitioning an existing table.
+func (c *BQClient) EnsureTable(ctx context.Context, dataset, table string) error {
+	t := c.dataset(dataset).Table(table)
+	_, err := t.Metadata(ctx)
+	if err == nil || !isNotFound(err) {
+		return err
+	}
+	return t.Create(ctx, dataTableMetadata())
+}
+
+// VerifySchema checks that the schema of an existing table for BQRows matches the expected one, and returns
+// an error describing all differences otherwise, since failed inserts only return an opaque error.
+func (c *BQClient) VerifySchema(ctx context.Context, dataset, table string) error {
+	md, err := c.dataset(dataset).Table(table).Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	if err := schemaDiff(dataTableSchema, md.Schema); err != nil {
+		return fmt.Errorf("Table %s.%s does not match the expected schema (see bq_schema.json): %v", dataset, table, err)
+	}
+	return nil
+}
+
+// CreateOrReplaceView creates a standard SQL view with a given query in a dataset, or updates the query of
+// the view if it already exists with a different one.
+func (c *BQClient) CreateOrReplaceView(ctx context.Context, dataset, view, query string) error {
+	t := c.dataset(dataset).Table(view)
+	md, err := t.Metadata(ctx)
+	if err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		return t.Create(ctx, &bigquery.TableMetadata{ViewQuery: query})
+	}
+	if md.ViewQuery == query {
+		return nil
+	}
+	_, err = t.Update(ctx, bigquery.TableMetadataToUpdate{ViewQuery: query}, md.ETag)
+	return err
+}
+
+// schemaDiff returns an error listing columns of the expected schema that are missing from the actual one or
+// have a different type, and required columns of the actual schema that are not expected (which would make
+// inserts fail). Column names are case-insensitive, and additional nullable columns are allowed.
+func schemaDiff(expected, actual bigquery.Schema) error {
+	columns := make(map[string]*bigquery.FieldSchema, len(actual))
+	for _, f := range actual {
+		columns[strings.ToLower(f.Name)] = f
+	}
+	var diffs []string
+	for _, want := range expected {
+		got, ok := columns[want.Name]
+		delete(columns, want.Name)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("column '%s' is missing", want.Name))
+		case got.Type != want.Type:
+			diffs = append(diffs, fmt.Sprintf("column '%s' has type %s; expected %s", got.Name, got.Type, want.Type))
+		case got.Repeated:
+			diffs = append(diffs, fmt.Sprintf("column '%s' is repeated", got.Name))
+		case got.Required && !want.Required:
+			diffs = append(diffs, fmt.Sprintf("column '%s' is required; expected nullable", got.Name))
+		}
+	}
+	for _, f := range actual {
+		if _, ok := columns[strings.ToLower(f.Name)]; ok && f.Required {
+			diffs = append(diffs, fmt.Sprintf("unexpected column '%s' is required", f.Name))
+		}
+	}
+	if len(diffs) > 0 {
+		return errors.New(strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// isNotFound returns whether an error returned by a BigQuery API call is "404 Not Found".
+func isNotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// IsNotFound returns whether an error returned by a BigQuery API call or query job is caused by a missing
+// dataset or table, e.g. a wildcard table matching no tables.
+func IsNotFound(err error) bool {
+	if e, ok := err.(*bigquery.Error); ok {
+		return e.Reason == "notFound"
+	}
+	return isNotFound(err)
+}
+
+// IsStreamingBuffer returns whether an error returned by DeleteRows is caused by matching rows that are
+// still in the streaming buffer, in which case they can only be deleted later.
+func IsStreamingBuffer(err error) bool {
+	switch e := err.(type) {
+	case *bigquery.Error:
+		return strings.Contains(e.Message, "streaming buffer")
+	case *googleapi.Error:
+		return strings.Contains(e.Message, "streaming buffer")
+	}
+	return false
+}
+
+// IsTransient returns whether an error returned by a BigQuery API call is transient (HTTP 429 or 5xx), so
+// that the call can be retried. Failed preconditions (e.g. a mismatched etag) are not transient.
+func IsTransient(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && isRetryableStatus(e.Code)
+}
+
+// IsPreconditionFailed returns whether an error returned by a BigQuery API call is caused by a failed
+// precondition (HTTP 412), e.g. metadata having been updated since the etag passed to the call was read.
+func IsPreconditionFailed(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusPreconditionFailed
 }
 
 // ReadDatasetMetadataLabel reads metadata for a given BigQuery Dataset and returns value of
 // a specific label as well as the current etag for metadata.
 func (c *BQClient) ReadDatasetMetadataLabel(ctx context.Context, dataset, label string) (string, string, error) {
-	md, err := c.bq.Dataset(dataset).Metadata(ctx)
+	md, err := c.dataset(dataset).Metadata(ctx)
 	if err != nil {
 		return "", "", err
 	}
@@ -129,6 +1033,6 @@ func (c *BQClient) WriteDatasetMetadataLabel(ctx context.Context, dataset, label
 		update.SetLabel(label, value)
 	}
 
-	_, err := c.bq.Dataset(dataset).Update(ctx, update, etag)
+	_, err := c.dataset(dataset).Update(ctx, update, etag)
 	return err
 }
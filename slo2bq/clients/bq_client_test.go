@@ -0,0 +1,545 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+func TestDataTableMetadata(t *testing.T) {
+	md := dataTableMetadata()
+	if md.TimePartitioning == nil || md.TimePartitioning.Field != "date" {
+		t.Errorf("expected table to be partitioned by date; got %+v", md.TimePartitioning)
+	}
+	if md.Clustering == nil || !reflect.DeepEqual(md.Clustering.Fields, []string{"service", "slo"}) {
+		t.Errorf("expected table to be clustered by service and slo; got %+v", md.Clustering)
+	}
+
+	var partitionField bool
+	for _, f := range md.Schema {
+		if f.Name == md.TimePartitioning.Field {
+			partitionField = true
+		}
+	}
+	if !partitionField {
+		t.Errorf("expected partitioning field to be present in the schema %v", md.Schema)
+	}
+}
+
+func TestBQRowSaveMatchesSchema(t *testing.T) {
+	values, _, err := (&BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01"}).Save()
+	if err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+	if values["Project"] != "p1" {
+		t.Errorf("expected project to be saved; got %v", values)
+	}
+
+	fields := make(map[string]bool)
+	for _, f := range dataTableSchema {
+		fields[f.Name] = true
+	}
+	for k := range values {
+		if !fields[strings.ToLower(k)] {
+			t.Errorf("column %s is saved but is not present in the schema", k)
+		}
+	}
+}
+
+func TestGoalChangeSaveMatchesSchema(t *testing.T) {
+	values, _, err := (&GoalChange{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01", OldTarget: 0.99, NewTarget: 0.999}).Save()
+	if err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+	if len(values) != len(goalChangesTableSchema) {
+		t.Errorf("expected %d columns to be saved; got %v", len(goalChangesTableSchema), values)
+	}
+	for _, f := range goalChangesTableSchema {
+		found := false
+		for k := range values {
+			found = found || strings.ToLower(k) == f.Name
+		}
+		if !found {
+			t.Errorf("column %s is present in the schema but is not saved", f.Name)
+		}
+	}
+}
+
+func TestSLODefinitionSaveMatchesSchema(t *testing.T) {
+	values, _, err := (&SLODefinition{Project: "p1", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-01-01",
+		Goal: 0.99, Definition: `{"goal": 0.99}`}).Save()
+	if err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+	if len(values) != len(sloDefinitionsTableSchema) {
+		t.Errorf("expected %d columns to be saved; got %v", len(sloDefinitionsTableSchema), values)
+	}
+	for _, f := range sloDefinitionsTableSchema {
+		found := false
+		for k := range values {
+			found = found || strings.ToLower(k) == f.Name
+		}
+		if !found {
+			t.Errorf("column %s is present in the schema but is not saved", f.Name)
+		}
+	}
+}
+
+func TestKnownSLOSaveMatchesSchema(t *testing.T) {
+	values, _, err := (&KnownSLO{Project: "p1", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", FirstSeen: time.Unix(1337, 0)}).Save()
+	if err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+	if len(values) != len(knownSLOsTableSchema) {
+		t.Errorf("expected %d columns to be saved; got %v", len(knownSLOsTableSchema), values)
+	}
+	for _, f := range knownSLOsTableSchema {
+		found := false
+		for k := range values {
+			found = found || strings.ToLower(k) == f.Name
+		}
+		if !found {
+			t.Errorf("column %s is present in the schema but is not saved", f.Name)
+		}
+	}
+}
+
+func TestSLOStateSaveMatchesSchema(t *testing.T) {
+	values, _, err := (&SLOState{Project: "p1", Service: "s1", SLO: "o1", Date: "2015-01-01", Deleted: true, Recorded: time.Unix(1337, 0)}).Save()
+	if err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+	if len(values) != len(sloStateTableSchema) {
+		t.Errorf("expected %d columns to be saved; got %v", len(sloStateTableSchema), values)
+	}
+	for _, f := range sloStateTableSchema {
+		found := false
+		for k := range values {
+			found = found || strings.ToLower(k) == f.Name
+		}
+		if !found {
+			t.Errorf("column %s is present in the schema but is not saved", f.Name)
+		}
+	}
+}
+
+func TestRunManifestSaveMatchesSchema(t *testing.T) {
+	values, _, err := (&RunManifest{Project: "p1", Start: time.Unix(1337, 0), End: time.Unix(1400, 0), Error: "boom", ConfigHash: "abc"}).Save()
+	if err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+	if len(values) != len(runsTableSchema) {
+		t.Errorf("expected %d columns to be saved; got %v", len(runsTableSchema), values)
+	}
+	for _, f := range runsTableSchema {
+		found := false
+		for k := range values {
+			found = found || strings.ToLower(k) == f.Name
+		}
+		if !found {
+			t.Errorf("column %s is present in the schema but is not saved", f.Name)
+		}
+	}
+	if values, _, _ := (&RunManifest{Success: true}).Save(); values["Error"] != nil {
+		t.Errorf("expected error of a successful run to be saved as NULL; got %v", values["Error"])
+	}
+}
+
+func TestSchemaDiff(t *testing.T) {
+	// withColumn returns a copy of dataTableSchema with a given column replaced (or added, if it's not there).
+	withColumn := func(name string, f *bigquery.FieldSchema) bigquery.Schema {
+		var schema bigquery.Schema
+		found := false
+		for _, c := range dataTableSchema {
+			if c.Name != name {
+				schema = append(schema, c)
+			} else if f != nil {
+				schema = append(schema, f)
+				found = true
+			} else {
+				found = true
+			}
+		}
+		if !found && f != nil {
+			schema = append(schema, f)
+		}
+		return schema
+	}
+	for _, tt := range []struct {
+		name    string
+		actual  bigquery.Schema
+		wantErr string
+	}{
+		{"same schema", dataTableSchema, ""},
+		{"column names in different case", withColumn("good", &bigquery.FieldSchema{Name: "Good", Type: bigquery.IntegerFieldType, Required: true}), ""},
+		{"additional nullable column", withColumn("comment", &bigquery.FieldSchema{Name: "comment", Type: bigquery.StringFieldType}), ""},
+		{"renamed column", withColumn("good", &bigquery.FieldSchema{Name: "goodevents", Type: bigquery.IntegerFieldType, Required: true}),
+			"column 'good' is missing; unexpected column 'goodevents' is required"},
+		{"missing column", withColumn("partial", nil), "column 'partial' is missing"},
+		{"changed type", withColumn("total", &bigquery.FieldSchema{Name: "total", Type: bigquery.FloatFieldType, Required: true}),
+			"column 'total' has type FLOAT; expected INTEGER"},
+		{"repeated column", withColumn("period", &bigquery.FieldSchema{Name: "period", Type: bigquery.StringFieldType, Repeated: true}),
+			"column 'period' is repeated"},
+		{"required column", withColumn("hour", &bigquery.FieldSchema{Name: "hour", Type: bigquery.IntegerFieldType, Required: true}),
+			"column 'hour' is required; expected nullable"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schemaDiff(dataTableSchema, tt.actual)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("schemaDiff() unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("schemaDiff() expected error '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBQRowInsertID(t *testing.T) {
+	row := func(project, service, slo, date string, hour bigquery.NullInt64, total int64) *BQRow {
+		return &BQRow{Project: project, Service: service, SLO: slo, Date: date, Hour: hour, Total: total}
+	}
+	id := func(r *BQRow) string {
+		_, id, err := r.Save()
+		if err != nil {
+			t.Fatalf("Save() unexpected error: %v", err)
+		}
+		return id
+	}
+
+	base := row("p1", "svc1", "slo1", "2015-01-01", bigquery.NullInt64{}, 10)
+	const want = "5b447341e36621dd677102e615e88eda636eb5e02963dfb9fb00fe3142c71802"
+	if got := id(base); got != want {
+		t.Errorf("Save() returned insertID %q; want %q", got, want)
+	}
+	if got := id(row("p1", "svc1", "slo1", "2015-01-01", bigquery.NullInt64{}, 20)); got != want {
+		t.Errorf("expected insertID not to depend on event counts; got %q", got)
+	}
+	withInterval := row("p1", "svc1", "slo1", "2015-01-01", bigquery.NullInt64{}, 10)
+	withInterval.IntervalStart, withInterval.IntervalEnd = time.Unix(1420070400, 0), time.Unix(1420156800, 0)
+	if got := id(withInterval); got != want {
+		t.Errorf("expected insertID not to depend on the queried interval; got %q", got)
+	}
+
+	for _, r := range []*BQRow{
+		row("p2", "svc1", "slo1", "2015-01-01", bigquery.NullInt64{}, 10),
+		row("p1", "svc2", "slo1", "2015-01-01", bigquery.NullInt64{}, 10),
+		row("p1", "svc1", "slo2", "2015-01-01", bigquery.NullInt64{}, 10),
+		row("p1", "svc1", "slo1", "2015-01-02", bigquery.NullInt64{}, 10),
+		row("p1", "svc1", "slo1", "2015-01-01", bigquery.NullInt64{Int64: 0, Valid: true}, 10),
+		// Field boundaries should not be ambiguous.
+		row("p1", "svc1/slo1", "", "2015-01-01", bigquery.NullInt64{}, 10),
+	} {
+		if got := id(r); got == want || len(got) > 128 {
+			t.Errorf("expected a different insertID of at most 128 characters for %+v; got %q", r, got)
+		}
+	}
+
+	// Services and SLOs with the same display names are distinguished by their IDs.
+	withIDs := func(serviceID, sloID string) *BQRow {
+		r := row("p1", "svc1", "slo1", "2015-01-01", bigquery.NullInt64{}, 10)
+		r.ServiceID, r.SLOID = serviceID, sloID
+		return r
+	}
+	first := id(withIDs("s1", "o1"))
+	for _, r := range []*BQRow{withIDs("s2", "o1"), withIDs("s1", "o2")} {
+		if got := id(r); got == first {
+			t.Errorf("expected insertID to differ from %+v for %+v; got %q", withIDs("s1", "o1"), r, got)
+		}
+	}
+	renamed := withIDs("s1", "o1")
+	renamed.Service, renamed.SLO = "svc2", "slo2"
+	if got := id(renamed); got != first {
+		t.Errorf("expected insertID not to depend on display names when IDs are set; got %q; want %q", got, first)
+	}
+}
+
+func TestEncodeNDJSON(t *testing.T) {
+	buf, err := encodeNDJSON([]*BQRow{
+		&BQRow{Project: "p1", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-01-01", Total: 100, Good: 90, Target: 0.5, ErrorBudget: 50, BadEvents: 10,
+			Period: "rolling 28d", IntervalStart: time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC), IntervalEnd: time.Date(2015, time.January, 2, 0, 0, 0, 0, time.UTC), ValueType: "INT64",
+			Labels: map[string]string{"tier": "1", "team": "frontend"}},
+		&BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01", Hour: bigquery.NullInt64{Int64: 3, Valid: true}},
+	})
+	if err != nil {
+		t.Fatalf("encodeNDJSON() unexpected error: %v", err)
+	}
+	want := `{"badevents":10,"date":"2015-01-01","emptycompliance":null,"errorbudget":50,"good":90,"hour":null,"intervalend":"2015-01-02T00:00:00Z","intervalstart":"2015-01-01T00:00:00Z","labels":"{\"team\":\"frontend\",\"tier\":\"1\"}","partial":false,"period":"rolling 28d","periodstart":null,"project":"p1","service":"svc1","serviceid":"s1","slo":"slo1","sloid":"o1","target":0.5,"total":100,"valuetype":"INT64"}
+{"badevents":0,"date":"2015-01-01","emptycompliance":null,"errorbudget":0,"good":0,"hour":3,"intervalend":null,"intervalstart":null,"labels":null,"partial":false,"period":"","periodstart":null,"project":"p1","service":"svc1","serviceid":"","slo":"slo1","sloid":"","target":0,"total":0,"valuetype":""}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("encodeNDJSON() = %s; want %s", got, want)
+	}
+}
+
+func TestReadNDJSON(t *testing.T) {
+	rows := []*BQRow{
+		&BQRow{Project: "p1", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-01-01", Total: 100, Good: 90, Target: 0.5},
+		&BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01", Hour: bigquery.NullInt64{Int64: 3, Valid: true}, Partial: true},
+	}
+	encoded, err := encodeNDJSON(rows)
+	if err != nil {
+		t.Fatalf("encodeNDJSON() unexpected error: %v", err)
+	}
+	for _, tt := range []struct {
+		name    string
+		input   string
+		want    []*BQRow
+		wantErr string
+	}{
+		{"encoded rows", encoded.String(), rows, ""},
+		{"extracted rows", `{"project":"p1","service":"svc1","slo":"slo1","date":"2015-01-01","hour":"3","total":"100","good":"90","target":0.5}`,
+			[]*BQRow{&BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-01-01", Hour: bigquery.NullInt64{Int64: 3, Valid: true}, Total: 100, Good: 90, Target: 0.5}}, ""},
+		{"empty", "", nil, ""},
+		{"malformed row", "{\"project\":\"p1\"}\n{\"project\":", nil, "could not decode row 2"},
+		{"fractional total", `{"total":1.5}`, nil, "could not decode row 1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadNDJSON(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ReadNDJSON() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadNDJSON() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadNDJSON() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryLocation(t *testing.T) {
+	for _, location := range []string{"", "asia-northeast1"} {
+		c := &BQClient{bq: &bigquery.Client{}, location: location}
+		q := c.newQuery("SELECT 1")
+		if q.Location != location {
+			t.Errorf("expected query to run in location %q; got %q", location, q.Location)
+		}
+	}
+}
+
+func TestQualifiedDataset(t *testing.T) {
+	for _, tt := range []struct {
+		project     string
+		wantName    string
+		wantProject string
+	}{
+		{"", "ds", ""},
+		{"app", "app.ds", "app"},
+	} {
+		c := &BQClient{bq: &bigquery.Client{}, project: tt.project}
+		if got := c.qualified("ds"); got != tt.wantName {
+			t.Errorf("qualified() = %q; want %q", got, tt.wantName)
+		}
+		if got := c.dataset("ds").ProjectID; got != tt.wantProject {
+			t.Errorf("dataset() returned a dataset in project %q; want %q", got, tt.wantProject)
+		}
+	}
+}
+
+func TestPruneQuery(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("could not load location: %v", err)
+	}
+	for _, tt := range []struct {
+		name      string
+		olderThan time.Time
+		want      string
+	}{
+		{"utc", time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC), "DELETE FROM `dataset.data` WHERE date < DATE '2019-06-01'"},
+		// Midnight in Tokyo is still the previous day in UTC; the date is taken in the location of olderThan.
+		{"local midnight", time.Date(2019, time.June, 1, 0, 0, 0, 0, tokyo), "DELETE FROM `dataset.data` WHERE date < DATE '2019-06-01'"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pruneQuery("dataset", "data", tt.olderThan); got != tt.want {
+				t.Errorf("pruneQuery() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unavailable", &googleapi.Error{Code: 503}, true},
+		{"internal error", &googleapi.Error{Code: 500}, true},
+		{"rate limited", &googleapi.Error{Code: 429}, true},
+		{"etag mismatch", &googleapi.Error{Code: 412}, false},
+		{"not found", &googleapi.Error{Code: 404}, false},
+		{"other error", fmt.Errorf("503"), false},
+		{"no error", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v; want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPreconditionFailed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"etag mismatch", &googleapi.Error{Code: 412}, true},
+		{"unavailable", &googleapi.Error{Code: 503}, false},
+		{"other error", fmt.Errorf("412"), false},
+		{"no error", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPreconditionFailed(tt.err); got != tt.want {
+				t.Errorf("IsPreconditionFailed(%v) = %v; want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"api not found", &googleapi.Error{Code: 404}, true},
+		{"bigquery not found", &bigquery.Error{Reason: "notFound"}, true},
+		{"bigquery invalid", &bigquery.Error{Reason: "invalid"}, false},
+		{"unavailable", &googleapi.Error{Code: 503}, false},
+		{"no error", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsNotFound(tt.err); got != tt.want {
+				t.Errorf("IsNotFound(%v) = %v; want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsStreamingBuffer(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"streaming buffer", &bigquery.Error{Reason: "invalidQuery", Message: "UPDATE or DELETE statement over table p.d.data would affect rows in the streaming buffer, which is not supported"}, true},
+		{"other query error", &bigquery.Error{Reason: "invalidQuery", Message: "Syntax error"}, false},
+		{"api error", &googleapi.Error{Code: 400, Message: "DELETE would affect rows in the streaming buffer"}, true},
+		{"other api error", &googleapi.Error{Code: 400, Message: "invalid"}, false},
+		{"no error", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsStreamingBuffer(tt.err); got != tt.want {
+				t.Errorf("IsStreamingBuffer(%v) = %v; want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeUploader records rows passed to Put, and returns errors from a list, one per call.
+type fakeUploader struct {
+	calls [][]string
+	errs  []error
+}
+
+func (u *fakeUploader) Put(ctx context.Context, src interface{}) error {
+	var slos []string
+	for _, r := range src.([]*BQRow) {
+		slos = append(slos, r.SLO)
+	}
+	u.calls = append(u.calls, slos)
+	if len(u.errs) == 0 {
+		return nil
+	}
+	err := u.errs[0]
+	u.errs = u.errs[1:]
+	return err
+}
+
+// rowError returns a bigquery.RowInsertionError of a row with a given index and reason.
+func rowError(index int, reason string) bigquery.RowInsertionError {
+	return bigquery.RowInsertionError{RowIndex: index, Errors: bigquery.MultiError{&bigquery.Error{Reason: reason, Message: reason}}}
+}
+
+func TestPutWithRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+	quota := &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}
+
+	for _, tt := range []struct {
+		name      string
+		errs      []error
+		wantErr   bool
+		wantCalls [][]string
+	}{
+		{"success", nil, false, [][]string{{"a", "b", "c"}}},
+		{"partial failure", []error{bigquery.PutMultiError{rowError(0, "quotaExceeded"), rowError(2, "rateLimitExceeded")}}, false,
+			[][]string{{"a", "b", "c"}, {"a", "c"}}},
+		// Row indexes refer to the rows of the failed request.
+		{"repeated partial failure", []error{bigquery.PutMultiError{rowError(0, "quotaExceeded"), rowError(2, "backendError")},
+			bigquery.PutMultiError{rowError(1, "quotaExceeded")}}, false,
+			[][]string{{"a", "b", "c"}, {"a", "c"}, {"c"}}},
+		{"quota exceeded", []error{quota}, false, [][]string{{"a", "b", "c"}, {"a", "b", "c"}}},
+		{"unavailable", []error{&googleapi.Error{Code: 503}}, false, [][]string{{"a", "b", "c"}, {"a", "b", "c"}}},
+		{"invalid row", []error{bigquery.PutMultiError{rowError(0, "stopped"), rowError(1, "invalid")}}, true, [][]string{{"a", "b", "c"}}},
+		{"mixed reasons", []error{bigquery.PutMultiError{rowError(0, "quotaExceeded"), rowError(1, "invalid")}}, true, [][]string{{"a", "b", "c"}}},
+		{"permission denied", []error{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}}}, true,
+			[][]string{{"a", "b", "c"}}},
+		{"other error", []error{fmt.Errorf("connection reset")}, true, [][]string{{"a", "b", "c"}}},
+		{"gives up", []error{quota, quota, quota, quota, quota}, true,
+			[][]string{{"a", "b", "c"}, {"a", "b", "c"}, {"a", "b", "c"}, {"a", "b", "c"}, {"a", "b", "c"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &fakeUploader{errs: tt.errs}
+			rows := []*BQRow{&BQRow{SLO: "a"}, &BQRow{SLO: "b"}, &BQRow{SLO: "c"}}
+			err := putWithRetry(context.Background(), u, rows)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("putWithRetry() = %v; want error: %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(u.calls, tt.wantCalls) {
+				t.Errorf("expected calls %q; got %q", tt.wantCalls, u.calls)
+			}
+		})
+	}
+}
+
+func TestPutWithRetryCancelled(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	u := &fakeUploader{errs: []error{&googleapi.Error{Code: 503}}}
+	if err := putWithRetry(ctx, u, []*BQRow{&BQRow{SLO: "a"}}); err != context.Canceled {
+		t.Errorf("putWithRetry() = %v; want %v", err, context.Canceled)
+	}
+}
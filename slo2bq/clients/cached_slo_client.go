@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clients provides clients for GCP services.
+// This file contains a caching wrapper for SLO clients.
+package clients
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CachedSLOClient is an SLOClient memoizing results of another SLOClient for a limited time.
+// Errors are not cached. It is safe for concurrent use.
+type CachedSLOClient struct {
+	c   SLOClient
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	services *cachedServices
+	// slos is keyed by service name.
+	slos map[string]*cachedSLOs
+}
+
+type cachedServices struct {
+	value   []*Service
+	expires time.Time
+}
+
+type cachedSLOs struct {
+	value   []*SLO
+	expires time.Time
+}
+
+// NewCachedSLOClient returns a client caching results of `c` for `ttl`.
+func NewCachedSLOClient(c SLOClient, ttl time.Duration) *CachedSLOClient {
+	return &CachedSLOClient{c: c, ttl: ttl, now: time.Now, slos: make(map[string]*cachedSLOs)}
+}
+
+// Services returns a list of services.
+func (c *CachedSLOClient) Services(ctx context.Context) ([]*Service, error) {
+	c.mu.Lock()
+	if s := c.services; s != nil && c.now().Before(s.expires) {
+		c.mu.Unlock()
+		return s.value, nil
+	}
+	c.mu.Unlock()
+
+	svcs, err := c.c.Services(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.services = &cachedServices{svcs, c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return svcs, nil
+}
+
+// SLOs returns a list of SLOs for a given service.
+func (c *CachedSLOClient) SLOs(ctx context.Context, service *Service) ([]*SLO, error) {
+	c.mu.Lock()
+	if s, ok := c.slos[service.Name]; ok && c.now().Before(s.expires) {
+		c.mu.Unlock()
+		return s.value, nil
+	}
+	c.mu.Unlock()
+
+	slos, err := c.c.SLOs(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.slos[service.Name] = &cachedSLOs{slos, c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return slos, nil
+}
+
+// Close closes the underlying client. Since it only releases idle connections, cached results are kept
+// and the client can still be used.
+func (c *CachedSLOClient) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingSLOClient is an SLOClient counting calls to its methods.
+type countingSLOClient struct {
+	services int
+	slos     map[string]int
+	closes   int
+	err      error
+}
+
+func (c *countingSLOClient) Services(ctx context.Context) ([]*Service, error) {
+	c.services++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []*Service{&Service{Name: "projects/p/services/svc1"}, &Service{Name: "projects/p/services/svc2"}}, nil
+}
+
+func (c *countingSLOClient) SLOs(ctx context.Context, s *Service) ([]*SLO, error) {
+	c.slos[s.Name]++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []*SLO{&SLO{Name: s.Name + "/serviceLevelObjectives/slo1"}}, nil
+}
+
+func (c *countingSLOClient) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestCachedSLOClientClose(t *testing.T) {
+	under := &countingSLOClient{slos: make(map[string]int)}
+	c := NewCachedSLOClient(under, time.Minute)
+	if _, err := c.Services(context.Background()); err != nil {
+		t.Fatalf("Services() unexpected error: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+	if under.closes != 1 {
+		t.Errorf("expected underlying client to be closed once; got %d", under.closes)
+	}
+	// Cached results are still available after closing.
+	if _, err := c.Services(context.Background()); err != nil || under.services != 1 {
+		t.Errorf("expected cached services after Close(); got %d calls (error %v)", under.services, err)
+	}
+}
+
+func TestCachedSLOClient(t *testing.T) {
+	now := time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC)
+	under := &countingSLOClient{slos: make(map[string]int)}
+	c := NewCachedSLOClient(under, time.Minute)
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		svcs, err := c.Services(context.Background())
+		if err != nil || len(svcs) != 2 {
+			t.Fatalf("Services() = %v, %v", svcs, err)
+		}
+		for _, s := range svcs {
+			if slos, err := c.SLOs(context.Background(), s); err != nil || len(slos) != 1 {
+				t.Fatalf("SLOs(%s) = %v, %v", s.Name, slos, err)
+			}
+		}
+	}
+	if under.services != 1 || under.slos["projects/p/services/svc1"] != 1 || under.slos["projects/p/services/svc2"] != 1 {
+		t.Errorf("expected underlying client to be called once per lookup; got %d Services() and %v SLOs() calls", under.services, under.slos)
+	}
+
+	now = now.Add(time.Minute)
+	c.Services(context.Background())
+	c.SLOs(context.Background(), &Service{Name: "projects/p/services/svc1"})
+	if under.services != 2 || under.slos["projects/p/services/svc1"] != 2 {
+		t.Errorf("expected expired entries to be refreshed; got %d Services() and %v SLOs() calls", under.services, under.slos)
+	}
+}
+
+func TestCachedSLOClientErrors(t *testing.T) {
+	under := &countingSLOClient{slos: make(map[string]int), err: fmt.Errorf("backend error")}
+	c := NewCachedSLOClient(under, time.Minute)
+	svc := &Service{Name: "projects/p/services/svc1"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Services(context.Background()); err == nil {
+			t.Errorf("Services() expected error")
+		}
+		if _, err := c.SLOs(context.Background(), svc); err == nil {
+			t.Errorf("SLOs() expected error")
+		}
+	}
+	if under.services != 2 || under.slos[svc.Name] != 2 {
+		t.Errorf("expected errors not to be cached; got %d Services() and %v SLOs() calls", under.services, under.slos)
+	}
+}
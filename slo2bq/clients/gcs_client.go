@@ -0,0 +1,77 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clients provides clients for GCP services.
+// This file contains Cloud Storage client.
+package clients
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+//go:generate mockgen -destination=mocks/mock_gcs_client.go -package mocks slo2bq/clients GCSClient
+
+// GCSClient is the interface implemented by this Cloud Storage client.
+type GCSClient interface {
+	WriteRows(context.Context, string, string, []*BQRow) error
+	Close() error
+}
+
+// StorageClient is a simple client writing BQRows to Cloud Storage.
+type StorageClient struct {
+	gcs *storage.Client
+	// newWriter returns a writer creating a given object; it's replaced in tests.
+	newWriter func(ctx context.Context, bucket, object string) io.WriteCloser
+}
+
+// NewStorageClient returns a new StorageClient. Application default credentials are used unless opts specify
+// otherwise.
+func NewStorageClient(ctx context.Context, opts ...option.ClientOption) (*StorageClient, error) {
+	gcs, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c := &StorageClient{gcs: gcs}
+	c.newWriter = func(ctx context.Context, bucket, object string) io.WriteCloser {
+		w := gcs.Bucket(bucket).Object(object).NewWriter(ctx)
+		w.ContentType = "application/x-ndjson"
+		return w
+	}
+	return c, nil
+}
+
+// Close closes the enclosed Cloud Storage client.
+func (c *StorageClient) Close() error {
+	return c.gcs.Close()
+}
+
+// WriteRows writes BQRows to a given object as newline-delimited JSON, which can be loaded into
+// a table with the same schema as the one used by BQClient. Existing objects are overwritten.
+func (c *StorageClient) WriteRows(ctx context.Context, bucket, object string, rows []*BQRow) error {
+	buf, err := encodeNDJSON(rows)
+	if err != nil {
+		return err
+	}
+	w := c.newWriter(ctx, bucket, object)
+	if _, err := buf.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	// The object is only created once the writer is closed successfully.
+	return w.Close()
+}
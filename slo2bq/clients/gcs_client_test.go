@@ -0,0 +1,57 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+// fakeObject is an in-memory object, which only becomes visible in the store once closed.
+type fakeObject struct {
+	bytes.Buffer
+	store map[string]string
+	name  string
+}
+
+func (o *fakeObject) Close() error {
+	o.store[o.name] = o.String()
+	return nil
+}
+
+func TestWriteRows(t *testing.T) {
+	store := make(map[string]string)
+	c := &StorageClient{newWriter: func(_ context.Context, bucket, object string) io.WriteCloser {
+		return &fakeObject{store: store, name: bucket + "/" + object}
+	}}
+
+	rows := []*BQRow{
+		&BQRow{Project: "p1", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-01-01", Total: 100, Good: 90, Target: 0.5,
+			ErrorBudget: 50, BadEvents: 10, Period: "rolling 28d"},
+		&BQRow{Project: "p1", Service: "svc1", SLO: "slo2", ServiceID: "s1", SLOID: "o2", Date: "2015-01-01"},
+	}
+	if err := c.WriteRows(context.Background(), "bucket", "prefix/2015-01-01.json", rows); err != nil {
+		t.Fatalf("WriteRows() unexpected error: %v", err)
+	}
+
+	want := `{"badevents":10,"date":"2015-01-01","emptycompliance":null,"errorbudget":50,"good":90,"hour":null,"intervalend":null,"intervalstart":null,"labels":null,"partial":false,"period":"rolling 28d","periodstart":null,"project":"p1","service":"svc1","serviceid":"s1","slo":"slo1","sloid":"o1","target":0.5,"total":100,"valuetype":""}
+{"badevents":0,"date":"2015-01-01","emptycompliance":null,"errorbudget":0,"good":0,"hour":null,"intervalend":null,"intervalstart":null,"labels":null,"partial":false,"period":"","periodstart":null,"project":"p1","service":"svc1","serviceid":"s1","slo":"slo2","sloid":"o2","target":0,"total":0,"valuetype":""}
+`
+	if got, ok := store["bucket/prefix/2015-01-01.json"]; !ok || got != want {
+		t.Errorf("expected object with content %s; got %v", want, store)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 	clients "slo2bq/clients"
+	time "time"
 )
 
 // MockBigQueryClient is a mock of BigQueryClient interface
@@ -48,6 +49,105 @@ func (mr *MockBigQueryClientMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockBigQueryClient)(nil).Close))
 }
 
+// CreateDataset mocks base method
+func (m *MockBigQueryClient) CreateDataset(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateDataset", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateDataset indicates an expected call of CreateDataset
+func (mr *MockBigQueryClientMockRecorder) CreateDataset(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDataset", reflect.TypeOf((*MockBigQueryClient)(nil).CreateDataset), arg0, arg1)
+}
+
+// CreateOrReplaceView mocks base method
+func (m *MockBigQueryClient) CreateOrReplaceView(arg0 context.Context, arg1, arg2, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateOrReplaceView", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateOrReplaceView indicates an expected call of CreateOrReplaceView
+func (mr *MockBigQueryClientMockRecorder) CreateOrReplaceView(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateOrReplaceView", reflect.TypeOf((*MockBigQueryClient)(nil).CreateOrReplaceView), arg0, arg1, arg2, arg3)
+}
+
+// DatasetExists mocks base method
+func (m *MockBigQueryClient) DatasetExists(arg0 context.Context, arg1 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DatasetExists", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DatasetExists indicates an expected call of DatasetExists
+func (mr *MockBigQueryClientMockRecorder) DatasetExists(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DatasetExists", reflect.TypeOf((*MockBigQueryClient)(nil).DatasetExists), arg0, arg1)
+}
+
+// DeleteRows mocks base method
+func (m *MockBigQueryClient) DeleteRows(arg0 context.Context, arg1, arg2, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteRows", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteRows indicates an expected call of DeleteRows
+func (mr *MockBigQueryClientMockRecorder) DeleteRows(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRows", reflect.TypeOf((*MockBigQueryClient)(nil).DeleteRows), arg0, arg1, arg2, arg3)
+}
+
+// EnsureTable mocks base method
+func (m *MockBigQueryClient) EnsureTable(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnsureTable", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnsureTable indicates an expected call of EnsureTable
+func (mr *MockBigQueryClientMockRecorder) EnsureTable(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureTable", reflect.TypeOf((*MockBigQueryClient)(nil).EnsureTable), arg0, arg1, arg2)
+}
+
+// Load mocks base method
+func (m *MockBigQueryClient) Load(arg0 context.Context, arg1, arg2 string, arg3 []*clients.BQRow) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Load", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Load indicates an expected call of Load
+func (mr *MockBigQueryClientMockRecorder) Load(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Load", reflect.TypeOf((*MockBigQueryClient)(nil).Load), arg0, arg1, arg2, arg3)
+}
+
+// PruneOldRows mocks base method
+func (m *MockBigQueryClient) PruneOldRows(arg0 context.Context, arg1, arg2 string, arg3 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PruneOldRows", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PruneOldRows indicates an expected call of PruneOldRows
+func (mr *MockBigQueryClientMockRecorder) PruneOldRows(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PruneOldRows", reflect.TypeOf((*MockBigQueryClient)(nil).PruneOldRows), arg0, arg1, arg2, arg3)
+}
+
 // Put mocks base method
 func (m *MockBigQueryClient) Put(arg0 context.Context, arg1, arg2 string, arg3 []*clients.BQRow) error {
 	m.ctrl.T.Helper()
@@ -93,6 +193,50 @@ func (mr *MockBigQueryClientMockRecorder) ReadDatasetMetadataLabel(arg0, arg1, a
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadDatasetMetadataLabel", reflect.TypeOf((*MockBigQueryClient)(nil).ReadDatasetMetadataLabel), arg0, arg1, arg2)
 }
 
+// ReadKnownSLOs mocks base method
+func (m *MockBigQueryClient) ReadKnownSLOs(arg0 context.Context, arg1, arg2, arg3 string) ([]*clients.KnownSLO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadKnownSLOs", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]*clients.KnownSLO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadKnownSLOs indicates an expected call of ReadKnownSLOs
+func (mr *MockBigQueryClientMockRecorder) ReadKnownSLOs(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadKnownSLOs", reflect.TypeOf((*MockBigQueryClient)(nil).ReadKnownSLOs), arg0, arg1, arg2, arg3)
+}
+
+// ReadSLOStates mocks base method
+func (m *MockBigQueryClient) ReadSLOStates(arg0 context.Context, arg1, arg2, arg3 string) ([]*clients.SLOState, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadSLOStates", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]*clients.SLOState)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadSLOStates indicates an expected call of ReadSLOStates
+func (mr *MockBigQueryClientMockRecorder) ReadSLOStates(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadSLOStates", reflect.TypeOf((*MockBigQueryClient)(nil).ReadSLOStates), arg0, arg1, arg2, arg3)
+}
+
+// VerifySchema mocks base method
+func (m *MockBigQueryClient) VerifySchema(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "VerifySchema", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// VerifySchema indicates an expected call of VerifySchema
+func (mr *MockBigQueryClientMockRecorder) VerifySchema(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifySchema", reflect.TypeOf((*MockBigQueryClient)(nil).VerifySchema), arg0, arg1, arg2)
+}
+
 // WriteDatasetMetadataLabel mocks base method
 func (m *MockBigQueryClient) WriteDatasetMetadataLabel(arg0 context.Context, arg1, arg2, arg3, arg4 string) error {
 	m.ctrl.T.Helper()
@@ -106,3 +250,73 @@ func (mr *MockBigQueryClientMockRecorder) WriteDatasetMetadataLabel(arg0, arg1,
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteDatasetMetadataLabel", reflect.TypeOf((*MockBigQueryClient)(nil).WriteDatasetMetadataLabel), arg0, arg1, arg2, arg3, arg4)
 }
+
+// WriteGoalChanges mocks base method
+func (m *MockBigQueryClient) WriteGoalChanges(arg0 context.Context, arg1, arg2 string, arg3 []*clients.GoalChange) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteGoalChanges", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteGoalChanges indicates an expected call of WriteGoalChanges
+func (mr *MockBigQueryClientMockRecorder) WriteGoalChanges(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteGoalChanges", reflect.TypeOf((*MockBigQueryClient)(nil).WriteGoalChanges), arg0, arg1, arg2, arg3)
+}
+
+// WriteKnownSLOs mocks base method
+func (m *MockBigQueryClient) WriteKnownSLOs(arg0 context.Context, arg1, arg2 string, arg3 []*clients.KnownSLO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteKnownSLOs", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteKnownSLOs indicates an expected call of WriteKnownSLOs
+func (mr *MockBigQueryClientMockRecorder) WriteKnownSLOs(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteKnownSLOs", reflect.TypeOf((*MockBigQueryClient)(nil).WriteKnownSLOs), arg0, arg1, arg2, arg3)
+}
+
+// WriteRunManifest mocks base method
+func (m *MockBigQueryClient) WriteRunManifest(arg0 context.Context, arg1, arg2 string, arg3 *clients.RunManifest) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteRunManifest", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteRunManifest indicates an expected call of WriteRunManifest
+func (mr *MockBigQueryClientMockRecorder) WriteRunManifest(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteRunManifest", reflect.TypeOf((*MockBigQueryClient)(nil).WriteRunManifest), arg0, arg1, arg2, arg3)
+}
+
+// WriteSLODefinitions mocks base method
+func (m *MockBigQueryClient) WriteSLODefinitions(arg0 context.Context, arg1, arg2 string, arg3 []*clients.SLODefinition) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteSLODefinitions", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteSLODefinitions indicates an expected call of WriteSLODefinitions
+func (mr *MockBigQueryClientMockRecorder) WriteSLODefinitions(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteSLODefinitions", reflect.TypeOf((*MockBigQueryClient)(nil).WriteSLODefinitions), arg0, arg1, arg2, arg3)
+}
+
+// WriteSLOStates mocks base method
+func (m *MockBigQueryClient) WriteSLOStates(arg0 context.Context, arg1, arg2 string, arg3 []*clients.SLOState) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteSLOStates", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteSLOStates indicates an expected call of WriteSLOStates
+func (mr *MockBigQueryClientMockRecorder) WriteSLOStates(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteSLOStates", reflect.TypeOf((*MockBigQueryClient)(nil).WriteSLOStates), arg0, arg1, arg2, arg3)
+}
@@ -9,6 +9,7 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	v3 "google.golang.org/genproto/googleapis/monitoring/v3"
 	reflect "reflect"
+	clients "slo2bq/clients"
 )
 
 // MockMetricClient is a mock of MetricClient interface
@@ -48,6 +49,20 @@ func (mr *MockMetricClientMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockMetricClient)(nil).Close))
 }
 
+// CreateTimeSeries mocks base method
+func (m *MockMetricClient) CreateTimeSeries(arg0 context.Context, arg1 *v3.CreateTimeSeriesRequest) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateTimeSeries", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateTimeSeries indicates an expected call of CreateTimeSeries
+func (mr *MockMetricClientMockRecorder) CreateTimeSeries(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateTimeSeries", reflect.TypeOf((*MockMetricClient)(nil).CreateTimeSeries), arg0, arg1)
+}
+
 // ListTimeSeries mocks base method
 func (m *MockMetricClient) ListTimeSeries(arg0 context.Context, arg1 *v3.ListTimeSeriesRequest) ([]*v3.TimeSeries, error) {
 	m.ctrl.T.Helper()
@@ -62,3 +77,18 @@ func (mr *MockMetricClientMockRecorder) ListTimeSeries(arg0, arg1 interface{}) *
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListTimeSeries", reflect.TypeOf((*MockMetricClient)(nil).ListTimeSeries), arg0, arg1)
 }
+
+// QueryTimeSeries mocks base method
+func (m *MockMetricClient) QueryTimeSeries(arg0 context.Context, arg1, arg2 string) (*clients.QueryResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QueryTimeSeries", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*clients.QueryResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// QueryTimeSeries indicates an expected call of QueryTimeSeries
+func (mr *MockMetricClientMockRecorder) QueryTimeSeries(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueryTimeSeries", reflect.TypeOf((*MockMetricClient)(nil).QueryTimeSeries), arg0, arg1, arg2)
+}
@@ -5,6 +5,7 @@
 package mocks
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 	clients "slo2bq/clients"
@@ -33,32 +34,46 @@ func (m *MockSLOClient) EXPECT() *MockSLOClientMockRecorder {
 	return m.recorder
 }
 
+// Close mocks base method
+func (m *MockSLOClient) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close
+func (mr *MockSLOClientMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockSLOClient)(nil).Close))
+}
+
 // SLOs mocks base method
-func (m *MockSLOClient) SLOs(arg0 *clients.Service) ([]*clients.SLO, error) {
+func (m *MockSLOClient) SLOs(arg0 context.Context, arg1 *clients.Service) ([]*clients.SLO, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SLOs", arg0)
+	ret := m.ctrl.Call(m, "SLOs", arg0, arg1)
 	ret0, _ := ret[0].([]*clients.SLO)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // SLOs indicates an expected call of SLOs
-func (mr *MockSLOClientMockRecorder) SLOs(arg0 interface{}) *gomock.Call {
+func (mr *MockSLOClientMockRecorder) SLOs(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SLOs", reflect.TypeOf((*MockSLOClient)(nil).SLOs), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SLOs", reflect.TypeOf((*MockSLOClient)(nil).SLOs), arg0, arg1)
 }
 
 // Services mocks base method
-func (m *MockSLOClient) Services() ([]*clients.Service, error) {
+func (m *MockSLOClient) Services(arg0 context.Context) ([]*clients.Service, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Services")
+	ret := m.ctrl.Call(m, "Services", arg0)
 	ret0, _ := ret[0].([]*clients.Service)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Services indicates an expected call of Services
-func (mr *MockSLOClientMockRecorder) Services() *gomock.Call {
+func (mr *MockSLOClientMockRecorder) Services(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Services", reflect.TypeOf((*MockSLOClient)(nil).Services))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Services", reflect.TypeOf((*MockSLOClient)(nil).Services), arg0)
 }
@@ -0,0 +1,70 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clients provides clients for GCP services.
+// This file contains a simple rate limiter for API calls.
+package clients
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out calls, so that they start at most `qps` times per second. Unlike a token bucket,
+// it does not allow bursts, which is what we want to stay within per-minute API quotas. A nil rateLimiter
+// does not limit anything.
+type rateLimiter struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// next is the earliest time when the next call can start.
+	next time.Time
+}
+
+// newRateLimiter returns a rateLimiter for a given number of calls per second, or nil if qps is not positive.
+func newRateLimiter(qps float64) *rateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / qps)}
+}
+
+// Wait blocks until a call is allowed to start, or the context is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+
+	d := start.Sub(now)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
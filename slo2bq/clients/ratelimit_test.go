@@ -0,0 +1,74 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const calls, qps = 6, 50
+	l := newRateLimiter(qps)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Wait(context.Background()); err != nil {
+				t.Errorf("Wait() unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The first call starts immediately, and each of the following ones waits for 1/qps.
+	if want, got := (calls-1)*time.Second/qps, time.Since(start); got < want {
+		t.Errorf("expected %d calls to take at least %v; got %v", calls, want, got)
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	l := newRateLimiter(0.001)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() expected deadline to be exceeded; got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected Wait() to return once the context is done; took %v", d)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(0)
+	if l != nil {
+		t.Fatalf("expected no limiter for zero QPS; got %+v", l)
+	}
+	for i := 0; i < 100; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() unexpected error: %v", err)
+		}
+	}
+}
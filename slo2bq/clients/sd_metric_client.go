@@ -17,33 +17,117 @@
 package clients
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
 
 	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"github.com/golang/protobuf/proto"
+	gax "github.com/googleapis/gax-go/v2"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
+// Default maximum number of time series returned by a single ListTimeSeries call.
+const defaultMaxSeries = 10000
+
 //go:generate mockgen -destination=mocks/mock_metric_client.go -package mocks slo2bq/clients MetricClient
 
 // MetricClient defines Stackdriver functions implemented by StackdriverMetricClient.
 type MetricClient interface {
 	ListTimeSeries(context.Context, *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error)
+	QueryTimeSeries(context.Context, string, string) (*QueryResult, error)
+	CreateTimeSeries(context.Context, *monitoringpb.CreateTimeSeriesRequest) error
 	Close() error
 }
 
 // StackdriverMetricClient wraps Stackdriver metric client, implementing MetricClient interface.
 type StackdriverMetricClient struct {
-	sd *monitoring.MetricClient
+	sd      *monitoring.MetricClient
+	limiter *rateLimiter
+	// maxSeries is the maximum number of time series returned by a single ListTimeSeries or QueryTimeSeries call.
+	maxSeries int
+	// http and endpoint are used for QueryTimeSeries, which is not supported by the Monitoring API client
+	// library version used here.
+	http     *http.Client
+	endpoint string
+}
+
+// QueryResult is the result of a Monitoring Query Language query: a table with value columns described by
+// PointDescriptors, and a row of points for every time series.
+type QueryResult struct {
+	PointDescriptors []*PointDescriptor
+	Data             []*TimeSeriesData
+}
+
+// PointDescriptor describes a value column of a QueryResult.
+type PointDescriptor struct {
+	Key        string `json:"key"`
+	ValueType  string `json:"valueType"`
+	MetricKind string `json:"metricKind"`
+}
+
+// TimeSeriesData holds points of a single time series returned by a query.
+type TimeSeriesData struct {
+	PointData []*PointData `json:"pointData"`
+}
+
+// PointData holds values of a single point, one for each of QueryResult.PointDescriptors.
+type PointData struct {
+	Values []*QueryValue `json:"values"`
+}
+
+// QueryValue is a single value, of the type given by the corresponding PointDescriptor.
+type QueryValue struct {
+	BoolValue         bool               `json:"boolValue"`
+	Int64Value        int64              `json:"int64Value,string"`
+	DoubleValue       float64            `json:"doubleValue"`
+	DistributionValue *QueryDistribution `json:"distributionValue"`
+}
+
+// QueryDistribution is a distribution value; only the number of values in it is used.
+type QueryDistribution struct {
+	Count int64 `json:"count,string"`
+}
+
+// queryResponse is a (trimmed) response of the timeSeries.query API method.
+type queryResponse struct {
+	Descriptor struct {
+		PointDescriptors []*PointDescriptor `json:"pointDescriptors"`
+	} `json:"timeSeriesDescriptor"`
+	Data          []*TimeSeriesData `json:"timeSeriesData"`
+	NextPageToken string            `json:"nextPageToken"`
+	PartialErrors []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"partialErrors"`
 }
 
-// NewStackdriverMetricClient returns a new client.
-func NewStackdriverMetricClient(ctx context.Context) (*StackdriverMetricClient, error) {
-	sd, err := monitoring.NewMetricClient(ctx)
+// NewStackdriverMetricClient returns a new client. If qps is positive, ListTimeSeries calls are spaced out
+// to start at most qps times per second. ListTimeSeries fails if a request matches more than maxSeries time
+// series (or defaultMaxSeries, if maxSeries is not positive), which protects against running out of memory
+// with a filter matching too much. Application default credentials are used unless opts specify otherwise.
+func NewStackdriverMetricClient(ctx context.Context, qps float64, maxSeries int, opts ...option.ClientOption) (*StackdriverMetricClient, error) {
+	sd, err := monitoring.NewMetricClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := htransport.NewClient(ctx, append([]option.ClientOption{option.WithScopes(monitoringReadScope)}, opts...)...)
 	if err != nil {
+		sd.Close()
 		return nil, err
 	}
-	return &StackdriverMetricClient{sd}, nil
+	if maxSeries <= 0 {
+		maxSeries = defaultMaxSeries
+	}
+	return &StackdriverMetricClient{sd, newRateLimiter(qps), maxSeries, h, monitoringEndpoint}, nil
 }
 
 // Close closes the metric client.
@@ -51,19 +135,166 @@ func (c *StackdriverMetricClient) Close() error {
 	return c.sd.Close()
 }
 
-// ListTimeSeries queries time series.
+// ListTimeSeries queries time series, reading all pages of the response.
 func (c *StackdriverMetricClient) ListTimeSeries(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
-	it := c.sd.ListTimeSeries(ctx, req)
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return readTimeSeries(&pageSeriesIterator{ctx: ctx, req: req, list: c.listTimeSeriesPage}, req.Filter, c.maxSeries)
+}
+
+// listTimeSeriesPage fetches a single page of time series. TimeSeriesIterator of the Monitoring API client
+// library version used here does not expose responses, so the RPC is called directly on the connection of
+// the client, using its retry settings.
+func (c *StackdriverMetricClient) listTimeSeriesPage(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) (*monitoringpb.ListTimeSeriesResponse, error) {
+	stub := monitoringpb.NewMetricServiceClient(c.sd.Connection())
+	var resp *monitoringpb.ListTimeSeriesResponse
+	err := gax.Invoke(ctx, func(ctx context.Context, settings gax.CallSettings) error {
+		var err error
+		resp, err = stub.ListTimeSeries(ctx, req, settings.GRPC...)
+		return err
+	}, c.sd.CallOptions.ListTimeSeries...)
+	return resp, err
+}
+
+// seriesIterator is implemented by pageSeriesIterator, and by fakes in tests.
+type seriesIterator interface {
+	Next() (*monitoringpb.TimeSeries, error)
+	// Response returns the raw response of the last page that has been fetched, if any.
+	Response() *monitoringpb.ListTimeSeriesResponse
+}
+
+var _ seriesIterator = (*pageSeriesIterator)(nil)
+
+// pageSeriesIterator returns time series of all pages of a ListTimeSeries request, fetching a page using
+// `list` whenever the previous one has been consumed.
+type pageSeriesIterator struct {
+	ctx  context.Context
+	req  *monitoringpb.ListTimeSeriesRequest
+	list func(context.Context, *monitoringpb.ListTimeSeriesRequest) (*monitoringpb.ListTimeSeriesResponse, error)
+	resp *monitoringpb.ListTimeSeriesResponse
+	pos  int
+}
+
+func (it *pageSeriesIterator) Next() (*monitoringpb.TimeSeries, error) {
+	for it.resp == nil || it.pos >= len(it.resp.TimeSeries) {
+		req := proto.Clone(it.req).(*monitoringpb.ListTimeSeriesRequest)
+		if it.resp != nil {
+			if it.resp.NextPageToken == "" {
+				return nil, iterator.Done
+			}
+			req.PageToken = it.resp.NextPageToken
+		}
+		resp, err := it.list(it.ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		it.resp, it.pos = resp, 0
+	}
+	it.pos++
+	return it.resp.TimeSeries[it.pos-1], nil
+}
+
+func (it *pageSeriesIterator) Response() *monitoringpb.ListTimeSeriesResponse {
+	return it.resp
+}
+
+// readTimeSeries reads all time series from an iterator, which fetches further pages as needed. An error is
+// returned if there are more than maxSeries series, or if any page reports execution errors: such partial
+// results (e.g. when some of the data could not be read in time) would undercount events.
+func readTimeSeries(it seriesIterator, filter string, maxSeries int) ([]*monitoringpb.TimeSeries, error) {
 	var series []*monitoringpb.TimeSeries
+	var last *monitoringpb.ListTimeSeriesResponse
 	for {
 		t, err := it.Next()
+		// Every page is checked once, right after it has been fetched (including an empty last page).
+		if r := it.Response(); r != nil && r != last {
+			last = r
+			if len(r.ExecutionErrors) > 0 {
+				var msgs []string
+				for _, e := range r.ExecutionErrors {
+					msgs = append(msgs, fmt.Sprintf("%s (code %d)", e.GetMessage(), e.GetCode()))
+				}
+				return nil, fmt.Errorf("partial result for filter '%s': %s", filter, strings.Join(msgs, "; "))
+			}
+		}
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
+		if len(series) >= maxSeries {
+			return nil, fmt.Errorf("filter '%s' matches more than %d time series; it might need a reducer", filter, maxSeries)
+		}
 		series = append(series, t)
 	}
 	return series, nil
 }
+
+// QueryTimeSeries evaluates a Monitoring Query Language query in a given project, reading all pages of the
+// response. Like ListTimeSeries, it fails if the result is partial or has more than the maximum number
+// of time series.
+func (c *StackdriverMetricClient) QueryTimeSeries(ctx context.Context, project, query string) (*QueryResult, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	uri := fmt.Sprintf("%s/v3/projects/%s/timeSeries:query", c.endpoint, project)
+	res := &QueryResult{}
+	var pageToken string
+	for {
+		page := &queryResponse{}
+		if err := c.post(ctx, uri, map[string]string{"query": query, "pageToken": pageToken}, page); err != nil {
+			return nil, err
+		}
+		if len(page.PartialErrors) > 0 {
+			var msgs []string
+			for _, e := range page.PartialErrors {
+				msgs = append(msgs, fmt.Sprintf("%s (code %d)", e.Message, e.Code))
+			}
+			return nil, fmt.Errorf("partial result for query '%s': %s", query, strings.Join(msgs, "; "))
+		}
+		if res.PointDescriptors == nil {
+			res.PointDescriptors = page.Descriptor.PointDescriptors
+		}
+		res.Data = append(res.Data, page.Data...)
+		if len(res.Data) > c.maxSeries {
+			return nil, fmt.Errorf("query '%s' returns more than %d time series", query, c.maxSeries)
+		}
+		pageToken = page.NextPageToken
+		if pageToken == "" {
+			return res, nil
+		}
+	}
+}
+
+// post sends a POST request with a JSON body and decodes JSON response into `v`.
+func (c *StackdriverMetricClient) post(ctx context.Context, uri string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return fmt.Errorf("POST %s returned %s: %s", uri, resp.Status, body)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	// Drain the body, so that the connection can be reused for the next page.
+	io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// CreateTimeSeries writes time series.
+func (c *StackdriverMetricClient) CreateTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest) error {
+	return c.sd.CreateTimeSeries(ctx, req)
+}
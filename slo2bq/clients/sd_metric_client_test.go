@@ -0,0 +1,242 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/iterator"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// fakeSeriesIterator returns time series from a list of pages, fetching a page whenever the previous
+// one has been consumed, like the Monitoring API client does.
+type fakeSeriesIterator struct {
+	pages   []*monitoringpb.ListTimeSeriesResponse
+	fetched int
+	pos     int
+	err     error
+}
+
+func (f *fakeSeriesIterator) Next() (*monitoringpb.TimeSeries, error) {
+	for f.fetched == 0 || f.pos >= len(f.pages[f.fetched-1].TimeSeries) {
+		if f.fetched == len(f.pages) {
+			if f.err != nil {
+				return nil, f.err
+			}
+			return nil, iterator.Done
+		}
+		f.fetched++
+		f.pos = 0
+	}
+	f.pos++
+	return f.pages[f.fetched-1].TimeSeries[f.pos-1], nil
+}
+
+func (f *fakeSeriesIterator) Response() *monitoringpb.ListTimeSeriesResponse {
+	if f.fetched == 0 {
+		return nil
+	}
+	return f.pages[f.fetched-1]
+}
+
+// seriesPages returns pages with given numbers of time series.
+func seriesPages(sizes ...int) []*monitoringpb.ListTimeSeriesResponse {
+	var pages []*monitoringpb.ListTimeSeriesResponse
+	for _, n := range sizes {
+		p := &monitoringpb.ListTimeSeriesResponse{}
+		for i := 0; i < n; i++ {
+			p.TimeSeries = append(p.TimeSeries, &monitoringpb.TimeSeries{})
+		}
+		pages = append(pages, p)
+	}
+	return pages
+}
+
+func TestPageSeriesIterator(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		pages    []*monitoringpb.ListTimeSeriesResponse
+		listErr  error
+		want     int
+		wantErr  string
+		wantReqs int
+	}{
+		{"single page", seriesPages(3), nil, 3, "", 1},
+		{"all pages are fetched", seriesPages(2, 0, 3), nil, 5, "", 3},
+		{"execution errors", append(seriesPages(2), &monitoringpb.ListTimeSeriesResponse{
+			ExecutionErrors: []*status.Status{{Code: 4, Message: "deadline exceeded"}}}), nil, 0, "deadline exceeded (code 4)", 2},
+		{"list error", seriesPages(2), fmt.Errorf("permission denied"), 0, "permission denied", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Pages are chained using tokens holding the index of the next page.
+			for i, p := range tt.pages[:len(tt.pages)-1] {
+				p.NextPageToken = fmt.Sprint(i + 1)
+			}
+			var tokens []string
+			list := func(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) (*monitoringpb.ListTimeSeriesResponse, error) {
+				tokens = append(tokens, req.PageToken)
+				if tt.listErr != nil {
+					return nil, tt.listErr
+				}
+				var i int
+				if req.PageToken != "" {
+					fmt.Sscan(req.PageToken, &i)
+				}
+				return tt.pages[i], nil
+			}
+			req := &monitoringpb.ListTimeSeriesRequest{Filter: "filter"}
+			series, err := readTimeSeries(&pageSeriesIterator{ctx: context.Background(), req: req, list: list}, req.Filter, 10)
+			if len(tokens) != tt.wantReqs {
+				t.Errorf("readTimeSeries() made %d requests (page tokens %q); want %d", len(tokens), tokens, tt.wantReqs)
+			}
+			if req.PageToken != "" {
+				t.Errorf("readTimeSeries() modified the original request: page token '%s'", req.PageToken)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("readTimeSeries() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readTimeSeries() unexpected error: %v", err)
+			}
+			if len(series) != tt.want {
+				t.Errorf("readTimeSeries() returned %d series; want %d", len(series), tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTimeSeries(t *testing.T) {
+	partial := seriesPages(2, 2)
+	partial[1].ExecutionErrors = []*status.Status{{Code: 4, Message: "deadline exceeded"}}
+	emptyPartial := seriesPages(2, 0)
+	emptyPartial[1].ExecutionErrors = []*status.Status{{Code: 14, Message: "unavailable"}}
+	for _, tt := range []struct {
+		name      string
+		it        *fakeSeriesIterator
+		maxSeries int
+		want      int
+		wantErr   string
+	}{
+		{"no series", &fakeSeriesIterator{}, 10, 0, ""},
+		{"single page", &fakeSeriesIterator{pages: seriesPages(3)}, 10, 3, ""},
+		{"all pages are read", &fakeSeriesIterator{pages: seriesPages(3, 0, 4)}, 10, 7, ""},
+		{"exactly the limit", &fakeSeriesIterator{pages: seriesPages(5, 5)}, 10, 10, ""},
+		{"over the limit", &fakeSeriesIterator{pages: seriesPages(5, 5, 1)}, 10, 0, "matches more than 10 time series"},
+		{"partial result", &fakeSeriesIterator{pages: partial}, 10, 0, "partial result for filter 'filter': deadline exceeded (code 4)"},
+		{"partial empty page", &fakeSeriesIterator{pages: emptyPartial}, 10, 0, "unavailable (code 14)"},
+		{"iterator error", &fakeSeriesIterator{pages: seriesPages(2), err: fmt.Errorf("permission denied")}, 10, 0, "permission denied"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			series, err := readTimeSeries(tt.it, "filter", tt.maxSeries)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("readTimeSeries() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readTimeSeries() unexpected error: %v", err)
+			}
+			if len(series) != tt.want {
+				t.Errorf("readTimeSeries() returned %d series; want %d", len(series), tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTimeSeries(t *testing.T) {
+	const query = "fetch gce_instance::custom.googleapis.com/requests"
+	pages := map[string]string{
+		"": `{"timeSeriesDescriptor": {"pointDescriptors": [{"key": "value.requests", "valueType": "INT64", "metricKind": "DELTA"}]},
+			"timeSeriesData": [{"pointData": [{"values": [{"int64Value": "40"}]}, {"values": [{"int64Value": "2"}]}]}],
+			"nextPageToken": "page2"}`,
+		"page2": `{"timeSeriesDescriptor": {"pointDescriptors": [{"key": "value.requests", "valueType": "INT64", "metricKind": "DELTA"}]},
+			"timeSeriesData": [{"pointData": [{"values": [{"int64Value": "8"}]}]}]}`,
+		"partial": `{"partialErrors": [{"code": 4, "message": "deadline exceeded"}]}`,
+	}
+	for _, tt := range []struct {
+		name      string
+		query     string
+		maxSeries int
+		status    int
+		want      []int64
+		wantErr   string
+	}{
+		{"all pages", query, 10, http.StatusOK, []int64{40, 2, 8}, ""},
+		{"too many series", query, 1, http.StatusOK, nil, "returns more than 1 time series"},
+		{"partial result", "partial", 10, http.StatusOK, nil, "partial result for query 'partial': deadline exceeded (code 4)"},
+		{"error status", query, 10, http.StatusBadRequest, nil, "400 Bad Request: invalid query"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if want := "/v3/projects/project/timeSeries:query"; r.Method != "POST" || r.URL.Path != want {
+					t.Errorf("expected POST %s; got %s %s", want, r.Method, r.URL.Path)
+				}
+				var body map[string]string
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("could not decode request body: %v", err)
+				}
+				if body["query"] != tt.query {
+					t.Errorf("expected query %q; got %q", tt.query, body["query"])
+				}
+				if tt.status != http.StatusOK {
+					http.Error(w, "invalid query", tt.status)
+					return
+				}
+				page := body["pageToken"]
+				if tt.query == "partial" {
+					page = "partial"
+				}
+				fmt.Fprint(w, pages[page])
+			}))
+			defer srv.Close()
+			c := &StackdriverMetricClient{maxSeries: tt.maxSeries, http: srv.Client(), endpoint: srv.URL}
+
+			res, err := c.QueryTimeSeries(context.Background(), "project", tt.query)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("QueryTimeSeries() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("QueryTimeSeries() unexpected error: %v", err)
+			}
+			if len(res.PointDescriptors) != 1 || res.PointDescriptors[0].ValueType != "INT64" {
+				t.Errorf("unexpected point descriptors: %+v", res.PointDescriptors)
+			}
+			var got []int64
+			for _, d := range res.Data {
+				for _, p := range d.PointData {
+					got = append(got, p.Values[0].Int64Value)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("QueryTimeSeries() returned values %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -17,24 +17,68 @@
 package clients
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
+// Default endpoint of the Stackdriver Monitoring API.
+const monitoringEndpoint = "https://monitoring.googleapis.com"
+
+// OAuth2 scope required to list services and SLOs.
+const monitoringReadScope = "https://www.googleapis.com/auth/monitoring.read"
+
+// Default number of services or SLOs requested per page.
+const defaultPageSize = 1000
+
+// Maximum number of response body bytes included in error messages.
+const maxErrorBodySize = 512
+
+// maxAttempts is the number of times a request will be attempted before giving up.
+var maxAttempts = 5
+
+// retryDelay is the delay before the first retry of a failed request. It is doubled after every attempt.
+var retryDelay = time.Second
+
 //go:generate mockgen -destination=mocks/mock_slo_client.go -package mocks slo2bq/clients SLOClient
 
 type SLOClient interface {
-	Services() ([]*Service, error)
-	SLOs(*Service) ([]*SLO, error)
+	Services(context.Context) ([]*Service, error)
+	SLOs(context.Context, *Service) ([]*SLO, error)
+	Close() error
 }
 
 // StackdriverSLOClient is a simple client for Stackdriver Service Monitoring.
 type StackdriverSLOClient struct {
-	project string
-	http    *http.Client
+	project  string
+	http     *http.Client
+	endpoint string
+	// pageSize is the number of services or SLOs requested per page.
+	pageSize int
+}
+
+// SLOClientOption configures a StackdriverSLOClient.
+type SLOClientOption func(*StackdriverSLOClient)
+
+// WithPageSize sets the number of services or SLOs requested per page, which defaults to defaultPageSize.
+// Values that are not positive keep the default.
+func WithPageSize(n int) SLOClientOption {
+	return func(c *StackdriverSLOClient) {
+		if n > 0 {
+			c.pageSize = n
+		}
+	}
 }
 
 // Service is a service defined in SD.
@@ -50,9 +94,18 @@ func (s *Service) HumanName() string {
 	if s.DisplayName != "" {
 		return s.DisplayName
 	}
+	return s.ID()
+}
+
+// ID returns the service ID, which unlike the display name cannot be changed.
+func (s *Service) ID() string {
 	// Name is like 'projects/$project/services/$service'.
-	elements := strings.Split(s.Name, "/")
-	return elements[3]
+	return s.Name[strings.LastIndex(s.Name, "/")+1:]
+}
+
+// ValidateName returns an error if the name of the service does not have the expected shape.
+func (s *Service) ValidateName() error {
+	return validateName(s.Name, "projects", "services")
 }
 
 type servicesResponse struct {
@@ -65,6 +118,90 @@ type SLO struct {
 	Name        string  `json:"name"`
 	DisplayName string  `json:"displayName"`
 	Goal        float64 `json:"goal"`
+	SLI         *SLI    `json:"serviceLevelIndicator"`
+	// Exactly one of RollingPeriod and CalendarPeriod is expected to be set. RollingPeriod is a duration
+	// in seconds formatted as a string (e.g. "2419200s"); CalendarPeriod is a calendar unit such as "MONTH".
+	RollingPeriod  string `json:"rollingPeriod"`
+	CalendarPeriod string `json:"calendarPeriod"`
+	// UserLabels are labels set on the SLO by its owners, e.g. to record the owning team.
+	UserLabels map[string]string `json:"userLabels"`
+	// Raw is the SLO object exactly as returned by the API, kept to archive its full definition. It is
+	// set when the SLO is decoded from JSON.
+	Raw json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON decodes an SLO, keeping a copy of the encoded object in Raw.
+func (s *SLO) UnmarshalJSON(b []byte) error {
+	// plain has the fields of SLO without its methods, so that decoding it does not recurse.
+	type plain SLO
+	if err := json.Unmarshal(b, (*plain)(s)); err != nil {
+		return err
+	}
+	s.Raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// SLI is a service level indicator. Exactly one of the fields is expected to be set.
+type SLI struct {
+	RequestBasedSLI *RequestBasedSLI `json:"requestBased"`
+	WindowsBasedSLI *WindowsBasedSLI `json:"windowsBased"`
+}
+
+// RequestBasedSLI is an SLI evaluated by counting individual events.
+type RequestBasedSLI struct {
+	GoodTotalRatioSLI *GoodTotalRatioSLI    `json:"goodTotalRatio"`
+	DistributionCut   *DistributionCut      `json:"distributionCut"`
+	TimeSeriesQuery   *TimeSeriesQueryRatio `json:"timeSeriesQuery"`
+}
+
+// GoodTotalRatioSLI defines good and total events using monitoring filters.
+// At least two of the three filters are expected to be set.
+type GoodTotalRatioSLI struct {
+	Good  string `json:"goodServiceFilter"`
+	Bad   string `json:"badServiceFilter"`
+	Total string `json:"totalServiceFilter"`
+}
+
+// TimeSeriesQueryRatio defines good and total events using Monitoring Query Language queries.
+// At least two of the three queries are expected to be set.
+type TimeSeriesQueryRatio struct {
+	Good  string `json:"goodQuery"`
+	Bad   string `json:"badQuery"`
+	Total string `json:"totalQuery"`
+}
+
+// DistributionCut defines good events as values of a distribution metric falling into a range.
+type DistributionCut struct {
+	DistributionFilter string `json:"distributionFilter"`
+	Range              *Range `json:"range"`
+}
+
+// Range is a range of values; both ends are inclusive.
+type Range struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// WindowsBasedSLI is an SLI evaluated by counting good time windows.
+type WindowsBasedSLI struct {
+	// WindowPeriod is a duration in seconds formatted as a string, e.g. "300s".
+	WindowPeriod            string                `json:"windowPeriod"`
+	GoodBadMetricFilter     string                `json:"goodBadMetricFilter"`
+	GoodTotalRatioThreshold *PerformanceThreshold `json:"goodTotalRatioThreshold"`
+	MetricMeanInRange       *MetricRange          `json:"metricMeanInRange"`
+	MetricSumInRange        *MetricRange          `json:"metricSumInRange"`
+}
+
+// PerformanceThreshold defines a window as good if its performance is above the threshold.
+type PerformanceThreshold struct {
+	Performance *RequestBasedSLI `json:"performance"`
+	Threshold   float64          `json:"threshold"`
+}
+
+// MetricRange defines a window as good if the value of a time series falls into a range.
+type MetricRange struct {
+	TimeSeries string `json:"timeSeries"`
+	Range      *Range `json:"range"`
 }
 
 // HumanName returns a human-readable name for a given SLO.
@@ -72,9 +209,55 @@ func (s *SLO) HumanName() string {
 	if s.DisplayName != "" {
 		return s.DisplayName
 	}
+	return s.ID()
+}
+
+// ID returns the SLO ID, which unlike the display name cannot be changed.
+func (s *SLO) ID() string {
 	// Name is like 'projects/$project/services/$service/serviceLevelObjectives/$slo'.
-	elements := strings.Split(s.Name, "/")
-	return elements[5]
+	return s.Name[strings.LastIndex(s.Name, "/")+1:]
+}
+
+// ValidateName returns an error if the name of the SLO does not have the expected shape.
+func (s *SLO) ValidateName() error {
+	return validateName(s.Name, "projects", "services", "serviceLevelObjectives")
+}
+
+// validateName checks that name is a resource name made of the given collections, each followed by a
+// non-empty ID, e.g. 'projects/$project/services/$service'. A name without any '/' is taken as a bare ID.
+func validateName(name string, collections ...string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if !strings.Contains(name, "/") {
+		return nil
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) != 2*len(collections) {
+		return fmt.Errorf("name '%s' has %d segments; want %d", name, len(parts), 2*len(collections))
+	}
+	for i, c := range collections {
+		if parts[2*i] != c || parts[2*i+1] == "" {
+			return fmt.Errorf("name '%s' does not match '%s/...'", name, strings.Join(collections, "/.../"))
+		}
+	}
+	return nil
+}
+
+// Period returns a description of the compliance period of the SLO, e.g. "rolling 28d" or
+// "calendar MONTH". Rolling periods that are not a whole number of days are kept in seconds.
+func (s *SLO) Period() string {
+	if s.CalendarPeriod != "" {
+		return "calendar " + s.CalendarPeriod
+	}
+	if s.RollingPeriod == "" {
+		return ""
+	}
+	d, err := time.ParseDuration(s.RollingPeriod)
+	if err != nil || d%(24*time.Hour) != 0 {
+		return "rolling " + s.RollingPeriod
+	}
+	return fmt.Sprintf("rolling %dd", d/(24*time.Hour))
 }
 
 type slosResponse struct {
@@ -82,19 +265,47 @@ type slosResponse struct {
 	NextPageToken string `json:"nextPageToken"`
 }
 
-// NewStackdriverSLOClient creates a new SLO client.
-func NewStackdriverSLOClient(project string, h *http.Client) *StackdriverSLOClient {
-	return &StackdriverSLOClient{project, h}
+// NewStackdriverSLOClient creates a new SLO client. The HTTP client is expected to be authorized
+// to read monitoring data; see NewStackdriverSLOClientWithCredentials.
+func NewStackdriverSLOClient(project string, h *http.Client, opts ...SLOClientOption) *StackdriverSLOClient {
+	c := &StackdriverSLOClient{project: project, http: h, endpoint: monitoringEndpoint, pageSize: defaultPageSize}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
 }
 
-func (c *StackdriverSLOClient) newRequest(tpe, uri, pageToken string) (*http.Request, error) {
+// NewStackdriverSLOClientWithCredentials creates a new SLO client using an HTTP client authorized with
+// the monitoring read scope. Application default credentials are used unless opts specify otherwise.
+// Quota is charged to the given project.
+func NewStackdriverSLOClientWithCredentials(ctx context.Context, project string, opts ...option.ClientOption) (*StackdriverSLOClient, error) {
+	opts = append([]option.ClientOption{option.WithScopes(monitoringReadScope)}, opts...)
+	h, _, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewStackdriverSLOClient(project, h), nil
+}
+
+// Close closes idle connections of the underlying HTTP transport, if it supports that. The client can
+// still be used afterwards, opening new connections as needed.
+func (c *StackdriverSLOClient) Close() error {
+	// http.Client.CloseIdleConnections is not available in Go 1.11, so the transport is checked directly.
+	// A nil transport means http.DefaultTransport, whose connections are shared with other clients.
+	if t, ok := c.http.Transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (c *StackdriverSLOClient) newRequest(ctx context.Context, tpe, uri, pageToken string) (*http.Request, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
 
 	q := u.Query()
-	q.Set("pageSize", "1000")
+	q.Set("pageSize", strconv.Itoa(c.pageSize))
 	if pageToken != "" {
 		q.Set("pageToken", pageToken)
 	}
@@ -105,29 +316,84 @@ func (c *StackdriverSLOClient) newRequest(tpe, uri, pageToken string) (*http.Req
 		return nil, err
 	}
 	req.Header.Add("X-Goog-User-Project", c.project)
-	return req, nil
+	// http.NewRequestWithContext is not available in Go 1.11.
+	return req.WithContext(ctx), nil
 }
 
-// Services returns a list of services.
-func (c *StackdriverSLOClient) Services() ([]*Service, error) {
-	var pageToken string
-	var results []*Service
-
-	for {
-		uri := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/services", c.project)
-		req, err := c.newRequest("GET", uri, pageToken)
+// get sends a GET request and decodes JSON response into `v`. Requests failing with a transient error
+// (HTTP 429 or 5xx) are retried with exponential backoff, honoring the Retry-After response header. Both
+// requests and waits between retries are aborted once ctx is done.
+func (c *StackdriverSLOClient) get(ctx context.Context, uri, pageToken string, v interface{}) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		req, err := c.newRequest(ctx, "GET", uri, pageToken)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		resp, err := c.http.Do(req)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if resp.StatusCode == http.StatusOK {
+			err := json.NewDecoder(resp.Body).Decode(v)
+			// Drain the body, so that the connection can be reused for the next page.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return err
+		}
+
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		resp.Body.Close()
+		err = fmt.Errorf("GET %s returned %s: %s", uri, resp.Status, body)
+		if !isRetryableStatus(resp.StatusCode) || attempt >= maxAttempts {
+			return err
+		}
+
+		wait := delay
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			wait = d
+		}
+		log.Printf("%v; retrying in %v", err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableStatus returns whether a request that failed with a given HTTP status code can be retried.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter parses the value of Retry-After header, which can be either a number of seconds or a date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
 		}
-		defer resp.Body.Close()
+		return 0, true
+	}
+	return 0, false
+}
+
+// Services returns a list of services.
+func (c *StackdriverSLOClient) Services(ctx context.Context) ([]*Service, error) {
+	var pageToken string
+	var results []*Service
 
-		svcs := &servicesResponse{}
-		if err := json.NewDecoder(resp.Body).Decode(&svcs); err != nil {
+	for {
+		svcs, err := c.servicesPage(ctx, pageToken)
+		if err != nil {
 			return nil, err
 		}
 		results = append(results, svcs.Services...)
@@ -140,26 +406,34 @@ func (c *StackdriverSLOClient) Services() ([]*Service, error) {
 	return results, nil
 }
 
+// FirstServices returns the first page of services. It's a cheap way to check that the API can be accessed.
+func (c *StackdriverSLOClient) FirstServices(ctx context.Context) ([]*Service, error) {
+	svcs, err := c.servicesPage(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return svcs.Services, nil
+}
+
+// servicesPage returns a page of services starting at a given page token.
+func (c *StackdriverSLOClient) servicesPage(ctx context.Context, pageToken string) (*servicesResponse, error) {
+	uri := fmt.Sprintf("%s/v3/projects/%s/services", c.endpoint, c.project)
+	svcs := &servicesResponse{}
+	if err := c.get(ctx, uri, pageToken, svcs); err != nil {
+		return nil, err
+	}
+	return svcs, nil
+}
+
 // SLOs returns a list of SLOs for a given service.
-func (c *StackdriverSLOClient) SLOs(service *Service) ([]*SLO, error) {
+func (c *StackdriverSLOClient) SLOs(ctx context.Context, service *Service) ([]*SLO, error) {
 	var pageToken string
 	var results []*SLO
 
 	for {
-		uri := fmt.Sprintf("https://monitoring.googleapis.com/v3/%s/serviceLevelObjectives", service.Name)
-		req, err := c.newRequest("GET", uri, pageToken)
-		if err != nil {
-			return nil, err
-		}
-
-		resp, err := c.http.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-
+		uri := fmt.Sprintf("%s/v3/%s/serviceLevelObjectives", c.endpoint, service.Name)
 		slos := &slosResponse{}
-		if err := json.NewDecoder(resp.Body).Decode(&slos); err != nil {
+		if err := c.get(ctx, uri, pageToken, slos); err != nil {
 			return nil, err
 		}
 		results = append(results, slos.SLOs...)
@@ -0,0 +1,708 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// slosPayload is a (slightly trimmed) response of the serviceLevelObjectives.list API method.
+const slosPayload = `{
+  "serviceLevelObjectives": [
+    {
+      "name": "projects/123/services/svc1/serviceLevelObjectives/availability",
+      "displayName": "99% of requests succeed",
+      "serviceLevelIndicator": {
+        "requestBased": {
+          "goodTotalRatio": {
+            "goodServiceFilter": "metric.type=\"custom.googleapis.com/requests\" metric.label.code=\"200\"",
+            "badServiceFilter": "metric.type=\"custom.googleapis.com/requests\" metric.label.code=\"500\"",
+            "totalServiceFilter": "metric.type=\"custom.googleapis.com/requests\""
+          }
+        }
+      },
+      "goal": 0.99,
+      "rollingPeriod": "2419200s",
+      "userLabels": {
+        "team": "frontend",
+        "tier": "1"
+      }
+    },
+    {
+      "name": "projects/123/services/svc1/serviceLevelObjectives/latency",
+      "serviceLevelIndicator": {
+        "requestBased": {
+          "distributionCut": {
+            "distributionFilter": "metric.type=\"custom.googleapis.com/latency\"",
+            "range": {
+              "min": 1,
+              "max": 500
+            }
+          }
+        }
+      },
+      "goal": 0.95,
+      "calendarPeriod": "MONTH"
+    },
+    {
+      "name": "projects/123/services/svc1/serviceLevelObjectives/windows",
+      "serviceLevelIndicator": {
+        "windowsBased": {
+          "windowPeriod": "300s",
+          "goodTotalRatioThreshold": {
+            "performance": {
+              "goodTotalRatio": {
+                "goodServiceFilter": "metric.type=\"custom.googleapis.com/good\"",
+                "totalServiceFilter": "metric.type=\"custom.googleapis.com/total\""
+              }
+            },
+            "threshold": 0.9
+          }
+        }
+      },
+      "goal": 0.9,
+      "rollingPeriod": "86400s"
+    }
+  ]
+}`
+
+func TestDecodeSLI(t *testing.T) {
+	var resp slosResponse
+	if err := json.Unmarshal([]byte(slosPayload), &resp); err != nil {
+		t.Fatalf("json.Unmarshal() unexpected error: %v", err)
+	}
+	if len(resp.SLOs) != 3 {
+		t.Fatalf("expected 3 SLOs; got %d", len(resp.SLOs))
+	}
+
+	ratio := resp.SLOs[0].SLI.RequestBasedSLI.GoodTotalRatioSLI
+	if ratio.Good == "" || ratio.Bad == "" || ratio.Total == "" {
+		t.Errorf("expected all good/bad/total filters to be set; got %+v", ratio)
+	}
+
+	cut := resp.SLOs[1].SLI.RequestBasedSLI.DistributionCut
+	if cut.DistributionFilter == "" || cut.Range == nil || cut.Range.Min != 1 || cut.Range.Max != 500 {
+		t.Errorf("unexpected distribution cut: %+v", cut)
+	}
+
+	if want := map[string]string{"team": "frontend", "tier": "1"}; !reflect.DeepEqual(resp.SLOs[0].UserLabels, want) {
+		t.Errorf("SLOs[0].UserLabels = %v; want %v", resp.SLOs[0].UserLabels, want)
+	}
+	if resp.SLOs[1].UserLabels != nil {
+		t.Errorf("expected no user labels for SLOs[1]; got %v", resp.SLOs[1].UserLabels)
+	}
+
+	for i, want := range []string{"rolling 28d", "calendar MONTH", "rolling 1d"} {
+		if got := resp.SLOs[i].Period(); got != want {
+			t.Errorf("SLOs[%d].Period() = %q; want %q", i, got, want)
+		}
+	}
+
+	w := resp.SLOs[2].SLI.WindowsBasedSLI
+	if w.WindowPeriod != "300s" || w.GoodTotalRatioThreshold.Threshold != 0.9 {
+		t.Errorf("unexpected windows-based SLI: %+v", w)
+	}
+	perf := w.GoodTotalRatioThreshold.Performance.GoodTotalRatioSLI
+	if perf.Good == "" || perf.Total == "" {
+		t.Errorf("expected good/total filters to be set in windows-based SLI; got %+v", perf)
+	}
+}
+
+func TestSLOsGoodTotalRatioFilters(t *testing.T) {
+	c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if want := "/v3/projects/123/services/svc1/serviceLevelObjectives"; r.URL.Path != want {
+			t.Errorf("expected request for %s; got %s", want, r.URL.Path)
+		}
+		fmt.Fprint(w, slosPayload)
+	})
+	defer cleanup()
+
+	slos, err := c.SLOs(context.Background(), &Service{Name: "projects/123/services/svc1"})
+	if err != nil {
+		t.Fatalf("SLOs() unexpected error: %v", err)
+	}
+	if len(slos) != 3 || slos[0].SLI == nil || slos[0].SLI.RequestBasedSLI == nil || slos[0].SLI.RequestBasedSLI.GoodTotalRatioSLI == nil {
+		t.Fatalf("expected a good/total ratio SLI in the first of 3 SLOs; got %+v", slos)
+	}
+	// Empty filters would make every SLO written with zero events, so compare the exact values.
+	want := GoodTotalRatioSLI{
+		Good:  `metric.type="custom.googleapis.com/requests" metric.label.code="200"`,
+		Bad:   `metric.type="custom.googleapis.com/requests" metric.label.code="500"`,
+		Total: `metric.type="custom.googleapis.com/requests"`,
+	}
+	if got := *slos[0].SLI.RequestBasedSLI.GoodTotalRatioSLI; got != want {
+		t.Errorf("expected filters %+v; got %+v", want, got)
+	}
+}
+
+func TestSLOsRaw(t *testing.T) {
+	c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, slosPayload)
+	})
+	defer cleanup()
+
+	slos, err := c.SLOs(context.Background(), &Service{Name: "projects/123/services/svc1"})
+	if err != nil {
+		t.Fatalf("SLOs() unexpected error: %v", err)
+	}
+	var resp struct {
+		SLOs []map[string]interface{} `json:"serviceLevelObjectives"`
+	}
+	if err := json.Unmarshal([]byte(slosPayload), &resp); err != nil {
+		t.Fatalf("json.Unmarshal() unexpected error: %v", err)
+	}
+	for i, slo := range slos {
+		// Raw should contain the whole object, including fields SLO does not decode.
+		var raw map[string]interface{}
+		if err := json.Unmarshal(slo.Raw, &raw); err != nil {
+			t.Fatalf("could not decode Raw of SLO %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(raw, resp.SLOs[i]) {
+			t.Errorf("Raw of SLO %d = %v; want %v", i, raw, resp.SLOs[i])
+		}
+		// Decoding Raw again should produce the same SLO.
+		var decoded SLO
+		if err := json.Unmarshal(slo.Raw, &decoded); err != nil {
+			t.Fatalf("could not decode Raw of SLO %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(&decoded, slo) {
+			t.Errorf("decoded Raw of SLO %d = %+v; want %+v", i, decoded, slo)
+		}
+	}
+}
+
+func TestSLOPeriod(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		slo  SLO
+		want string
+	}{
+		{"rolling days", SLO{RollingPeriod: "604800s"}, "rolling 7d"},
+		{"rolling seconds", SLO{RollingPeriod: "90000s"}, "rolling 90000s"},
+		{"calendar", SLO{CalendarPeriod: "QUARTER"}, "calendar QUARTER"},
+		{"unset", SLO{}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.slo.Period(); got != tt.want {
+				t.Errorf("Period() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIDs(t *testing.T) {
+	svc := &Service{Name: "projects/123/services/svc-id", DisplayName: "Service"}
+	if got := svc.ID(); got != "svc-id" {
+		t.Errorf("Service.ID() = %q; want %q", got, "svc-id")
+	}
+	slo := &SLO{Name: "projects/123/services/svc-id/serviceLevelObjectives/slo-id", DisplayName: "SLO"}
+	if got := slo.ID(); got != "slo-id" {
+		t.Errorf("SLO.ID() = %q; want %q", got, "slo-id")
+	}
+	if got := slo.HumanName(); got != "SLO" {
+		t.Errorf("SLO.HumanName() = %q; want %q", got, "SLO")
+	}
+	slo.DisplayName = ""
+	if got := slo.HumanName(); got != "slo-id" {
+		t.Errorf("SLO.HumanName() without display name = %q; want %q", got, "slo-id")
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		svcErr bool
+		sloErr bool
+		wantID string
+	}{
+		{"projects/p/services/svc", false, true, "svc"},
+		{"projects/p/services/svc/serviceLevelObjectives/slo", true, false, "slo"},
+		{"svc", false, false, "svc"},
+		{"", true, true, ""},
+		{"/", true, true, ""},
+		{"projects/p", true, true, "p"},
+		{"projects/p/services/", true, true, ""},
+		{"projects/p/services/svc/serviceLevelObjectives", true, true, "serviceLevelObjectives"},
+		{"projects/p/services/svc/serviceLevelObjectives/", true, true, ""},
+		{"projects/p/services/svc/serviceLevelObjectives/slo/extra", true, true, "extra"},
+		{"projects/p/foo/svc/serviceLevelObjectives/slo", true, true, "slo"},
+		{"projects//services/svc", true, true, "svc"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &Service{Name: tt.name}
+			slo := &SLO{Name: tt.name}
+			if err := svc.ValidateName(); (err != nil) != tt.svcErr {
+				t.Errorf("Service.ValidateName() = %v; want error: %v", err, tt.svcErr)
+			}
+			if err := slo.ValidateName(); (err != nil) != tt.sloErr {
+				t.Errorf("SLO.ValidateName() = %v; want error: %v", err, tt.sloErr)
+			}
+			// Malformed names should never make these panic.
+			if got := svc.HumanName(); got != tt.wantID {
+				t.Errorf("Service.HumanName() = %q; want %q", got, tt.wantID)
+			}
+			if got := slo.ID(); got != tt.wantID {
+				t.Errorf("SLO.ID() = %q; want %q", got, tt.wantID)
+			}
+		})
+	}
+}
+
+// newTestClient returns an SLO client talking to a test HTTP server that uses a given handler.
+func newTestClient(h http.HandlerFunc, opts ...SLOClientOption) (*StackdriverSLOClient, func()) {
+	srv := httptest.NewServer(h)
+	c := NewStackdriverSLOClient("project", srv.Client(), opts...)
+	c.endpoint = srv.URL
+	return c, srv.Close
+}
+
+// trackingBody is a response body recording whether it has been fully read and closed.
+type trackingBody struct {
+	io.ReadCloser
+	eof, closed bool
+}
+
+func (b *trackingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return b.ReadCloser.Close()
+}
+
+// trackingTransport wraps response bodies returned by an underlying transport in trackingBody.
+type trackingTransport struct {
+	rt     http.RoundTripper
+	bodies []*trackingBody
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	b := &trackingBody{ReadCloser: resp.Body}
+	t.bodies = append(t.bodies, b)
+	resp.Body = b
+	return resp, nil
+}
+
+// closingTransport is an HTTP transport counting calls to CloseIdleConnections.
+type closingTransport struct {
+	http.RoundTripper
+	closes int
+}
+
+func (t *closingTransport) CloseIdleConnections() {
+	t.closes++
+}
+
+func TestClose(t *testing.T) {
+	c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"services": [{"name": "projects/project/services/svc1"}]}`)
+	})
+	defer cleanup()
+	tr := &closingTransport{RoundTripper: c.http.Transport}
+	c.http = &http.Client{Transport: tr}
+
+	if _, err := c.Services(context.Background()); err != nil {
+		t.Fatalf("Services() unexpected error: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+	if tr.closes != 1 {
+		t.Errorf("expected idle connections to be closed once; got %d", tr.closes)
+	}
+	// The client can still be used after closing idle connections.
+	if _, err := c.Services(context.Background()); err != nil {
+		t.Errorf("Services() after Close() unexpected error: %v", err)
+	}
+
+	// Transports not supporting CloseIdleConnections are left alone.
+	if err := (&StackdriverSLOClient{http: &http.Client{Transport: &trackingTransport{}}}).Close(); err != nil {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	const pages = 5
+	for _, tt := range []struct {
+		name      string
+		failPage  int
+		wantErr   string
+		wantSvcs  int
+		wantCalls int
+	}{
+		{"all pages", 0, "", pages, pages},
+		{"error mid-pagination", 3, "403 Forbidden", 0, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				page := 1
+				if tok := r.URL.Query().Get("pageToken"); tok != "" {
+					fmt.Sscanf(tok, "page%d", &page)
+				}
+				if page != calls {
+					t.Errorf("expected request %d to ask for page %d; got page %d", calls, calls, page)
+				}
+				if page == tt.failPage {
+					http.Error(w, "permission denied", http.StatusForbidden)
+					return
+				}
+				next := ""
+				if page < pages {
+					next = fmt.Sprintf("page%d", page+1)
+				}
+				// Trailing whitespace is not consumed by the JSON decoder.
+				fmt.Fprintf(w, `{"services": [{"name": "projects/project/services/svc%d"}], "nextPageToken": %q}`+"\n\n", page, next)
+			})
+			defer cleanup()
+			tr := &trackingTransport{rt: c.http.Transport}
+			c.http = &http.Client{Transport: tr}
+
+			svcs, err := c.Services(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Services() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Services() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+			if len(svcs) != tt.wantSvcs {
+				t.Errorf("expected %d services; got %d", tt.wantSvcs, len(svcs))
+			}
+			if calls != tt.wantCalls || len(tr.bodies) != tt.wantCalls {
+				t.Errorf("expected %d requests; got %d (%d responses)", tt.wantCalls, calls, len(tr.bodies))
+			}
+			for i, b := range tr.bodies {
+				if !b.closed {
+					t.Errorf("expected body of response %d to be closed", i+1)
+				}
+				if !b.eof && i+1 != tt.failPage {
+					t.Errorf("expected body of response %d to be fully read", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestFirstServices(t *testing.T) {
+	var calls int
+	c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if tok := r.URL.Query().Get("pageToken"); tok != "" {
+			t.Errorf("expected no page token; got %q", tok)
+		}
+		fmt.Fprint(w, `{"services": [{"name": "projects/project/services/svc1"}], "nextPageToken": "page2"}`)
+	})
+	defer cleanup()
+
+	svcs, err := c.FirstServices(context.Background())
+	if err != nil {
+		t.Fatalf("FirstServices() unexpected error: %v", err)
+	}
+	// Further pages are not requested.
+	if len(svcs) != 1 || svcs[0].ID() != "svc1" || calls != 1 {
+		t.Errorf("FirstServices() = %v after %d requests; want svc1 after 1 request", svcs, calls)
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		opts      []SLOClientOption
+		slos      int
+		wantSize  string
+		wantCalls int
+	}{
+		{"default", nil, 5, "1000", 1},
+		{"small pages", []SLOClientOption{WithPageSize(2)}, 5, "2", 3},
+		{"exact pages", []SLOClientOption{WithPageSize(5)}, 10, "5", 2},
+		{"non-positive size keeps default", []SLOClientOption{WithPageSize(0)}, 5, "1000", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				q := r.URL.Query()
+				if got := q.Get("pageSize"); got != tt.wantSize {
+					t.Errorf("expected page size %s; got %s", tt.wantSize, got)
+				}
+				size, _ := strconv.Atoi(q.Get("pageSize"))
+				first := 0
+				if tok := q.Get("pageToken"); tok != "" {
+					fmt.Sscanf(tok, "from%d", &first)
+				}
+				var names []string
+				for i := first; i < first+size && i < tt.slos; i++ {
+					names = append(names, fmt.Sprintf(`{"name": "projects/project/services/svc/serviceLevelObjectives/slo%d"}`, i))
+				}
+				next := ""
+				if first+size < tt.slos {
+					next = fmt.Sprintf("from%d", first+size)
+				}
+				fmt.Fprintf(w, `{"serviceLevelObjectives": [%s], "nextPageToken": %q}`, strings.Join(names, ", "), next)
+			}, tt.opts...)
+			defer cleanup()
+
+			slos, err := c.SLOs(context.Background(), &Service{Name: "projects/project/services/svc"})
+			if err != nil {
+				t.Fatalf("SLOs() unexpected error: %v", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d requests; got %d", tt.wantCalls, calls)
+			}
+			if len(slos) != tt.slos {
+				t.Fatalf("expected %d SLOs; got %d", tt.slos, len(slos))
+			}
+			for i, slo := range slos {
+				if want := fmt.Sprintf("slo%d", i); slo.ID() != want {
+					t.Errorf("expected SLO %d to be %s; got %s", i, want, slo.ID())
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaProjectHeader(t *testing.T) {
+	var headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("X-Goog-User-Project"))
+		fmt.Fprint(w, `{"services": [{"name": "projects/quota-project/services/svc1"}]}`)
+	}))
+	defer srv.Close()
+
+	c, err := NewStackdriverSLOClientWithCredentials(context.Background(), "quota-project", option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("NewStackdriverSLOClientWithCredentials() unexpected error: %v", err)
+	}
+	c.endpoint = srv.URL
+	svcs, err := c.Services(context.Background())
+	if err != nil {
+		t.Fatalf("Services() unexpected error: %v", err)
+	}
+	if _, err := c.SLOs(context.Background(), svcs[0]); err != nil {
+		t.Fatalf("SLOs() unexpected error: %v", err)
+	}
+	if len(headers) != 2 {
+		t.Fatalf("expected 2 requests; got %d", len(headers))
+	}
+	for i, h := range headers {
+		if h != "quota-project" {
+			t.Errorf("expected request %d to have X-Goog-User-Project header set to quota-project; got %q", i+1, h)
+		}
+	}
+}
+
+func TestServicesRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	for _, tt := range []struct {
+		name       string
+		status     int
+		retryAfter string
+	}{
+		{"service unavailable", http.StatusServiceUnavailable, ""},
+		{"too many requests", http.StatusTooManyRequests, ""},
+		{"retry-after header", http.StatusServiceUnavailable, "0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					http.Error(w, "try again later", tt.status)
+					return
+				}
+				fmt.Fprint(w, `{"services": [{"name": "projects/project/services/svc1"}]}`)
+			})
+			defer cleanup()
+
+			svcs, err := c.Services(context.Background())
+			if err != nil {
+				t.Fatalf("Services() unexpected error: %v", err)
+			}
+			if len(svcs) != 1 || svcs[0].HumanName() != "svc1" {
+				t.Errorf("unexpected services: %v", svcs)
+			}
+			if calls != 2 {
+				t.Errorf("expected 2 requests; got %d", calls)
+			}
+		})
+	}
+}
+
+func TestServicesRetryGivesUp(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	var calls int
+	c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "backend error", http.StatusInternalServerError)
+	})
+	defer cleanup()
+
+	_, err := c.Services(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "backend error") {
+		t.Errorf("Services() expected error to contain status and body; got %v", err)
+	}
+	if calls != maxAttempts {
+		t.Errorf("expected %d requests; got %d", maxAttempts, calls)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// handler serves a request, and gets a function cancelling the context of the call.
+		handler func(w http.ResponseWriter, r *http.Request, cancel func(), release chan struct{})
+		call    func(ctx context.Context, c *StackdriverSLOClient) error
+	}{
+		{"hung page", func(w http.ResponseWriter, r *http.Request, cancel func(), release chan struct{}) {
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprint(w, `{"services": [{"name": "projects/project/services/svc1"}], "nextPageToken": "page2"}`)
+				return
+			}
+			// The second page never arrives.
+			cancel()
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}, func(ctx context.Context, c *StackdriverSLOClient) error { _, err := c.Services(ctx); return err }},
+		{"waiting to retry", func(w http.ResponseWriter, r *http.Request, cancel func(), release chan struct{}) {
+			time.AfterFunc(50*time.Millisecond, cancel)
+			w.Header().Set("Retry-After", "3600")
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+		}, func(ctx context.Context, c *StackdriverSLOClient) error {
+			_, err := c.SLOs(ctx, &Service{Name: "projects/project/services/svc1"})
+			return err
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			release := make(chan struct{})
+			c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(w, r, cancel, release)
+			})
+			defer cleanup()
+			defer close(release)
+
+			errc := make(chan error, 1)
+			go func() { errc <- tt.call(ctx, c) }()
+			select {
+			case err := <-errc:
+				if err == nil || !strings.Contains(err.Error(), "context canceled") {
+					t.Errorf("expected error to contain 'context canceled'; got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected the call to return once the context got cancelled")
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"bogus", 0, false},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0, true},
+	} {
+		got, ok := parseRetryAfter(tt.value)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestNon200Response(t *testing.T) {
+	longBody := strings.Repeat("x", 10*maxErrorBodySize)
+	for _, tt := range []struct {
+		name    string
+		status  int
+		body    string
+		call    func(*StackdriverSLOClient) (int, error)
+		wantErr string
+	}{
+		{"services permission denied", http.StatusForbidden, "permission denied",
+			func(c *StackdriverSLOClient) (int, error) {
+				s, err := c.Services(context.Background())
+				return len(s), err
+			}, "403 Forbidden: permission denied"},
+		{"SLOs unauthenticated", http.StatusUnauthorized, "login required",
+			func(c *StackdriverSLOClient) (int, error) {
+				s, err := c.SLOs(context.Background(), &Service{Name: "projects/project/services/svc1"})
+				return len(s), err
+			}, "401 Unauthorized: login required"},
+		{"services not found", http.StatusNotFound, longBody,
+			func(c *StackdriverSLOClient) (int, error) {
+				s, err := c.Services(context.Background())
+				return len(s), err
+			}, "404 Not Found: xxx"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			c, cleanup := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				http.Error(w, tt.body, tt.status)
+			})
+			defer cleanup()
+
+			n, err := tt.call(c)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+			if err != nil && len(err.Error()) > 2*maxErrorBodySize {
+				t.Errorf("expected response body to be truncated in error message; got %d bytes", len(err.Error()))
+			}
+			if n != 0 {
+				t.Errorf("expected no results; got %d", n)
+			}
+			if calls != 1 {
+				t.Errorf("expected non-retryable error to be returned after 1 request; got %d", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command dashboard serves a minimal HTML page showing recent compliance of synced SLOs at /dashboard, as
+// handled by slo2bq.DashboardHandler. It's separate from cmd/server, so that read access to SLO data is
+// only exposed when deployed explicitly.
+package main
+
+import (
+	"log"
+	"os"
+	"slo2bq"
+)
+
+func main() {
+	// Cloud Run sets PORT to the port the service should listen on.
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	log.Printf("Listening on port %s", port)
+	if err := slo2bq.ServeDashboard(":" + port); err != nil {
+		log.Fatalf("ERROR: %v\n", err)
+	}
+}
@@ -15,34 +15,286 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"slo2bq"
+	"strings"
 	"time"
 )
 
-func main() {
-	project := flag.String("project", "", "Cloud project name")
-	dataset := flag.String("dataset", "", "Name of the BigQuery dataset to use")
-	tz := flag.String("tz", "Europe/London", "Timezone to use to create daily rollups")
-	flag.Parse()
+// mode is what the command does with the parsed Config.
+type mode int
 
-	_, err := time.LoadLocation(*tz)
-	if err != nil {
-		log.Fatalf("error parsing --tz: %s\n", err)
+const (
+	modeSync mode = iota
+	// modeList lists services and SLOs instead of syncing.
+	modeList
+	// modeHealthcheck checks access to Service Monitoring and BigQuery instead of syncing.
+	modeHealthcheck
+)
+
+// parseConfig builds a Config from command line arguments. If --config is given, the file is read
+// first, and any flags set explicitly on the command line override values from the file. The returned
+// mode is set by --list and --healthcheck. now is used to resolve --since into a backfill range.
+func parseConfig(args []string, now time.Time) (*slo2bq.Config, mode, error) {
+	fs := flag.NewFlagSet("slo2bq", flag.ContinueOnError)
+	list := fs.Bool("list", false, "List services and SLOs that would be synced, without syncing (--dataset is not required)")
+	healthcheck := fs.Bool("healthcheck", false, "Check access to Service Monitoring and BigQuery without syncing, and exit with status 1 on failure")
+	configFile := fs.String("config", "", "Path to a JSON file with configuration (same fields as the Pub/Sub message)")
+	project := fs.String("project", "", "Cloud project name")
+	projects := fs.String("projects", "", "Comma-separated list of Cloud projects to sync SLO data from (defaults to --project)")
+	failOnDuplicateNames := fs.Bool("fail_on_duplicate_names", false, "Fail if several synced SLOs have the same service and SLO names, instead of logging a warning")
+	sloLabels := fs.String("slo_labels", "", "Comma-separated list of SLO user label keys to copy into the labels column")
+	billingProject := fs.String("billing_project", "", "Cloud project to run BigQuery jobs in and bill them to (defaults to --project)")
+	metricsProject := fs.String("metrics_project", "", "Cloud project to read time series matching SLI filters from (defaults to the synced project)")
+	dataset := fs.String("dataset", "", "Name of the BigQuery dataset to use")
+	table := fs.String("table", "", "Name of the BigQuery table to use (defaults to data)")
+	shardByDate := fs.Bool("shard_by_date", false, "Write rows into date-sharded tables named after --table with a _YYYYMMDD suffix")
+	location := fs.String("location", "", "BigQuery location of the dataset, e.g. asia-northeast1")
+	tz := fs.String("tz", "Europe/London", "Timezone to use to create daily rollups")
+	dryRun := fs.Bool("dry_run", false, "Log rows instead of writing them to BigQuery")
+	refreshZeroRows := fs.Bool("refresh_zero_rows", false, "Re-sync days that have been written with no events")
+	granularity := fs.String("granularity", "daily", "Granularity of rows to sync: daily or hourly")
+	preferSLIType := fs.String("prefer_sli_type", "", "SLI to sync for SLOs with both representations: request (default) or windows")
+	continueOnError := fs.Bool("continue_on_error", false, "Keep syncing other SLOs if some of them fail")
+	logFormat := fs.String("log_format", "", "Format of log entries: text (default) or json")
+	existingDataFile := fs.String("existing_data_file", "", "Path of a newline-delimited JSON file to read existing rows from instead of BigQuery")
+	credentialsFile := fs.String("credentials_file", "", "Path of a service account key file to use instead of application default credentials")
+	selfMetrics := fs.Bool("self_metrics", false, "Write metrics about the sync run to Stackdriver")
+	webhookURL := fs.String("webhook_url", "", "URL (e.g. of a Slack incoming webhook) to notify when the sync fails")
+	notifyRecovery := fs.Bool("notify_recovery", false, "Also notify --webhook_url when a sync succeeds after a failed one")
+	timeout := fs.String("timeout", "", "Maximum duration of the sync, e.g. 5m (defaults to 8m30s)")
+	minInterval := fs.String("min_interval", "", "Do nothing if the previous successful sync finished less than this long ago, e.g. 1h")
+	backfillStart := fs.String("backfill_start", "", "First day (YYYY-MM-DD) of a date range to recompute")
+	backfillEnd := fs.String("backfill_end", "", "Last day (YYYY-MM-DD) of a date range to recompute")
+	since := fs.String("since", "", "Recompute all days from this day (YYYY-MM-DD) until yesterday; shorthand for --backfill_start and --backfill_end")
+	tombstoneDeletedSLOs := fs.Bool("tombstone_deleted_slos", false, "Record SLOs with recent rows that have been deleted in the slo_state table")
+	recordRuns := fs.Bool("record_runs", false, "Write a summary of every sync to the runs table")
+	recordGoalChanges := fs.Bool("record_goal_changes", false, "Write detected changes of SLO goals to the slo_changes table")
+	archiveDefinitions := fs.Bool("archive_definitions", false, "Write the full definition of every synced SLO to the slo_definitions table")
+	periodToDate := fs.Bool("period_to_date", false, "Also write performance of calendar-period SLOs since the start of the current period to the period_to_date table")
+	skipEmptyDays := fs.Bool("skip_empty_days", false, "Do not write rows for days without any matching time series")
+	emptyDayCompliance := fs.String("empty_day_compliance", "", "Handling of days with zero events: skip, hundred or zero (defaults to a NULL emptycompliance)")
+	normalizeGoals := fs.Bool("normalize_goals", false, "Divide SLO goals larger than 1 by 100, treating them as percentages")
+	probeInactiveSLOs := fs.Bool("probe_inactive_slos", false, "Query each SLO once over the whole synced interval, and skip per-day queries of SLOs without data")
+	complianceView := fs.Bool("compliance_view", false, "Create or update a compliance view of the data table in --dataset")
+	force := fs.Bool("force", false, "Break an existing lease before syncing (only use if a previous run got stuck)")
+	qps := fs.Float64("qps", 0, "Maximum number of Stackdriver queries per second (0 means no limit)")
+	backfillDays := fs.Int("backfill_days", 0, "Number of days in the past to sync data for (up to 40; 0 means 40)")
+	fastPathDays := fs.Int("fast_path_days", 0, "Number of days to sync for SLOs backfilled by earlier syncs (0 means backfill_days)")
+	retentionDays := fs.Int("retention_days", 0, "Delete rows older than this many days after a successful sync (0 keeps all rows)")
+	includeToday := fs.Bool("include_today", false, "Also sync the current day so far, as partial rows replaced by later syncs")
+	createDataset := fs.Bool("create_dataset", false, "Create the BigQuery dataset if it does not exist")
+	if err := fs.Parse(args); err != nil {
+		return nil, modeSync, err
 	}
 
-	if *project == "" || *dataset == "" {
-		log.Fatalln("--project and --dataset are required")
+	// Flag defaults apply unless overridden by the config file.
+	cfg := &slo2bq.Config{TimeZone: *tz, Granularity: *granularity}
+	if *configFile != "" {
+		b, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, modeSync, fmt.Errorf("error reading config file: %v", err)
+		}
+		// Unknown fields are rejected like in PubSub messages, so that misspelled names don't go unnoticed.
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, modeSync, fmt.Errorf("error parsing config file %s: %v", *configFile, err)
+		}
 	}
 
-	j, err := json.Marshal(&slo2bq.Config{
-		Project:  *project,
-		Dataset:  *dataset,
-		TimeZone: *tz,
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "project":
+			cfg.Project = *project
+		case "projects":
+			cfg.Projects = nil
+			if *projects != "" {
+				cfg.Projects = strings.Split(*projects, ",")
+			}
+		case "fail_on_duplicate_names":
+			cfg.FailOnDuplicateNames = *failOnDuplicateNames
+		case "slo_labels":
+			cfg.SLOLabels = nil
+			if *sloLabels != "" {
+				cfg.SLOLabels = strings.Split(*sloLabels, ",")
+			}
+		case "billing_project":
+			cfg.BillingProject = *billingProject
+		case "metrics_project":
+			cfg.MetricsProject = *metricsProject
+		case "dataset":
+			cfg.Dataset = *dataset
+		case "table":
+			cfg.Table = *table
+		case "shard_by_date":
+			cfg.ShardByDate = *shardByDate
+		case "location":
+			cfg.Location = *location
+		case "tz":
+			cfg.TimeZone = *tz
+		case "dry_run":
+			cfg.DryRun = *dryRun
+		case "refresh_zero_rows":
+			cfg.RefreshZeroRows = *refreshZeroRows
+		case "granularity":
+			cfg.Granularity = *granularity
+		case "prefer_sli_type":
+			cfg.PreferSLIType = *preferSLIType
+		case "continue_on_error":
+			cfg.ContinueOnError = *continueOnError
+		case "log_format":
+			cfg.LogFormat = *logFormat
+		case "credentials_file":
+			cfg.CredentialsFile = *credentialsFile
+		case "existing_data_file":
+			cfg.ExistingDataFile = *existingDataFile
+		case "self_metrics":
+			cfg.SelfMetrics = *selfMetrics
+		case "webhook_url":
+			cfg.WebhookURL = *webhookURL
+		case "notify_recovery":
+			cfg.NotifyRecovery = *notifyRecovery
+		case "timeout":
+			cfg.Timeout = *timeout
+		case "min_interval":
+			cfg.MinInterval = *minInterval
+		case "backfill_start":
+			cfg.BackfillStart = *backfillStart
+		case "backfill_end":
+			cfg.BackfillEnd = *backfillEnd
+		case "force":
+			cfg.Force = *force
+		case "skip_empty_days":
+			cfg.SkipEmptyDays = *skipEmptyDays
+		case "empty_day_compliance":
+			cfg.EmptyDayCompliance = *emptyDayCompliance
+		case "normalize_goals":
+			cfg.NormalizeGoals = *normalizeGoals
+		case "probe_inactive_slos":
+			cfg.ProbeInactiveSLOs = *probeInactiveSLOs
+		case "compliance_view":
+			cfg.ComplianceView = *complianceView
+		case "tombstone_deleted_slos":
+			cfg.TombstoneDeletedSLOs = *tombstoneDeletedSLOs
+		case "record_runs":
+			cfg.RecordRuns = *recordRuns
+		case "record_goal_changes":
+			cfg.RecordGoalChanges = *recordGoalChanges
+		case "archive_definitions":
+			cfg.ArchiveDefinitions = *archiveDefinitions
+		case "period_to_date":
+			cfg.PeriodToDate = *periodToDate
+		case "include_today":
+			cfg.IncludeToday = *includeToday
+		case "create_dataset":
+			cfg.CreateDataset = *createDataset
+		case "backfill_days":
+			cfg.BackfillDays = *backfillDays
+		case "fast_path_days":
+			cfg.FastPathDays = *fastPathDays
+		case "retention_days":
+			cfg.RetentionDays = *retentionDays
+		case "qps":
+			cfg.QPS = *qps
+		}
 	})
+
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, modeSync, fmt.Errorf("error parsing time zone: %v", err)
+	}
+	if *since != "" {
+		if *backfillStart != "" || *backfillEnd != "" {
+			return nil, modeSync, fmt.Errorf("--since cannot be combined with --backfill_start or --backfill_end")
+		}
+		if err := applySince(cfg, *since, now.In(loc)); err != nil {
+			return nil, modeSync, err
+		}
+	}
+	if *list && *healthcheck {
+		return nil, modeSync, fmt.Errorf("--list and --healthcheck cannot be combined")
+	}
+	// Listing SLOs does not access BigQuery, so it does not need a dataset.
+	if cfg.Project == "" || (cfg.Dataset == "" && !*list) {
+		return nil, modeSync, fmt.Errorf("project and dataset are required (set via --project and --dataset, or in the config file)")
+	}
+	switch {
+	case *list:
+		return cfg, modeList, nil
+	case *healthcheck:
+		return cfg, modeHealthcheck, nil
+	}
+	return cfg, modeSync, nil
+}
+
+// applySince sets the backfill range of cfg to the days from since until yesterday. It checks that
+// since is in the past and, if RetentionDays is set, that rows for it would not be deleted again.
+func applySince(cfg *slo2bq.Config, since string, now time.Time) error {
+	start, err := time.ParseInLocation("2006-01-02", since, now.Location())
+	if err != nil {
+		return fmt.Errorf("error parsing --since: %v", err)
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if !start.Before(today) {
+		return fmt.Errorf("--since should be before today (%s); got %s", today.Format("2006-01-02"), since)
+	}
+	if cfg.RetentionDays > 0 && start.Before(today.AddDate(0, 0, -cfg.RetentionDays)) {
+		return fmt.Errorf("--since should be within RetentionDays (%d days); got %s", cfg.RetentionDays, since)
+	}
+	// BackfillEnd has to be in the past in UTC as well, which is not yet the case for
+	// yesterday in time zones ahead of UTC.
+	end := today.AddDate(0, 0, -1).Format("2006-01-02")
+	if utc := now.UTC().AddDate(0, 0, -1).Format("2006-01-02"); utc < end {
+		end = utc
+	}
+	if end < since {
+		return fmt.Errorf("--since should be before yesterday in UTC (%s); got %s", end, since)
+	}
+	cfg.BackfillStart = since
+	cfg.BackfillEnd = end
+	return nil
+}
+
+func main() {
+	cfg, m, err := parseConfig(os.Args[1:], time.Now())
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	switch m {
+	case modeList:
+		if err := slo2bq.ListSLOs(context.Background(), cfg, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		return
+	case modeHealthcheck:
+		res, err := slo2bq.Healthcheck(context.Background(), cfg)
+		if err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			log.Fatalf("error marshalling json: %v\n", err)
+		}
+		if !res.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	j, err := json.Marshal(cfg)
 	if err != nil {
 		log.Fatalf("error marshalling json: %v\n", err)
 	}
@@ -0,0 +1,138 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slo2bq"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNow is the time passed to parseConfig: 2019-05-10 22:30 UTC, already May 11 in Pacific/Kiritimati.
+var testNow = time.Date(2019, 5, 10, 22, 30, 0, 0, time.UTC)
+
+// writeConfig writes a config file to a temporary directory and returns its path.
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "slo2bq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestParseConfig(t *testing.T) {
+	path, cleanup := writeConfig(t, `{
+  "Project": "file-project",
+  "Projects": ["p1", "p2"],
+  "Dataset": "file_dataset",
+  "TimeZone": "America/New_York",
+  "BackfillDays": 7,
+  "ContinueOnError": true,
+  "SLOExclude": ["*-test"]
+}`)
+	defer cleanup()
+
+	for _, tt := range []struct {
+		name     string
+		args     []string
+		want     *slo2bq.Config
+		wantMode mode
+	}{
+		{"flags only", []string{"--project", "p", "--dataset", "ds", "--table", "data_prod", "--location", "asia-northeast1", "--projects", "a,b", "--dry_run", "--min_interval", "1h",
+			"--metrics_project", "m"},
+			&slo2bq.Config{Project: "p", Projects: []string{"a", "b"}, MetricsProject: "m", Dataset: "ds", Table: "data_prod", Location: "asia-northeast1", TimeZone: "Europe/London", Granularity: "daily", DryRun: true,
+				MinInterval: "1h"}, modeSync},
+		{"file only", []string{"--config", path},
+			&slo2bq.Config{Project: "file-project", Projects: []string{"p1", "p2"}, Dataset: "file_dataset", TimeZone: "America/New_York",
+				Granularity: "daily", BackfillDays: 7, ContinueOnError: true, SLOExclude: []string{"*-test"}}, modeSync},
+		{"flags override file", []string{"--config", path, "--dataset", "ds", "--tz", "UTC", "--backfill_days", "3", "--continue_on_error=false", "--projects", "",
+			"--include_today", "--create_dataset", "--archive_definitions", "--period_to_date", "--fast_path_days", "2", "--retention_days", "400", "--empty_day_compliance", "hundred", "--credentials_file", "key.json", "--existing_data_file", "rows.json",
+			"--slo_labels", "team,tier", "--fail_on_duplicate_names", "--compliance_view", "--probe_inactive_slos", "--normalize_goals", "--record_runs", "--billing_project", "analytics", "--tombstone_deleted_slos",
+			"--webhook_url", "https://hooks.example.com/x", "--notify_recovery"},
+			&slo2bq.Config{Project: "file-project", Dataset: "ds", TimeZone: "UTC",
+				Granularity: "daily", BackfillDays: 3, FastPathDays: 2, RetentionDays: 400, EmptyDayCompliance: "hundred", IncludeToday: true, CreateDataset: true, ArchiveDefinitions: true, PeriodToDate: true, CredentialsFile: "key.json", ExistingDataFile: "rows.json", SLOLabels: []string{"team", "tier"}, FailOnDuplicateNames: true, ComplianceView: true, ProbeInactiveSLOs: true, NormalizeGoals: true, RecordRuns: true, BillingProject: "analytics", TombstoneDeletedSLOs: true, WebhookURL: "https://hooks.example.com/x", NotifyRecovery: true, SLOExclude: []string{"*-test"}}, modeSync},
+		{"shard by date", []string{"--project", "p", "--dataset", "ds", "--shard_by_date"},
+			&slo2bq.Config{Project: "p", Dataset: "ds", TimeZone: "Europe/London", Granularity: "daily", ShardByDate: true}, modeSync},
+		{"list without dataset", []string{"--project", "p", "--list"},
+			&slo2bq.Config{Project: "p", TimeZone: "Europe/London", Granularity: "daily"}, modeList},
+		{"healthcheck", []string{"--project", "p", "--dataset", "ds", "--healthcheck"},
+			&slo2bq.Config{Project: "p", Dataset: "ds", TimeZone: "Europe/London", Granularity: "daily"}, modeHealthcheck},
+		{"since", []string{"--project", "p", "--dataset", "ds", "--since", "2019-05-01"},
+			&slo2bq.Config{Project: "p", Dataset: "ds", TimeZone: "Europe/London", Granularity: "daily", BackfillStart: "2019-05-01", BackfillEnd: "2019-05-09"}, modeSync},
+		{"since overrides file", []string{"--config", path, "--since", "2019-05-08"},
+			&slo2bq.Config{Project: "file-project", Projects: []string{"p1", "p2"}, Dataset: "file_dataset", TimeZone: "America/New_York",
+				Granularity: "daily", BackfillDays: 7, ContinueOnError: true, SLOExclude: []string{"*-test"}, BackfillStart: "2019-05-08", BackfillEnd: "2019-05-09"}, modeSync},
+		{"since ahead of UTC", []string{"--project", "p", "--dataset", "ds", "--tz", "Pacific/Kiritimati", "--since", "2019-05-08"},
+			&slo2bq.Config{Project: "p", Dataset: "ds", TimeZone: "Pacific/Kiritimati", Granularity: "daily", BackfillStart: "2019-05-08", BackfillEnd: "2019-05-09"}, modeSync},
+		{"since within retention", []string{"--project", "p", "--dataset", "ds", "--retention_days", "10", "--since", "2019-04-30"},
+			&slo2bq.Config{Project: "p", Dataset: "ds", TimeZone: "Europe/London", Granularity: "daily", RetentionDays: 10, BackfillStart: "2019-04-30", BackfillEnd: "2019-05-09"}, modeSync},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, m, err := parseConfig(tt.args, testNow)
+			if err != nil {
+				t.Fatalf("parseConfig() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || m != tt.wantMode {
+				t.Errorf("parseConfig() = %+v, %v; want %+v, %v", got, m, tt.want, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	invalid, cleanup := writeConfig(t, `{"Project": `)
+	defer cleanup()
+	noDataset, cleanup2 := writeConfig(t, `{"Project": "p"}`)
+	defer cleanup2()
+	misspelled, cleanup3 := writeConfig(t, `{"Project": "p", "Datset": "ds"}`)
+	defer cleanup3()
+
+	for _, tt := range []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"missing file", []string{"--config", "/nonexistent/config.json"}, "error reading config file"},
+		{"invalid json", []string{"--config", invalid}, "error parsing config file"},
+		{"misspelled field", []string{"--config", misspelled}, `unknown field "Datset"`},
+		{"missing dataset", []string{"--config", noDataset}, "project and dataset are required"},
+		{"list without project", []string{"--list"}, "project and dataset are required"},
+		{"invalid tz", []string{"--project", "p", "--dataset", "ds", "--tz", "Nowhere/Foo"}, "error parsing time zone"},
+		{"unknown flag", []string{"--bogus"}, "bogus"},
+		{"healthcheck without dataset", []string{"--project", "p", "--healthcheck"}, "project and dataset are required"},
+		{"list and healthcheck", []string{"--project", "p", "--dataset", "ds", "--list", "--healthcheck"}, "cannot be combined"},
+		{"invalid since", []string{"--project", "p", "--dataset", "ds", "--since", "05/01/2019"}, "error parsing --since"},
+		{"since today", []string{"--project", "p", "--dataset", "ds", "--since", "2019-05-10"}, "should be before today"},
+		{"since yesterday ahead of UTC", []string{"--project", "p", "--dataset", "ds", "--tz", "Pacific/Kiritimati", "--since", "2019-05-10"}, "should be before yesterday in UTC"},
+		{"since beyond retention", []string{"--project", "p", "--dataset", "ds", "--retention_days", "10", "--since", "2019-04-29"}, "should be within RetentionDays"},
+		{"since with backfill_start", []string{"--project", "p", "--dataset", "ds", "--since", "2019-05-01", "--backfill_start", "2019-05-01"}, "cannot be combined"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseConfig(tt.args, testNow)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseConfig() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
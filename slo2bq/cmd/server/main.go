@@ -0,0 +1,54 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command server runs slo2bq as a long-lived HTTP service, e.g. on Cloud Run. Syncs are triggered by
+// HTTP requests configured the same way as the SyncSloPerformanceHTTP function. On SIGTERM (sent by
+// Cloud Run before stopping an instance) or SIGINT, in-flight syncs are cancelled, write rows computed
+// so far and release the lease before the server exits.
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"slo2bq"
+	"syscall"
+)
+
+func main() {
+	// Cloud Run sets PORT to the port the service should listen on.
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		log.Printf("Got %v", <-sigs)
+		cancel()
+	}()
+
+	log.Printf("Listening on port %s", port)
+	if err := slo2bq.Serve(ctx, l); err != nil {
+		log.Fatalf("ERROR: %v\n", err)
+	}
+}
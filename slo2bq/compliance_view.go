@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"slo2bq/clients"
+	"strconv"
+)
+
+// complianceViewQueryTemplate computes the compliance of every row of the data table, and whether it meets
+// the target. Compliance of rows with zero total events is given by Config.EmptyDayCompliance.
+const complianceViewQueryTemplate = `SELECT *, compliance >= target AS met
+FROM (
+  SELECT *, IF(total > 0, good / total, %s) AS compliance
+  FROM ` + "`%s.%s`" + `
+)`
+
+// complianceViewQuery returns the query of the complianceViewName view for a given config.
+func complianceViewQuery(cfg *Config) string {
+	empty := "CAST(NULL AS FLOAT64)"
+	if c := emptyCompliance(cfg); c.Valid {
+		empty = strconv.FormatFloat(c.Float64, 'f', 1, 64)
+	}
+	table := cfg.table()
+	if cfg.ShardByDate {
+		table += "_*"
+	}
+	return fmt.Sprintf(complianceViewQueryTemplate, empty, cfg.qualifiedDataset(), table)
+}
+
+// EnsureComplianceView creates or updates the complianceViewName view in cfg.Dataset, which adds compliance
+// and met columns to rows of the data table, so that all consumers treat days without events the same way
+// as the sync does.
+func EnsureComplianceView(ctx context.Context, cfg *Config, bq clients.BigQueryClient) error {
+	if err := bq.CreateOrReplaceView(ctx, cfg.Dataset, complianceViewName, complianceViewQuery(cfg)); err != nil {
+		return fmt.Errorf("could not create view %s.%s: %v", cfg.Dataset, complianceViewName, err)
+	}
+	return nil
+}
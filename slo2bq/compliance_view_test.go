@@ -0,0 +1,97 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestComplianceViewQuery(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"null", Config{Dataset: "ds"}, "SELECT *, compliance >= target AS met\n" +
+			"FROM (\n" +
+			"  SELECT *, IF(total > 0, good / total, CAST(NULL AS FLOAT64)) AS compliance\n" +
+			"  FROM `ds.data`\n" +
+			")"},
+		{"skip", Config{Dataset: "ds", EmptyDayCompliance: "skip"}, "SELECT *, compliance >= target AS met\n" +
+			"FROM (\n" +
+			"  SELECT *, IF(total > 0, good / total, CAST(NULL AS FLOAT64)) AS compliance\n" +
+			"  FROM `ds.data`\n" +
+			")"},
+		{"hundred", Config{Dataset: "ds", EmptyDayCompliance: "hundred"}, "SELECT *, compliance >= target AS met\n" +
+			"FROM (\n" +
+			"  SELECT *, IF(total > 0, good / total, 1.0) AS compliance\n" +
+			"  FROM `ds.data`\n" +
+			")"},
+		{"zero", Config{Dataset: "ds", EmptyDayCompliance: "zero", Table: "data_prod"}, "SELECT *, compliance >= target AS met\n" +
+			"FROM (\n" +
+			"  SELECT *, IF(total > 0, good / total, 0.0) AS compliance\n" +
+			"  FROM `ds.data_prod`\n" +
+			")"},
+		{"sharded", Config{Dataset: "ds", ShardByDate: true}, "SELECT *, compliance >= target AS met\n" +
+			"FROM (\n" +
+			"  SELECT *, IF(total > 0, good / total, CAST(NULL AS FLOAT64)) AS compliance\n" +
+			"  FROM `ds.data_*`\n" +
+			")"},
+		{"billing project", Config{Project: "app", BillingProject: "analytics", Dataset: "ds"}, "SELECT *, compliance >= target AS met\n" +
+			"FROM (\n" +
+			"  SELECT *, IF(total > 0, good / total, CAST(NULL AS FLOAT64)) AS compliance\n" +
+			"  FROM `app.ds.data`\n" +
+			")"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := complianceViewQuery(&tt.cfg); got != tt.want {
+				t.Errorf("complianceViewQuery() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureComplianceView(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{"created", nil, ""},
+		{"error", fmt.Errorf("permission denied"), "could not create view ds.compliance: permission denied"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			cfg := &Config{Dataset: "ds", EmptyDayCompliance: "hundred"}
+			bq.EXPECT().CreateOrReplaceView(gomock.Any(), "ds", "compliance", complianceViewQuery(cfg)).Return(tt.err)
+
+			err := EnsureComplianceView(context.Background(), cfg, bq)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("EnsureComplianceView() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("EnsureComplianceView() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
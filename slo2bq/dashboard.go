@@ -0,0 +1,206 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slo2bq/clients"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultDashboardDays is the number of past days shown by DashboardHandler unless the Days parameter is set.
+const defaultDashboardDays = 7
+
+// maxDashboardDays limits the number of days read by DashboardHandler, and hence the number of scanned partitions.
+const maxDashboardDays = 90
+
+// dashboardBQClient creates the BigQuery client used by DashboardHandler. It's a variable to allow mocking in tests.
+var dashboardBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) {
+	return clients.NewBQClient(ctx, cfg.Project, cfg.BillingProject, cfg.Location, cfg.clientOptions()...)
+}
+
+// sloCompliance is the compliance of an SLO over the days shown by DashboardHandler.
+type sloCompliance struct {
+	Project, Service, SLO string
+	Good, Total           int64
+	// Target is the target of the most recent row of the SLO.
+	Target float64
+	// Compliance is Good/Total, or nil if there were no events.
+	Compliance *float64
+	// latest is the date of the row Target was taken from.
+	latest string
+}
+
+// met returns whether compliance is at or above the target, and false if there were no events.
+func (c *sloCompliance) met() bool {
+	return c.Compliance != nil && *c.Compliance >= c.Target
+}
+
+// dashboardResponse is the JSON response returned by DashboardHandler.
+type dashboardResponse struct {
+	// Since is the first date (formatted as YYYY-MM-DD) that has been read.
+	Since string
+	SLOs  []*sloCompliance
+}
+
+// DashboardHandler serves compliance of all SLOs over the last days, computed from rows in the data
+// table, for checking recent performance without opening BigQuery. Project, Dataset, Table, Location,
+// TimeZone and Granularity are read from query parameters like in SyncSloPerformanceHTTP, along with Days
+// (the number of past days to show, 7 by default) and Format ("html", the default, or "json").
+func DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := configFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &httpResponse{Error: err.Error()})
+		return
+	}
+	q := r.URL.Query()
+	if cfg.Project == "" || cfg.Dataset == "" {
+		writeJSON(w, http.StatusBadRequest, &httpResponse{Error: "Project and Dataset are required"})
+		return
+	}
+	days := defaultDashboardDays
+	if v := q.Get("Days"); v != "" {
+		if days, err = strconv.Atoi(v); err != nil || days < 1 || days > maxDashboardDays {
+			writeJSON(w, http.StatusBadRequest, &httpResponse{Error: fmt.Sprintf("Days should be between 1 and %d; got %q", maxDashboardDays, v)})
+			return
+		}
+	}
+	format := q.Get("Format")
+	if format != "" && format != "html" && format != "json" {
+		writeJSON(w, http.StatusBadRequest, &httpResponse{Error: fmt.Sprintf("Format should be either \"html\" or \"json\"; got %q", format)})
+		return
+	}
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &httpResponse{Error: err.Error()})
+		return
+	}
+
+	bq, err := dashboardBQClient(r.Context(), cfg)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &httpResponse{Error: err.Error()})
+		return
+	}
+	defer bq.Close()
+
+	since := daysAgoMidnightTimestamp(cfg.now(), loc, days).Format("2006-01-02")
+	slos, err := readCompliance(r.Context(), cfg, bq, since)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &httpResponse{Error: err.Error()})
+		return
+	}
+	res := &dashboardResponse{Since: since, SLOs: slos}
+	if format == "json" {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, res); err != nil {
+		log.Printf("Could not write HTTP response: %v", err)
+	}
+}
+
+// dashboardQuery returns the query reading rows of the configured granularity since a given date.
+func dashboardQuery(cfg *Config, since string) string {
+	return fmt.Sprintf("SELECT project, IFNULL(service, '') as service, IFNULL(slo, '') as slo, "+
+		"IFNULL(FORMAT_DATE('%%F', `date`), '') as date, hour, good, total, target FROM `%s.%s` "+
+		"WHERE date >= DATE '%s' AND hour %s;", cfg.qualifiedDataset(), cfg.table(), since, hourCondition(cfg))
+}
+
+// readCompliance reads rows since a given date, and returns compliance of each SLO sorted by project,
+// service and SLO.
+func readCompliance(ctx context.Context, cfg *Config, bq clients.BigQueryClient, since string) ([]*sloCompliance, error) {
+	rows, err := bq.Query(ctx, dashboardQuery(cfg, since))
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[[3]string]*sloCompliance)
+	for _, row := range rows {
+		k := [3]string{row.Project, row.Service, row.SLO}
+		c, ok := byKey[k]
+		if !ok {
+			c = &sloCompliance{Project: row.Project, Service: row.Service, SLO: row.SLO}
+			byKey[k] = c
+		}
+		c.Good += row.Good
+		c.Total += row.Total
+		if row.Date >= c.latest {
+			c.Target, c.latest = row.Target, row.Date
+		}
+	}
+
+	slos := make([]*sloCompliance, 0, len(byKey))
+	for _, c := range byKey {
+		if c.Total > 0 {
+			v := float64(c.Good) / float64(c.Total)
+			c.Compliance = &v
+		}
+		slos = append(slos, c)
+	}
+	sort.Slice(slos, func(i, j int) bool {
+		a, b := slos[i], slos[j]
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.SLO < b.SLO
+	})
+	return slos, nil
+}
+
+// percent formats a ratio as a percentage with enough digits to tell e.g. 99.95% and 99.99% apart.
+func percent(v float64) string {
+	return fmt.Sprintf("%.3f%%", v*100)
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"percent": percent,
+	"status": func(c *sloCompliance) string {
+		switch {
+		case c.Compliance == nil:
+			return "no data"
+		case c.met():
+			return "met"
+		}
+		return "missed"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>SLO compliance since {{.Since}}</title></head>
+<body>
+<h1>SLO compliance since {{.Since}}</h1>
+<table>
+<tr><th>Project</th><th>Service</th><th>SLO</th><th>Good</th><th>Total</th><th>Compliance</th><th>Target</th><th>Status</th></tr>
+{{range .SLOs}}<tr><td>{{.Project}}</td><td>{{.Service}}</td><td>{{.SLO}}</td><td>{{.Good}}</td><td>{{.Total}}</td><td>{{if .Compliance}}{{percent .Compliance}}{{else}}-{{end}}</td><td>{{percent .Target}}</td><td>{{status .}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ServeDashboard starts an HTTP server serving DashboardHandler at /dashboard. It blocks until the server
+// fails, similarly to http.ListenAndServe.
+func ServeDashboard(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dashboard", DashboardHandler)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+// dashboardRows are rows of two SLOs over three days; the goal of svc1/slo1 got raised on the last day.
+var dashboardRows = []*clients.BQRow{
+	&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-05-08", Good: 990, Total: 1000, Target: 0.99},
+	&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-05-09", Good: 1000, Total: 1000, Target: 0.995},
+	&clients.BQRow{Project: "p1", Service: "svc1", SLO: "slo1", Date: "2015-05-07", Good: 999, Total: 1000, Target: 0.99},
+	&clients.BQRow{Project: "p1", Service: "svc0", SLO: "slo2", Date: "2015-05-09", Good: 90, Total: 100, Target: 0.95},
+	&clients.BQRow{Project: "p1", Service: "svc0", SLO: "empty", Date: "2015-05-09", Target: 0.9},
+}
+
+func TestReadCompliance(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), queryContains("FROM `ds.data` WHERE date >= DATE '2015-05-07' AND hour IS NULL")).Return(dashboardRows, nil)
+
+	slos, err := readCompliance(context.Background(), &Config{Dataset: "ds"}, bq, "2015-05-07")
+	if err != nil {
+		t.Fatalf("readCompliance() unexpected error: %v", err)
+	}
+	var got []string
+	for _, c := range slos {
+		compliance := "-"
+		if c.Compliance != nil {
+			compliance = percent(*c.Compliance)
+		}
+		got = append(got, fmt.Sprintf("%s/%s/%s %d/%d %s target %s met %v", c.Project, c.Service, c.SLO, c.Good, c.Total, compliance, percent(c.Target), c.met()))
+	}
+	want := []string{
+		"p1/svc0/empty 0/0 - target 90.000% met false",
+		"p1/svc0/slo2 90/100 90.000% target 95.000% met false",
+		"p1/svc1/slo1 2989/3000 99.633% target 99.500% met true",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("readCompliance() = %q; want %q", got, want)
+	}
+}
+
+func TestDashboardHandler(t *testing.T) {
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { dashboardBQClient = f }(dashboardBQClient)
+
+	for _, tt := range []struct {
+		name       string
+		url        string
+		wantStatus int
+		// wantBody are strings expected in the response body.
+		wantBody []string
+	}{
+		{"html", "/dashboard?Project=p1&Dataset=ds", 200, []string{
+			"<td>svc0</td><td>slo2</td><td>90</td><td>100</td><td>90.000%</td><td>95.000%</td><td>missed</td>",
+			"<td>svc1</td><td>slo1</td><td>2989</td><td>3000</td><td>99.633%</td><td>99.500%</td><td>met</td>",
+			"<td>svc0</td><td>empty</td><td>0</td><td>0</td><td>-</td><td>90.000%</td><td>no data</td>",
+		}},
+		{"json", "/dashboard?Project=p1&Dataset=ds&Days=3&Format=json", 200, []string{`"Service":"svc1","SLO":"slo1","Good":2989,"Total":3000,"Target":0.995,"Compliance":0.9963333333333333`}},
+		{"missing dataset", "/dashboard?Project=p1", 400, []string{"Project and Dataset are required"}},
+		{"invalid days", "/dashboard?Project=p1&Dataset=ds&Days=0", 400, []string{"Days should be between 1 and 90"}},
+		{"too many days", "/dashboard?Project=p1&Dataset=ds&Days=365", 400, []string{"Days should be between 1 and 90"}},
+		{"unknown format", "/dashboard?Project=p1&Dataset=ds&Format=csv", 400, []string{"Format should be either"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			if tt.wantStatus == 200 {
+				bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return(dashboardRows, nil)
+				bq.EXPECT().Close().Return(nil)
+			}
+			dashboardBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) {
+				return bq, nil
+			}
+
+			w := httptest.NewRecorder()
+			DashboardHandler(w, httptest.NewRequest("GET", tt.url, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("DashboardHandler() returned status %d; want %d", w.Code, tt.wantStatus)
+			}
+			body := w.Body.String()
+			for _, s := range tt.wantBody {
+				if !strings.Contains(body, s) {
+					t.Errorf("DashboardHandler() expected response to contain '%s'; got %s", s, body)
+				}
+			}
+		})
+	}
+}
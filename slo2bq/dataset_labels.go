@@ -0,0 +1,107 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"slo2bq/clients"
+	"strings"
+	"time"
+)
+
+// Labels of Dataset from which SyncSloPerformance reads Config fields that are not set in the message, so that
+// configuration shared by all syncs of a dataset can be stored with it.
+const (
+	metricsProjectLabelName = "slo2bq_metrics_project"
+	tableLabelName          = "slo2bq_table"
+	granularityLabelName    = "slo2bq_granularity"
+	// Label values can't contain slashes or uppercase letters, see timeZoneFromLabel.
+	timeZoneLabelName = "slo2bq_time_zone"
+)
+
+// datasetLabelsBQClient creates the BigQuery client used to read dataset labels. It's a variable to allow
+// mocking in tests.
+var datasetLabelsBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) {
+	return clients.NewBQClient(ctx, cfg.Project, cfg.BillingProject, cfg.Location, cfg.clientOptions()...)
+}
+
+// configFromDatasetLabels sets Config fields that are empty from labels of cfg.Dataset. Fields set explicitly
+// always take precedence, and labels are only read if some of the fields are empty.
+func configFromDatasetLabels(ctx context.Context, cfg *Config) error {
+	var missing []labelField
+	for _, f := range []labelField{
+		{metricsProjectLabelName, &cfg.MetricsProject, nil},
+		{tableLabelName, &cfg.Table, nil},
+		{granularityLabelName, &cfg.Granularity, nil},
+		{timeZoneLabelName, &cfg.TimeZone, timeZoneFromLabel},
+	} {
+		if *f.dst == "" {
+			missing = append(missing, f)
+		}
+	}
+	if cfg.Project == "" || cfg.Dataset == "" || len(missing) == 0 {
+		return nil
+	}
+	bq, err := datasetLabelsBQClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer bq.Close()
+	for _, f := range missing {
+		v, _, err := bq.ReadDatasetMetadataLabel(ctx, cfg.Dataset, f.label)
+		if err != nil {
+			return fmt.Errorf("could not read label %s of dataset %s: %v", f.label, cfg.Dataset, err)
+		}
+		if v == "" {
+			continue
+		}
+		if f.decode != nil {
+			if v, err = f.decode(v); err != nil {
+				return fmt.Errorf("invalid label %s of dataset %s: %v", f.label, cfg.Dataset, err)
+			}
+		}
+		logEntry(cfg, severityInfo, logFields{"label": f.label, "value": v}, "Using %s from label %s of dataset %s", v, f.label, cfg.Dataset)
+		*f.dst = v
+	}
+	return nil
+}
+
+// labelField is a Config field that can be read from a dataset label, optionally decoded by a function.
+type labelField struct {
+	label  string
+	dst    *string
+	decode func(string) (string, error)
+}
+
+// timeZoneFromLabel returns the name of a time zone stored in a dataset label, which is the name in lowercase
+// with slashes replaced by double underscores (e.g. "america__new_york"). Words are capitalized, so zones
+// with other capitalization (e.g. America/Port-au-Prince) can't be stored in a label.
+func timeZoneFromLabel(v string) (string, error) {
+	name := strings.ToUpper(v)
+	if name != "UTC" {
+		words := []byte(strings.Replace(v, "__", "/", -1))
+		for i := range words {
+			if i == 0 || strings.IndexByte("/_-", words[i-1]) >= 0 {
+				words[i] = strings.ToUpper(string(words[i]))[0]
+			}
+		}
+		name = string(words)
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return "", fmt.Errorf("%q is not a known time zone (decoded as %q); set TimeZone instead", v, name)
+	}
+	return name, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+// mockDatasetLabels makes datasetLabelsBQClient return a client with the given labels of dataset "ds".
+func mockDatasetLabels(mockCtrl *gomock.Controller, labels map[string]string) {
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "ds", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, dataset, label string) (string, string, error) {
+			if v, ok := labels[label]; ok && v == "error" {
+				return "", "", fmt.Errorf("boom")
+			}
+			return labels[label], "etag", nil
+		}).AnyTimes()
+	bq.EXPECT().Close().AnyTimes()
+	datasetLabelsBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) { return bq, nil }
+}
+
+func TestConfigFromDatasetLabels(t *testing.T) {
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { datasetLabelsBQClient = f }(datasetLabelsBQClient)
+	labels := map[string]string{
+		metricsProjectLabelName: "metrics",
+		tableLabelName:          "slos",
+		granularityLabelName:    "hourly",
+		timeZoneLabelName:       "america__new_york",
+	}
+
+	for _, tt := range []struct {
+		name    string
+		cfg     Config
+		labels  map[string]string
+		want    Config
+		wantErr string
+	}{
+		{"all from labels", Config{Project: "p", Dataset: "ds"}, labels, Config{Project: "p", Dataset: "ds",
+			MetricsProject: "metrics", Table: "slos", Granularity: "hourly", TimeZone: "America/New_York"}, ""},
+		{"explicit config wins", Config{Project: "p", Dataset: "ds", Table: "t", TimeZone: "UTC"}, labels, Config{Project: "p", Dataset: "ds",
+			MetricsProject: "metrics", Table: "t", Granularity: "hourly", TimeZone: "UTC"}, ""},
+		{"no labels", Config{Project: "p", Dataset: "ds"}, nil, Config{Project: "p", Dataset: "ds"}, ""},
+		{"no dataset", Config{Project: "p"}, map[string]string{tableLabelName: "error"}, Config{Project: "p"}, ""},
+		{"read error", Config{Project: "p", Dataset: "ds"}, map[string]string{tableLabelName: "error"}, Config{}, "could not read label slo2bq_table"},
+		{"unknown time zone", Config{Project: "p", Dataset: "ds"}, map[string]string{timeZoneLabelName: "mars__olympus"}, Config{},
+			"invalid label slo2bq_time_zone"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mockDatasetLabels(mockCtrl, tt.labels)
+
+			cfg := tt.cfg
+			err := configFromDatasetLabels(context.Background(), &cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("configFromDatasetLabels() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("configFromDatasetLabels() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(cfg, tt.want) {
+				t.Errorf("configFromDatasetLabels() = %+v; want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeZoneFromLabel(t *testing.T) {
+	for _, tt := range []struct {
+		label   string
+		want    string
+		wantErr bool
+	}{
+		{"utc", "UTC", false},
+		{"europe__london", "Europe/London", false},
+		{"america__argentina__buenos_aires", "America/Argentina/Buenos_Aires", false},
+		{"america__blanc-sablon", "America/Blanc-Sablon", false},
+		{"america__port-au-prince", "", true},
+		{"nowhere", "", true},
+	} {
+		t.Run(tt.label, func(t *testing.T) {
+			got, err := timeZoneFromLabel(tt.label)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("timeZoneFromLabel(%q) unexpected error state: %v", tt.label, err)
+			}
+			if got != tt.want {
+				t.Errorf("timeZoneFromLabel(%q) = %q; want %q", tt.label, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSloPerformanceDatasetLabels(t *testing.T) {
+	defer func() { runSync = run }()
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { datasetLabelsBQClient = f }(datasetLabelsBQClient)
+	defer os.Setenv("GCP_PROJECT", os.Getenv("GCP_PROJECT"))
+	os.Setenv("GCP_PROJECT", "p1")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDatasetLabels(mockCtrl, map[string]string{metricsProjectLabelName: "metrics", timeZoneLabelName: "europe__london"})
+	var got *Config
+	runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+		got = cfg
+		return &SyncResult{}, nil
+	}
+
+	if err := SyncSloPerformance(context.Background(), PubSubMessage{Data: []byte(`{"Dataset": "ds", "Table": "t"}`)}); err != nil {
+		t.Fatalf("SyncSloPerformance() unexpected error: %v", err)
+	}
+	if got == nil || got.Project != "p1" || got.MetricsProject != "metrics" || got.Table != "t" || got.TimeZone != "Europe/London" {
+		t.Errorf("expected sync to run with project from GCP_PROJECT and fields from dataset labels; got %+v", got)
+	}
+}
+
+func TestSyncSloPerformanceHTTPDatasetLabels(t *testing.T) {
+	defer func() { runSync = run }()
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { datasetLabelsBQClient = f }(datasetLabelsBQClient)
+	for _, tt := range []struct {
+		name       string
+		labels     map[string]string
+		wantStatus int
+		wantErr    string
+	}{
+		{"fields from labels", map[string]string{metricsProjectLabelName: "metrics", timeZoneLabelName: "europe__london"}, http.StatusOK, ""},
+		{"label error", map[string]string{metricsProjectLabelName: "error"}, http.StatusInternalServerError, "could not read label"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mockDatasetLabels(mockCtrl, tt.labels)
+			var got *Config
+			runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+				got = cfg
+				return &SyncResult{}, nil
+			}
+
+			w := httptest.NewRecorder()
+			SyncSloPerformanceHTTP(w, httptest.NewRequest("POST", "/?Project=p1&Dataset=ds&Table=t", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d; got %d (%s)", tt.wantStatus, w.Code, w.Body)
+			}
+			if tt.wantErr != "" {
+				if got != nil || !strings.Contains(w.Body.String(), tt.wantErr) {
+					t.Errorf("expected sync not to run and response to contain '%s'; got %s", tt.wantErr, w.Body)
+				}
+				return
+			}
+			if got == nil || got.MetricsProject != "metrics" || got.Table != "t" || got.TimeZone != "Europe/London" {
+				t.Errorf("expected sync to run with fields from dataset labels; got %+v", got)
+			}
+		})
+	}
+}
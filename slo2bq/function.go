@@ -16,23 +16,715 @@
 package slo2bq
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
 	"slo2bq/clients"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
-// BigQuery table name for the raw data.
-const tableName = "data"
+// Default BigQuery table name for the raw data.
+const defaultTableName = "data"
+
+// BigQuery table name for detected SLO goal changes.
+const goalChangesTableName = "slo_changes"
+
+// BigQuery table name for SLOs that have been backfilled, see Config.FastPathDays.
+const knownSLOsTableName = "known_slos"
+
+// BigQuery table name for archived SLO definitions.
+const sloDefinitionsTableName = "slo_definitions"
+
+// BigQuery table name for period-to-date rows of calendar-period SLOs.
+const periodToDateTableName = "period_to_date"
+
+// BigQuery table name for deleted SLOs, see Config.TombstoneDeletedSLOs.
+const sloStateTableName = "slo_state"
+
+// BigQuery table name for summaries of syncs, see Config.RecordRuns.
+const runsTableName = "runs"
+
+// BigQuery view name for rows of the data table with their compliance, see Config.ComplianceView.
+const complianceViewName = "compliance"
+
+// validTableName matches table names allowed by BigQuery.
+var validTableName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Stackdriver metric retention is 6 weeks (42 days), so we backfill up to 40
+// days in the past.
+const maxBackfillDays = 40
+
+// Default number of concurrent Stackdriver queries.
+const defaultConcurrency = 4
+
+// Supported values of Config.Granularity.
+const (
+	granularityDaily  = "daily"
+	granularityHourly = "hourly"
+)
+
+// Supported values of Config.PreferSLIType.
+const (
+	sliTypeRequest = "request"
+	sliTypeWindows = "windows"
+)
+
+// maxSubIntervals is the maximum value of Config.SubIntervals. With daily granularity, it results in
+// queries covering 15 minutes each.
+const maxSubIntervals = 96
+
+// Supported values of Config.EmptyDayCompliance.
+const (
+	emptyDaySkip    = "skip"
+	emptyDayHundred = "hundred"
+	emptyDayZero    = "zero"
+)
+
+// Duration for which lists of services and SLOs are cached if Config.Cached is set.
+const sloCacheTTL = 5 * time.Minute
+
+// Duration of the BigQuery lease, which gets renewed while the sync is running.
+const leaseDuration = 10 * time.Minute
+
+// Default sync timeout. It's shorter than the lease duration and the 9 minute GCF limit, leaving time
+// to release the lease.
+const defaultTimeout = 8*time.Minute + 30*time.Second
 
 // Config is a configuration structure expected by this function as JSON in a PubSub message.
 type Config struct {
-	Project  string
-	Dataset  string
+	// Project is the Cloud project hosting the BigQuery dataset. Unless Projects is set, SLO data is
+	// synced from this project as well.
+	Project string
+	// Projects is a list of Cloud projects to sync SLO data from. All of them share a single dataset.
+	Projects []string
+	// MetricsProject is the Cloud project that time series matching SLI filters are read from, e.g. the
+	// scoping project of a metrics scope which includes the synced projects. Defaults to the project being
+	// synced. SLIs evaluated using select_slo_counts (such as windows-based ones) are always read from the
+	// project hosting the SLO.
+	MetricsProject string
+	// BillingProject is the Cloud project that BigQuery jobs run in and are billed to, e.g. a central
+	// analytics project. Defaults to Project, which hosts Dataset.
+	BillingProject string
+	Dataset        string
+	// CreateDataset makes the sync create Dataset (in Location) if it does not exist yet. By default, a
+	// missing dataset fails the sync.
+	CreateDataset bool
+	// Table is the name of the table storing SLO data in Dataset. Defaults to defaultTableName.
+	Table string
+	// ShardByDate writes rows to date-sharded tables named after Table and the date of the rows, e.g.
+	// data_20150510, instead of a single partitioned table. Existing rows are read using a wildcard table.
+	ShardByDate bool
+	// Location is the BigQuery location of Dataset (e.g. "asia-northeast1"). It needs to be set for
+	// datasets outside of the US and EU multi-regions.
+	Location string
 	TimeZone string
+	// BackfillDays is the number of days in the past to sync data for. Defaults to maxBackfillDays.
+	BackfillDays int
+	// FastPathDays enables incremental discovery of SLOs: SLOs that have been backfilled by an earlier sync
+	// (as recorded in the knownSLOsTableName table in Dataset) only get their last FastPathDays days synced,
+	// while newly appeared SLOs are backfilled for BackfillDays. Zero (default) syncs BackfillDays for all
+	// SLOs. It is ignored when recomputing a BackfillStart/BackfillEnd date range or Replay cells.
+	FastPathDays int
+	// RetentionDays enables deletion of rows older than RetentionDays days (in all projects sharing Table) at
+	// the end of each successful sync, for tables without partition expiration. It needs to be larger than
+	// BackfillDays, so that synced rows are not deleted again. Zero (default) keeps all rows. Rows are not
+	// pruned when recomputing a BackfillStart/BackfillEnd date range or Replay cells.
+	RetentionDays int
+	// IncludeToday enables syncing of the current day until the time of the sync. Such rows are marked
+	// as partial, and are replaced by every sync until the day is over. It is ignored when recomputing a
+	// BackfillStart/BackfillEnd date range or Replay cells.
+	IncludeToday bool
+	// Concurrency is the maximum number of concurrent Stackdriver queries. Defaults to defaultConcurrency.
+	Concurrency int
+	// QPS limits the rate of Stackdriver queries (per second) to stay within API quotas. Zero means no limit.
+	QPS float64
+	// MaxTimeSeries is the maximum number of time series a single Stackdriver query may return before the
+	// sync of the SLO fails, which protects against running out of memory with a filter matching too much
+	// (e.g. an aggregation without a reducer). Defaults to 10000.
+	MaxTimeSeries int
+	// SubIntervals splits each day (or hour) into this many equal sub-intervals, which are queried separately
+	// and summed when counting events matching a filter. It helps with counters that have so many time series
+	// that a single query covering the whole day hits server-side limits. Defaults to 1.
+	SubIntervals int
+	// DryRun disables all writes to BigQuery; rows that would have been written are logged instead.
+	DryRun bool
+	// RefreshZeroRows enables re-syncing of rows that have been written with no events (e.g. because
+	// Stackdriver data was incomplete at the time). Original rows are deleted once the new rows have
+	// events; rows that still have no events are not written again. Rows written within the last hour or
+	// so can't be deleted, and are refreshed by a later sync.
+	RefreshZeroRows bool
+	// Granularity is either "daily" (default) or "hourly". Hourly rows have the same date as daily
+	// rows, with the number of hours since local midnight in the Hour column.
+	Granularity string
+	// ServiceInclude and ServiceExclude are lists of glob patterns (as supported by path.Match) matched
+	// against service names. Only services matching at least one include pattern (or all services, if there
+	// are no include patterns) and not matching any exclude patterns are synced.
+	ServiceInclude, ServiceExclude []string
+	// SLOInclude and SLOExclude are lists of glob patterns matched against SLO names, similarly to
+	// ServiceInclude and ServiceExclude.
+	SLOInclude, SLOExclude []string
+	// SLOLabels are keys of SLO user labels (e.g. team or tier) to copy into the labels column of rows,
+	// which holds them as a JSON object. Other user labels are ignored.
+	SLOLabels []string
+	// FailOnDuplicateNames makes a sync fail if several synced SLOs have the same service and SLO names
+	// (e.g. because they share a display name). By default, a warning is logged. Rows of such SLOs can
+	// only be told apart by the ServiceID and SLOID columns.
+	FailOnDuplicateNames bool
+	// SkipMalformedExistingRows makes existing rows without a service, SLO or date (e.g. written by a broken
+	// import) get logged and ignored when reading existing data. By default, such rows fail the sync.
+	SkipMalformedExistingRows bool
+	// ContinueOnError makes errors of individual services and SLOs not abort the sync. All errors
+	// are returned together once all other SLOs have been synced.
+	ContinueOnError bool
+	// SelfMetrics enables writing metrics about each successful sync run (such as the number of rows
+	// written) to Stackdriver in Project. Metric types start with SelfMetricsPrefix, which defaults
+	// to defaultSelfMetricsPrefix.
+	SelfMetrics       bool
+	SelfMetricsPrefix string
+	// WebhookURL is a URL (e.g. of a Slack incoming webhook) receiving a JSON Notification when a sync
+	// triggered via PubSub or the command line fails. It can not be set in HTTP requests.
+	WebhookURL string
+	// NotifyRecovery makes the first successful sync after a failed one also send a notification to
+	// WebhookURL. Failures are tracked using a dataset label.
+	NotifyRecovery bool
+	// Timeout limits the duration of the sync, as parsed by time.ParseDuration (e.g. "5m"). Defaults
+	// to defaultTimeout.
+	Timeout string
+	// BackfillStart and BackfillEnd (both inclusive, formatted as YYYY-MM-DD) can be set to recompute data
+	// for a given date range. Existing rows in the range are replaced, and BackfillDays is ignored.
+	BackfillStart, BackfillEnd string
+	// Replay is a list of cells to recompute, e.g. after a data-quality incident. If it is set, only
+	// these cells are synced: existing rows are replaced, and neither BackfillDays nor maxBackfillDays
+	// apply. It can not be combined with BackfillStart and BackfillEnd.
+	Replay []ReplayCell
+	// Force breaks an existing lease before acquiring a new one. It should only be used to recover
+	// from a stuck lease.
+	Force bool
+	// RecordGoalChanges enables writing detected changes of SLO goals to the goalChangesTableName table
+	// in Dataset. Changes are logged regardless of this setting.
+	RecordGoalChanges bool
+	// TombstoneDeletedSLOs enables recording SLOs which have recent rows in the data table, but are not
+	// returned by the Service Monitoring API anymore, as deleted in the sloStateTableName table in Dataset.
+	TombstoneDeletedSLOs bool
+	// RecordRuns enables writing a summary of every sync (except dry runs and syncs skipped because of
+	// MinInterval) to the runsTableName table in Dataset.
+	RecordRuns bool
+	// ArchiveDefinitions enables writing the full definition of every synced SLO, as returned by the API, to
+	// the sloDefinitionsTableName table in Dataset once per sync, so that audits can tell how an SLO was
+	// defined when its rows were computed.
+	ArchiveDefinitions bool
+	// PeriodToDate enables writing, for SLOs with a calendar period (e.g. MONTH), a row counting events from
+	// the start of the current period (in TimeZone) until the sync to the periodToDateTableName table in
+	// Dataset, with PeriodStart set. Every sync appends new rows, so the most recent row of an SLO has its
+	// current period-to-date performance. It is ignored when recomputing a date range or replaying cells.
+	PeriodToDate bool
+	// Aggregations overrides the aligner and reducer used for time series matching a given filter, keyed
+	// by the filter as it appears in the SLI definition. By default, ALIGN_DELTA and REDUCE_SUM are used,
+	// which is correct for counters; SLIs based on gauge metrics may need e.g. ALIGN_COUNT or ALIGN_MEAN.
+	Aggregations map[string]Aggregation
+	// Scales multiplies the sum of values of time series matching a given filter, keyed by the filter as
+	// it appears in the SLI definition, for metrics that are not reported in events (e.g. 1000 for a metric
+	// counting thousands of requests, or 0.001 for one counting milliseconds of work per request). Scaled
+	// sums are rounded to the nearest integer.
+	Scales map[string]float64
+	// LabelRatios defines request-based SLIs of given SLOs using a single metric whose time series are
+	// told apart by a label (e.g. response_code_class), keyed by service and SLO IDs as "SERVICE/SLO". They
+	// take precedence over the SLI of the SLO, and are expanded into good, bad and total filters which can
+	// be referenced in Aggregations and Scales.
+	LabelRatios map[string]LabelRatio
+	// SLOTimeZones overrides TimeZone for the rows of given SLOs, keyed by service and SLO IDs as
+	// "SERVICE/SLO", so that their days are aligned to the region of the owning team.
+	SLOTimeZones map[string]string
+	// SkipEmptyDays disables writing rows for days (or hours) when no time series match the SLI, which
+	// usually means either no traffic or a misconfigured filter. Such days are then queried again by every
+	// sync within BackfillDays. By default, rows with zero events are written.
+	SkipEmptyDays bool
+	// NormalizeGoals divides SLO goals between 1 and 100 by 100, for SLOs with goals expressed as a
+	// percentage (e.g. 99) rather than a fraction (0.99). Goals larger than 100 then fail the SLO.
+	NormalizeGoals bool
+	// ProbeInactiveSLOs makes the sync query events of every SLO over the whole synced interval before
+	// querying each day (or hour), and skip the latter if no time series match the SLI, which saves most
+	// queries for SLOs of services that no longer emit metrics. Their rows are written as if no time series
+	// matched on each day (see SkipEmptyDays and EmptyDayCompliance).
+	ProbeInactiveSLOs bool
+	// EmptyDayCompliance controls rows of days (or hours) with zero total events, whose compliance is
+	// undefined: "skip" doesn't write them, while "hundred" and "zero" write them with emptycompliance
+	// set to 1 (no traffic means no violations) or 0 (non-compliant). By default, they are written with
+	// a NULL emptycompliance.
+	EmptyDayCompliance string
+	// ComplianceView makes every sync create or update the complianceViewName view in Dataset, which adds
+	// compliance (good / total, or the value chosen by EmptyDayCompliance for rows without events) and
+	// met columns to rows of the data table.
+	ComplianceView bool
+	// Cached enables caching of service and SLO lists for sloCacheTTL within the process, so that
+	// repeated syncs (e.g. triggered both via HTTP and PubSub) don't list them again.
+	Cached bool
+	// PreferSLIType selects which SLI representation is synced for SLOs that have both a request-based
+	// and a windows-based one: either "request" (default) or "windows". SLOs with a single representation
+	// are always synced using it.
+	PreferSLIType string
+	// MinInterval makes a sync exit early without doing anything if the previous successful sync finished
+	// less than MinInterval ago (as parsed by time.ParseDuration, e.g. "1h"), which protects against
+	// duplicate PubSub deliveries and over-eager schedulers. Syncs of a BackfillStart/BackfillEnd date
+	// range and replays are never skipped.
+	MinInterval string
+	// LogFormat is either "text" (default) or "json". JSON log entries contain structured fields (such as
+	// service, SLO and date) which can be queried in Cloud Logging.
+	LogFormat string
+	// CredentialsFile is the path of a service account key file used to authenticate all API calls instead
+	// of application default credentials, e.g. to run locally as a specific service account. It can not be
+	// set in HTTP requests, since that would allow reading arbitrary files of the server.
+	CredentialsFile string
+	// ExistingDataQueryTemplate overrides the query used to read existing rows, e.g. for data kept in a view or
+	// a table with a different date column. It's a text/template rendered with .Project, .Dataset (qualified
+	// with the project hosting it if BillingProject is set), .Table, .StartDate (formatted as YYYY-MM-DD) and
+	// .HourCondition (e.g. "IS NULL"), and needs to return the same columns as defaultExistingDataQueryTemplate.
+	ExistingDataQueryTemplate string
+	// ExistingDataFile is the path of a newline-delimited JSON file (e.g. written by GCSExport or a BigQuery
+	// extract job) from which existing rows are read instead of the data table, e.g. for offline
+	// reprocessing. New rows are still written to BigQuery. Like CredentialsFile, it can not be set in HTTP
+	// requests.
+	ExistingDataFile string
+	// GCSExport enables writing synced rows to Cloud Storage as newline-delimited JSON, in addition to
+	// BigQuery (which is still used to keep track of rows that have already been synced).
+	GCSExport *GCSExport
+
+	// clock returns the current time; it defaults to time.Now, and is only set in tests.
+	clock func() time.Time
+	// datasetProject is the project hosting Dataset in copies of the Config syncing one of Projects, whose
+	// Project is the synced project.
+	datasetProject string
+	// lease is the lease held by the sync, or nil if there is none (e.g. in dry runs).
+	lease *bqLease
+}
+
+// GCSExport configures the export of synced rows to Cloud Storage. Rows of each date are written to
+// objects named Prefix/YYYY-MM-DD/PROJECT-TIMESTAMP.json in Bucket, where TIMESTAMP is the Unix time of
+// the sync run, so that objects written by earlier runs are not overwritten.
+type GCSExport struct {
+	Bucket, Prefix string
+}
+
+// ReplayCell identifies rows of a single SLO and date (formatted as YYYY-MM-DD) to recompute. Service
+// and SLO are matched against both IDs and display names. Project defaults to Config.Project.
+type ReplayCell struct {
+	Project, Service, SLO, Date string
+}
+
+// Aggregation configures how time series are aggregated. Values are names of aligners and reducers
+// as defined by the Monitoring API (e.g. "ALIGN_MEAN" and "REDUCE_SUM"); empty values keep the defaults.
+type Aggregation struct {
+	Aligner, Reducer string
+	// Rate marks metrics reporting per-second rates (e.g. a gauge of requests per second) rather than
+	// counts of events. Such time series are aligned with ALIGN_MEAN (unless Aligner is set to ALIGN_RATE,
+	// which turns a counter into a rate), and the resulting rate is multiplied by the length of the interval.
+	Rate bool
+}
+
+// LabelRatio defines good and bad events as time series matching Filter, with the value of Label in Good
+// and Bad respectively. At least one of Good and Bad needs to be set; if only one of them is, all time series
+// matching Filter are counted as total events.
+type LabelRatio struct {
+	// Filter selects time series of the metric, e.g. `metric.type="loadbalancing.googleapis.com/https/request_count"`.
+	Filter string
+	// Label is the label telling events apart, e.g. "metric.label.response_code_class".
+	Label     string
+	Good, Bad []string
+}
+
+// filters returns monitoring filters for good, bad and total events defined by the label ratio.
+func (r LabelRatio) filters() *clients.GoodTotalRatioSLI {
+	sli := &clients.GoodTotalRatioSLI{}
+	if len(r.Good) > 0 {
+		sli.Good = labelFilter(r.Filter, r.Label, r.Good)
+	}
+	if len(r.Bad) > 0 {
+		sli.Bad = labelFilter(r.Filter, r.Label, r.Bad)
+	}
+	if sli.Good == "" || sli.Bad == "" {
+		sli.Total = r.Filter
+	}
+	return sli
+}
+
+// labelFilter returns a filter matching time series matching a given filter, with a label set to one of
+// given values.
+func labelFilter(filter, label string, values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return fmt.Sprintf("%s AND %s = one_of(%s)", filter, label, strings.Join(quoted, ", "))
+}
+
+// validate checks that configuration values are within allowed bounds.
+func (c *Config) validate() error {
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("WebhookURL should be an http or https URL; got %q", c.WebhookURL)
+		}
+	}
+	if c.NotifyRecovery && c.WebhookURL == "" {
+		return fmt.Errorf("NotifyRecovery requires WebhookURL to be set")
+	}
+	if c.BackfillDays < 0 || c.BackfillDays > maxBackfillDays {
+		return fmt.Errorf("BackfillDays should be between 0 (default) and %d; got %d", maxBackfillDays, c.BackfillDays)
+	}
+	if c.FastPathDays < 0 || c.FastPathDays > maxBackfillDays {
+		return fmt.Errorf("FastPathDays should be between 0 (default) and %d; got %d", maxBackfillDays, c.FastPathDays)
+	}
+	if c.RetentionDays < 0 {
+		return fmt.Errorf("RetentionDays should not be negative; got %d", c.RetentionDays)
+	}
+	if c.RetentionDays > 0 && c.RetentionDays <= c.backfillDays() {
+		return fmt.Errorf("RetentionDays should be larger than BackfillDays (%d); got %d", c.backfillDays(), c.RetentionDays)
+	}
+	if c.Concurrency < 0 {
+		return fmt.Errorf("Concurrency should not be negative; got %d", c.Concurrency)
+	}
+	if c.SubIntervals < 0 || c.SubIntervals > maxSubIntervals {
+		return fmt.Errorf("SubIntervals should be between 0 (default) and %d; got %d", maxSubIntervals, c.SubIntervals)
+	}
+	if c.MaxTimeSeries < 0 {
+		return fmt.Errorf("MaxTimeSeries should not be negative; got %d", c.MaxTimeSeries)
+	}
+	if c.QPS < 0 {
+		return fmt.Errorf("QPS should not be negative; got %v", c.QPS)
+	}
+	if c.Table != "" && !validTableName.MatchString(c.Table) {
+		return fmt.Errorf("Table should only contain letters, numbers and underscores; got %q", c.Table)
+	}
+	if c.ShardByDate && c.RetentionDays > 0 {
+		return fmt.Errorf("RetentionDays can not be combined with ShardByDate; set a default table expiration on the dataset instead")
+	}
+	if c.ShardByDate && len(c.Replay) > 0 {
+		return fmt.Errorf("Replay can not be combined with ShardByDate")
+	}
+	if c.PreferSLIType != "" && c.PreferSLIType != sliTypeRequest && c.PreferSLIType != sliTypeWindows {
+		return fmt.Errorf("PreferSLIType should be either %q or %q; got %q", sliTypeRequest, sliTypeWindows, c.PreferSLIType)
+	}
+	switch c.EmptyDayCompliance {
+	case "", emptyDaySkip:
+	case emptyDayHundred, emptyDayZero:
+		if c.SkipEmptyDays {
+			return fmt.Errorf("SkipEmptyDays can not be combined with EmptyDayCompliance %q", c.EmptyDayCompliance)
+		}
+	default:
+		return fmt.Errorf("EmptyDayCompliance should be one of %q, %q or %q; got %q", emptyDaySkip, emptyDayHundred, emptyDayZero, c.EmptyDayCompliance)
+	}
+	if c.LogFormat != "" && c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		return fmt.Errorf("LogFormat should be either %q or %q; got %q", logFormatText, logFormatJSON, c.LogFormat)
+	}
+	if c.GCSExport != nil && c.GCSExport.Bucket == "" {
+		return fmt.Errorf("GCSExport.Bucket should be set")
+	}
+	if c.Granularity != "" && c.Granularity != granularityDaily && c.Granularity != granularityHourly {
+		return fmt.Errorf("Granularity should be either %q or %q; got %q", granularityDaily, granularityHourly, c.Granularity)
+	}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return fmt.Errorf("could not parse Timeout: %v", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("Timeout should be positive; got %v", d)
+		}
+	}
+	if c.MinInterval != "" {
+		d, err := time.ParseDuration(c.MinInterval)
+		if err != nil {
+			return fmt.Errorf("could not parse MinInterval: %v", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("MinInterval should not be negative; got %v", d)
+		}
+	}
+	if c.BackfillStart != "" || c.BackfillEnd != "" {
+		start, err := time.Parse("2006-01-02", c.BackfillStart)
+		if err != nil {
+			return fmt.Errorf("could not parse BackfillStart: %v", err)
+		}
+		end, err := time.Parse("2006-01-02", c.BackfillEnd)
+		if err != nil {
+			return fmt.Errorf("could not parse BackfillEnd: %v", err)
+		}
+		if end.Before(start) {
+			return fmt.Errorf("BackfillEnd (%s) should not be before BackfillStart (%s)", c.BackfillEnd, c.BackfillStart)
+		}
+		// Dates are compared in UTC, which is good enough to reject days without Stackdriver data or not yet finished.
+		today := c.now().UTC().Truncate(24 * time.Hour)
+		if !end.Before(today) {
+			return fmt.Errorf("BackfillEnd should be in the past; got %s", c.BackfillEnd)
+		}
+		if start.Before(today.AddDate(0, 0, -maxBackfillDays)) {
+			return fmt.Errorf("BackfillStart should be within %d days; got %s", maxBackfillDays, c.BackfillStart)
+		}
+	}
+	if len(c.Replay) > 0 {
+		if c.backfillRange() {
+			return fmt.Errorf("Replay can not be combined with BackfillStart and BackfillEnd")
+		}
+		today := c.now().UTC().Truncate(24 * time.Hour)
+		for _, cell := range c.Replay {
+			if cell.Service == "" || cell.SLO == "" {
+				return fmt.Errorf("Replay cells require Service and SLO; got %+v", cell)
+			}
+			d, err := time.Parse("2006-01-02", cell.Date)
+			if err != nil {
+				return fmt.Errorf("could not parse Replay date: %v", err)
+			}
+			if !d.Before(today) {
+				return fmt.Errorf("Replay dates should be in the past; got %s", cell.Date)
+			}
+		}
+	}
+	for filter, a := range c.Aggregations {
+		if _, ok := monitoringpb.Aggregation_Aligner_value[a.Aligner]; a.Aligner != "" && !ok {
+			return fmt.Errorf("Aggregations contains an unknown aligner %q for filter '%s'", a.Aligner, filter)
+		}
+		if _, ok := monitoringpb.Aggregation_Reducer_value[a.Reducer]; a.Reducer != "" && !ok {
+			return fmt.Errorf("Aggregations contains an unknown reducer %q for filter '%s'", a.Reducer, filter)
+		}
+		if a.Rate && a.Aligner != "" && a.Aligner != "ALIGN_MEAN" && a.Aligner != "ALIGN_RATE" {
+			return fmt.Errorf("Aggregations of rates should use ALIGN_MEAN or ALIGN_RATE; got %q for filter '%s'", a.Aligner, filter)
+		}
+	}
+	for key, r := range c.LabelRatios {
+		if strings.Count(key, "/") != 1 {
+			return fmt.Errorf("LabelRatios should be keyed by \"SERVICE/SLO\"; got %q", key)
+		}
+		if r.Filter == "" || r.Label == "" || len(r.Good)+len(r.Bad) == 0 {
+			return fmt.Errorf("LabelRatios should set Filter, Label and at least one of Good and Bad; got %+v for %q", r, key)
+		}
+	}
+	for key, tz := range c.SLOTimeZones {
+		if strings.Count(key, "/") != 1 {
+			return fmt.Errorf("SLOTimeZones should be keyed by \"SERVICE/SLO\"; got %q", key)
+		}
+		if _, err := time.LoadLocation(tz); err != nil {
+			return fmt.Errorf("SLOTimeZones contains an invalid time zone %q for %q: %v", tz, key, err)
+		}
+	}
+	for filter, scale := range c.Scales {
+		if scale <= 0 {
+			return fmt.Errorf("Scales should be positive; got %v for filter '%s'", scale, filter)
+		}
+	}
+	if c.ExistingDataFile != "" && c.ExistingDataQueryTemplate != "" {
+		return fmt.Errorf("ExistingDataFile can not be combined with ExistingDataQueryTemplate")
+	}
+	if c.ExistingDataQueryTemplate != "" {
+		if _, err := existingDataQuery(c, "2006-01-02"); err != nil {
+			return err
+		}
+	}
+	for name, patterns := range map[string][]string{
+		"ServiceInclude": c.ServiceInclude, "ServiceExclude": c.ServiceExclude,
+		"SLOInclude": c.SLOInclude, "SLOExclude": c.SLOExclude,
+	} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("%s contains an invalid pattern %q: %v", name, p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// timeout returns the maximum duration of the sync. Config is expected to be validated.
+func (c *Config) timeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+	return defaultTimeout
+}
+
+// minInterval returns the minimum interval between successful syncs; zero means no limit.
+func (c *Config) minInterval() time.Duration {
+	d, _ := time.ParseDuration(c.MinInterval)
+	return d
+}
+
+// qualifiedDataset returns the name of Dataset to use in queries. Unqualified names are resolved in the
+// project jobs run in, so with a separate BillingProject it's qualified with the project hosting it.
+func (c *Config) qualifiedDataset() string {
+	p := c.Project
+	if c.datasetProject != "" {
+		p = c.datasetProject
+	}
+	if c.BillingProject == "" || c.BillingProject == p {
+		return c.Dataset
+	}
+	return p + "." + c.Dataset
+}
+
+// now returns the current time according to c.clock.
+func (c *Config) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// backfillRange returns whether a date range to backfill has been configured.
+func (c *Config) backfillRange() bool {
+	return c.BackfillStart != ""
+}
+
+// fastPath returns whether SLOs that have already been backfilled should only get recent days synced.
+func (c *Config) fastPath() bool {
+	return c.FastPathDays > 0 && !c.backfillRange()
+}
+
+// periodToDate returns whether period-to-date rows should be written for calendar-period SLOs.
+func (c *Config) periodToDate() bool {
+	return c.PeriodToDate && !c.backfillRange() && !c.replay()
+}
+
+// prune returns whether rows older than RetentionDays should be deleted after a successful sync.
+func (c *Config) prune() bool {
+	return c.RetentionDays > 0 && !c.backfillRange() && !c.replay() && !c.DryRun
+}
+
+// replay returns whether only the cells listed in Replay should be synced.
+func (c *Config) replay() bool {
+	return len(c.Replay) > 0
+}
+
+// replayCells returns cells of a given project, with Project set.
+func (c *Config) replayCells(project string) []ReplayCell {
+	var cells []ReplayCell
+	for _, cell := range c.Replay {
+		if cell.Project == "" {
+			cell.Project = c.Project
+		}
+		if cell.Project == project {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+// metricsProject returns the project to read time series matching SLI filters from.
+func (c *Config) metricsProject() string {
+	if c.MetricsProject != "" {
+		return c.MetricsProject
+	}
+	return c.Project
+}
+
+// hourly returns whether hourly rows should be synced instead of daily ones.
+func (c *Config) hourly() bool {
+	return c.Granularity == granularityHourly
+}
+
+// projects returns the list of projects to sync SLO data from.
+func (c *Config) projects() []string {
+	if c.replay() {
+		var projects []string
+		seen := make(map[string]bool)
+		for _, cell := range c.Replay {
+			p := cell.Project
+			if p == "" {
+				p = c.Project
+			}
+			if !seen[p] {
+				seen[p] = true
+				projects = append(projects, p)
+			}
+		}
+		return projects
+	}
+	if len(c.Projects) > 0 {
+		return c.Projects
+	}
+	return []string{c.Project}
+}
+
+// aggregation returns the aligner and reducer to use for time series matching a given filter.
+// Config is expected to be validated.
+func (c *Config) aggregation(filter string) (monitoringpb.Aggregation_Aligner, monitoringpb.Aggregation_Reducer) {
+	aligner, reducer := monitoringpb.Aggregation_ALIGN_DELTA, monitoringpb.Aggregation_REDUCE_SUM
+	if a, ok := c.Aggregations[filter]; ok {
+		if a.Rate {
+			aligner = monitoringpb.Aggregation_ALIGN_MEAN
+		}
+		if v, ok := monitoringpb.Aggregation_Aligner_value[a.Aligner]; ok {
+			aligner = monitoringpb.Aggregation_Aligner(v)
+		}
+		if v, ok := monitoringpb.Aggregation_Reducer_value[a.Reducer]; ok {
+			reducer = monitoringpb.Aggregation_Reducer(v)
+		}
+	}
+	return aligner, reducer
+}
+
+// rate returns whether time series matching a given filter report per-second rates, see Aggregation.Rate.
+func (c *Config) rate(filter string) bool {
+	return c.Aggregations[filter].Rate
+}
+
+// table returns the name of the table storing SLO data.
+func (c *Config) table() string {
+	if c.Table == "" {
+		return defaultTableName
+	}
+	return c.Table
+}
+
+// shardTable returns the name of the table storing rows of a given date (formatted as YYYY-MM-DD): the
+// table of the date if ShardByDate is set, and the single data table otherwise.
+func (c *Config) shardTable(date string) string {
+	if !c.ShardByDate {
+		return c.table()
+	}
+	return c.table() + "_" + strings.Replace(date, "-", "", -1)
+}
+
+// clientOptions returns options used to create all API clients.
+func (c *Config) clientOptions() []option.ClientOption {
+	if c.CredentialsFile == "" {
+		return nil
+	}
+	return []option.ClientOption{option.WithCredentialsFile(c.CredentialsFile)}
+}
+
+// backfillDays returns the number of days to backfill.
+func (c *Config) backfillDays() int {
+	if c.BackfillDays == 0 {
+		return maxBackfillDays
+	}
+	return c.BackfillDays
+}
+
+// subIntervals returns the number of sub-intervals each interval is split into when counting events.
+func (c *Config) subIntervals() int {
+	if c.SubIntervals == 0 {
+		return 1
+	}
+	return c.SubIntervals
+}
+
+// concurrency returns the maximum number of concurrent Stackdriver queries.
+func (c *Config) concurrency() int {
+	if c.Concurrency == 0 {
+		return defaultConcurrency
+	}
+	return c.Concurrency
 }
 
 // PubSubMessage is the message received from pubsub. Payload (`Data` field) should be a JSON-serialized Config message.
@@ -40,39 +732,404 @@ type PubSubMessage struct {
 	Data []byte `json:"data"`
 }
 
+// parseConfig parses a JSON-serialized Config message. Unknown fields are rejected, so that misspelled
+// names fail the sync instead of leaving fields unset.
+func parseConfig(data []byte) (Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("invalid Config message: %v", err)
+	}
+	if dec.More() {
+		return cfg, fmt.Errorf("invalid Config message: unexpected data after the Config object")
+	}
+	return cfg, nil
+}
+
 // SyncSloPerformance is the exported function triggered via a pubsub queue.
 func SyncSloPerformance(ctx context.Context, m PubSubMessage) error {
-	var cfg Config
-	if err := json.Unmarshal(m.Data, &cfg); err != nil {
+	cfg, err := parseConfig(m.Data)
+	if err != nil {
+		return err
+	}
+	// The Cloud Functions runtime sets GCP_PROJECT to the project the function runs in.
+	if cfg.Project == "" {
+		cfg.Project = os.Getenv("GCP_PROJECT")
+	}
+	var res *SyncResult
+	err = configFromDatasetLabels(ctx, &cfg)
+	if err == nil {
+		res, err = runSync(ctx, &cfg)
+	}
+	if res != nil {
+		if j, err := json.Marshal(res); err == nil {
+			logEntry(&cfg, severityInfo, logFields{"result": res}, "Sync result: %s", j)
+		}
+	}
+	notifySync(ctx, &cfg, res, err)
+	return err
+}
+
+// BackfillSloPerformance is the exported function recomputing SLO data for a date range, which is expected
+// to be set in the Config message as BackfillStart and BackfillEnd. It can be triggered via a pubsub queue.
+func BackfillSloPerformance(ctx context.Context, m PubSubMessage) error {
+	cfg, err := parseConfig(m.Data)
+	if err != nil {
 		return err
 	}
-	log.Printf("Got configuration: %+v", cfg)
+	if cfg.BackfillStart == "" || cfg.BackfillEnd == "" {
+		return fmt.Errorf("BackfillStart and BackfillEnd are required")
+	}
+	return SyncSloPerformance(ctx, m)
+}
 
-	bq, err := clients.NewBQClient(ctx, cfg.Project)
+// ReplaySloPerformance is the exported function recomputing a list of SLO and date cells, which is expected
+// to be set in the Config message as Replay. It can be triggered via a pubsub queue.
+func ReplaySloPerformance(ctx context.Context, m PubSubMessage) error {
+	cfg, err := parseConfig(m.Data)
 	if err != nil {
 		return err
 	}
+	if len(cfg.Replay) == 0 {
+		return fmt.Errorf("Replay is required")
+	}
+	return SyncSloPerformance(ctx, m)
+}
+
+// SyncSloPerformanceHTTP is the exported function triggered via HTTP. Configuration is expected either as
+// a JSON-serialized Config message in the request body, or as query parameters named after Config fields.
+// A JSON-serialized SyncResult is returned on success.
+func SyncSloPerformanceHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg, err := configFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &httpResponse{Error: err.Error()})
+		return
+	}
+	if err := configFromDatasetLabels(r.Context(), cfg); err != nil {
+		writeJSON(w, http.StatusInternalServerError, &httpResponse{Error: err.Error()})
+		return
+	}
+
+	res, err := runSync(r.Context(), cfg)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &httpResponse{SyncResult: res, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &httpResponse{SyncResult: res})
+}
+
+// httpResponse is the response returned by SyncSloPerformanceHTTP.
+type httpResponse struct {
+	*SyncResult
+	Error string `json:",omitempty"`
+}
+
+// configFromRequest parses Config from an HTTP request.
+func configFromRequest(r *http.Request) (*Config, error) {
+	var cfg Config
+	if r.Body != nil && r.ContentLength != 0 {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not parse request body: %v", err)
+		}
+		if cfg.CredentialsFile != "" {
+			return nil, fmt.Errorf("CredentialsFile can not be set in HTTP requests")
+		}
+		if cfg.ExistingDataFile != "" {
+			return nil, fmt.Errorf("ExistingDataFile can not be set in HTTP requests")
+		}
+		if cfg.WebhookURL != "" {
+			return nil, fmt.Errorf("WebhookURL can not be set in HTTP requests")
+		}
+	}
+
+	q := r.URL.Query()
+	for name, dst := range map[string]*string{"Project": &cfg.Project, "MetricsProject": &cfg.MetricsProject, "BillingProject": &cfg.BillingProject, "Dataset": &cfg.Dataset, "Table": &cfg.Table, "Location": &cfg.Location, "TimeZone": &cfg.TimeZone,
+		"Granularity": &cfg.Granularity, "PreferSLIType": &cfg.PreferSLIType, "EmptyDayCompliance": &cfg.EmptyDayCompliance, "LogFormat": &cfg.LogFormat, "SelfMetricsPrefix": &cfg.SelfMetricsPrefix, "Timeout": &cfg.Timeout,
+		"MinInterval": &cfg.MinInterval, "BackfillStart": &cfg.BackfillStart, "BackfillEnd": &cfg.BackfillEnd} {
+		if v := q.Get(name); v != "" {
+			*dst = v
+		}
+	}
+	for name, dst := range map[string]*[]string{"Projects": &cfg.Projects,
+		"ServiceInclude": &cfg.ServiceInclude, "ServiceExclude": &cfg.ServiceExclude,
+		"SLOInclude": &cfg.SLOInclude, "SLOExclude": &cfg.SLOExclude, "SLOLabels": &cfg.SLOLabels} {
+		if v := q.Get(name); v != "" {
+			*dst = strings.Split(v, ",")
+		}
+	}
+	if v := q.Get("QPS"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse QPS: %v", err)
+		}
+		cfg.QPS = f
+	}
+	for name, dst := range map[string]*int{"BackfillDays": &cfg.BackfillDays, "FastPathDays": &cfg.FastPathDays, "RetentionDays": &cfg.RetentionDays, "Concurrency": &cfg.Concurrency,
+		"MaxTimeSeries": &cfg.MaxTimeSeries, "SubIntervals": &cfg.SubIntervals} {
+		if v := q.Get(name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse %s: %v", name, err)
+			}
+			*dst = i
+		}
+	}
+	for name, dst := range map[string]*bool{"DryRun": &cfg.DryRun, "RefreshZeroRows": &cfg.RefreshZeroRows, "Force": &cfg.Force,
+		"ContinueOnError": &cfg.ContinueOnError, "SelfMetrics": &cfg.SelfMetrics, "RecordGoalChanges": &cfg.RecordGoalChanges,
+		"SkipEmptyDays": &cfg.SkipEmptyDays, "Cached": &cfg.Cached, "IncludeToday": &cfg.IncludeToday,
+		"CreateDataset": &cfg.CreateDataset, "SkipMalformedExistingRows": &cfg.SkipMalformedExistingRows, "ArchiveDefinitions": &cfg.ArchiveDefinitions,
+		"PeriodToDate": &cfg.PeriodToDate, "FailOnDuplicateNames": &cfg.FailOnDuplicateNames, "ShardByDate": &cfg.ShardByDate,
+		"ComplianceView": &cfg.ComplianceView, "ProbeInactiveSLOs": &cfg.ProbeInactiveSLOs, "NormalizeGoals": &cfg.NormalizeGoals,
+		"RecordRuns": &cfg.RecordRuns, "TombstoneDeletedSLOs": &cfg.TombstoneDeletedSLOs} {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse %s: %v", name, err)
+			}
+			*dst = b
+		}
+	}
+	return &cfg, nil
+}
+
+// writeJSON writes a JSON-serialized value as an HTTP response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Could not write HTTP response: %v", err)
+	}
+}
+
+// runSync is the sync implementation shared by all entry points. It's a variable to allow mocking in tests.
+var runSync = run
+
+// run creates all necessary clients and syncs SLO data to BigQuery.
+func run(ctx context.Context, cfg *Config) (res *SyncResult, err error) {
+	start, parent := cfg.now(), ctx
+	logEntry(cfg, severityInfo, logFields{"config": cfg}, "Got configuration: %+v", cfg)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.DryRun {
+		logEntry(cfg, severityInfo, nil, "Dry run: nothing will be written to BigQuery")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	defer cancel()
+
+	bq, err := clients.NewBQClient(ctx, cfg.Project, cfg.BillingProject, cfg.Location, cfg.clientOptions()...)
+	if err != nil {
+		return nil, err
+	}
 	defer bq.Close()
 
+	if err := ensureDataset(ctx, cfg, bq); err != nil {
+		return nil, err
+	}
+
 	// GCF runtime will kill the function after 9 minutes, so getting a lease for 10 minutes
-	// ensures that at most one instance of the function is executed at any time.
-	l, err := newBqLease(ctx, bq, cfg.Dataset, time.Now().Add(10*time.Minute))
+	// ensures that at most one instance of the function is executed at any time. The lease is
+	// renewed in background in case the sync runs longer (e.g. when running locally), and the
+	// sync is cancelled if the lease gets lost.
+	// Dry runs don't write anything, so they don't need a lease.
+	var lease *bqLease
+	if !cfg.DryRun {
+		skip, err := skipRecentSync(ctx, cfg, bq)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return &SyncResult{RecentlySynced: true}, nil
+		}
+		if cfg.RecordRuns {
+			// Runs are recorded using the parent context, since the sync may have failed by timing out.
+			defer func() { recordRun(parent, cfg, bq, start, res, err) }()
+		}
+		if cfg.Force {
+			if err := BreakLease(ctx, bq, cfg.Dataset); err != nil {
+				return nil, err
+			}
+		}
+		lease, err = newBqLease(ctx, bq, cfg.Dataset, leaseOwner(), cfg.now().Add(leaseDuration))
+		if err != nil {
+			return nil, err
+		}
+		defer lease.Release()
+		ctx = lease.renewInBackground(ctx, leaseDuration, cfg.now)
+
+		// Date-sharded tables are created when rows are written to them.
+		if !cfg.ShardByDate {
+			if err := bq.EnsureTable(ctx, cfg.Dataset, cfg.table()); err != nil {
+				return nil, err
+			}
+			if err := bq.VerifySchema(ctx, cfg.Dataset, cfg.table()); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.ComplianceView {
+			if err := EnsureComplianceView(ctx, cfg, bq); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var gcs clients.GCSClient
+	if cfg.GCSExport != nil {
+		c, err := clients.NewStorageClient(ctx, cfg.clientOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		gcs = c
+	}
+
+	res = &SyncResult{DryRun: cfg.DryRun}
+	for _, p := range cfg.projects() {
+		// Rows of all projects are written into the same table, with Project set to the project being synced.
+		pcfg := *cfg
+		pcfg.Project, pcfg.datasetProject, pcfg.lease = p, cfg.Project, lease
+		if cfg.replay() {
+			pcfg.Replay = cfg.replayCells(p)
+		}
+		r, err := syncProject(ctx, &pcfg, bq, gcs)
+		if r != nil {
+			res.add(r)
+		}
+		if err != nil {
+			return res, fmt.Errorf("error syncing project %s: %v", p, err)
+		}
+	}
+
+	if !cfg.DryRun && !cfg.backfillRange() && !cfg.replay() {
+		if err := recordSuccess(ctx, bq, cfg.Dataset, cfg.now()); err != nil {
+			logEntry(cfg, severityWarning, logFields{"error": err.Error()}, "Could not record successful sync: %v", err)
+		}
+	}
+
+	// Failing to prune does not fail the sync, since the next successful sync prunes the same rows.
+	if err := pruneOldRows(ctx, cfg, bq); err != nil {
+		logEntry(cfg, severityWarning, logFields{"error": err.Error()}, "Could not prune old rows: %v", err)
+	}
+
+	if cfg.SelfMetrics && !cfg.DryRun {
+		// Failing to write metrics does not fail the sync itself; a missing metric should trigger an alert anyway.
+		if err := reportSelfMetrics(ctx, cfg, res, cfg.now().Sub(start)); err != nil {
+			logEntry(cfg, severityWarning, logFields{"error": err.Error()}, "Could not write self metrics: %v", err)
+		}
+	}
+	return res, nil
+}
+
+// ensureDataset checks that cfg.Dataset exists, creating it if cfg.CreateDataset is set (except in dry runs).
+// A missing dataset would otherwise only fail the sync with an opaque "not found" error of the first query.
+func ensureDataset(ctx context.Context, cfg *Config, bq clients.BigQueryClient) error {
+	exists, err := bq.DatasetExists(ctx, cfg.Dataset)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not check whether dataset %s exists: %v", cfg.Dataset, err)
+	}
+	if exists {
+		return nil
+	}
+	if !cfg.CreateDataset || cfg.DryRun {
+		return fmt.Errorf("dataset %s does not exist in project %s; create it (e.g. with `bq mk --dataset %s:%s`) "+
+			"or set CreateDataset to create it automatically", cfg.Dataset, cfg.Project, cfg.Project, cfg.Dataset)
 	}
-	defer l.Close(ctx)
+	logEntry(cfg, severityInfo, logFields{"dataset": cfg.Dataset}, "Creating dataset %s", cfg.Dataset)
+	if err := bq.CreateDataset(ctx, cfg.Dataset); err != nil {
+		return fmt.Errorf("could not create dataset %s: %v", cfg.Dataset, err)
+	}
+	return nil
+}
 
-	h, err := google.DefaultClient(ctx)
+// skipRecentSync returns whether a sync should be skipped because the previous successful sync finished
+// less than cfg.MinInterval ago.
+func skipRecentSync(ctx context.Context, cfg *Config, bq clients.BigQueryClient) (bool, error) {
+	if cfg.minInterval() == 0 || cfg.backfillRange() || cfg.replay() {
+		return false, nil
+	}
+	t, err := lastSuccess(ctx, bq, cfg.Dataset)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if t.IsZero() || cfg.now().Sub(t) >= cfg.minInterval() {
+		return false, nil
 	}
+	logEntry(cfg, severityInfo, logFields{"last_success": t, "min_interval": cfg.MinInterval},
+		"Skipping sync: previous sync finished at %v, less than %v ago", t, cfg.minInterval())
+	return true, nil
+}
 
-	sd, err := clients.NewStackdriverMetricClient(ctx)
+// reportSelfMetrics creates a Stackdriver client and writes metrics describing a sync run.
+func reportSelfMetrics(ctx context.Context, cfg *Config, res *SyncResult, duration time.Duration) error {
+	sd, err := clients.NewStackdriverMetricClient(ctx, 0, 0, cfg.clientOptions()...)
 	if err != nil {
 		return err
 	}
 	defer sd.Close()
+	return writeSelfMetrics(ctx, cfg, sd, res, duration)
+}
 
-	slo := clients.NewStackdriverSLOClient(cfg.Project, h)
-	return syncAllServices(ctx, &cfg, sd, slo, bq)
+// syncProject creates Stackdriver clients for cfg.Project and syncs its SLO data to BigQuery (and Cloud
+// Storage, if gcs is not nil).
+func syncProject(ctx context.Context, cfg *Config, bq clients.BigQueryClient, gcs clients.GCSClient) (*SyncResult, error) {
+	logEntry(cfg, severityInfo, logFields{"project": cfg.Project}, "Syncing project %s", cfg.Project)
+	sd, err := clients.NewStackdriverMetricClient(ctx, cfg.QPS, cfg.MaxTimeSeries, cfg.clientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	defer sd.Close()
+
+	var slo clients.SLOClient
+	if cfg.Cached {
+		// The cached client is shared with later runs, so it's not closed.
+		slo, err = cachedSLOClient(cfg)
+	} else {
+		slo, err = clients.NewStackdriverSLOClientWithCredentials(ctx, cfg.Project, cfg.clientOptions()...)
+		if err == nil {
+			defer slo.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.replay() {
+		return replayCells(ctx, cfg, sd, slo, bq, gcs)
+	}
+	return syncAllServices(ctx, cfg, sd, slo, bq, gcs)
+}
+
+// sloClients holds caching SLO clients for each project and credentials file. They are kept for the
+// lifetime of the process, which in GCF can span several invocations.
+var sloClients = struct {
+	sync.Mutex
+	m map[[2]string]*clients.CachedSLOClient
+}{m: make(map[[2]string]*clients.CachedSLOClient)}
+
+// newCachedSLOClient creates the SLO client wrapped by a cached client. It is a variable to allow mocking.
+var newCachedSLOClient = func(ctx context.Context, cfg *Config) (clients.SLOClient, error) {
+	return clients.NewStackdriverSLOClientWithCredentials(ctx, cfg.Project, cfg.clientOptions()...)
+}
+
+// cachedSLOClient returns a caching SLO client for cfg.Project, creating it if necessary.
+func cachedSLOClient(cfg *Config) (clients.SLOClient, error) {
+	sloClients.Lock()
+	defer sloClients.Unlock()
+	key := [2]string{cfg.Project, cfg.CredentialsFile}
+	if c, ok := sloClients.m[key]; ok {
+		return c, nil
+	}
+	// The HTTP client (and the token source refreshing credentials) keeps the context it has been
+	// created with, so it must not be the context of the current run, which is cancelled when the run
+	// ends while the client is used by later runs.
+	slo, err := newCachedSLOClient(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := clients.NewCachedSLOClient(slo, sloCacheTTL)
+	sloClients.m[key] = c
+	return c, nil
 }
@@ -0,0 +1,585 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/api/option"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"default backfill", Config{}, ""},
+		{"custom backfill", Config{BackfillDays: 7}, ""},
+		{"maximum backfill", Config{BackfillDays: 40}, ""},
+		{"backfill too long", Config{BackfillDays: 41}, "BackfillDays"},
+		{"negative backfill", Config{BackfillDays: -1}, "BackfillDays"},
+		{"fast path", Config{BackfillDays: 7, FastPathDays: 2}, ""},
+		{"fast path too long", Config{FastPathDays: 41}, "FastPathDays"},
+		{"negative fast path", Config{FastPathDays: -1}, "FastPathDays"},
+		{"retention", Config{BackfillDays: 7, RetentionDays: 365}, ""},
+		{"retention within backfill days", Config{BackfillDays: 7, RetentionDays: 7}, "RetentionDays"},
+		{"retention within default backfill days", Config{RetentionDays: 30}, "RetentionDays"},
+		{"negative retention", Config{RetentionDays: -1}, "RetentionDays"},
+		{"custom concurrency", Config{Concurrency: 10}, ""},
+		{"negative concurrency", Config{Concurrency: -1}, "Concurrency"},
+		{"qps limit", Config{QPS: 0.5}, ""},
+		{"negative qps", Config{QPS: -1}, "QPS"},
+		{"negative max time series", Config{MaxTimeSeries: -1}, "MaxTimeSeries"},
+		{"sub-intervals", Config{SubIntervals: 4}, ""},
+		{"negative sub-intervals", Config{SubIntervals: -1}, "SubIntervals"},
+		{"too many sub-intervals", Config{SubIntervals: 97}, "SubIntervals"},
+		{"label ratio", Config{LabelRatios: map[string]LabelRatio{"svc/slo": {Filter: "metric", Label: "code", Bad: []string{"5xx"}}}}, ""},
+		{"label ratio without service", Config{LabelRatios: map[string]LabelRatio{"slo": {Filter: "metric", Label: "code", Bad: []string{"5xx"}}}}, "SERVICE/SLO"},
+		{"label ratio without values", Config{LabelRatios: map[string]LabelRatio{"svc/slo": {Filter: "metric", Label: "code"}}}, "at least one of Good and Bad"},
+		{"sharded", Config{ShardByDate: true}, ""},
+		{"existing data file", Config{ExistingDataFile: "rows.json"}, ""},
+		{"existing data file with template", Config{ExistingDataFile: "rows.json", ExistingDataQueryTemplate: defaultExistingDataQueryTemplate},
+			"ExistingDataFile can not be combined with ExistingDataQueryTemplate"},
+		{"webhook", Config{WebhookURL: "https://hooks.example.com/x", NotifyRecovery: true}, ""},
+		{"webhook not a URL", Config{WebhookURL: "hooks.example.com/x"}, "WebhookURL should be an http or https URL"},
+		{"recovery without webhook", Config{NotifyRecovery: true}, "NotifyRecovery requires WebhookURL"},
+		{"sharded with retention", Config{ShardByDate: true, RetentionDays: 400}, "can not be combined with ShardByDate"},
+		{"slo time zone", Config{SLOTimeZones: map[string]string{"svc/slo": "America/New_York"}}, ""},
+		{"slo time zone without service", Config{SLOTimeZones: map[string]string{"slo": "America/New_York"}}, "SERVICE/SLO"},
+		{"invalid slo time zone", Config{SLOTimeZones: map[string]string{"svc/slo": "Nowhere/Foo"}}, "invalid time zone"},
+		{"label ratio without label", Config{LabelRatios: map[string]LabelRatio{"svc/slo": {Filter: "metric", Good: []string{"2xx"}}}}, "LabelRatios"},
+		{"gcs export", Config{GCSExport: &GCSExport{Bucket: "bucket", Prefix: "slo"}}, ""},
+		{"gcs export without bucket", Config{GCSExport: &GCSExport{Prefix: "slo"}}, "GCSExport.Bucket"},
+		{"daily granularity", Config{Granularity: "daily"}, ""},
+		{"hourly granularity", Config{Granularity: "hourly"}, ""},
+		{"unknown granularity", Config{Granularity: "weekly"}, "Granularity"},
+		{"prefer windows-based SLI", Config{PreferSLIType: "windows"}, ""},
+		{"unknown SLI type", Config{PreferSLIType: "basic"}, "PreferSLIType"},
+		{"empty days skipped", Config{EmptyDayCompliance: "skip", SkipEmptyDays: true}, ""},
+		{"empty days compliant", Config{EmptyDayCompliance: "hundred"}, ""},
+		{"unknown empty day compliance", Config{EmptyDayCompliance: "fifty"}, "EmptyDayCompliance"},
+		{"empty day compliance with skipped days", Config{EmptyDayCompliance: "zero", SkipEmptyDays: true}, "SkipEmptyDays"},
+		{"json logs", Config{LogFormat: "json"}, ""},
+		{"unknown log format", Config{LogFormat: "xml"}, "LogFormat"},
+		{"valid patterns", Config{ServiceInclude: []string{"svc*"}, SLOExclude: []string{"canary-?"}}, ""},
+		{"invalid pattern", Config{SLOExclude: []string{"slo["}}, "SLOExclude"},
+		{"custom timeout", Config{Timeout: "5m"}, ""},
+		{"malformed timeout", Config{Timeout: "5 minutes"}, "Timeout"},
+		{"negative timeout", Config{Timeout: "-5m"}, "Timeout"},
+		{"min interval", Config{MinInterval: "1h"}, ""},
+		{"malformed min interval", Config{MinInterval: "hourly"}, "MinInterval"},
+		{"negative min interval", Config{MinInterval: "-1h"}, "MinInterval"},
+		{"custom table", Config{Table: "data_prod"}, ""},
+		{"invalid table", Config{Table: "data`; DROP TABLE data; --"}, "Table"},
+		{"valid aggregations", Config{Aggregations: map[string]Aggregation{"f1": {Aligner: "ALIGN_MEAN"}, "f2": {Reducer: "REDUCE_MAX"}}}, ""},
+		{"unknown aligner", Config{Aggregations: map[string]Aggregation{"f1": {Aligner: "ALIGN_MEDIAN"}}}, "unknown aligner"},
+		{"unknown reducer", Config{Aggregations: map[string]Aggregation{"f1": {Reducer: "sum"}}}, "unknown reducer"},
+		{"valid query template", Config{ExistingDataQueryTemplate: "SELECT project, service, slo, serviceid, sloid, date, hour, good, total, target, partial FROM `{{.Dataset}}.v`"}, ""},
+		{"query template missing columns", Config{ExistingDataQueryTemplate: "SELECT * FROM `{{.Dataset}}.v`"}, "should select columns"},
+		{"valid rates", Config{Aggregations: map[string]Aggregation{"f1": {Rate: true}, "f2": {Aligner: "ALIGN_RATE", Rate: true}}}, ""},
+		{"rate with delta aligner", Config{Aggregations: map[string]Aggregation{"f1": {Aligner: "ALIGN_DELTA", Rate: true}}}, "ALIGN_MEAN or ALIGN_RATE"},
+		{"valid scales", Config{Scales: map[string]float64{"f1": 1000, "f2": 0.001}}, ""},
+		{"zero scale", Config{Scales: map[string]float64{"f1": 0}}, "Scales should be positive"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConfigProjects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{"single project", Config{Project: "p1"}, []string{"p1"}},
+		{"multiple projects", Config{Project: "p1", Projects: []string{"p2", "p3"}}, []string{"p2", "p3"}},
+		{"replay", Config{Project: "p1", Projects: []string{"p2"}, Replay: []ReplayCell{
+			{Service: "s", SLO: "o", Date: "2015-05-01"}, {Project: "p3", Service: "s", SLO: "o", Date: "2015-05-01"},
+			{Project: "p1", Service: "s", SLO: "o", Date: "2015-05-02"}}}, []string{"p1", "p3"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.projects(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("projects() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigQualifiedDataset(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"no billing project", Config{Project: "app", Dataset: "ds"}, "ds"},
+		{"same billing project", Config{Project: "app", BillingProject: "app", Dataset: "ds"}, "ds"},
+		{"billing project", Config{Project: "app", BillingProject: "analytics", Dataset: "ds"}, "app.ds"},
+		{"synced project", Config{Project: "other", BillingProject: "analytics", Dataset: "ds", datasetProject: "app"}, "app.ds"},
+		{"synced project billed to dataset project", Config{Project: "other", BillingProject: "app", Dataset: "ds", datasetProject: "app"}, "ds"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.qualifiedDataset(); got != tt.want {
+				t.Errorf("qualifiedDataset() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigShardTable(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"single table", Config{}, "data"},
+		{"single custom table", Config{Table: "data_prod"}, "data_prod"},
+		{"sharded", Config{ShardByDate: true}, "data_20150510"},
+		{"sharded custom table", Config{Table: "data_prod", ShardByDate: true}, "data_prod_20150510"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.shardTable("2015-05-10"); got != tt.want {
+				t.Errorf("shardTable() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelRatioFilters(t *testing.T) {
+	const metric = `metric.type="loadbalancing.googleapis.com/https/request_count"`
+	for _, tt := range []struct {
+		name  string
+		ratio LabelRatio
+		want  *clients.GoodTotalRatioSLI
+	}{
+		{"good and bad", LabelRatio{Filter: metric, Label: "metric.label.response_code_class", Good: []string{"200", "300"}, Bad: []string{"500"}},
+			&clients.GoodTotalRatioSLI{
+				Good: metric + ` AND metric.label.response_code_class = one_of("200", "300")`,
+				Bad:  metric + ` AND metric.label.response_code_class = one_of("500")`,
+			}},
+		{"good only", LabelRatio{Filter: metric, Label: "metric.label.response_code_class", Good: []string{"200"}},
+			&clients.GoodTotalRatioSLI{Good: metric + ` AND metric.label.response_code_class = one_of("200")`, Total: metric}},
+		{"bad only", LabelRatio{Filter: metric, Label: "metric.label.cache_result", Bad: []string{"MISS", "ERROR"}},
+			&clients.GoodTotalRatioSLI{Bad: metric + ` AND metric.label.cache_result = one_of("MISS", "ERROR")`, Total: metric}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ratio.filters(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filters() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidateBackfillRange(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	for _, tt := range []struct {
+		name       string
+		start, end string
+		wantErr    string
+	}{
+		{"single day", "2015-05-09", "2015-05-09", ""},
+		{"a week", "2015-05-01", "2015-05-07", ""},
+		{"missing end", "2015-05-01", "", "BackfillEnd"},
+		{"missing start", "", "2015-05-01", "BackfillStart"},
+		{"malformed date", "2015/05/01", "2015-05-07", "BackfillStart"},
+		{"end before start", "2015-05-07", "2015-05-01", "should not be before"},
+		{"today", "2015-05-09", "2015-05-10", "should be in the past"},
+		{"beyond retention", "2015-03-01", "2015-05-01", "within 40 days"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Config{clock: clock, BackfillStart: tt.start, BackfillEnd: tt.end}).validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidateReplay(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	for _, tt := range []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"beyond retention", Config{clock: clock, Replay: []ReplayCell{{Service: "s", SLO: "o", Date: "2015-01-01"}}}, ""},
+		{"missing SLO", Config{clock: clock, Replay: []ReplayCell{{Service: "s", Date: "2015-05-01"}}}, "require Service and SLO"},
+		{"malformed date", Config{clock: clock, Replay: []ReplayCell{{Service: "s", SLO: "o", Date: "2015/05/01"}}}, "could not parse Replay date"},
+		{"today", Config{clock: clock, Replay: []ReplayCell{{Service: "s", SLO: "o", Date: "2015-05-10"}}}, "should be in the past"},
+		{"backfill range", Config{clock: clock, BackfillStart: "2015-05-01", BackfillEnd: "2015-05-01",
+			Replay: []ReplayCell{{Service: "s", SLO: "o", Date: "2015-05-01"}}}, "can not be combined"},
+		{"sharded", Config{clock: clock, ShardByDate: true, Replay: []ReplayCell{{Service: "s", SLO: "o", Date: "2015-05-01"}}}, "ShardByDate"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConfigClientOptions(t *testing.T) {
+	if opts := (&Config{}).clientOptions(); len(opts) != 0 {
+		t.Errorf("expected no client options without CredentialsFile; got %v", opts)
+	}
+	want := []option.ClientOption{option.WithCredentialsFile("/tmp/key.json")}
+	if opts := (&Config{CredentialsFile: "/tmp/key.json"}).clientOptions(); !reflect.DeepEqual(opts, want) {
+		t.Errorf("clientOptions() = %v; want %v", opts, want)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		data    string
+		want    Config
+		wantErr string
+	}{
+		{"valid", `{"Project": "p1", "Dataset": "ds", "Replay": [{"project": "p2", "date": "2015-05-01"}]}`,
+			Config{Project: "p1", Dataset: "ds", Replay: []ReplayCell{{Project: "p2", Date: "2015-05-01"}}}, ""},
+		{"misspelled field", `{"Project": "p1", "Datset": "ds"}`, Config{}, `unknown field "Datset"`},
+		{"misspelled replay field", `{"Project": "p1", "Replay": [{"sloo": "slo1"}]}`, Config{}, `unknown field "sloo"`},
+		{"malformed", `{"Project": `, Config{}, "invalid Config message"},
+		{"trailing data", `{"Project": "p1"} {"Dataset": "ds"}`, Config{}, "unexpected data after the Config object"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseConfig() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfig() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSloPerformanceMisspelledField(t *testing.T) {
+	defer func() { runSync = run }()
+	var called bool
+	runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+		called = true
+		return &SyncResult{}, nil
+	}
+
+	err := SyncSloPerformance(context.Background(), PubSubMessage{Data: []byte(`{"Project": "p1", "Datset": "ds"}`)})
+	if err == nil || !strings.Contains(err.Error(), `unknown field "Datset"`) {
+		t.Errorf("SyncSloPerformance() expected error to contain 'unknown field \"Datset\"'; got %v", err)
+	}
+	if called {
+		t.Errorf("expected sync not to run with a misspelled field")
+	}
+}
+
+func TestReplaySloPerformance(t *testing.T) {
+	defer func() { runSync = run }()
+	var got *Config
+	runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+		got = cfg
+		return &SyncResult{}, nil
+	}
+
+	err := ReplaySloPerformance(context.Background(), PubSubMessage{Data: []byte(`{"Project": "p1"}`)})
+	if err == nil || !strings.Contains(err.Error(), "Replay is required") {
+		t.Errorf("ReplaySloPerformance() expected error to contain 'Replay is required'; got %v", err)
+	}
+	if got != nil {
+		t.Errorf("expected sync not to run without cells to replay")
+	}
+
+	err = ReplaySloPerformance(context.Background(), PubSubMessage{
+		Data: []byte(`{"Project": "p1", "Replay": [{"project": "p2", "service": "svc1", "slo": "slo1", "date": "2015-05-01"}]}`)})
+	if err != nil {
+		t.Fatalf("ReplaySloPerformance() unexpected error: %v", err)
+	}
+	if want := []ReplayCell{{Project: "p2", Service: "svc1", SLO: "slo1", Date: "2015-05-01"}}; got == nil || !reflect.DeepEqual(got.Replay, want) {
+		t.Errorf("expected sync to run with Replay %+v; got %+v", want, got)
+	}
+}
+
+func TestBackfillSloPerformance(t *testing.T) {
+	defer func() { runSync = run }()
+	var called bool
+	runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+		called = true
+		return &SyncResult{}, nil
+	}
+
+	err := BackfillSloPerformance(context.Background(), PubSubMessage{Data: []byte(`{"Project": "p1"}`)})
+	if err == nil || !strings.Contains(err.Error(), "BackfillStart and BackfillEnd are required") {
+		t.Errorf("BackfillSloPerformance() expected error about missing dates; got %v", err)
+	}
+	if called {
+		t.Errorf("expected sync not to run without a date range")
+	}
+
+	err = BackfillSloPerformance(context.Background(), PubSubMessage{
+		Data: []byte(`{"Project": "p1", "BackfillStart": "2015-05-01", "BackfillEnd": "2015-05-02"}`)})
+	if err != nil || !called {
+		t.Errorf("BackfillSloPerformance() expected sync to run; got %v", err)
+	}
+}
+
+func TestEnsureDataset(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		cfg        Config
+		exists     bool
+		existsErr  error
+		wantCreate bool
+		createErr  error
+		wantErr    string
+	}{
+		{"exists", Config{}, true, nil, false, nil, ""},
+		{"exists, create enabled", Config{CreateDataset: true}, true, nil, false, nil, ""},
+		{"missing", Config{}, false, nil, false, nil, "dataset dsname does not exist in project p1; create it (e.g. with `bq mk --dataset p1:dsname`)"},
+		{"missing, created", Config{CreateDataset: true}, false, nil, true, nil, ""},
+		{"missing, create fails", Config{CreateDataset: true}, false, nil, true, fmt.Errorf("access denied"), "could not create dataset dsname: access denied"},
+		{"missing, dry run", Config{CreateDataset: true, DryRun: true}, false, nil, false, nil, "does not exist"},
+		{"check fails", Config{CreateDataset: true}, false, fmt.Errorf("error1"), false, nil, "could not check whether dataset dsname exists: error1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().DatasetExists(gomock.Any(), "dsname").Return(tt.exists, tt.existsErr)
+			if tt.wantCreate {
+				bq.EXPECT().CreateDataset(gomock.Any(), "dsname").Return(tt.createErr)
+			}
+			cfg := tt.cfg
+			cfg.Project, cfg.Dataset = "p1", "dsname"
+			err := ensureDataset(context.Background(), &cfg, bq)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("ensureDataset() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("ensureDataset() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSkipRecentSync(t *testing.T) {
+	clock := fixedClock(time.Unix(100000, 0))
+	for _, tt := range []struct {
+		name        string
+		cfg         Config
+		lastSuccess string
+		readErr     error
+		wantRead    bool
+		wantSkip    bool
+		wantErr     string
+	}{
+		{"no min interval", Config{clock: clock}, "", nil, false, false, ""},
+		{"never succeeded", Config{clock: clock, MinInterval: "1h"}, "", nil, true, false, ""},
+		{"recent success", Config{clock: clock, MinInterval: "1h"}, "99000", nil, true, true, ""},
+		{"old success", Config{clock: clock, MinInterval: "1h"}, "96400", nil, true, false, ""},
+		{"backfill range", Config{clock: clock, MinInterval: "1h", BackfillStart: "2015-01-01"}, "99000", nil, false, false, ""},
+		{"bogus label", Config{clock: clock, MinInterval: "1h"}, "bogus", nil, true, false, "Could not parse last success time"},
+		{"reading metadata returns error", Config{clock: clock, MinInterval: "1h"}, "", fmt.Errorf("error1"), true, false, "error1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			if tt.wantRead {
+				bq.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "dsname", lastSuccessLabelName).Return(tt.lastSuccess, "etag1", tt.readErr)
+			}
+			cfg := tt.cfg
+			cfg.Dataset = "dsname"
+			skip, err := skipRecentSync(context.Background(), &cfg, bq)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("skipRecentSync() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("skipRecentSync() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+			if skip != tt.wantSkip {
+				t.Errorf("skipRecentSync() = %v; want %v", skip, tt.wantSkip)
+			}
+		})
+	}
+}
+
+func TestConfigTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		timeout string
+		want    time.Duration
+	}{
+		{"", defaultTimeout},
+		{"90s", 90 * time.Second},
+	} {
+		cfg := &Config{Timeout: tt.timeout}
+		if got := cfg.timeout(); got != tt.want {
+			t.Errorf("timeout() for %q = %v; want %v", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestCachedSLOClientOutlivesRun(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	defer func(f func(context.Context, *Config) (clients.SLOClient, error)) { newCachedSLOClient = f }(newCachedSLOClient)
+	cfg := &Config{Project: "cached-project", CredentialsFile: "/tmp/key.json"}
+	defer func() {
+		sloClients.Lock()
+		delete(sloClients.m, [2]string{cfg.Project, cfg.CredentialsFile})
+		sloClients.Unlock()
+	}()
+	// Like an HTTP client refreshing credentials, the mock fails once the context it has been created
+	// with is cancelled.
+	created := 0
+	newCachedSLOClient = func(ctx context.Context, cfg *Config) (clients.SLOClient, error) {
+		created++
+		slo := mocks.NewMockSLOClient(mockCtrl)
+		slo.EXPECT().SLOs(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, *clients.Service) ([]*clients.SLO, error) {
+			return nil, ctx.Err()
+		}).AnyTimes()
+		return slo, nil
+	}
+
+	for run := 1; run <= 2; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		slo, err := cachedSLOClient(cfg)
+		if err != nil {
+			t.Fatalf("cachedSLOClient() unexpected error in run %d: %v", run, err)
+		}
+		// A different service in each run, so that SLOs are not served from the cache.
+		_, err = slo.SLOs(ctx, &clients.Service{Name: fmt.Sprintf("service%d", run)})
+		cancel()
+		if err != nil {
+			t.Errorf("SLOs() unexpected error in run %d: %v", run, err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("cachedSLOClient() created %d clients; want 1", created)
+	}
+}
+
+func TestSyncSloPerformanceHTTP(t *testing.T) {
+	defer func() { runSync = run }()
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { datasetLabelsBQClient = f }(datasetLabelsBQClient)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	// Datasets have no labels, so fields are not changed.
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return("", "etag", nil)
+	bq.EXPECT().Close().AnyTimes()
+	datasetLabelsBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) { return bq, nil }
+	for _, tt := range []struct {
+		name       string
+		url        string
+		body       string
+		syncErr    error
+		wantCfg    *Config
+		wantStatus int
+		wantResp   httpResponse
+	}{
+		{"config in body", "/", `{"Project": "p1", "Dataset": "ds1", "TimeZone": "UTC"}`, nil,
+			&Config{Project: "p1", Dataset: "ds1", TimeZone: "UTC"}, http.StatusOK,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}}},
+		{"config in query", "/?Project=p1&Dataset=ds1&TimeZone=UTC&BackfillDays=3&FastPathDays=1&RetentionDays=90", "", nil,
+			&Config{Project: "p1", Dataset: "ds1", TimeZone: "UTC", BackfillDays: 3, FastPathDays: 1, RetentionDays: 90}, http.StatusOK,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}}},
+		{"dry run in query", "/?Project=p1&DryRun=true", "", nil,
+			&Config{Project: "p1", DryRun: true}, http.StatusOK,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}}},
+		{"filters in query", "/?Project=p1&ServiceInclude=svc1,svc2&SLOExclude=canary*&SLOLabels=team", "", nil,
+			&Config{Project: "p1", ServiceInclude: []string{"svc1", "svc2"}, SLOExclude: []string{"canary*"}, SLOLabels: []string{"team"}}, http.StatusOK,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}}},
+		{"force in query", "/?Project=p1&Force=1", "", nil,
+			&Config{Project: "p1", Force: true}, http.StatusOK,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}}},
+		{"projects in query", "/?Project=p1&Projects=p2,p3", "", nil,
+			&Config{Project: "p1", Projects: []string{"p2", "p3"}}, http.StatusOK,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}}},
+		{"query overrides body", "/?Dataset=ds2", `{"Project": "p1", "Dataset": "ds1"}`, nil,
+			&Config{Project: "p1", Dataset: "ds2"}, http.StatusOK,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}}},
+		{"malformed body", "/", `{"Project": `, nil, nil, http.StatusBadRequest,
+			httpResponse{Error: "could not parse request body: unexpected EOF"}},
+		{"misspelled field in body", "/", `{"Project": "p1", "Datset": "ds1"}`, nil, nil, http.StatusBadRequest,
+			httpResponse{Error: `could not parse request body: json: unknown field "Datset"`}},
+		{"credentials file in body", "/", `{"Project": "p1", "CredentialsFile": "/etc/passwd"}`, nil, nil, http.StatusBadRequest,
+			httpResponse{Error: "CredentialsFile can not be set in HTTP requests"}},
+		{"existing data file in body", "/", `{"Project": "p1", "ExistingDataFile": "/etc/passwd"}`, nil, nil, http.StatusBadRequest,
+			httpResponse{Error: "ExistingDataFile can not be set in HTTP requests"}},
+		{"webhook in body", "/", `{"Project": "p1", "WebhookURL": "http://169.254.169.254/"}`, nil, nil, http.StatusBadRequest,
+			httpResponse{Error: "WebhookURL can not be set in HTTP requests"}},
+		{"malformed query", "/?BackfillDays=many", "", nil, nil, http.StatusBadRequest,
+			httpResponse{Error: `could not parse BackfillDays: strconv.Atoi: parsing "many": invalid syntax`}},
+		{"sync error", "/", `{"Project": "p1"}`, fmt.Errorf("myerror"), &Config{Project: "p1"}, http.StatusInternalServerError,
+			httpResponse{SyncResult: &SyncResult{SLOsProcessed: 2, RowsWritten: 10}, Error: "myerror"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotCfg *Config
+			runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+				gotCfg = cfg
+				return &SyncResult{SLOsProcessed: 2, RowsWritten: 10}, tt.syncErr
+			}
+
+			w := httptest.NewRecorder()
+			SyncSloPerformanceHTTP(w, httptest.NewRequest("POST", tt.url, strings.NewReader(tt.body)))
+
+			if !reflect.DeepEqual(gotCfg, tt.wantCfg) {
+				t.Errorf("expected sync to be called with %+v; got %+v", tt.wantCfg, gotCfg)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d; got %d", tt.wantStatus, w.Code)
+			}
+			var resp httpResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if !reflect.DeepEqual(resp, tt.wantResp) {
+				t.Errorf("expected response %+v; got %+v", tt.wantResp, resp)
+			}
+		})
+	}
+}
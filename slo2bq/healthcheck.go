@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"slo2bq/clients"
+)
+
+// healthcheckServices returns the first page of services of a project, as listed by Healthcheck. It's a
+// variable to allow mocking in tests.
+var healthcheckServices = func(ctx context.Context, cfg *Config, project string) ([]*clients.Service, error) {
+	c, err := clients.NewStackdriverSLOClientWithCredentials(ctx, project, cfg.clientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.FirstServices(ctx)
+}
+
+// healthcheckBQClient creates the BigQuery client used by Healthcheck. It's a variable to allow mocking in tests.
+var healthcheckBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) {
+	return clients.NewBQClient(ctx, cfg.Project, cfg.BillingProject, cfg.Location, cfg.clientOptions()...)
+}
+
+// HealthcheckResult describes which checks run by Healthcheck passed.
+type HealthcheckResult struct {
+	Checks []*HealthcheckCheck
+}
+
+// HealthcheckCheck is the outcome of a single check.
+type HealthcheckCheck struct {
+	// Name describes what has been checked, e.g. "monitoring:my-project" or "bigquery-query".
+	Name string
+	// Error is empty if the check passed.
+	Error string `json:",omitempty"`
+}
+
+// OK returns whether all checks passed.
+func (r *HealthcheckResult) OK() bool {
+	for _, c := range r.Checks {
+		if c.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// add records the outcome of a check.
+func (r *HealthcheckResult) add(name string, err error) {
+	c := &HealthcheckCheck{Name: name}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// Healthcheck checks that Service Monitoring and BigQuery can be accessed with the configured credentials,
+// without writing anything: it lists a page of services of every configured project, runs a trivial query
+// and reads metadata of the dataset. Failed checks are reported in the result; an error is only returned
+// for an invalid configuration.
+func Healthcheck(ctx context.Context, cfg *Config) (*HealthcheckResult, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Project == "" || cfg.Dataset == "" {
+		return nil, fmt.Errorf("Project and Dataset are required")
+	}
+	res := &HealthcheckResult{}
+	for _, p := range cfg.projects() {
+		_, err := healthcheckServices(ctx, cfg, p)
+		res.add("monitoring:"+p, err)
+	}
+
+	bq, err := healthcheckBQClient(ctx, cfg)
+	if err != nil {
+		res.add("bigquery-client", err)
+		return res, nil
+	}
+	defer bq.Close()
+	_, err = bq.Query(ctx, "SELECT 1")
+	res.add("bigquery-query", err)
+	exists, err := bq.DatasetExists(ctx, cfg.Dataset)
+	// Missing datasets are created by syncs if CreateDataset is set.
+	if err == nil && !exists && !cfg.CreateDataset {
+		err = fmt.Errorf("dataset %s does not exist", cfg.Dataset)
+	}
+	res.add("bigquery-dataset:"+cfg.Dataset, err)
+	return res, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestHealthcheck(t *testing.T) {
+	defer func(f func(context.Context, *Config, string) ([]*clients.Service, error)) { healthcheckServices = f }(healthcheckServices)
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { healthcheckBQClient = f }(healthcheckBQClient)
+	denied := fmt.Errorf("googleapi: Error 403: Permission denied")
+
+	for _, tt := range []struct {
+		name string
+		cfg  *Config
+		// deniedProject is a project services can't be listed of.
+		deniedProject string
+		queryErr      error
+		exists        bool
+		want          []*HealthcheckCheck
+	}{
+		{"all pass", &Config{Project: "p1", Dataset: "ds"}, "", nil, true, []*HealthcheckCheck{
+			{Name: "monitoring:p1"}, {Name: "bigquery-query"}, {Name: "bigquery-dataset:ds"}}},
+		{"monitoring denied", &Config{Project: "p1", Projects: []string{"p1", "p2"}, Dataset: "ds"}, "p2", nil, true, []*HealthcheckCheck{
+			{Name: "monitoring:p1"}, {Name: "monitoring:p2", Error: denied.Error()}, {Name: "bigquery-query"}, {Name: "bigquery-dataset:ds"}}},
+		{"query denied", &Config{Project: "p1", Dataset: "ds"}, "", denied, true, []*HealthcheckCheck{
+			{Name: "monitoring:p1"}, {Name: "bigquery-query", Error: denied.Error()}, {Name: "bigquery-dataset:ds"}}},
+		{"missing dataset", &Config{Project: "p1", Dataset: "ds"}, "", nil, false, []*HealthcheckCheck{
+			{Name: "monitoring:p1"}, {Name: "bigquery-query"}, {Name: "bigquery-dataset:ds", Error: "dataset ds does not exist"}}},
+		{"missing dataset created by sync", &Config{Project: "p1", Dataset: "ds", CreateDataset: true}, "", nil, false, []*HealthcheckCheck{
+			{Name: "monitoring:p1"}, {Name: "bigquery-query"}, {Name: "bigquery-dataset:ds"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			// Nothing but the query and dataset metadata should be accessed.
+			bq.EXPECT().Query(gomock.Any(), "SELECT 1").Return(nil, tt.queryErr)
+			bq.EXPECT().DatasetExists(gomock.Any(), "ds").Return(tt.exists, nil)
+			bq.EXPECT().Close().Return(nil)
+			healthcheckBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) {
+				return bq, nil
+			}
+			healthcheckServices = func(ctx context.Context, cfg *Config, project string) ([]*clients.Service, error) {
+				if project == tt.deniedProject {
+					return nil, denied
+				}
+				return []*clients.Service{&clients.Service{Name: "projects/" + project + "/services/svc1"}}, nil
+			}
+
+			res, err := Healthcheck(context.Background(), tt.cfg)
+			if err != nil {
+				t.Fatalf("Healthcheck() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(res.Checks, tt.want) {
+				t.Errorf("Healthcheck() = %s; want %s", checkNames(res.Checks), checkNames(tt.want))
+			}
+			wantOK := true
+			for _, c := range tt.want {
+				wantOK = wantOK && c.Error == ""
+			}
+			if res.OK() != wantOK {
+				t.Errorf("OK() = %v; want %v", res.OK(), wantOK)
+			}
+		})
+	}
+}
+
+func TestHealthcheckErrors(t *testing.T) {
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { healthcheckBQClient = f }(healthcheckBQClient)
+	defer func(f func(context.Context, *Config, string) ([]*clients.Service, error)) { healthcheckServices = f }(healthcheckServices)
+	healthcheckServices = func(ctx context.Context, cfg *Config, project string) ([]*clients.Service, error) {
+		return nil, nil
+	}
+	healthcheckBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) {
+		return nil, fmt.Errorf("could not find default credentials")
+	}
+
+	// Failing to create the BigQuery client skips the other BigQuery checks.
+	res, err := Healthcheck(context.Background(), &Config{Project: "p1", Dataset: "ds"})
+	if err != nil {
+		t.Fatalf("Healthcheck() unexpected error: %v", err)
+	}
+	want := []*HealthcheckCheck{{Name: "monitoring:p1"}, {Name: "bigquery-client", Error: "could not find default credentials"}}
+	if !reflect.DeepEqual(res.Checks, want) || res.OK() {
+		t.Errorf("Healthcheck() = %s; want %s", checkNames(res.Checks), checkNames(want))
+	}
+
+	if _, err := Healthcheck(context.Background(), &Config{Project: "p1"}); err == nil || !strings.Contains(err.Error(), "Dataset") {
+		t.Errorf("Healthcheck() expected error to contain 'Dataset'; got %v", err)
+	}
+}
+
+// checkNames formats healthcheck results for test failure messages.
+func checkNames(checks []*HealthcheckCheck) string {
+	var s []string
+	for _, c := range checks {
+		s = append(s, fmt.Sprintf("%s=%q", c.Name, c.Error))
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slo2bq/clients"
+	"text/tabwriter"
+)
+
+// ListSLOs writes a table of services and SLOs of all configured projects to `w`, without accessing
+// BigQuery. It's meant for debugging permissions and ServiceInclude/SLOInclude filters.
+func ListSLOs(ctx context.Context, cfg *Config, w io.Writer) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tSERVICE\tSLO\tNAME\tGOAL\tSLI\tSYNCED")
+	for _, p := range cfg.projects() {
+		slo, err := clients.NewStackdriverSLOClientWithCredentials(ctx, p, cfg.clientOptions()...)
+		if err != nil {
+			return err
+		}
+		err = listSLOs(ctx, p, cfg, slo, tw)
+		slo.Close()
+		if err != nil {
+			return fmt.Errorf("error listing SLOs of project %s: %v", p, err)
+		}
+	}
+	return tw.Flush()
+}
+
+// listSLOs writes a tab-separated line for each SLO of a project (or service, if it has no SLOs) to `w`.
+func listSLOs(ctx context.Context, project string, cfg *Config, sloc clients.SLOClient, w io.Writer) error {
+	svcs, err := sloc.Services(ctx)
+	if err != nil {
+		return err
+	}
+	for _, svc := range svcs {
+		if !nameMatches(svc.HumanName(), cfg.ServiceInclude, cfg.ServiceExclude) {
+			fmt.Fprintf(w, "%s\t%s\t-\t%s\t-\t-\tno (service excluded)\n", project, svc.ID(), svc.HumanName())
+			continue
+		}
+		slos, err := sloc.SLOs(ctx, svc)
+		if err != nil {
+			return err
+		}
+		if len(slos) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t-\t%s\t-\t-\tno (no SLOs)\n", project, svc.ID(), svc.HumanName())
+		}
+		for _, slo := range slos {
+			synced := "yes"
+			if !nameMatches(slo.HumanName(), cfg.SLOInclude, cfg.SLOExclude) {
+				synced = "no (SLO excluded)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\t%s\n", project, svc.ID(), slo.ID(), slo.HumanName(), slo.Goal, sliType(cfg, slo), synced)
+		}
+	}
+	return nil
+}
+
+// sliType returns a short description of the SLI of an SLO, as used by getGoodTotal.
+func sliType(cfg *Config, slo *clients.SLO) string {
+	if _, ok := cfg.LabelRatios[sloKey(slo)]; ok {
+		return "config/labelRatio"
+	}
+	sli := slo.SLI
+	if sli == nil {
+		return "other"
+	}
+	if sli.RequestBasedSLI != nil && (sli.WindowsBasedSLI == nil || cfg.PreferSLIType != sliTypeWindows) {
+		switch {
+		case sli.RequestBasedSLI.GoodTotalRatioSLI != nil:
+			return "request/goodTotalRatio"
+		case sli.RequestBasedSLI.DistributionCut != nil:
+			return "request/distributionCut"
+		case sli.RequestBasedSLI.TimeSeriesQuery != nil:
+			return "request/timeSeriesQuery"
+		}
+		return "request/other"
+	}
+	if sli.WindowsBasedSLI != nil {
+		return "windows"
+	}
+	return "other"
+}
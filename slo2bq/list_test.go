@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestListSLOs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	svc1 := &clients.Service{Name: "projects/p/services/svc1", DisplayName: "Frontend"}
+	svc2 := &clients.Service{Name: "projects/p/services/svc2"}
+	svc3 := &clients.Service{Name: "projects/p/services/istio-svc3"}
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{svc1, svc2, svc3}, nil)
+	// SLOs of the excluded service should not be listed.
+	sloc.EXPECT().SLOs(gomock.Any(), svc1).Return([]*clients.SLO{
+		&clients.SLO{Name: svc1.Name + "/serviceLevelObjectives/availability", DisplayName: "99% available", Goal: 0.99,
+			SLI: &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}}}},
+		&clients.SLO{Name: svc1.Name + "/serviceLevelObjectives/latency", Goal: 0.95,
+			SLI: &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{DistributionCut: &clients.DistributionCut{DistributionFilter: "latency"}}}},
+		&clients.SLO{Name: svc1.Name + "/serviceLevelObjectives/canary-windows", Goal: 0.9,
+			SLI: &clients.SLI{WindowsBasedSLI: &clients.WindowsBasedSLI{WindowPeriod: "300s"}}},
+	}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), svc2).Return(nil, nil)
+
+	cfg := &Config{ServiceExclude: []string{"istio-*"}, SLOExclude: []string{"canary-*"}}
+	var b bytes.Buffer
+	if err := listSLOs(context.Background(), "p", cfg, sloc, &b); err != nil {
+		t.Fatalf("listSLOs() unexpected error: %v", err)
+	}
+	want := []string{
+		"p\tsvc1\tavailability\t99% available\t0.99\trequest/goodTotalRatio\tyes",
+		"p\tsvc1\tlatency\tlatency\t0.95\trequest/distributionCut\tyes",
+		"p\tsvc1\tcanary-windows\tcanary-windows\t0.9\twindows\tno (SLO excluded)",
+		"p\tsvc2\t-\tsvc2\t-\t-\tno (no SLOs)",
+		"p\tistio-svc3\t-\tistio-svc3\t-\t-\tno (service excluded)",
+	}
+	if got, want := b.String(), strings.Join(want, "\n")+"\n"; got != want {
+		t.Errorf("listSLOs() output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestListSLOsError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return(nil, fmt.Errorf("permission denied"))
+
+	var b bytes.Buffer
+	if err := listSLOs(context.Background(), "p", &Config{}, sloc, &b); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("listSLOs() expected error to contain 'permission denied'; got %v", err)
+	}
+}
+
+func TestSLIType(t *testing.T) {
+	both := &clients.SLI{
+		RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}},
+		WindowsBasedSLI: &clients.WindowsBasedSLI{WindowPeriod: "300s"},
+	}
+	for _, tt := range []struct {
+		name   string
+		sli    *clients.SLI
+		prefer string
+		want   string
+	}{
+		{"no SLI", nil, "", "other"},
+		{"request-based without details", &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{}}, "", "request/other"},
+		{"both, default", both, "", "request/goodTotalRatio"},
+		{"mql", &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{
+			TimeSeriesQuery: &clients.TimeSeriesQueryRatio{Good: "fetch good", Total: "fetch total"}}}, "", "request/timeSeriesQuery"},
+		{"both, prefer windows", both, "windows", "windows"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sliType(&Config{PreferSLIType: tt.prefer}, &clients.SLO{SLI: tt.sli}); got != tt.want {
+				t.Errorf("sliType() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSLITypeLabelRatio(t *testing.T) {
+	cfg := &Config{LabelRatios: map[string]LabelRatio{"svc1/slo1": {Filter: "metric", Label: "code", Good: []string{"2xx"}}}}
+	slo := &clients.SLO{Name: "projects/p/services/svc1/serviceLevelObjectives/slo1",
+		SLI: &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}}}}
+	if got, want := sliType(cfg, slo), "config/labelRatio"; got != want {
+		t.Errorf("sliType() = %q; want %q", got, want)
+	}
+}
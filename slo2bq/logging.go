@@ -0,0 +1,71 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Supported values of Config.LogFormat.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Severities of log entries, as defined by Cloud Logging.
+const (
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+)
+
+// logFields are structured data attached to a log entry.
+type logFields map[string]interface{}
+
+// logOutput is where JSON log entries are written. It's a variable to allow capturing output in tests.
+var logOutput io.Writer = os.Stderr
+
+// logMu serializes writes to logOutput, since entries are logged concurrently by fillRecords.
+var logMu sync.Mutex
+
+// logEntry logs a message formatted according to cfg.LogFormat. Text entries are written using the standard
+// logger and only contain the message, so all fields are expected to be mentioned in it as well. JSON entries
+// are written to logOutput as a single line with the message, severity and fields, which Cloud Logging
+// turns into a structured log entry.
+func logEntry(cfg *Config, severity string, fields logFields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if cfg.LogFormat != logFormatJSON {
+		log.Print(msg)
+		return
+	}
+	entry := map[string]interface{}{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["message"] = msg
+	entry["severity"] = severity
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Could not encode log entry %q: %v", msg, err)
+		return
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(b, '\n'))
+}
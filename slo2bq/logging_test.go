@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestLogEntry(t *testing.T) {
+	var out, text bytes.Buffer
+	defer func(w io.Writer) { logOutput = w }(logOutput)
+	logOutput = &out
+	log.SetOutput(&text)
+	defer log.SetOutput(os.Stderr)
+
+	logEntry(&Config{}, severityInfo, logFields{"count": 3}, "Got %d rows", 3)
+	if out.Len() != 0 || !strings.Contains(text.String(), "Got 3 rows") {
+		t.Errorf("expected a text entry; got JSON %q and text %q", out.String(), text.String())
+	}
+
+	text.Reset()
+	logEntry(&Config{LogFormat: "json"}, severityWarning, logFields{"count": 3, "service": "svc1"}, "Got %d rows", 3)
+	if text.Len() != 0 {
+		t.Errorf("expected no text entry; got %q", text.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("could not parse JSON entry %q: %v", out.String(), err)
+	}
+	want := map[string]interface{}{"message": "Got 3 rows", "severity": "WARNING", "count": float64(3), "service": "svc1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected JSON entry %v; got %v", want, got)
+	}
+}
+
+func TestSyncAllServicesJSONLogs(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	var out bytes.Buffer
+	defer func(w io.Writer) { logOutput = w }(logOutput)
+	logOutput = &out
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1, DryRun: true, LogFormat: "json"}
+	if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err != nil {
+		t.Fatalf("syncAllServices() unexpected error: %v", err)
+	}
+
+	// Every line should be a JSON object; entries about records of an SLO should have structured fields.
+	var records, data map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("could not parse JSON entry %q: %v", line, err)
+		}
+		if msg, _ := e["message"].(string); strings.HasPrefix(msg, "Got 1 new records") {
+			records = e
+		} else if strings.HasPrefix(msg, "SLO data for") {
+			data = e
+		}
+	}
+	for _, f := range []string{"service", "slo", "count", "severity"} {
+		if _, ok := records[f]; !ok {
+			t.Errorf("expected field %q in entry %v", f, records)
+		}
+	}
+	for _, f := range []string{"service", "slo", "date", "good", "total"} {
+		if _, ok := data[f]; !ok {
+			t.Errorf("expected field %q in entry %v", f, data)
+		}
+	}
+	if data["date"] != "2015-05-09" {
+		t.Errorf("expected date 2015-05-09 in entry %v", data)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slo2bq/clients"
+	"strconv"
+	"time"
+)
+
+// failingSinceLabelName is the dataset label storing the time (as a Unix timestamp) of the first failed
+// sync since the last successful one. It's only maintained if Config.NotifyRecovery is set.
+const failingSinceLabelName = "slo2bq_failing_since"
+
+// notifyTimeout limits the time spent notifying of the outcome of a sync, so that an unresponsive
+// webhook does not delay the sync itself.
+const notifyTimeout = 30 * time.Second
+
+// Notification describes a failed or recovered sync.
+type Notification struct {
+	// Text is a human-readable description, which is what Slack incoming webhooks display.
+	Text    string `json:"text"`
+	Project string `json:"project"`
+	Dataset string `json:"dataset"`
+	// Error is the error of a failed sync.
+	Error string `json:"error,omitempty"`
+	// Recovered is set for the first successful sync after a failed one.
+	Recovered bool `json:"recovered,omitempty"`
+}
+
+// Notifier sends notifications about syncs, e.g. to a chat channel.
+type Notifier interface {
+	Notify(context.Context, *Notification) error
+}
+
+// WebhookNotifier is a Notifier posting notifications as JSON to a URL, e.g. a Slack incoming webhook.
+type WebhookNotifier struct {
+	URL string
+	// Client is used to send requests; http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// Notify posts a notification to the webhook, and returns an error unless it responds with a 2xx status.
+func (n *WebhookNotifier) Notify(ctx context.Context, notification *Notification) error {
+	b, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// http.NewRequestWithContext is not available in Go 1.11.
+	req = req.WithContext(ctx)
+	c := n.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// newNotifier returns the Notifier configured by cfg, or nil if notifications are disabled. It's a variable
+// to allow mocking in tests.
+var newNotifier = func(cfg *Config) Notifier {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	return &WebhookNotifier{URL: cfg.WebhookURL}
+}
+
+// notifyBQClient creates the BigQuery client used to track failed syncs for Config.NotifyRecovery. It's a
+// variable to allow mocking in tests.
+var notifyBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) {
+	return clients.NewBQClient(ctx, cfg.Project, cfg.BillingProject, cfg.Location, cfg.clientOptions()...)
+}
+
+// notifySync notifies of the outcome of a sync returning a given error. Failures are always notified, and
+// successes only if cfg.NotifyRecovery is set and the previous sync failed. Dry runs are never notified.
+// Notifying does not change the outcome of the sync, so errors are only logged.
+func notifySync(ctx context.Context, cfg *Config, res *SyncResult, syncErr error) {
+	n := newNotifier(cfg)
+	if n == nil || cfg.DryRun || (syncErr == nil && (!cfg.NotifyRecovery || res == nil || res.RecentlySynced)) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	var notification *Notification
+	var err error
+	if syncErr != nil {
+		notification = &Notification{Project: cfg.Project, Dataset: cfg.Dataset, Error: syncErr.Error(),
+			Text: fmt.Sprintf("SLO sync of project %s to dataset %s failed: %v", cfg.Project, cfg.Dataset, syncErr)}
+		if cfg.NotifyRecovery {
+			err = recordFailing(ctx, cfg)
+		}
+	} else {
+		notification, err = recoveryNotification(ctx, cfg)
+	}
+	if err != nil {
+		logEntry(cfg, severityWarning, logFields{"error": err.Error()}, "Could not track failed syncs: %v", err)
+	}
+	if notification == nil {
+		return
+	}
+	if err := n.Notify(ctx, notification); err != nil {
+		logEntry(cfg, severityWarning, logFields{"error": err.Error()}, "Could not send notification: %v", err)
+	}
+}
+
+// recordFailing records the time of a failed sync in the dataset, unless an earlier failure is recorded.
+func recordFailing(ctx context.Context, cfg *Config) error {
+	bq, err := notifyBQClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer bq.Close()
+	v, etag, err := bq.ReadDatasetMetadataLabel(ctx, cfg.Dataset, failingSinceLabelName)
+	if err != nil || v != "" {
+		return err
+	}
+	return bq.WriteDatasetMetadataLabel(ctx, cfg.Dataset, failingSinceLabelName, strconv.FormatInt(cfg.now().Unix(), 10), etag)
+}
+
+// recoveryNotification returns a notification of a successful sync if a failure is recorded in the dataset
+// (clearing it), or nil otherwise.
+func recoveryNotification(ctx context.Context, cfg *Config) (*Notification, error) {
+	bq, err := notifyBQClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer bq.Close()
+	v, etag, err := bq.ReadDatasetMetadataLabel(ctx, cfg.Dataset, failingSinceLabelName)
+	if err != nil || v == "" {
+		return nil, err
+	}
+	if err := bq.WriteDatasetMetadataLabel(ctx, cfg.Dataset, failingSinceLabelName, "", etag); err != nil {
+		return nil, err
+	}
+	since := v
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		since = time.Unix(ts, 0).UTC().Format(time.RFC3339)
+	}
+	return &Notification{Project: cfg.Project, Dataset: cfg.Dataset, Recovered: true,
+		Text: fmt.Sprintf("SLO sync of project %s to dataset %s recovered after failing since %s", cfg.Project, cfg.Dataset, since)}, nil
+}
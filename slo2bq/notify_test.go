@@ -0,0 +1,158 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+// fakeNotifier records notifications it is sent.
+type fakeNotifier struct {
+	sent []*Notification
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, notification *Notification) error {
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		status  int
+		wantErr string
+	}{
+		{"ok", http.StatusOK, ""},
+		{"server error", http.StatusInternalServerError, "500"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Notification
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("expected a JSON POST request; got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+				}
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("could not decode notification: %v", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			want := Notification{Text: "failed", Project: "p", Dataset: "ds", Error: "boom"}
+			err := (&WebhookNotifier{URL: srv.URL}).Notify(context.Background(), &want)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Notify() unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Notify() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected webhook to receive %+v; got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestNotifySync(t *testing.T) {
+	defer func(f func(*Config) Notifier) { newNotifier = f }(newNotifier)
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { notifyBQClient = f }(notifyBQClient)
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	for _, tt := range []struct {
+		name           string
+		cfg            Config
+		res            *SyncResult
+		err            error
+		failingSince   string
+		wantLabel      string
+		wantWriteLabel bool
+		want           []*Notification
+	}{
+		{"failure", Config{}, nil, fmt.Errorf("boom"), "", "", false, []*Notification{{Project: "p", Dataset: "ds", Error: "boom",
+			Text: "SLO sync of project p to dataset ds failed: boom"}}},
+		{"first failure with recovery", Config{NotifyRecovery: true}, nil, fmt.Errorf("boom"), "", "1431270000", true, []*Notification{{
+			Project: "p", Dataset: "ds", Error: "boom", Text: "SLO sync of project p to dataset ds failed: boom"}}},
+		{"repeated failure with recovery", Config{NotifyRecovery: true}, nil, fmt.Errorf("boom"), "1431000000", "", false, []*Notification{{
+			Project: "p", Dataset: "ds", Error: "boom", Text: "SLO sync of project p to dataset ds failed: boom"}}},
+		{"success", Config{}, &SyncResult{}, nil, "", "", false, nil},
+		{"recovery", Config{NotifyRecovery: true}, &SyncResult{}, nil, "1431000000", "", true, []*Notification{{Project: "p", Dataset: "ds", Recovered: true,
+			Text: "SLO sync of project p to dataset ds recovered after failing since 2015-05-07T12:00:00Z"}}},
+		{"success without failure", Config{NotifyRecovery: true}, &SyncResult{}, nil, "", "", false, nil},
+		{"recently synced", Config{NotifyRecovery: true}, &SyncResult{RecentlySynced: true}, nil, "1431000000", "", false, nil},
+		{"dry run", Config{DryRun: true}, nil, fmt.Errorf("boom"), "", "", false, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().ReadDatasetMetadataLabel(gomock.Any(), "ds", failingSinceLabelName).Return(tt.failingSince, "etag", nil).AnyTimes()
+			bq.EXPECT().Close().AnyTimes()
+			if tt.wantWriteLabel {
+				bq.EXPECT().WriteDatasetMetadataLabel(gomock.Any(), "ds", failingSinceLabelName, tt.wantLabel, "etag")
+			}
+			notifyBQClient = func(ctx context.Context, cfg *Config) (clients.BigQueryClient, error) { return bq, nil }
+			n := &fakeNotifier{}
+			newNotifier = func(cfg *Config) Notifier { return n }
+
+			cfg := tt.cfg
+			cfg.clock, cfg.Project, cfg.Dataset = clock, "p", "ds"
+			notifySync(context.Background(), &cfg, tt.res, tt.err)
+			if !reflect.DeepEqual(n.sent, tt.want) {
+				t.Errorf("notifySync() sent %+v; want %+v", n.sent, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSloPerformanceNotifiesFailure(t *testing.T) {
+	defer func() { runSync = run }()
+	defer func(f func(*Config) Notifier) { newNotifier = f }(newNotifier)
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { datasetLabelsBQClient = f }(datasetLabelsBQClient)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDatasetLabels(mockCtrl, nil)
+	runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+		return nil, fmt.Errorf("boom")
+	}
+	n := &fakeNotifier{}
+	newNotifier = func(cfg *Config) Notifier {
+		if cfg.WebhookURL != "https://hooks.example.com/x" {
+			t.Errorf("expected notifier for WebhookURL from the message; got %q", cfg.WebhookURL)
+		}
+		return n
+	}
+
+	err := SyncSloPerformance(context.Background(), PubSubMessage{
+		Data: []byte(`{"Project": "p1", "Dataset": "ds", "WebhookURL": "https://hooks.example.com/x"}`)})
+	if err == nil || err.Error() != "boom" {
+		t.Errorf("SyncSloPerformance() expected error 'boom'; got %v", err)
+	}
+	want := []*Notification{{Project: "p1", Dataset: "ds", Error: "boom", Text: "SLO sync of project p1 to dataset ds failed: boom"}}
+	if !reflect.DeepEqual(n.sent, want) {
+		t.Errorf("SyncSloPerformance() sent %+v; want %+v", n.sent, want)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncMetrics holds per-project counters of sync runs in this process, exported in the Prometheus
+// text format by metricsHandler.
+type syncMetrics struct {
+	sync.Mutex
+	rowsWritten map[string]int64
+	slosSkipped map[string]int64
+	// lastSuccess is the Unix time of the last successful sync of each project.
+	lastSuccess map[string]int64
+}
+
+func newSyncMetrics() *syncMetrics {
+	return &syncMetrics{
+		rowsWritten: make(map[string]int64),
+		slosSkipped: make(map[string]int64),
+		lastSuccess: make(map[string]int64),
+	}
+}
+
+// promMetrics is updated by every sync run that is not a dry run.
+var promMetrics = newSyncMetrics()
+
+// record updates counters with the result of a sync of a given project finished at a given time, which
+// succeeded if err is nil.
+func (m *syncMetrics) record(project string, res *SyncResult, err error, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.rowsWritten[project] += int64(res.RowsWritten)
+	m.slosSkipped[project] += int64(len(res.Skipped))
+	if err == nil {
+		m.lastSuccess[project] = now.Unix()
+	}
+}
+
+// write writes all metrics in the Prometheus text exposition format.
+func (m *syncMetrics) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	family := func(name, tpe, help string, values map[string]int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, tpe)
+		projects := make([]string, 0, len(values))
+		for p := range values {
+			projects = append(projects, p)
+		}
+		sort.Strings(projects)
+		for _, p := range projects {
+			fmt.Fprintf(w, "%s{project=\"%s\"} %d\n", name, labelEscaper.Replace(p), values[p])
+		}
+	}
+	family("slo2bq_rows_written_total", "counter", "Number of rows written to BigQuery.", m.rowsWritten)
+	family("slo2bq_slos_skipped_total", "counter", "Number of services and SLOs skipped by filters.", m.slosSkipped)
+	family("slo2bq_last_success_timestamp", "gauge", "Unix time of the last successful sync.", m.lastSuccess)
+}
+
+// labelEscaper escapes label values as required by the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsHandler serves metrics of sync runs in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	promMetrics.write(w)
+}
+
+// ServeMetrics starts an HTTP server exposing Prometheus metrics of sync runs at /metrics, for use when
+// the sync runs in a long-lived process (e.g. on Cloud Run) rather than as a Cloud Function. It blocks
+// until the server fails, similarly to http.ListenAndServe.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	return http.ListenAndServe(addr, mux)
+}
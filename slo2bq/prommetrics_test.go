@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(m *syncMetrics) { promMetrics = m }(promMetrics)
+	promMetrics = newSyncMetrics()
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil).Times(3)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Return(nil).Times(2)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil).Times(2)
+	sloc.EXPECT().Services(gomock.Any()).Return(nil, fmt.Errorf("permission denied"))
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{
+		&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99},
+		&clients.SLO{Name: "s2", DisplayName: "canary-slo", Goal: 0.99},
+	}, nil).Times(2)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+	// Two successful runs for one project, and a failed run for another one.
+	for _, tt := range []struct {
+		project string
+		wantErr bool
+	}{{"project1", false}, {"project1", false}, {"project2", true}} {
+		cfg := &Config{clock: clock, Project: tt.project, Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2,
+			SLOExclude: []string{"canary-*"}}
+		if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); (err != nil) != tt.wantErr {
+			t.Fatalf("syncAllServices() unexpected error: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text/plain content type; got %s", ct)
+	}
+	got := w.Body.String()
+	for _, want := range []string{
+		"# TYPE slo2bq_rows_written_total counter\n",
+		"slo2bq_rows_written_total{project=\"project1\"} 4\n",
+		"slo2bq_rows_written_total{project=\"project2\"} 0\n",
+		"slo2bq_slos_skipped_total{project=\"project1\"} 2\n",
+		"# TYPE slo2bq_last_success_timestamp gauge\n",
+		"slo2bq_last_success_timestamp{project=\"project1\"} 1431270000\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected metrics to contain %q; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "slo2bq_last_success_timestamp{project=\"project2\"}") {
+		t.Errorf("expected no successful sync of project2; got:\n%s", got)
+	}
+}
+
+func TestMetricsDryRun(t *testing.T) {
+	defer func(m *syncMetrics) { promMetrics = m }(promMetrics)
+	promMetrics = newSyncMetrics()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return(nil, nil)
+
+	cfg := &Config{Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", DryRun: true}
+	if _, err := syncAllServices(context.Background(), cfg, nil, sloc, bq, nil); err != nil {
+		t.Fatalf("syncAllServices() unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), "project=") {
+		t.Errorf("expected no metrics after a dry run; got:\n%s", w.Body.String())
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	m := newSyncMetrics()
+	m.rowsWritten["a\"b\\c\nd"] = 1
+	var b strings.Builder
+	m.write(&b)
+	if want := `slo2bq_rows_written_total{project="a\"b\\c\nd"} 1`; !strings.Contains(b.String(), want) {
+		t.Errorf("expected metrics to contain %s; got:\n%s", want, b.String())
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slo2bq/clients"
+	"time"
+)
+
+// replayCells recomputes rows of cfg.Replay cells, which are expected to belong to cfg.Project, and
+// replaces existing rows of these cells in BigQuery. Unlike syncAllServices, it does not read existing
+// rows and is not limited to recent days.
+func replayCells(ctx context.Context, cfg *Config, sd clients.MetricClient, sloc clients.SLOClient, bq clients.BigQueryClient, gcs clients.GCSClient) (res *SyncResult, err error) {
+	res = &SyncResult{DryRun: cfg.DryRun}
+	if !cfg.DryRun {
+		defer func() { promMetrics.record(cfg.Project, res, err, cfg.now()) }()
+	}
+	svcs, err := sloc.Services(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.ServicesSeen = len(svcs)
+
+	var errs syncErrors
+	var recs []*record
+	slos := make(map[string][]*clients.SLO)
+	processed := make(map[string]bool)
+	seen := make(map[ReplayCell]bool)
+	for _, cell := range cfg.Replay {
+		if seen[cell] {
+			continue
+		}
+		seen[cell] = true
+		svc := findService(svcs, cell.Service)
+		if svc == nil {
+			err := fmt.Errorf("service '%s' not found in project %s", cell.Service, cfg.Project)
+			if !cfg.ContinueOnError {
+				return res, err
+			}
+			errs.service(cell.Service, err)
+			continue
+		}
+		if _, ok := slos[svc.Name]; !ok {
+			if slos[svc.Name], err = sloc.SLOs(ctx, svc); err != nil {
+				if !cfg.ContinueOnError {
+					return res, err
+				}
+				errs.service(svc.HumanName(), err)
+				continue
+			}
+		}
+		slo := findSLO(slos[svc.Name], cell.SLO)
+		if slo == nil {
+			err := fmt.Errorf("SLO '%s' not found in service '%s'", cell.SLO, svc.HumanName())
+			if !cfg.ContinueOnError {
+				return res, err
+			}
+			errs.slo(svc.HumanName(), cell.SLO, err)
+			continue
+		}
+		loc, err := sloLocation(cfg, slo)
+		if err != nil {
+			return res, err
+		}
+		// Config is expected to be validated, so the date can be parsed.
+		dayStart, _ := time.ParseInLocation("2006-01-02", cell.Date, loc)
+		recs = append(recs, dayRecords(cfg, svc, slo, dayStart, dayStart.AddDate(0, 0, 1), nil)...)
+		if !processed[slo.Name] {
+			processed[slo.Name] = true
+			res.SLOsProcessed++
+		}
+	}
+
+	var rows []*clients.BQRow
+	err = fillRecords(ctx, cfg, recs, sd, func(r *record) error {
+		if r.err != nil {
+			errs.slo(r.row.Service, r.row.SLO, r.err)
+			return nil
+		}
+		if r.empty {
+			logEntry(cfg, severityInfo, logFields{"service": r.row.Service, "slo": r.row.SLO, "date": r.row.Date},
+				"Not writing a row for Service '%s' SLO '%s' on %s: no events", r.row.Service, r.row.SLO, r.row.Date)
+			return nil
+		}
+		rows = append(rows, r.row)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	if cfg.DryRun {
+		for _, r := range rows {
+			log.Printf("Dry run: not writing %+v", r)
+		}
+	} else if len(rows) > 0 {
+		// Existing rows are only deleted once all cells have been recomputed.
+		where := cellCondition(cfg, rows)
+		logEntry(cfg, severityInfo, logFields{"condition": where}, "Deleting existing rows matching %s", where)
+		if err := bq.DeleteRows(ctx, cfg.Dataset, cfg.table(), where); err != nil {
+			return res, err
+		}
+		put := bq.Put
+		if len(rows) >= loadJobThreshold {
+			put = bq.Load
+		}
+		if err := put(ctx, cfg.Dataset, cfg.table(), rows); err != nil {
+			return res, err
+		}
+	}
+	for _, r := range rows {
+		res.addRows(r.Project+"/"+r.Service+"/"+r.SLO, 1)
+	}
+	if cfg.GCSExport != nil {
+		if err := exportRows(ctx, cfg, gcs, rows); err != nil {
+			return res, err
+		}
+	}
+	res.SLOsFailed = len(errs.slos)
+	return res, errs.err()
+}
+
+// findService returns the service with a given ID or display name, or nil if there is none.
+func findService(svcs []*clients.Service, name string) *clients.Service {
+	for _, svc := range svcs {
+		if svc.ID() == name || svc.HumanName() == name {
+			return svc
+		}
+	}
+	return nil
+}
+
+// findSLO returns the SLO with a given ID or display name, or nil if there is none.
+func findSLO(slos []*clients.SLO, name string) *clients.SLO {
+	for _, slo := range slos {
+		if slo.ID() == name || slo.HumanName() == name {
+			return slo
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestReplayCells(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	// Existing rows are not read, since replayed cells are always replaced.
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+
+	svc1 := &clients.Service{Name: "s1", DisplayName: "svc1"}
+	svc2 := &clients.Service{Name: "s2", DisplayName: "svc2"}
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{svc1, svc2}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), svc1).Return([]*clients.SLO{
+		&clients.SLO{Name: "o1", DisplayName: "slo1", Goal: 0.99},
+		&clients.SLO{Name: "o2", DisplayName: "slo2", Goal: 0.9},
+	}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), svc2).Return([]*clients.SLO{&clients.SLO{Name: "o3", DisplayName: "slo3", Goal: 0.999}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	gomock.InOrder(
+		sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(goodBadSeries(90, 10), nil),
+		sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(goodBadSeries(100, 0), nil),
+	)
+
+	// Rows of replayed cells are deleted once all of them have been recomputed.
+	gomock.InOrder(
+		bq.EXPECT().DeleteRows(gomock.Any(), "datasetname", "data",
+			`IFNULL(project, 'project') = 'project' AND hour IS NULL AND `+
+				`((date, serviceid, sloid) IN ((DATE '2015-03-01', "s1", "o2"), (DATE '2015-05-02', "s2", "o3")) OR `+
+				`(serviceid IS NULL AND (date, service, slo) IN ((DATE '2015-03-01', "svc1", "slo2"), (DATE '2015-05-02', "svc2", "slo3"))))`).Return(nil),
+		bq.EXPECT().Put(gomock.Any(), "datasetname", "data", []*clients.BQRow{
+			londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo2", ServiceID: "s1", SLOID: "o2", Date: "2015-03-01", Target: 0.9,
+				Good: 90, BadEvents: 10, Total: 100, ErrorBudget: errorBudget(100, 0.9), ValueType: "DOUBLE"}),
+			londonDay(&clients.BQRow{Project: "project", Service: "svc2", SLO: "slo3", ServiceID: "s2", SLOID: "o3", Date: "2015-05-02", Target: 0.999,
+				Good: 100, Total: 100, ErrorBudget: errorBudget(100, 0.999), ValueType: "DOUBLE"}),
+		}).Return(nil),
+	)
+
+	// Cells are matched by display names or IDs, and may be older than maxBackfillDays.
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", Replay: []ReplayCell{
+		{Project: "project", Service: "svc1", SLO: "o2", Date: "2015-03-01"},
+		{Project: "project", Service: "s2", SLO: "slo3", Date: "2015-05-02"},
+	}}
+	res, err := replayCells(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Fatalf("replayCells() unexpected error: %v", err)
+	}
+	if res.RowsWritten != 2 || res.SLOsProcessed != 2 {
+		t.Errorf("expected 2 rows of 2 SLOs to be written; got %+v", res)
+	}
+}
+
+func TestReplayCellsNotFound(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cell    ReplayCell
+		wantErr string
+	}{
+		{"unknown service", ReplayCell{Service: "svc9", SLO: "slo1", Date: "2015-05-01"}, "service 'svc9' not found in project project"},
+		{"unknown SLO", ReplayCell{Service: "svc1", SLO: "slo9", Date: "2015-05-01"}, "SLO 'slo9' not found in service 'svc1'"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			// Nothing is written if any of the cells can not be resolved.
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "o1", DisplayName: "slo1", Goal: 0.99}}, nil).AnyTimes()
+
+			cfg := &Config{Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", Replay: []ReplayCell{tt.cell}}
+			_, err := replayCells(context.Background(), cfg, nil, sloc, bq, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("replayCells() expected error to contain '%s'; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"slo2bq/clients"
+	"time"
+)
+
+// runManifest returns a RunManifest summarizing a sync started at `start`, which returned `res` and `err`.
+func runManifest(cfg *Config, start time.Time, res *SyncResult, err error) *clients.RunManifest {
+	m := &clients.RunManifest{
+		Project:    cfg.Project,
+		Start:      start,
+		End:        cfg.now(),
+		Success:    err == nil,
+		ConfigHash: configHash(cfg),
+	}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	if res != nil {
+		m.ServicesSeen = res.ServicesSeen
+		m.SLOsProcessed = res.SLOsProcessed
+		m.SLOsFailed = res.SLOsFailed
+		m.Skipped = len(res.Skipped)
+		m.RowsWritten = res.RowsWritten
+	}
+	return m
+}
+
+// configHash returns a short hash of the JSON-serialized Config, which is the same for syncs with the
+// same configuration.
+func configHash(cfg *Config) string {
+	j, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(j))[:16]
+}
+
+// recordRun writes a RunManifest of a sync to the runsTableName table. Failing to write it is logged as a
+// warning without failing the sync.
+func recordRun(ctx context.Context, cfg *Config, bq clients.BigQueryClient, start time.Time, res *SyncResult, err error) {
+	m := runManifest(cfg, start, res, err)
+	if err := bq.WriteRunManifest(ctx, cfg.Dataset, runsTableName, m); err != nil {
+		logEntry(cfg, severityWarning, logFields{"error": err.Error()}, "Could not record run: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestRecordRun(t *testing.T) {
+	start := time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	cfg := &Config{clock: fixedClock(end), Project: "p1", Dataset: "ds", RecordRuns: true}
+
+	for _, tt := range []struct {
+		name     string
+		res      *SyncResult
+		err      error
+		writeErr error
+		want     *clients.RunManifest
+	}{
+		{"success", &SyncResult{ServicesSeen: 2, SLOsProcessed: 3, RowsWritten: 10, Skipped: map[string]string{"p1/svc3": "excluded"}}, nil, nil,
+			&clients.RunManifest{Project: "p1", Start: start, End: end, Success: true, ServicesSeen: 2, SLOsProcessed: 3, Skipped: 1, RowsWritten: 10,
+				ConfigHash: configHash(cfg)}},
+		{"partial failure", &SyncResult{ServicesSeen: 1, SLOsProcessed: 2, SLOsFailed: 1, RowsWritten: 4}, fmt.Errorf("1 SLOs failed"), nil,
+			&clients.RunManifest{Project: "p1", Start: start, End: end, Error: "1 SLOs failed", ServicesSeen: 1, SLOsProcessed: 2, SLOsFailed: 1,
+				RowsWritten: 4, ConfigHash: configHash(cfg)}},
+		{"failure without result", nil, fmt.Errorf("boom"), nil,
+			&clients.RunManifest{Project: "p1", Start: start, End: end, Error: "boom", ConfigHash: configHash(cfg)}},
+		{"write error", &SyncResult{}, nil, fmt.Errorf("quota exceeded"),
+			&clients.RunManifest{Project: "p1", Start: start, End: end, Success: true, ConfigHash: configHash(cfg)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().WriteRunManifest(gomock.Any(), "ds", "runs", tt.want).Return(tt.writeErr)
+
+			recordRun(context.Background(), cfg, bq, start, tt.res, tt.err)
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	a := configHash(&Config{Project: "p1", Dataset: "ds"})
+	if len(a) != 16 {
+		t.Errorf("configHash() = %q; expected 16 hex digits", a)
+	}
+	if b := configHash(&Config{Project: "p1", Dataset: "ds", clock: fixedClock(time.Unix(0, 0))}); b != a {
+		t.Errorf("configHash() = %q; expected the same hash %q for the same configuration", b, a)
+	}
+	if c := configHash(&Config{Project: "p1", Dataset: "ds2"}); c == a {
+		t.Errorf("configHash() = %q; expected a different hash for a different configuration", c)
+	}
+}
@@ -16,145 +16,1290 @@ package slo2bq
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"path"
 	"slo2bq/clients"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/golang/protobuf/ptypes/duration"
 	googlepb "github.com/golang/protobuf/ptypes/timestamp"
+	"golang.org/x/sync/errgroup"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
-var timeNow = time.Now
+// errNoTimeSeries is returned when no time series match an SLI, which can mean either no traffic or
+// a misconfigured filter (e.g. a metric that does not exist).
+var errNoTimeSeries = errors.New("no time series found")
 
-// Stackdriver metric retention is 6 weeks (42 days), so we backfill up to 40
-// days in the past.
-var backfillDays = 40
+// Reasons of a CounterError.
+const (
+	// CounterSeriesCount means that a filter matched an unexpected number of time series.
+	CounterSeriesCount = "series count"
+	// CounterPointCount means that a time series did not have exactly one point.
+	CounterPointCount = "point count"
+	// CounterValueType means that a time series had a value type which can't be counted.
+	CounterValueType = "value type"
+)
+
+// CounterError is returned when time series matching a filter can't be counted. Messages only include
+// counts rather than the time series themselves, which can be very large.
+type CounterError struct {
+	Filter string
+	// Reason is one of CounterSeriesCount, CounterPointCount or CounterValueType.
+	Reason string
+	// SeriesCount is the number of time series matching Filter.
+	SeriesCount int
+	// PointCount is the number of points of the offending time series, if Reason is CounterPointCount.
+	PointCount int
+	// Detail describes the offending time series, e.g. its value type and metric if Reason is CounterValueType.
+	Detail string
+}
+
+func (e *CounterError) Error() string {
+	switch e.Reason {
+	case CounterPointCount:
+		return fmt.Sprintf("expected to get 1 point in each of %d time series matching '%s'; got %d", e.SeriesCount, e.Filter, e.PointCount)
+	case CounterValueType:
+		return fmt.Sprintf("unsupported value type %s for filter '%s'; SLIs should use DOUBLE, INT64, DISTRIBUTION or BOOL metrics", e.Detail, e.Filter)
+	}
+	return fmt.Sprintf("expected to get %s matching '%s'; got %d", e.Detail, e.Filter, e.SeriesCount)
+}
 
 // bqBatchSize is the number of BigQuery rows we will write at a time.
 var bqBatchSize = 100
 
+// partialFlushTimeout limits the time spent writing rows computed before the sync got cancelled.
+const partialFlushTimeout = 30 * time.Second
+
+// loadJobThreshold is the number of new rows starting from which rows are written using load jobs rather
+// than streaming inserts (e.g. for initial backfills). It's also the number of rows written by each load job.
+var loadJobThreshold = 1000
+
 // daysAgoMidnightTimestamp returns a timestamp that corresponds to midnight of the day
 // that was daysAgo days ago in a given location.
+//
+// In some zones (e.g. America/Havana or America/Santiago) clocks are changed at midnight, so midnight
+// might not exist or might occur twice. The returned timestamp is always the first instant of the day:
+// the end of the DST gap if midnight is skipped, or the earlier midnight if it is repeated. Days are
+// thus contiguous and never overlap, with the end of each day being the start of the next one.
 func daysAgoMidnightTimestamp(now time.Time, loc *time.Location, daysAgo int) time.Time {
-	year, month, day := now.In(loc).AddDate(0, 0, -daysAgo).Date()
-	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	// The date is computed in UTC, so that calendar arithmetic is not affected by DST transitions.
+	year, month, day := now.In(loc).Date()
+	year, month, day = time.Date(year, month, day-daysAgo, 0, 0, 0, 0, time.UTC).Date()
+
+	// time.Date returns an instant on the previous day if midnight is skipped, so midnight is instead
+	// tried with each UTC offset in effect around it, and the earliest instant within the day is used.
+	wall := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	guess := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	var start time.Time
+	for _, near := range []time.Time{guess.Add(-12 * time.Hour), guess, guess.Add(12 * time.Hour)} {
+		_, offset := near.Zone()
+		t := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if y, m, d := t.Date(); y == year && m == month && d == day && (start.IsZero() || t.Before(start)) {
+			start = t
+		}
+	}
+	if start.IsZero() {
+		// The whole day has been skipped (e.g. 2011-12-30 in Pacific/Apia), so it's empty.
+		return daysAgoMidnightTimestamp(now, loc, daysAgo-1)
+	}
+	return start
 }
 
-// syncAllServices enumerates all services and their SLOs and syncs new data to BigQuery.
-func syncAllServices(ctx context.Context, cfg *Config, sd clients.MetricClient, sloc clients.SLOClient, bq clients.BigQueryClient) error {
-	existing, err := readBQMap(ctx, bq, cfg)
-	if err != nil {
-		return err
+// SyncResult summarizes a single sync run. Services and SLOs are identified as "project/service"
+// and "project/service/slo" respectively.
+type SyncResult struct {
+	// ServicesSeen is the number of services returned by the Service Monitoring API.
+	ServicesSeen int
+	// SLOsProcessed is the number of SLOs for which new data was checked.
+	SLOsProcessed int
+	// Skipped contains services and SLOs that have not been synced, with the reason for skipping them.
+	Skipped map[string]string `json:",omitempty"`
+	// RowsWritten is the number of rows written to BigQuery (or, in a dry run, that would have been written).
+	RowsWritten int
+	// RowsPerSLO is the number of rows written for each SLO.
+	RowsPerSLO map[string]int `json:",omitempty"`
+	// SLOsFailed is the number of SLOs that could not be synced when Config.ContinueOnError is set.
+	SLOsFailed int `json:",omitempty"`
+	// MalformedRowsSkipped is the number of existing rows without Service, SLO or Date that have been
+	// ignored because Config.SkipMalformedExistingRows is set.
+	MalformedRowsSkipped int `json:",omitempty"`
+	// DryRun is set if nothing has actually been written to BigQuery.
+	DryRun bool `json:",omitempty"`
+	// RecentlySynced is set if nothing has been synced because the previous successful sync finished
+	// less than Config.MinInterval ago.
+	RecentlySynced bool `json:",omitempty"`
+}
+
+// add adds counters from another SyncResult.
+func (r *SyncResult) add(o *SyncResult) {
+	r.ServicesSeen += o.ServicesSeen
+	r.SLOsProcessed += o.SLOsProcessed
+	r.RowsWritten += o.RowsWritten
+	r.SLOsFailed += o.SLOsFailed
+	r.MalformedRowsSkipped += o.MalformedRowsSkipped
+	for k, v := range o.Skipped {
+		r.skip(k, v)
+	}
+	for k, v := range o.RowsPerSLO {
+		if r.RowsPerSLO == nil {
+			r.RowsPerSLO = make(map[string]int)
+		}
+		r.RowsPerSLO[k] += v
+	}
+}
+
+// skip records that a service or an SLO has not been synced.
+func (r *SyncResult) skip(name, reason string) {
+	if r.Skipped == nil {
+		r.Skipped = make(map[string]string)
+	}
+	r.Skipped[name] = reason
+}
+
+// addRows records rows written for a given SLO.
+func (r *SyncResult) addRows(slo string, n int) {
+	if r.RowsPerSLO == nil {
+		r.RowsPerSLO = make(map[string]int)
 	}
+	r.RowsPerSLO[slo] += n
+	r.RowsWritten += n
+}
+
+// syncErrors accumulates errors of individual services and SLOs when Config.ContinueOnError is set.
+type syncErrors struct {
+	msgs []string
+	// slos is the set of failed SLOs; only the first error of each SLO is kept.
+	slos map[string]bool
+}
+
+// service records an error affecting a whole service.
+func (e *syncErrors) service(svc string, err error) {
+	log.Printf("Could not sync Service '%s': %v", svc, err)
+	e.msgs = append(e.msgs, fmt.Sprintf("Service '%s': %v", svc, err))
+}
+
+// slo records an error of a single SLO.
+func (e *syncErrors) slo(svc, slo string, err error) {
+	key := sloErrorKey(svc, slo)
+	if e.slos[key] {
+		return
+	}
+	if e.slos == nil {
+		e.slos = make(map[string]bool)
+	}
+	e.slos[key] = true
+	log.Printf("Could not sync %s: %v", key, err)
+	e.msgs = append(e.msgs, fmt.Sprintf("%s: %v", key, err))
+}
+
+// failed returns whether an error of a given SLO has been recorded.
+func (e *syncErrors) failed(svc, slo string) bool {
+	return e.slos[sloErrorKey(svc, slo)]
+}
+
+// sloErrorKey returns the key of an SLO in syncErrors.slos, which is also used in error messages.
+func sloErrorKey(svc, slo string) string {
+	return fmt.Sprintf("Service '%s' SLO '%s'", svc, slo)
+}
 
-	svcs, err := sloc.Services()
+// err returns a combined error, or nil if there were no errors.
+func (e *syncErrors) err() error {
+	if len(e.msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d SLOs and %d services failed to sync: %s",
+		len(e.slos), len(e.msgs)-len(e.slos), strings.Join(e.msgs, "; "))
+}
+
+// syncAllServices enumerates all services and their SLOs and syncs new data to BigQuery. If cfg.GCSExport
+// is set, new rows are also exported to Cloud Storage using gcs.
+func syncAllServices(ctx context.Context, cfg *Config, sd clients.MetricClient, sloc clients.SLOClient, bq clients.BigQueryClient, gcs clients.GCSClient) (res *SyncResult, err error) {
+	res = &SyncResult{DryRun: cfg.DryRun}
+	if !cfg.DryRun {
+		defer func() { promMetrics.record(cfg.Project, res, err, cfg.now()) }()
+	}
+	// When backfilling a date range, existing rows are replaced, so there is no need to read them.
+	existing := make(bqMap)
+	if !cfg.backfillRange() {
+		var err error
+		if existing, res.MalformedRowsSkipped, err = newExistingDataSource(cfg, bq).readExisting(ctx, cfg); err != nil {
+			return res, err
+		}
+	}
+	// With cfg.FastPathDays, SLOs that have already been backfilled are synced using `shallow` config.
+	var known map[[2]string]bool
+	var shallow *Config
+	if cfg.fastPath() {
+		var err error
+		if known, err = readKnownSLOs(ctx, bq, cfg); err != nil {
+			return res, err
+		}
+		c := *cfg
+		c.BackfillDays = cfg.FastPathDays
+		shallow = &c
+	}
+
+	svcs, err := sloc.Services(ctx)
 	if err != nil {
-		return err
+		return res, err
 	}
+	res.ServicesSeen = len(svcs)
+	inv := newSLOInventory(svcs)
 
-	var rows []*clients.BQRow
+	// With cfg.ContinueOnError, errors of individual services and SLOs are accumulated in `errs`.
+	var errs syncErrors
+	var recs []*record
+	var changes []*clients.GoalChange
+	var newSLOs []*clients.KnownSLO
+	var defs []*clients.SLODefinition
+	var periodRecs []*record
+	// names maps service and SLO names of synced SLOs to their IDs, to detect SLOs with the same names.
+	names := make(map[[2]string]string)
+	targets := existing.latestTargets()
 	for _, svc := range svcs {
-		slos, err := sloc.SLOs(svc)
+		// SLO lists may come from a cache, which does not check the context, so it is also checked explicitly.
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		if err := svc.ValidateName(); err != nil {
+			logEntry(cfg, severityWarning, logFields{"service": svc.Name}, "Skipping Service with unparseable name: %v", err)
+			res.skip(cfg.Project+"/"+svc.Name, "unparseable name")
+			continue
+		}
+		if !nameMatches(svc.HumanName(), cfg.ServiceInclude, cfg.ServiceExclude) {
+			logEntry(cfg, severityInfo, logFields{"service": svc.HumanName()}, "Skipping Service '%s'", svc.HumanName())
+			res.skip(cfg.Project+"/"+svc.HumanName(), "excluded by ServiceInclude/ServiceExclude")
+			continue
+		}
+		slos, err := sloc.SLOs(ctx, svc)
 		if err != nil {
-			return err
+			if !cfg.ContinueOnError {
+				return res, err
+			}
+			errs.service(svc.HumanName(), err)
+			continue
 		}
+		inv.addSLOs(svc, slos)
 		for _, slo := range slos {
-			res, err := newRecords(ctx, cfg, svc, slo, existing, sd)
+			if err := slo.ValidateName(); err != nil {
+				logEntry(cfg, severityWarning, logFields{"service": svc.HumanName(), "slo": slo.Name},
+					"Skipping SLO with unparseable name in Service '%s': %v", svc.HumanName(), err)
+				res.skip(cfg.Project+"/"+svc.HumanName()+"/"+slo.Name, "unparseable name")
+				continue
+			}
+			if !nameMatches(slo.HumanName(), cfg.SLOInclude, cfg.SLOExclude) {
+				logEntry(cfg, severityInfo, logFields{"service": svc.HumanName(), "slo": slo.HumanName()},
+					"Skipping Service '%s' SLO '%s'", svc.HumanName(), slo.HumanName())
+				res.skip(cfg.Project+"/"+svc.HumanName()+"/"+slo.HumanName(), "excluded by SLOInclude/SLOExclude")
+				continue
+			}
+			if err := checkDuplicateName(cfg, names, svc, slo); err != nil {
+				return res, err
+			}
+			slo, err := checkGoal(cfg, svc, slo)
 			if err != nil {
+				if !cfg.ContinueOnError {
+					return res, err
+				}
+				errs.slo(svc.HumanName(), slo.HumanName(), err)
+				continue
+			}
+			if c := goalChange(cfg, svc, slo, targets); c != nil {
+				logEntry(cfg, severityInfo, logFields{"service": c.Service, "slo": c.SLO, "old_target": c.OldTarget, "new_target": c.NewTarget},
+					"Goal of Service '%s' SLO '%s' changed from %v to %v", c.Service, c.SLO, c.OldTarget, c.NewTarget)
+				changes = append(changes, c)
+			}
+			scfg := cfg
+			if cfg.fastPath() {
+				if known[[2]string{svc.ID(), slo.ID()}] {
+					scfg = shallow
+				} else {
+					logEntry(cfg, severityInfo, logFields{"service": svc.HumanName(), "slo": slo.HumanName()},
+						"Backfilling new Service '%s' SLO '%s'", svc.HumanName(), slo.HumanName())
+					newSLOs = append(newSLOs, &clients.KnownSLO{Project: cfg.Project, Service: svc.HumanName(), SLO: slo.HumanName(),
+						ServiceID: svc.ID(), SLOID: slo.ID(), FirstSeen: cfg.now()})
+				}
+			}
+			r, err := newRecords(scfg, svc, slo, existing)
+			if err != nil {
+				if !cfg.ContinueOnError {
+					return res, err
+				}
+				errs.slo(svc.HumanName(), slo.HumanName(), err)
+				continue
+			}
+			if cfg.ProbeInactiveSLOs {
+				probeRecords(ctx, cfg, slo, r, sd)
+			}
+			recs = append(recs, r...)
+			res.SLOsProcessed++
+			if cfg.ArchiveDefinitions {
+				defs = append(defs, sloDefinition(cfg, svc, slo))
+			}
+			if cfg.periodToDate() {
+				if p := periodRecord(cfg, svc, slo); p != nil {
+					periodRecs = append(periodRecs, p)
+				}
+			}
+			logEntry(cfg, severityInfo, logFields{"service": svc.HumanName(), "slo": slo.HumanName(), "count": len(r)},
+				"Got %d new records for Service '%s' SLO '%s'", len(r), svc.HumanName(), slo.HumanName())
+		}
+	}
+
+	// Partial rows are deleted before being recomputed, since keeping them would double count events.
+	// If the sync then fails, the missing rows are recomputed by the next one.
+	if rows := partialRows(recs); len(rows) > 0 && !cfg.DryRun {
+		tables, byTable := rowsByTable(cfg, rows)
+		for _, t := range tables {
+			where := "partial AND " + cellCondition(cfg, byTable[t])
+			logEntry(cfg, severityInfo, logFields{"condition": where, "table": t}, "Deleting partial rows matching %s", where)
+			if err := bq.DeleteRows(ctx, cfg.Dataset, t, where); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	// Date-sharded tables are created before rows are deleted from or written to them.
+	shards := make(map[string]bool)
+	ensureShard := func(ctx context.Context, table string) error {
+		if !cfg.ShardByDate || shards[table] {
+			return nil
+		}
+		if err := bq.EnsureTable(ctx, cfg.Dataset, table); err != nil {
+			return err
+		}
+		shards[table] = true
+		return nil
+	}
+
+	// Streaming inserts are used for regular incremental syncs, and load jobs for large backfills.
+	batchSize, put := bqBatchSize, bq.Put
+	if len(recs) >= loadJobThreshold {
+		logEntry(cfg, severityInfo, logFields{"count": len(recs)}, "Using load jobs to write %d records", len(recs))
+		batchSize, put = loadJobThreshold, bq.Load
+	}
+	// When backfilling a date range, existing rows are only deleted after all new rows have been
+	// computed, so all rows are written at the end.
+	if cfg.backfillRange() {
+		batchSize = len(recs) + 1
+	}
+
+	// Rows written to BigQuery are exported to Cloud Storage once the sync is done.
+	var exported, refreshed []*clients.BQRow
+	w := newBatchWriter(cfg, batchSize, func(ctx context.Context, dataset, table string, rows []*clients.BQRow) error {
+		if cfg.ShardByDate && len(rows) == 0 {
+			return nil
+		}
+		var complete, partial []*clients.BQRow
+		for _, r := range rows {
+			if r.Partial {
+				partial = append(partial, r)
+			} else {
+				complete = append(complete, r)
+			}
+		}
+		if cfg.DryRun {
+			for _, r := range rows {
+				log.Printf("Dry run: not writing %+v", r)
+			}
+		} else {
+			if err := ensureShard(ctx, table); err != nil {
+				return err
+			}
+			if err := put(ctx, dataset, table, complete); err != nil {
 				return err
 			}
-			rows = append(rows, res...)
-			log.Printf("Got %d new records for Service '%s' SLO '%s'", len(res), svc.HumanName(), slo.HumanName())
-			if len(rows) >= bqBatchSize {
-				log.Printf("Flushing %d rows to BigQuery", len(rows))
-				if err := bq.Put(ctx, cfg.Dataset, tableName, rows); err != nil {
+			// Rows written using streaming inserts can't be deleted for a while, so partial rows are always
+			// written using load jobs.
+			if len(partial) > 0 {
+				if err := bq.Load(ctx, dataset, table, partial); err != nil {
 					return err
 				}
-				rows = nil
 			}
 		}
+		for _, r := range rows {
+			res.addRows(r.Project+"/"+r.Service+"/"+r.SLO, 1)
+		}
+		// Partial rows are not exported, since objects are never replaced.
+		if cfg.GCSExport != nil {
+			exported = append(exported, complete...)
+		}
+		return nil
+	})
+	// The data table is flushed at the end of every sync, even if there are no new rows. Date-sharded
+	// tables only exist for dates that have rows.
+	if !cfg.ShardByDate {
+		w.batch(cfg.Dataset, cfg.table())
+	}
+	err = fillRecords(ctx, cfg, recs, sd, func(r *record) error {
+		if r.err != nil {
+			errs.slo(r.row.Service, r.row.SLO, r.err)
+			return nil
+		}
+		if r.empty {
+			logEntry(cfg, severityInfo, logFields{"service": r.row.Service, "slo": r.row.SLO, "date": r.row.Date},
+				"Not writing a row for Service '%s' SLO '%s' on %s: no events", r.row.Service, r.row.SLO, r.row.Date)
+			return nil
+		}
+		// Refreshed rows that now have events are only written once the rows they replace are deleted.
+		// Rows that still have no events are not written again, since the existing rows are kept.
+		if r.refreshesZero {
+			if r.row.Total > 0 {
+				refreshed = append(refreshed, r.row)
+			}
+			return nil
+		}
+		return w.add(ctx, cfg.Dataset, cfg.shardTable(r.row.Date), r.row)
+	})
+	if err == nil {
+		err = writeRefreshedRows(ctx, cfg, bq, w, refreshed)
+	}
+	if err != nil {
+		// When the sync is cancelled (e.g. because it's about to time out), rows computed so far are
+		// still written, so that the next sync does not need to compute them again. Rows of a backfill
+		// range can only be written once existing rows are deleted, so they are discarded. Nothing is
+		// written once the lease is lost, since another sync may be writing the same rows.
+		n := w.pendingCount()
+		if ctx.Err() != nil && cfg.lease.lost() && n > 0 {
+			logEntry(cfg, severityWarning, logFields{"count": n}, "Sync cancelled after losing the BQ lease; discarding %d rows computed so far", n)
+		} else if ctx.Err() != nil && !cfg.backfillRange() && n > 0 {
+			fctx, cancel := context.WithTimeout(context.Background(), partialFlushTimeout)
+			defer cancel()
+			logEntry(cfg, severityWarning, logFields{"count": n}, "Sync cancelled; flushing %d rows computed so far", n)
+			if ferr := w.flush(fctx); ferr != nil {
+				logEntry(cfg, severityWarning, logFields{"error": ferr.Error()}, "Could not flush rows: %v", ferr)
+			} else if ferr := exportRows(fctx, cfg, gcs, exported); ferr != nil {
+				logEntry(cfg, severityWarning, logFields{"error": ferr.Error()}, "Could not export rows: %v", ferr)
+			}
+		}
+		return res, err
+	}
+	if rows := w.pendingRows(); cfg.backfillRange() && !cfg.DryRun && len(rows) > 0 {
+		tables, byTable := rowsByTable(cfg, rows)
+		for _, t := range tables {
+			if err := ensureShard(ctx, t); err != nil {
+				return res, err
+			}
+			where := backfillCondition(cfg, byTable[t])
+			logEntry(cfg, severityInfo, logFields{"condition": where, "table": t}, "Deleting existing rows matching %s", where)
+			if err := bq.DeleteRows(ctx, cfg.Dataset, t, where); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := w.flush(ctx); err != nil {
+		return res, err
+	}
+	if err := exportRows(ctx, cfg, gcs, exported); err != nil {
+		return res, err
+	}
+	// New SLOs are only recorded once the sync has succeeded, so that SLOs which failed to backfill are
+	// backfilled by the next sync again.
+	var backfilled []*clients.KnownSLO
+	for _, k := range newSLOs {
+		if !errs.failed(k.Service, k.SLO) {
+			backfilled = append(backfilled, k)
+		}
 	}
-	return bq.Put(ctx, cfg.Dataset, tableName, rows)
+	if !cfg.DryRun && len(backfilled) > 0 {
+		if err := bq.WriteKnownSLOs(ctx, cfg.Dataset, knownSLOsTableName, backfilled); err != nil {
+			return res, err
+		}
+	}
+	if err := writePeriodToDate(ctx, cfg, periodRecs, sd, bq, &errs); err != nil {
+		return res, err
+	}
+	if cfg.RecordGoalChanges && !cfg.DryRun && len(changes) > 0 {
+		if err := bq.WriteGoalChanges(ctx, cfg.Dataset, goalChangesTableName, changes); err != nil {
+			return res, err
+		}
+	}
+	// Replays and date ranges only cover some rows, so they don't detect deleted SLOs.
+	if cfg.TombstoneDeletedSLOs && !cfg.backfillRange() && !cfg.replay() {
+		if err := recordSLOStates(ctx, cfg, bq, targets, inv); err != nil {
+			return res, err
+		}
+	}
+	if cfg.ArchiveDefinitions && !cfg.DryRun && len(defs) > 0 {
+		if err := bq.WriteSLODefinitions(ctx, cfg.Dataset, sloDefinitionsTableName, defs); err != nil {
+			return res, err
+		}
+	}
+	res.SLOsFailed = len(errs.slos)
+	return res, errs.err()
 }
 
-// newRecords returns a list of BigQuery rows that need to be inserted to BigQuery for a given SLO.
-func newRecords(ctx context.Context, cfg *Config, svc *clients.Service, slo *clients.SLO, existing bqMap, sd clients.MetricClient) ([]*clients.BQRow, error) {
+// pruneOldRows deletes rows older than cfg.RetentionDays days from the data table, if configured.
+func pruneOldRows(ctx context.Context, cfg *Config, bq clients.BigQueryClient) error {
+	if !cfg.prune() {
+		return nil
+	}
 	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	olderThan := daysAgoMidnightTimestamp(cfg.now(), loc, cfg.RetentionDays)
+	logEntry(cfg, severityInfo, logFields{"date": olderThan.Format("2006-01-02")},
+		"Deleting rows older than %s", olderThan.Format("2006-01-02"))
+	return bq.PruneOldRows(ctx, cfg.Dataset, cfg.table(), olderThan)
+}
+
+// exportRows writes rows to Cloud Storage as configured by cfg.GCSExport, with a separate object for each date.
+func exportRows(ctx context.Context, cfg *Config, gcs clients.GCSClient, rows []*clients.BQRow) error {
+	byDate := make(map[string][]*clients.BQRow)
+	var dates []string
+	for _, r := range rows {
+		if _, ok := byDate[r.Date]; !ok {
+			dates = append(dates, r.Date)
+		}
+		byDate[r.Date] = append(byDate[r.Date], r)
+	}
+	for _, date := range dates {
+		object := exportObjectName(cfg, date)
+		if cfg.DryRun {
+			logEntry(cfg, severityInfo, logFields{"count": len(byDate[date]), "date": date, "object": object},
+				"Dry run: not writing %d rows to gs://%s/%s", len(byDate[date]), cfg.GCSExport.Bucket, object)
+			continue
+		}
+		logEntry(cfg, severityInfo, logFields{"count": len(byDate[date]), "date": date, "object": object},
+			"Writing %d rows to gs://%s/%s", len(byDate[date]), cfg.GCSExport.Bucket, object)
+		if err := gcs.WriteRows(ctx, cfg.GCSExport.Bucket, object, byDate[date]); err != nil {
+			return fmt.Errorf("could not export rows for %s: %v", date, err)
+		}
+	}
+	return nil
+}
+
+// exportObjectName returns the name of the Cloud Storage object storing rows of a given date synced by this run.
+func exportObjectName(cfg *Config, date string) string {
+	name := fmt.Sprintf("%s/%s-%d.json", date, cfg.Project, cfg.now().Unix())
+	if prefix := strings.Trim(cfg.GCSExport.Prefix, "/"); prefix != "" {
+		name = prefix + "/" + name
+	}
+	return name
+}
+
+// checkGoal warns about SLO goals larger than 1, which are likely expressed as a percentage rather than
+// a fraction. With Config.NormalizeGoals, a copy of the SLO with the goal divided by 100 is returned, and
+// goals larger than 100 are an error. SLOs may be shared through the SLO cache, so they are not modified.
+func checkGoal(cfg *Config, svc *clients.Service, slo *clients.SLO) (*clients.SLO, error) {
+	if slo.Goal <= 1 {
+		return slo, nil
+	}
+	fields := logFields{"service": svc.HumanName(), "slo": slo.HumanName(), "goal": slo.Goal}
+	if !cfg.NormalizeGoals {
+		logEntry(cfg, severityWarning, fields, "Goal %v of Service '%s' SLO '%s' is larger than 1; set NormalizeGoals if it is a percentage",
+			slo.Goal, svc.HumanName(), slo.HumanName())
+		return slo, nil
+	}
+	if slo.Goal > 100 {
+		return slo, fmt.Errorf("goal %v of Service '%s' SLO '%s' is out of range", slo.Goal, svc.HumanName(), slo.HumanName())
+	}
+	normalized := *slo
+	normalized.Goal = slo.Goal / 100
+	logEntry(cfg, severityWarning, fields, "Goal %v of Service '%s' SLO '%s' is larger than 1; using %v",
+		slo.Goal, svc.HumanName(), slo.HumanName(), normalized.Goal)
+	return &normalized, nil
+}
+
+// goalChange returns a GoalChange if the goal of an SLO differs from the target of its most recent
+// row in BigQuery, and nil otherwise (including when there are no rows for the SLO).
+func goalChange(cfg *Config, svc *clients.Service, slo *clients.SLO, targets map[bqMapKey]sloTarget) *clients.GoalChange {
+	row := &clients.BQRow{Project: cfg.Project, Service: svc.HumanName(), SLO: slo.HumanName(), ServiceID: svc.ID(), SLOID: slo.ID()}
+	t, ok := targets[keyOf(row)]
+	if !ok {
+		t, ok = targets[nameKeyOf(row)]
+	}
+	if !ok || t.Target == slo.Goal {
+		return nil
+	}
+	loc, err := sloLocation(cfg, slo)
+	if err != nil {
+		loc = time.UTC
+	}
+	return &clients.GoalChange{
+		Project:   row.Project,
+		Service:   row.Service,
+		SLO:       row.SLO,
+		ServiceID: row.ServiceID,
+		SLOID:     row.SLOID,
+		Date:      cfg.now().In(loc).Format("2006-01-02"),
+		OldTarget: t.Target,
+		NewTarget: slo.Goal,
+	}
+}
+
+// sloDefinition returns an SLODefinition recording the definition of an SLO as of the current sync.
+// SLOs not decoded from an API response (which have no Raw JSON) are encoded from their parsed fields.
+func sloDefinition(cfg *Config, svc *clients.Service, slo *clients.SLO) *clients.SLODefinition {
+	loc, err := sloLocation(cfg, slo)
+	if err != nil {
+		loc = time.UTC
+	}
+	raw := []byte(slo.Raw)
+	if len(raw) == 0 {
+		raw, _ = json.Marshal(slo)
+	}
+	return &clients.SLODefinition{
+		Project:    cfg.Project,
+		Service:    svc.HumanName(),
+		SLO:        slo.HumanName(),
+		ServiceID:  svc.ID(),
+		SLOID:      slo.ID(),
+		Date:       cfg.now().In(loc).Format("2006-01-02"),
+		Goal:       slo.Goal,
+		Definition: string(raw),
+	}
+}
+
+// nameMatches returns whether a name matches any of the `include` glob patterns (or `include` is empty)
+// and does not match any of the `exclude` patterns. Patterns are expected to be validated by Config.validate.
+func nameMatches(name string, include, exclude []string) bool {
+	for _, p := range exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, p := range include {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// record is a BigQuery row for a single SLO and day (or hour) that needs to be filled with data from Stackdriver.
+type record struct {
+	slo        *clients.SLO
+	start, end time.Time
+	row        *clients.BQRow
+	// err is set if data could not be retrieved and Config.ContinueOnError is set.
+	err error
+	// empty is set if the row should not be written: either no time series matched the SLI and
+	// Config.SkipEmptyDays is set, or it has no events and Config.EmptyDayCompliance is "skip".
+	empty bool
+	// replacesPartial is set if a partial row with the same key exists in BigQuery.
+	replacesPartial bool
+	// refreshesZero is set if a row with the same key and no events exists in BigQuery, and is re-synced
+	// because Config.RefreshZeroRows is set.
+	refreshesZero bool
+	// noData is set if no time series matched the SLI over the intervals of all records of the SLO (see
+	// probeRecords), so the record is filled without querying Stackdriver.
+	noData bool
+}
+
+// newRecords returns a list of records that need to be inserted to BigQuery for a given SLO.
+func newRecords(cfg *Config, svc *clients.Service, slo *clients.SLO, existing bqMap) ([]*record, error) {
+	loc, err := sloLocation(cfg, slo)
 	if err != nil {
 		return nil, err
 	}
 
+	var recs []*record
+	if cfg.IncludeToday && !cfg.backfillRange() {
+		// Interval boundaries need to be aligned to a second, see newTimeSeriesRequest.
+		now := cfg.now().Truncate(time.Second)
+		for _, r := range dayRecords(cfg, svc, slo, daysAgoMidnightTimestamp(now, loc, 0), now, existing) {
+			r.row.Partial = true
+			recs = append(recs, r)
+		}
+	}
+	for _, day := range syncDays(cfg, loc) {
+		recs = append(recs, dayRecords(cfg, svc, slo, day[0], day[1], existing)...)
+	}
+	return recs, nil
+}
+
+// calendarPeriodStart returns the start of the calendar period (as in SLO.CalendarPeriod) containing `now`
+// in a given location, or false if the period is not supported. Weeks start on Monday, following ISO 8601.
+// Fortnights are not supported, since their alignment is not documented.
+func calendarPeriodStart(now time.Time, loc *time.Location, period string) (time.Time, bool) {
+	local := now.In(loc)
+	year, month, day := local.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	var start time.Time
+	switch period {
+	case "DAY":
+		start = today
+	case "WEEK":
+		start = today.AddDate(0, 0, -(int(local.Weekday())+6)%7)
+	case "MONTH":
+		start = time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	case "QUARTER":
+		start = time.Date(year, (month-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+	case "HALF":
+		start = time.Date(year, (month-1)/6*6+1, 1, 0, 0, 0, 0, time.UTC)
+	case "YEAR":
+		start = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Time{}, false
+	}
+	// Dates are computed in UTC, so that each day is exactly 24 hours long.
+	return daysAgoMidnightTimestamp(now, loc, int(today.Sub(start).Hours()/24)), true
+}
+
+// periodRecord returns a record covering the current calendar period of an SLO up to now, or nil if the SLO
+// does not have a supported calendar period or the period has just started.
+func periodRecord(cfg *Config, svc *clients.Service, slo *clients.SLO) *record {
+	if slo.CalendarPeriod == "" {
+		return nil
+	}
+	loc, err := sloLocation(cfg, slo)
+	if err != nil {
+		return nil
+	}
+	// Interval boundaries need to be aligned to a second, see newTimeSeriesRequest.
+	now := cfg.now().Truncate(time.Second)
+	start, ok := calendarPeriodStart(now, loc, slo.CalendarPeriod)
+	if !ok {
+		logEntry(cfg, severityWarning, logFields{"service": svc.HumanName(), "slo": slo.HumanName(), "period": slo.CalendarPeriod},
+			"Not computing period-to-date performance of Service '%s' SLO '%s': unsupported calendar period %s",
+			svc.HumanName(), slo.HumanName(), slo.CalendarPeriod)
+		return nil
+	}
+	if now.Sub(start) < time.Minute {
+		return nil
+	}
+	row := &clients.BQRow{
+		Project:       cfg.Project,
+		Service:       svc.HumanName(),
+		SLO:           slo.HumanName(),
+		ServiceID:     svc.ID(),
+		SLOID:         slo.ID(),
+		Date:          now.In(loc).Format("2006-01-02"),
+		Target:        slo.Goal,
+		Period:        slo.Period(),
+		IntervalStart: start.UTC(),
+		IntervalEnd:   now.UTC(),
+		PeriodStart:   start.UTC(),
+		Labels:        sloLabels(cfg, slo),
+	}
+	return &record{slo: slo, start: start, end: now, row: row}
+}
+
+// writePeriodToDate computes period-to-date rows of given records and appends them to the
+// periodToDateTableName table. With cfg.ContinueOnError, errors of individual SLOs are added to errs.
+func writePeriodToDate(ctx context.Context, cfg *Config, recs []*record, sd clients.MetricClient, bq clients.BigQueryClient, errs *syncErrors) error {
+	if len(recs) == 0 {
+		return nil
+	}
 	var rows []*clients.BQRow
-	for daysAgo := 1; daysAgo <= backfillDays; daysAgo++ {
-		start := daysAgoMidnightTimestamp(timeNow(), loc, daysAgo)
-		end := daysAgoMidnightTimestamp(timeNow(), loc, daysAgo-1)
-		date := start.Format("2006-01-02")
-
-		row := clients.BQRow{
-			Service: svc.HumanName(),
-			SLO:     slo.HumanName(),
-			Date:    date,
-			Target:  slo.Goal,
-		}
-		if existing.Check(row.Service, row.SLO, row.Date) {
+	err := fillRecords(ctx, cfg, recs, sd, func(r *record) error {
+		if r.err != nil {
+			errs.slo(r.row.Service, r.row.SLO, r.err)
+			return nil
+		}
+		if !r.empty {
+			rows = append(rows, r.row)
+		}
+		return nil
+	})
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	if cfg.DryRun {
+		for _, r := range rows {
+			log.Printf("Dry run: not writing period-to-date row %+v", r)
+		}
+		return nil
+	}
+	if err := bq.EnsureTable(ctx, cfg.Dataset, periodToDateTableName); err != nil {
+		return err
+	}
+	logEntry(cfg, severityInfo, logFields{"count": len(rows)}, "Writing %d period-to-date rows", len(rows))
+	return bq.Load(ctx, cfg.Dataset, periodToDateTableName, rows)
+}
+
+// dayRecords returns records of a given SLO and day (one per hour, if cfg.Granularity is hourly) that
+// are not present in existing, or are only present as partial rows. Intervals shorter than the minimum
+// alignment period of a minute (e.g. the current hour of a partial day) are skipped.
+func dayRecords(cfg *Config, svc *clients.Service, slo *clients.SLO, dayStart, dayEnd time.Time, existing bqMap) []*record {
+	intervals := [][2]time.Time{{dayStart, dayEnd}}
+	if cfg.hourly() {
+		intervals = hourlyIntervals(dayStart, dayEnd)
+	}
+	var recs []*record
+	for i, in := range intervals {
+		if in[1].Sub(in[0]) < time.Minute {
+			continue
+		}
+		row := &clients.BQRow{
+			Project:   cfg.Project,
+			Service:   svc.HumanName(),
+			SLO:       slo.HumanName(),
+			ServiceID: svc.ID(),
+			SLOID:     slo.ID(),
+			Date:      dayStart.Format("2006-01-02"),
+			Target:    slo.Goal,
+			Period:    slo.Period(),
+			// The interval is recorded to make it possible to audit what exactly has been queried.
+			IntervalStart: in[0].UTC(),
+			IntervalEnd:   in[1].UTC(),
+			Labels:        sloLabels(cfg, slo),
+		}
+		if cfg.hourly() {
+			row.Hour = bigquery.NullInt64{Int64: int64(i), Valid: true}
+		}
+		v, ok := existing.Get(row)
+		if ok && !v.Partial && !(cfg.RefreshZeroRows && v.Total == 0) {
 			continue
 		}
+		recs = append(recs, &record{slo: slo, start: in[0], end: in[1], row: row, replacesPartial: ok && v.Partial,
+			refreshesZero: ok && !v.Partial})
+	}
+	return recs
+}
 
-		row.Good, row.Total, err = getGoodTotal(ctx, cfg, slo, start, end, sd)
-		if err != nil {
-			return nil, err
+// backfillCondition returns a condition matching existing rows that are replaced by given rows when
+// backfilling a date range. Only rows of SLOs that have been successfully recomputed are matched, by
+// their IDs or, for rows written before ID columns were added, by their names.
+func backfillCondition(cfg *Config, rows []*clients.BQRow) string {
+	seen := make(map[[2]string]bool)
+	var ids, names []string
+	for _, r := range rows {
+		k := [2]string{r.ServiceID, r.SLOID}
+		if !seen[k] {
+			seen[k] = true
+			ids = append(ids, fmt.Sprintf("(%s, %s)", strconv.Quote(r.ServiceID), strconv.Quote(r.SLOID)))
+			names = append(names, fmt.Sprintf("(%s, %s)", strconv.Quote(r.Service), strconv.Quote(r.SLO)))
 		}
+	}
+	return fmt.Sprintf("date BETWEEN DATE '%s' AND DATE '%s' AND IFNULL(project, '%s') = '%s' AND hour %s AND "+
+		"((serviceid, sloid) IN (%s) OR (serviceid IS NULL AND (service, slo) IN (%s)))",
+		cfg.BackfillStart, cfg.BackfillEnd, cfg.Project, cfg.Project, hourCondition(cfg), strings.Join(ids, ", "), strings.Join(names, ", "))
+}
+
+// cellCondition returns a condition matching existing rows of the same SLOs and dates as given rows (e.g.
+// rows replaced when replaying cells). Similarly to backfillCondition, rows are matched by IDs or, for rows
+// written before ID columns were added, by names.
+func cellCondition(cfg *Config, rows []*clients.BQRow) string {
+	seen := make(map[[3]string]bool)
+	var ids, names []string
+	for _, r := range rows {
+		k := [3]string{r.Date, r.ServiceID, r.SLOID}
+		if !seen[k] {
+			seen[k] = true
+			ids = append(ids, fmt.Sprintf("(DATE '%s', %s, %s)", r.Date, strconv.Quote(r.ServiceID), strconv.Quote(r.SLOID)))
+			names = append(names, fmt.Sprintf("(DATE '%s', %s, %s)", r.Date, strconv.Quote(r.Service), strconv.Quote(r.SLO)))
+		}
+	}
+	return fmt.Sprintf("IFNULL(project, '%s') = '%s' AND hour %s AND "+
+		"((date, serviceid, sloid) IN (%s) OR (serviceid IS NULL AND (date, service, slo) IN (%s)))",
+		cfg.Project, cfg.Project, hourCondition(cfg), strings.Join(ids, ", "), strings.Join(names, ", "))
+}
+
+// writeRefreshedRows deletes existing rows without events that are replaced by given rows (see
+// Config.RefreshZeroRows), and then adds the given rows to the batch writer. Rows written within the last
+// hour or so can't be deleted yet, in which case the rows of that table are skipped, and refreshed again
+// by a later sync.
+func writeRefreshedRows(ctx context.Context, cfg *Config, bq clients.BigQueryClient, w *batchWriter, rows []*clients.BQRow) error {
+	tables, byTable := rowsByTable(cfg, rows)
+	for _, t := range tables {
+		if !cfg.DryRun {
+			where := zeroRowCondition(cfg, byTable[t])
+			logEntry(cfg, severityInfo, logFields{"condition": where, "table": t}, "Deleting rows without events matching %s", where)
+			if err := bq.DeleteRows(ctx, cfg.Dataset, t, where); clients.IsStreamingBuffer(err) {
+				logEntry(cfg, severityWarning, logFields{"error": err.Error(), "table": t, "count": len(byTable[t])},
+					"Not refreshing %d rows without events in table %s: %v", len(byTable[t]), t, err)
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		for _, r := range byTable[t] {
+			if err := w.add(ctx, cfg.Dataset, t, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// zeroRowCondition returns a condition matching existing complete rows without events of the same SLOs,
+// dates and hours as given rows. Similarly to cellCondition, rows are matched by IDs or, for rows written
+// before ID columns were added, by names.
+func zeroRowCondition(cfg *Config, rows []*clients.BQRow) string {
+	var ids, names []string
+	for _, r := range rows {
+		hour := int64(-1)
+		if r.Hour.Valid {
+			hour = r.Hour.Int64
+		}
+		ids = append(ids, fmt.Sprintf("(DATE '%s', %d, %s, %s)", r.Date, hour, strconv.Quote(r.ServiceID), strconv.Quote(r.SLOID)))
+		names = append(names, fmt.Sprintf("(DATE '%s', %d, %s, %s)", r.Date, hour, strconv.Quote(r.Service), strconv.Quote(r.SLO)))
+	}
+	return fmt.Sprintf("NOT IFNULL(partial, FALSE) AND total = 0 AND IFNULL(project, '%s') = '%s' AND "+
+		"((date, IFNULL(hour, -1), serviceid, sloid) IN (%s) OR (serviceid IS NULL AND (date, IFNULL(hour, -1), service, slo) IN (%s)))",
+		cfg.Project, cfg.Project, strings.Join(ids, ", "), strings.Join(names, ", "))
+}
+
+// partialRows returns rows of given records that replace existing partial rows.
+func partialRows(recs []*record) []*clients.BQRow {
+	var rows []*clients.BQRow
+	for _, r := range recs {
+		if r.replacesPartial {
+			rows = append(rows, r.row)
+		}
+	}
+	return rows
+}
+
+// rowsByTable groups rows by the table they are stored in (see Config.shardTable), and returns the tables
+// in the order of their first row.
+func rowsByTable(cfg *Config, rows []*clients.BQRow) ([]string, map[string][]*clients.BQRow) {
+	var tables []string
+	byTable := make(map[string][]*clients.BQRow)
+	for _, r := range rows {
+		t := cfg.shardTable(r.Date)
+		if _, ok := byTable[t]; !ok {
+			tables = append(tables, t)
+		}
+		byTable[t] = append(byTable[t], r)
+	}
+	return tables, byTable
+}
+
+// syncDays returns start and end timestamps of days that should be synced, most recent day first.
+// Unless a backfill range is configured, these are backfillDays days preceding the current day.
+func syncDays(cfg *Config, loc *time.Location) [][2]time.Time {
+	now, count := cfg.now(), cfg.backfillDays()
+	if cfg.backfillRange() {
+		// Config is expected to be validated, so dates can be parsed. Days of the range are counted back
+		// from noon of the day after BackfillEnd, so that they start at the same instants as recent days.
+		first, _ := time.Parse("2006-01-02", cfg.BackfillStart)
+		last, _ := time.Parse("2006-01-02", cfg.BackfillEnd)
+		now = time.Date(last.Year(), last.Month(), last.Day()+1, 12, 0, 0, 0, loc)
+		count = int(last.Sub(first).Hours()/24) + 1
+	}
+	var days [][2]time.Time
+	for daysAgo := 1; daysAgo <= count; daysAgo++ {
+		days = append(days, [2]time.Time{
+			daysAgoMidnightTimestamp(now, loc, daysAgo),
+			daysAgoMidnightTimestamp(now, loc, daysAgo-1),
+		})
+	}
+	return days
+}
+
+// hourlyIntervals splits a day into one hour long intervals. Days are not always 24 hours long
+// because of DST transitions, so there might be 23 or 25 intervals, and the last interval might be
+// shorter than an hour (e.g. in Australia/Lord_Howe, which shifts clocks by 30 minutes).
+func hourlyIntervals(start, end time.Time) [][2]time.Time {
+	var result [][2]time.Time
+	for s := start; s.Before(end); s = s.Add(time.Hour) {
+		e := s.Add(time.Hour)
+		if e.After(end) {
+			e = end
+		}
+		result = append(result, [2]time.Time{s, e})
+	}
+	return result
+}
+
+// emptyCompliance returns the compliance recorded for rows with zero total events, as configured by
+// Config.EmptyDayCompliance.
+func emptyCompliance(cfg *Config) bigquery.NullFloat64 {
+	switch cfg.EmptyDayCompliance {
+	case emptyDayHundred:
+		return bigquery.NullFloat64{Float64: 1, Valid: true}
+	case emptyDayZero:
+		return bigquery.NullFloat64{Float64: 0, Valid: true}
+	}
+	return bigquery.NullFloat64{}
+}
+
+// fillRecords queries Stackdriver for good and total event counts of each record using up to
+// cfg.Concurrency parallel workers. `done` is called for every record in the original order
+// as soon as the record and all records preceding it have been filled. The first error returned
+// by a worker or by `done` cancels all outstanding work and is returned. If cfg.ContinueOnError is set, worker
+// errors are instead stored in the record, which is then passed to `done` as usual.
+func fillRecords(ctx context.Context, cfg *Config, recs []*record, sd clients.MetricClient, done func(*record) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	filled := make([]chan struct{}, len(recs))
+	for i := range filled {
+		filled[i] = make(chan struct{})
+	}
+
+	work := make(chan int)
+	g.Go(func() error {
+		defer close(work)
+		for i := range recs {
+			select {
+			case work <- i:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	for w := 0; w < cfg.concurrency(); w++ {
+		g.Go(func() error {
+			for i := range work {
+				r := recs[i]
+				err := errNoTimeSeries
+				if !r.noData {
+					r.row.Good, r.row.Total, r.row.ValueType, err = getGoodTotal(ctx, cfg, r.slo, r.start, r.end, sd)
+				}
+				if err == errNoTimeSeries {
+					// Unless empty days are skipped, no data is recorded as a row with zero events.
+					r.empty, err = cfg.SkipEmptyDays, nil
+				}
+				if err != nil {
+					// Errors caused by cancellation of the whole sync are never ignored.
+					if !cfg.ContinueOnError || ctx.Err() != nil {
+						return err
+					}
+					ce, ok := err.(*CounterError)
+					if ok {
+						logEntry(cfg, severityWarning, logFields{"service": r.row.Service, "slo": r.row.SLO, "date": r.row.Date,
+							"filter": ce.Filter, "reason": ce.Reason, "series_count": ce.SeriesCount, "point_count": ce.PointCount},
+							"Could not count events of Service '%s' SLO '%s' on %s: %v", r.row.Service, r.row.SLO, r.row.Date, ce)
+					}
+					r.err = err
+					close(filled[i])
+					continue
+				}
+				r.row.BadEvents = r.row.Total - r.row.Good
+				r.row.ErrorBudget = errorBudget(r.row.Total, r.row.Target)
+				if r.row.Total == 0 {
+					r.empty = r.empty || cfg.EmptyDayCompliance == emptyDaySkip
+					r.row.EmptyCompliance = emptyCompliance(cfg)
+				}
+				logEntry(cfg, severityInfo, logFields{"service": r.row.Service, "slo": r.row.SLO, "date": r.row.Date,
+					"start": r.start, "end": r.end, "good": r.row.Good, "total": r.row.Total},
+					"SLO data for %s from %v to %v: %d good, %d total", r.slo.HumanName(), r.start, r.end, r.row.Good, r.row.Total)
+				close(filled[i])
+			}
+			return nil
+		})
+	}
 
-		log.Printf("SLO data for %s on %s: %d good, %d total", slo.HumanName(), date, row.Good, row.Total)
-		rows = append(rows, &row)
+	g.Go(func() error {
+		for i, r := range recs {
+			// Records filled before cancellation are still passed to `done`, so that they can be saved.
+			select {
+			case <-filled[i]:
+			default:
+				select {
+				case <-filled[i]:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if err := done(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return g.Wait()
+}
+
+// probeRecords queries Stackdriver once for events of an SLO over the interval covering all of its records,
+// and marks them with noData if no time series match the SLI, so that SLOs of services that no longer emit
+// metrics don't need a query per day. If the probe fails, records are queried as usual.
+func probeRecords(ctx context.Context, cfg *Config, slo *clients.SLO, recs []*record, sd clients.MetricClient) {
+	if len(recs) == 0 {
+		return
+	}
+	start, end := recs[0].start, recs[0].end
+	for _, r := range recs[1:] {
+		if r.start.Before(start) {
+			start = r.start
+		}
+		if r.end.After(end) {
+			end = r.end
+		}
+	}
+	_, _, _, err := getGoodTotal(ctx, cfg, slo, start, end, sd)
+	if err == nil {
+		return
+	}
+	svc := recs[0].row.Service
+	if err != errNoTimeSeries {
+		logEntry(cfg, severityWarning, logFields{"service": svc, "slo": slo.HumanName(), "error": err.Error()},
+			"Could not probe Service '%s' SLO '%s' for data; querying every day: %v", svc, slo.HumanName(), err)
+		return
+	}
+	logEntry(cfg, severityInfo, logFields{"service": svc, "slo": slo.HumanName(), "start": start, "end": end},
+		"No time series for Service '%s' SLO '%s' from %v to %v; skipping queries of %d records", svc, slo.HumanName(), start, end, len(recs))
+	for _, r := range recs {
+		r.noData = true
 	}
-	return rows, nil
+}
+
+// errorBudget returns the number of bad events allowed by the SLO target for a given number of total events.
+func errorBudget(total int64, target float64) float64 {
+	return float64(total) * (1 - target)
 }
 
 // getGoodTotal returns two numbers corresponding to the cumulative count of good and total events for a given
-// SLO between the two timestamps.
-func getGoodTotal(ctx context.Context, cfg *Config, slo *clients.SLO, start, end time.Time, sd clients.MetricClient) (int64, int64, error) {
-	req := &monitoringpb.ListTimeSeriesRequest{
+// SLO between the two timestamps. For SLOs with both request-based and windows-based SLIs, cfg.PreferSLIType
+// decides which one is used.
+func getGoodTotal(ctx context.Context, cfg *Config, slo *clients.SLO, start, end time.Time, sd clients.MetricClient) (int64, int64, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, "", err
+	}
+	if r, ok := cfg.LabelRatios[sloKey(slo)]; ok {
+		return getGoodTotalRatio(ctx, cfg, r.filters(), start, end, sd, getSubIntervalCounter)
+	}
+	// Windows-based SLIs (like all SLIs without a request-based representation) are evaluated by
+	// Stackdriver using select_slo_counts, which counts good and total windows.
+	preferWindows := cfg.PreferSLIType == sliTypeWindows && slo.SLI != nil && slo.SLI.WindowsBasedSLI != nil
+	if slo.SLI != nil && slo.SLI.RequestBasedSLI != nil && !preferWindows {
+		if sli := slo.SLI.RequestBasedSLI.GoodTotalRatioSLI; sli != nil {
+			return getGoodTotalRatio(ctx, cfg, sli, start, end, sd, getSubIntervalCounter)
+		}
+		if sli := slo.SLI.RequestBasedSLI.TimeSeriesQuery; sli != nil {
+			filters := &clients.GoodTotalRatioSLI{Good: sli.Good, Bad: sli.Bad, Total: sli.Total}
+			return getGoodTotalRatio(ctx, cfg, filters, start, end, sd, getQueryCounter)
+		}
+		if sli := slo.SLI.RequestBasedSLI.DistributionCut; sli != nil {
+			good, total, err := getDistributionCut(ctx, cfg, sli, start, end, sd)
+			if err != nil {
+				return 0, 0, "", err
+			}
+			return good, total, metricpb.MetricDescriptor_DISTRIBUTION.String(), nil
+		}
+	}
+	good, total, err := getSLOCounts(ctx, cfg, slo, start, end, sd)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	// select_slo_counts always returns DOUBLE time series.
+	return good, total, metricpb.MetricDescriptor_DOUBLE.String(), nil
+}
+
+// checkDuplicateName records the names of an SLO in `names`, and logs a warning if another SLO with different
+// IDs has the same service and SLO names. With cfg.FailOnDuplicateNames, an error is returned instead.
+func checkDuplicateName(cfg *Config, names map[[2]string]string, svc *clients.Service, slo *clients.SLO) error {
+	key := [2]string{svc.HumanName(), slo.HumanName()}
+	id := svc.ID() + "/" + slo.ID()
+	other, ok := names[key]
+	if !ok {
+		names[key] = id
+		return nil
+	}
+	if other == id {
+		return nil
+	}
+	if cfg.FailOnDuplicateNames {
+		return fmt.Errorf("Service '%s' SLO '%s' is the name of both %s and %s", key[0], key[1], other, id)
+	}
+	logEntry(cfg, severityWarning, logFields{"service": key[0], "slo": key[1], "ids": []string{other, id}},
+		"WARNING: Service '%s' SLO '%s' is the name of both %s and %s; their rows can only be told apart by the serviceid and sloid columns",
+		key[0], key[1], other, id)
+	return nil
+}
+
+// sloTimeZone returns the time zone days of an SLO are computed in: its entry in cfg.SLOTimeZones, if any,
+// and cfg.TimeZone otherwise.
+func sloTimeZone(cfg *Config, slo *clients.SLO) string {
+	if tz, ok := cfg.SLOTimeZones[sloKey(slo)]; ok {
+		return tz
+	}
+	return cfg.TimeZone
+}
+
+// sloLocation returns the location of sloTimeZone, which all dates of the SLO's rows are computed in.
+func sloLocation(cfg *Config, slo *clients.SLO) (*time.Location, error) {
+	return time.LoadLocation(sloTimeZone(cfg, slo))
+}
+
+// sloLabels returns the user labels of an SLO listed in cfg.SLOLabels, or nil if it has none of them.
+func sloLabels(cfg *Config, slo *clients.SLO) map[string]string {
+	var labels map[string]string
+	for _, k := range cfg.SLOLabels {
+		v, ok := slo.UserLabels[k]
+		if !ok {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[k] = v
+	}
+	return labels
+}
+
+// sloKey returns service and SLO IDs of an SLO as "SERVICE/SLO", as used by Config.LabelRatios.
+func sloKey(slo *clients.SLO) string {
+	// Name is like 'projects/$project/services/$service/serviceLevelObjectives/$slo'.
+	parts := strings.Split(slo.Name, "/")
+	if len(parts) < 6 {
+		return slo.ID()
+	}
+	return parts[3] + "/" + parts[5]
+}
+
+// newTimeSeriesRequest returns a request for time series matching a given filter, aligned to produce a single
+// point covering the whole interval between the two timestamps.
+func newTimeSeriesRequest(cfg *Config, filter string, start, end time.Time) *monitoringpb.ListTimeSeriesRequest {
+	return &monitoringpb.ListTimeSeriesRequest{
 		Name:   fmt.Sprintf("projects/%s", cfg.Project),
-		Filter: fmt.Sprintf(`select_slo_counts("%s")`, slo.Name),
+		Filter: filter,
 		Interval: &monitoringpb.TimeInterval{
 			// `start` and `end` are guaranteed to be aligned to a second (since they come from
-			// daysAgoMidnightTimestamp()), so there is no need to fill `Timestamp.Nanos`.
+			// daysAgoMidnightTimestamp() and hourlyIntervals()), so there is no need to fill `Timestamp.Nanos`.
 			StartTime: &googlepb.Timestamp{Seconds: start.Unix()},
 			EndTime:   &googlepb.Timestamp{Seconds: end.Unix()},
 		},
 		// DELTA aligner and an alignment period covering the whole request interval should produce a response
-		// with a single point containing the sum of all values within the request interval.
+		// with a single point containing the sum of all values within the request interval. Alignment period
+		// can be any number of seconds (60 or more), so DST-affected days don't need special handling.
 		Aggregation: &monitoringpb.Aggregation{
 			AlignmentPeriod: &duration.Duration{
 				Seconds: end.Unix() - start.Unix(),
 			},
 			PerSeriesAligner: monitoringpb.Aggregation_ALIGN_DELTA,
 		},
+		// HEADERS view would omit points, which are needed by all callers (there are no callers that only
+		// check whether any time series exist). Aggregation already limits FULL view to a single point per series.
+		View: monitoringpb.ListTimeSeriesRequest_FULL,
 	}
+}
 
+// getSLOCounts uses the `select_slo_counts` time series selector to get the number of good and total events
+// for any SLO, regardless of the way its SLI is defined.
+func getSLOCounts(ctx context.Context, cfg *Config, slo *clients.SLO, start, end time.Time, sd clients.MetricClient) (int64, int64, error) {
+	filter := fmt.Sprintf(`select_slo_counts("%s")`, slo.Name)
+	req := newTimeSeriesRequest(cfg, filter, start, end)
 	series, err := sd.ListTimeSeries(ctx, req)
 	if err != nil {
 		return 0, 0, fmt.Errorf("ListTimeSeries (%v) error: %v", req, err)
 	}
 
 	if len(series) == 0 {
-		log.Printf("Got 0 time series while querying '%s'", slo.Name)
-		return 0, 0, nil
+		logEntry(cfg, severityInfo, logFields{"filter": slo.Name}, "Got 0 time series while querying '%s'", slo.Name)
+		return 0, 0, errNoTimeSeries
 	} else if len(series) != 2 {
-		return 0, 0, fmt.Errorf("expected to get 2 time series while querying %v; got %v", slo, series)
+		return 0, 0, &CounterError{Filter: filter, Reason: CounterSeriesCount, SeriesCount: len(series), Detail: "good and bad time series"}
 	}
 
 	var good, total float64
 	for _, s := range series {
 		if len(s.Points) != 1 {
-			return 0, 0, fmt.Errorf("expected to get 1 point in %v; got %v", s.GetMetric(), s.Points)
+			return 0, 0, &CounterError{Filter: filter, Reason: CounterPointCount, SeriesCount: len(series), PointCount: len(s.Points)}
 		}
 		if s.ValueType != metricpb.MetricDescriptor_DOUBLE {
-			return 0, 0, fmt.Errorf("unexpected value type in %v: %v", s.GetMetric(), s.ValueType)
+			return 0, 0, &CounterError{Filter: filter, Reason: CounterValueType, SeriesCount: len(series), Detail: s.ValueType.String()}
 		}
 		value := s.Points[0].GetValue().GetDoubleValue()
 		labels := s.GetMetric().GetLabels()
@@ -169,3 +1314,355 @@ func getGoodTotal(ctx context.Context, cfg *Config, slo *clients.SLO, start, end
 	}
 	return int64(good), int64(total), nil
 }
+
+// counterFunc returns the number of events matching a filter (or query) between two timestamps, and value
+// types of the time series they were counted from.
+type counterFunc func(ctx context.Context, cfg *Config, filter string, start, end time.Time, sd clients.MetricClient) (int64, valueTypes, error)
+
+// getGoodTotalRatio returns the number of good and total events for an SLI defined as a ratio of two filters,
+// which are evaluated using count (getSubIntervalCounter for monitoring filters, or getQueryCounter for MQL queries).
+// errNoTimeSeries is only returned if neither of the filters matches any time series; if only one of them
+// does, events it counts are still recorded (see goodTotalFromRatio).
+func getGoodTotalRatio(ctx context.Context, cfg *Config, sli *clients.GoodTotalRatioSLI, start, end time.Time, sd clients.MetricClient, count counterFunc) (int64, int64, string, error) {
+	var found bool
+	missing := make(map[string]bool)
+	types := make(valueTypes)
+	counter := func(filter string) (int64, bool, error) {
+		v, t, err := count(ctx, cfg, filter, start, end, sd)
+		if err == errNoTimeSeries {
+			missing[filter] = true
+			return 0, false, nil
+		}
+		found = found || err == nil
+		types.add(t)
+		return v, err == nil, err
+	}
+	good, total, err := goodTotalFromRatio(sli, counter)
+	if err == nil && !found {
+		return 0, 0, "", errNoTimeSeries
+	}
+	if err == nil && sli.Good != "" && missing[sli.Good] && total > 0 {
+		// Unlike a bad filter matching nothing on a day without errors, a good filter matching nothing while
+		// there are other events usually means an outage, or a filter that no longer matches.
+		logEntry(cfg, severityWarning, logFields{"filter": sli.Good, "start": start, "end": end, "total": total},
+			"No time series match good filter '%s' from %v to %v; recording all %d events as bad", sli.Good, start, end, total)
+	}
+	return good, total, types.String(), err
+}
+
+// valueTypes is a set of value types of time series.
+type valueTypes map[metricpb.MetricDescriptor_ValueType]bool
+
+// add adds all types of another set.
+func (v valueTypes) add(o valueTypes) {
+	for t := range o {
+		v[t] = true
+	}
+}
+
+// String returns names of the types in the set, sorted and separated by commas.
+func (v valueTypes) String() string {
+	var names []string
+	for t := range v {
+		names = append(names, t.String())
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// goodTotalFromRatio returns the number of good and total events for an SLI defined as a ratio of two
+// filters, using a given function to count events matching a filter and report whether any time series
+// matched it. If the total filter matches no time series while the other one does, the known events are
+// counted as the total, so that the number of good events is never negative or larger than the total.
+func goodTotalFromRatio(sli *clients.GoodTotalRatioSLI, counter func(string) (int64, bool, error)) (int64, int64, error) {
+	switch {
+	case sli.Good != "" && sli.Total != "":
+		good, _, err := counter(sli.Good)
+		if err != nil {
+			return 0, 0, err
+		}
+		total, found, err := counter(sli.Total)
+		if !found {
+			total = good
+		}
+		return good, total, err
+	case sli.Good != "" && sli.Bad != "":
+		good, _, err := counter(sli.Good)
+		if err != nil {
+			return 0, 0, err
+		}
+		bad, _, err := counter(sli.Bad)
+		return good, good + bad, err
+	case sli.Bad != "" && sli.Total != "":
+		bad, _, err := counter(sli.Bad)
+		if err != nil {
+			return 0, 0, err
+		}
+		total, found, err := counter(sli.Total)
+		if !found {
+			total = bad
+		}
+		return total - bad, total, err
+	}
+	return 0, 0, fmt.Errorf("expected two of good, bad and total filters to be set; got %+v", sli)
+}
+
+// getDistributionCut returns the number of good and total events for an SLI defined as a range of values of
+// a distribution metric.
+func getDistributionCut(ctx context.Context, cfg *Config, sli *clients.DistributionCut, start, end time.Time, sd clients.MetricClient) (int64, int64, error) {
+	if sli.Range == nil {
+		return 0, 0, fmt.Errorf("expected range to be set in distribution cut %+v", sli)
+	}
+	series, err := getAggregatedSeries(ctx, cfg, sli.DistributionFilter, start, end, sd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var good, total int64
+	for _, s := range series {
+		if s.ValueType != metricpb.MetricDescriptor_DISTRIBUTION {
+			return 0, 0, &CounterError{Filter: sli.DistributionFilter, Reason: CounterValueType, SeriesCount: len(series), Detail: s.ValueType.String()}
+		}
+		for _, p := range s.Points {
+			d := p.GetValue().GetDistributionValue()
+			good += countInRange(d, sli.Range)
+			total += d.GetCount()
+		}
+	}
+	return good, total, nil
+}
+
+// getSubIntervalCounter returns the number of events matching a given filter between the two timestamps like
+// getCounter, but splits the interval into cfg.SubIntervals sub-intervals of equal length (rounded to whole
+// seconds, with the last one ending exactly at `end`) and sums their counts. Intervals are split into fewer
+// sub-intervals if needed to keep them at least a minute long. errNoTimeSeries is only returned if none of
+// the sub-intervals has any time series.
+func getSubIntervalCounter(ctx context.Context, cfg *Config, filter string, start, end time.Time, sd clients.MetricClient) (int64, valueTypes, error) {
+	seconds := end.Unix() - start.Unix()
+	n := int64(cfg.subIntervals())
+	if limit := seconds / 60; n > limit {
+		n = limit
+	}
+	if n <= 1 {
+		return getCounter(ctx, cfg, filter, start, end, sd)
+	}
+
+	var sum int64
+	types := make(valueTypes)
+	found := false
+	for i := int64(0); i < n; i++ {
+		s, e := start.Add(time.Duration(seconds*i/n)*time.Second), start.Add(time.Duration(seconds*(i+1)/n)*time.Second)
+		if i == n-1 {
+			e = end
+		}
+		v, t, err := getCounter(ctx, cfg, filter, s, e, sd)
+		if err == errNoTimeSeries {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		found = true
+		sum += v
+		types.add(t)
+	}
+	if !found {
+		return 0, nil, errNoTimeSeries
+	}
+	return sum, types, nil
+}
+
+// getCounter returns the sum of values of all time series matching a given filter between the two timestamps.
+// For distribution metrics, the number of values in the distribution is returned, and for boolean metrics,
+// the number of series with a true value. The sum is multiplied by the scale configured for the filter in
+// cfg.Scales, if any.
+//
+// The whole interval is always covered by a single request, even if it is not a whole number of hours long
+// (e.g. 23 or 25 hours on days with DST transitions, or 23h30m in Australia/Lord_Howe): the only constraint
+// on the alignment period of ALIGN_DELTA is that it should be at least 60 seconds, and an alignment period
+// equal to the request interval produces a single point regardless of its length.
+func getCounter(ctx context.Context, cfg *Config, filter string, start, end time.Time, sd clients.MetricClient) (int64, valueTypes, error) {
+	series, err := getAggregatedSeries(ctx, cfg, filter, start, end, sd)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var sum float64
+	types := make(valueTypes)
+	fractional := false
+	for _, s := range series {
+		types[s.ValueType] = true
+		for _, p := range s.Points {
+			value := p.GetValue()
+			switch s.ValueType {
+			case metricpb.MetricDescriptor_DOUBLE:
+				v := value.GetDoubleValue()
+				fractional = fractional || v != math.Trunc(v)
+				sum += v
+			case metricpb.MetricDescriptor_INT64:
+				sum += float64(value.GetInt64Value())
+			case metricpb.MetricDescriptor_DISTRIBUTION:
+				sum += float64(value.GetDistributionValue().GetCount())
+			case metricpb.MetricDescriptor_BOOL:
+				if value.GetBoolValue() {
+					sum++
+				}
+			default:
+				return 0, nil, &CounterError{Filter: filter, Reason: CounterValueType, SeriesCount: len(series),
+					Detail: fmt.Sprintf("%v of metric %s (kind %v)", s.ValueType, s.GetMetric().GetType(), s.MetricKind)}
+			}
+		}
+	}
+	_, aggregated := cfg.Aggregations[filter]
+	scale, scaled := cfg.Scales[filter]
+	if fractional && !aggregated && !scaled {
+		// Deltas of counters are whole numbers of events, so fractional values usually mean that the filter
+		// matches a gauge (e.g. latency) rather than a counter.
+		logEntry(cfg, severityWarning, logFields{"filter": filter, "start": start, "end": end},
+			"Time series matching '%s' from %v to %v have non-integer DOUBLE values; the filter might not match a counter", filter, start, end)
+	}
+	if !scaled && !cfg.rate(filter) {
+		return int64(sum), types, nil
+	}
+	if cfg.rate(filter) {
+		// Points contain the mean per-second rate over the whole interval (see newTimeSeriesRequest).
+		sum *= end.Sub(start).Seconds()
+	}
+	if scaled {
+		sum *= scale
+	}
+	// Products are rounded rather than truncated, since e.g. 0.29*100 is 28.999999999999996.
+	return int64(math.Round(sum)), types, nil
+}
+
+// Format of MQL date literals. Timestamps are formatted in UTC, which MQL assumes by default.
+const mqlDateFormat = "2006/01/02 15:04:05"
+
+// getQueryCounter returns the sum of values of all points returned by a Monitoring Query Language query
+// between the two timestamps; for distributions, the number of values is used, and for booleans, the
+// number of true values. Since points are added up, queries are expected to return deltas (e.g. using
+// `align delta()`), possibly already summed up with `group_by`. The query must have a single value column.
+func getQueryCounter(ctx context.Context, cfg *Config, query string, start, end time.Time, sd clients.MetricClient) (int64, valueTypes, error) {
+	q := fmt.Sprintf("%s | within d'%s', d'%s'", query, start.UTC().Format(mqlDateFormat), end.UTC().Format(mqlDateFormat))
+	res, err := sd.QueryTimeSeries(ctx, cfg.metricsProject(), q)
+	if err != nil {
+		return 0, nil, fmt.Errorf("QueryTimeSeries (%s) error: %v", q, err)
+	}
+	if len(res.Data) == 0 {
+		logEntry(cfg, severityInfo, logFields{"filter": query}, "Got 0 time series while querying '%s'", query)
+		return 0, nil, errNoTimeSeries
+	}
+	if len(res.PointDescriptors) != 1 {
+		return 0, nil, fmt.Errorf("expected query '%s' to return a single value column; got %d", query, len(res.PointDescriptors))
+	}
+	valueType := res.PointDescriptors[0].ValueType
+	var sum float64
+	for _, s := range res.Data {
+		for _, p := range s.PointData {
+			if len(p.Values) != 1 {
+				return 0, nil, fmt.Errorf("expected to get 1 value in points returned by query '%s'; got %d", query, len(p.Values))
+			}
+			v := p.Values[0]
+			switch valueType {
+			case "INT64":
+				sum += float64(v.Int64Value)
+			case "DOUBLE":
+				sum += v.DoubleValue
+			case "DISTRIBUTION":
+				if v.DistributionValue != nil {
+					sum += float64(v.DistributionValue.Count)
+				}
+			case "BOOL":
+				if v.BoolValue {
+					sum++
+				}
+			default:
+				return 0, nil, fmt.Errorf("unsupported value type %s returned by query '%s'; "+
+					"SLIs should use DOUBLE, INT64, DISTRIBUTION or BOOL values", valueType, query)
+			}
+		}
+	}
+	types := valueTypes{metricpb.MetricDescriptor_ValueType(metricpb.MetricDescriptor_ValueType_value[valueType]): true}
+	return int64(sum), types, nil
+}
+
+// getAggregatedSeries returns time series matching a given filter in cfg.MetricsProject (or cfg.Project, if it's
+// not set) between the two timestamps, each containing a single point with the sum of values within the interval
+// (unless another aligner is configured for the filter in cfg.Aggregations). Cross-series reducer is expected to
+// collapse all matching time series into one, but if the filter results in several time series (e.g. when some
+// of them lack a label used for grouping), all of them are returned. If no time series match the filter,
+// errNoTimeSeries is returned.
+//
+// The alignment period covers the whole interval, but the API occasionally returns two points when the interval
+// is split at an alignment boundary. Points of ALIGN_DELTA are additive, so callers add up all points of such
+// series; with other aligners (e.g. ALIGN_MEAN), every series needs exactly one point. Series without points
+// are always an error.
+func getAggregatedSeries(ctx context.Context, cfg *Config, filter string, start, end time.Time, sd clients.MetricClient) ([]*monitoringpb.TimeSeries, error) {
+	req := newTimeSeriesRequest(cfg, filter, start, end)
+	req.Name = fmt.Sprintf("projects/%s", cfg.metricsProject())
+	req.Aggregation.PerSeriesAligner, req.Aggregation.CrossSeriesReducer = cfg.aggregation(filter)
+
+	series, err := sd.ListTimeSeries(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("ListTimeSeries (%v) error: %v", req, err)
+	}
+
+	if len(series) == 0 {
+		logEntry(cfg, severityInfo, logFields{"filter": filter}, "Got 0 time series while querying '%s'", filter)
+		return nil, errNoTimeSeries
+	} else if len(series) > 1 {
+		logEntry(cfg, severityInfo, logFields{"filter": filter, "count": len(series)},
+			"Got %d time series while querying '%s'; adding them up", len(series), filter)
+	}
+	additive := req.Aggregation.PerSeriesAligner == monitoringpb.Aggregation_ALIGN_DELTA
+	for _, s := range series {
+		if len(s.Points) == 0 || (len(s.Points) > 1 && !additive) {
+			return nil, &CounterError{Filter: filter, Reason: CounterPointCount, SeriesCount: len(series), PointCount: len(s.Points)}
+		}
+		if len(s.Points) > 1 {
+			logEntry(cfg, severityInfo, logFields{"filter": filter, "count": len(s.Points)},
+				"Got %d points in a time series matching '%s'; adding them up", len(s.Points), filter)
+		}
+	}
+	return series, nil
+}
+
+// countInRange returns the number of values in a distribution that fall into a given range.
+// Since only bucket counts are known, a bucket is counted only if it lies within the range completely;
+// SLO ranges are expected to be aligned with bucket boundaries.
+func countInRange(d *distributionpb.Distribution, r *clients.Range) int64 {
+	bounds := bucketBounds(d.GetBucketOptions())
+	var count int64
+	for i, c := range d.GetBucketCounts() {
+		// Bucket 0 is the underflow bucket (-inf, bounds[0]); bucket i is [bounds[i-1], bounds[i]);
+		// the last bucket is the overflow bucket [bounds[len-1], +inf).
+		lower, upper := math.Inf(-1), math.Inf(1)
+		if i > 0 && i-1 < len(bounds) {
+			lower = bounds[i-1]
+		}
+		if i < len(bounds) {
+			upper = bounds[i]
+		}
+		if lower >= r.Min && upper <= r.Max {
+			count += c
+		}
+	}
+	return count
+}
+
+// bucketBounds returns the finite bucket boundaries defined by distribution bucket options.
+func bucketBounds(opts *distributionpb.Distribution_BucketOptions) []float64 {
+	var bounds []float64
+	if b := opts.GetLinearBuckets(); b != nil {
+		for i := 0; i <= int(b.NumFiniteBuckets); i++ {
+			bounds = append(bounds, b.Offset+b.Width*float64(i))
+		}
+	} else if b := opts.GetExponentialBuckets(); b != nil {
+		for i := 0; i <= int(b.NumFiniteBuckets); i++ {
+			bounds = append(bounds, b.Scale*math.Pow(b.GrowthFactor, float64(i)))
+		}
+	} else if b := opts.GetExplicitBuckets(); b != nil {
+		bounds = b.Bounds
+	}
+	return bounds
+}
@@ -15,19 +15,33 @@
 package slo2bq
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"reflect"
 	"slo2bq/clients"
 	"slo2bq/clients/mocks"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/golang/mock/gomock"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
+// fixedClock returns a clock for Config.clock which always returns a given time.
+func fixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
 func TestDaysAgoMidnightTimestamp(t *testing.T) {
 	for _, tt := range []struct {
 		name            string
@@ -39,6 +53,18 @@ func TestDaysAgoMidnightTimestamp(t *testing.T) {
 		{"2015-03-29 in London is 23hr long", time.Date(2015, time.March, 29, 15, 0, 0, 0, time.UTC), "Europe/London", 23 * time.Hour},
 		{"2015-10-25 in London is 25hr long", time.Date(2015, time.October, 25, 15, 0, 0, 0, time.UTC), "Europe/London", 25 * time.Hour},
 		{"2015-10-04 in Lord Howe is 23h30m long", time.Date(2015, time.October, 4, 1, 0, 0, 0, time.UTC), "Australia/Lord_Howe", 23*time.Hour + 30*time.Minute},
+		// Midnight is skipped: the day starts at 01:00, and the day before is not affected.
+		{"2015-03-07 in Havana is 24hr long", time.Date(2015, time.March, 7, 15, 0, 0, 0, time.UTC), "America/Havana", 24 * time.Hour},
+		{"2015-03-08 in Havana is 23hr long", time.Date(2015, time.March, 8, 15, 0, 0, 0, time.UTC), "America/Havana", 23 * time.Hour},
+		{"2016-08-13 in Santiago is 24hr long", time.Date(2016, time.August, 13, 15, 0, 0, 0, time.UTC), "America/Santiago", 24 * time.Hour},
+		{"2016-08-14 in Santiago is 23hr long", time.Date(2016, time.August, 14, 15, 0, 0, 0, time.UTC), "America/Santiago", 23 * time.Hour},
+		{"2008-06-01 in Casablanca is 23hr long", time.Date(2008, time.June, 1, 15, 0, 0, 0, time.UTC), "Africa/Casablanca", 23 * time.Hour},
+		// Midnight is repeated: the day starts at the first one.
+		{"2015-10-31 in Havana is 24hr long", time.Date(2015, time.October, 31, 15, 0, 0, 0, time.UTC), "America/Havana", 24 * time.Hour},
+		{"2015-11-01 in Havana is 25hr long", time.Date(2015, time.November, 1, 15, 0, 0, 0, time.UTC), "America/Havana", 25 * time.Hour},
+		// The clock is set back from midnight to 23:00, so the previous day is longer.
+		{"2016-05-14 in Santiago is 25hr long", time.Date(2016, time.May, 14, 15, 0, 0, 0, time.UTC), "America/Santiago", 25 * time.Hour},
+		{"2016-05-15 in Santiago is 24hr long", time.Date(2016, time.May, 15, 15, 0, 0, 0, time.UTC), "America/Santiago", 24 * time.Hour},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			loc, err := time.LoadLocation(tt.timeZone)
@@ -53,28 +79,57 @@ func TestDaysAgoMidnightTimestamp(t *testing.T) {
 			if duration != tt.wantDayDuration {
 				t.Errorf("expected duration of %v; got %v", tt.wantDayDuration, duration)
 			}
+			// The day starts on its own date, and the previous day ends right before it.
+			if got, want := ts1.In(loc).Format("2006-01-02"), tt.time.In(loc).Format("2006-01-02"); got != want {
+				t.Errorf("expected the day to start on %s; got %v", want, ts1)
+			}
+			if got, want := ts1.Add(-time.Nanosecond).In(loc).Format("2006-01-02"), tt.time.In(loc).AddDate(0, 0, -1).Format("2006-01-02"); got != want {
+				t.Errorf("expected the previous day (%s) to end at %v; got %s", want, ts1, got)
+			}
 		})
 	}
 }
 
+func TestDaysAgoMidnightTimestampSkippedDay(t *testing.T) {
+	// Samoa moved across the date line, skipping 2011-12-30.
+	loc, err := time.LoadLocation("Pacific/Apia")
+	if err != nil {
+		t.Fatalf("LoadLocation() unexpected error: %v", err)
+	}
+	now := time.Date(2011, time.December, 31, 12, 0, 0, 0, loc)
+	start, end := daysAgoMidnightTimestamp(now, loc, 1), daysAgoMidnightTimestamp(now, loc, 0)
+	if !start.Equal(end) {
+		t.Errorf("expected 2011-12-30 in Apia to be empty; got %v - %v", start, end)
+	}
+	if d := start.Sub(daysAgoMidnightTimestamp(now, loc, 2)); d != 24*time.Hour {
+		t.Errorf("expected 2011-12-29 in Apia to be 24hr long; got %v", d)
+	}
+}
+
+// londonDay sets the queried interval of a daily row to its date in Europe/London.
+func londonDay(r *clients.BQRow) *clients.BQRow {
+	loc, _ := time.LoadLocation("Europe/London")
+	start, _ := time.ParseInLocation("2006-01-02", r.Date, loc)
+	r.IntervalStart, r.IntervalEnd = start.UTC(), start.AddDate(0, 0, 1).UTC()
+	return r
+}
+
 func TestSyncAllServices(t *testing.T) {
-	timeNow = func() time.Time { return time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC) }
-	backfillDays = 2
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
 	bqBatchSize = 1
-	defer func() { timeNow = time.Now }()
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	bq := mocks.NewMockBigQueryClient(mockCtrl)
 	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{
-		&clients.BQRow{Service: "svc1", SLO: "slo1", Date: "2015-05-08"},
-		&clients.BQRow{Service: "svc1", SLO: "slo2", Date: "2015-05-09"},
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: "2015-05-08"},
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo2", Date: "2015-05-09"},
 	}, nil)
 
 	sloc := mocks.NewMockSLOClient(mockCtrl)
-	sloc.EXPECT().Services().Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
-	sloc.EXPECT().SLOs(gomock.Any()).Return([]*clients.SLO{
-		&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99},
-		&clients.SLO{Name: "s1", DisplayName: "slo2", Goal: 0.5},
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "projects/project/services/svc1-id", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{
+		&clients.SLO{Name: "projects/project/services/svc1-id/serviceLevelObjectives/slo1-id", DisplayName: "slo1", Goal: 0.99, RollingPeriod: "2419200s"},
+		&clients.SLO{Name: "projects/project/services/svc1-id/serviceLevelObjectives/slo2-id", DisplayName: "slo2", Goal: 0.5, CalendarPeriod: "MONTH"},
 	}, nil)
 
 	sd := mocks.NewMockMetricClient(mockCtrl)
@@ -91,18 +146,70 @@ func TestSyncAllServices(t *testing.T) {
 	}, nil)
 
 	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", []*clients.BQRow{
-		&clients.BQRow{Service: "svc1", SLO: "slo1", Date: "2015-05-09", Target: 0.99, Good: 100, Total: 111},
+		londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "svc1-id", SLOID: "slo1-id", Date: "2015-05-09", Target: 0.99, Good: 100, Total: 111,
+			BadEvents: 11, ErrorBudget: errorBudget(111, 0.99), Period: "rolling 28d", ValueType: "DOUBLE"}),
 	})
 	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", []*clients.BQRow{
-		&clients.BQRow{Service: "svc1", SLO: "slo2", Date: "2015-05-08", Target: 0.5, Good: 100, Total: 111},
+		londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo2", ServiceID: "svc1-id", SLOID: "slo2-id", Date: "2015-05-08", Target: 0.5, Good: 100, Total: 111,
+			BadEvents: 11, ErrorBudget: 55.5, Period: "calendar MONTH", ValueType: "DOUBLE"}),
 	})
 	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", nil) // final Put with no rows.
 
-	cfg := &Config{Project: "project", Dataset: "datasetname", TimeZone: "Europe/London"}
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2}
+
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	want := &SyncResult{
+		ServicesSeen:  1,
+		SLOsProcessed: 2,
+		RowsWritten:   2,
+		RowsPerSLO:    map[string]int{"project/svc1/slo1": 1, "project/svc1/slo2": 1},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("expected sync result %+v; got %+v", want, res)
+	}
+}
+
+func TestSyncAllServicesShardByDate(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	bqBatchSize = 1
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).Return([]*monitoringpb.TimeSeries{
+		&monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "good"}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 100}}}}},
+		&monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "bad"}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 11}}}}},
+	}, nil)
+
+	// Each shard is created once, before rows are written to it; the unsharded table is not used.
+	for _, shard := range []string{"data_20150508", "data_20150509"} {
+		bq.EXPECT().EnsureTable(gomock.Any(), "datasetname", shard)
+		bq.EXPECT().Put(gomock.Any(), "datasetname", shard, gomock.Any())
+	}
 
-	if err := syncAllServices(context.Background(), cfg, sd, sloc, bq); err != nil {
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2, ShardByDate: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
 		t.Errorf("syncAllServices() unexpected error: %v", err)
 	}
+	if res.RowsWritten != 2 {
+		t.Errorf("syncAllServices() expected 2 rows written; got %d", res.RowsWritten)
+	}
 }
 
 func TestSyncAllServicesErrors(t *testing.T) {
@@ -129,8 +236,8 @@ func TestSyncAllServicesErrors(t *testing.T) {
 			bq.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Return(tt.putErr)
 
 			sloc := mocks.NewMockSLOClient(mockCtrl)
-			sloc.EXPECT().Services().AnyTimes().Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, tt.servicesErr)
-			sloc.EXPECT().SLOs(gomock.Any()).AnyTimes().Return([]*clients.SLO{
+			sloc.EXPECT().Services(gomock.Any()).AnyTimes().Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, tt.servicesErr)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).AnyTimes().Return([]*clients.SLO{
 				&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, tt.slosErr)
 
 			sd := mocks.NewMockMetricClient(mockCtrl)
@@ -146,10 +253,2789 @@ func TestSyncAllServicesErrors(t *testing.T) {
 			}, tt.sdErr)
 
 			cfg := &Config{Project: "project", Dataset: "datasetname", TimeZone: "Europe/London"}
-			err := syncAllServices(context.Background(), cfg, sd, sloc, bq)
+			_, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
 			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
 				t.Errorf("syncAllServices() expected error to contain '%s'; got %v", tt.wantErr, err)
 			}
 		})
 	}
 }
+
+func TestGetGoodTotalDistributionCut(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Do(func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) {
+		if req.Filter != "latency" {
+			t.Errorf("unexpected filter: %s", req.Filter)
+		}
+		if req.Aggregation.PerSeriesAligner != monitoringpb.Aggregation_ALIGN_DELTA || req.Aggregation.CrossSeriesReducer != monitoringpb.Aggregation_REDUCE_SUM {
+			t.Errorf("unexpected aggregation: %v", req.Aggregation)
+		}
+	}).Return([]*monitoringpb.TimeSeries{
+		&monitoringpb.TimeSeries{
+			ValueType: metricpb.MetricDescriptor_DISTRIBUTION, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{
+					DistributionValue: &distributionpb.Distribution{
+						Count: 157,
+						// Buckets: (-inf, 0), [0, 100), [100, 200), [200, 300), [300, 400), [400, 500), [500, +inf).
+						BucketOptions: &distributionpb.Distribution_BucketOptions{Options: &distributionpb.Distribution_BucketOptions_LinearBuckets{
+							LinearBuckets: &distributionpb.Distribution_BucketOptions_Linear{NumFiniteBuckets: 5, Width: 100, Offset: 0}}},
+						BucketCounts: []int64{0, 10, 20, 30, 40, 50, 7},
+					}}}}}},
+	}, nil)
+
+	slo := &clients.SLO{Name: "s1", SLI: &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{
+		DistributionCut: &clients.DistributionCut{DistributionFilter: "latency", Range: &clients.Range{Min: 0, Max: 300}}}}}
+	cfg := &Config{Project: "project"}
+	start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+	good, total, valueType, err := getGoodTotal(context.Background(), cfg, slo, start, start.AddDate(0, 0, 1), sd)
+	if err != nil {
+		t.Errorf("getGoodTotal() unexpected error: %v", err)
+	}
+	if good != 60 || total != 157 {
+		t.Errorf("expected 60 good and 157 total events; got %d and %d", good, total)
+	}
+	if valueType != "DISTRIBUTION" {
+		t.Errorf("expected value type DISTRIBUTION; got %q", valueType)
+	}
+}
+
+func TestGetGoodTotalPreferSLIType(t *testing.T) {
+	sli := &clients.SLI{
+		RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}},
+		WindowsBasedSLI: &clients.WindowsBasedSLI{WindowPeriod: "300s", GoodBadMetricFilter: "healthy"},
+	}
+	for _, tt := range []struct {
+		name                string
+		prefer              string
+		sli                 *clients.SLI
+		wantFilters         []string
+		wantGood, wantTotal int64
+		wantValueType       string
+	}{
+		{"both, default", "", sli, []string{"good", "total"}, 90, 100, "INT64"},
+		{"both, prefer request", "request", sli, []string{"good", "total"}, 90, 100, "INT64"},
+		{"both, prefer windows", "windows", sli, []string{`select_slo_counts("s1")`}, 280, 288, "DOUBLE"},
+		{"request only, prefer windows", "windows", &clients.SLI{RequestBasedSLI: sli.RequestBasedSLI}, []string{"good", "total"}, 90, 100, "INT64"},
+		{"windows only, prefer request", "request", &clients.SLI{WindowsBasedSLI: sli.WindowsBasedSLI}, []string{`select_slo_counts("s1")`}, 280, 288, "DOUBLE"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			values := map[string]int64{"good": 90, "total": 100}
+			var filters []string
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(len(tt.wantFilters)).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					filters = append(filters, req.Filter)
+					if strings.HasPrefix(req.Filter, "select_slo_counts") {
+						// 280 good and 8 bad 5-minute windows.
+						return []*monitoringpb.TimeSeries{
+							&monitoringpb.TimeSeries{Metric: &metricpb.Metric{Labels: map[string]string{"event_type": "good"}},
+								ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+									&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 280}}}}},
+							&monitoringpb.TimeSeries{Metric: &metricpb.Metric{Labels: map[string]string{"event_type": "bad"}},
+								ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+									&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 8}}}}},
+						}, nil
+					}
+					return []*monitoringpb.TimeSeries{
+						&monitoringpb.TimeSeries{
+							ValueType: metricpb.MetricDescriptor_INT64, Points: []*monitoringpb.Point{
+								&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: values[req.Filter]}}}}},
+					}, nil
+				})
+
+			slo := &clients.SLO{Name: "s1", SLI: tt.sli}
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			good, total, valueType, err := getGoodTotal(context.Background(), &Config{Project: "project", PreferSLIType: tt.prefer}, slo, start, start.AddDate(0, 0, 1), sd)
+			if err != nil {
+				t.Errorf("getGoodTotal() unexpected error: %v", err)
+			}
+			if good != tt.wantGood || total != tt.wantTotal {
+				t.Errorf("expected %d good and %d total events; got %d and %d", tt.wantGood, tt.wantTotal, good, total)
+			}
+			if valueType != tt.wantValueType {
+				t.Errorf("expected value type %q; got %q", tt.wantValueType, valueType)
+			}
+			sort.Strings(filters)
+			if !reflect.DeepEqual(filters, tt.wantFilters) {
+				t.Errorf("expected queries for filters %v; got %v", tt.wantFilters, filters)
+			}
+		})
+	}
+}
+
+// queryResult returns a result of a query with a single value column of a given type, with a time series
+// for every list of values.
+func queryResult(valueType string, series ...[]*clients.QueryValue) *clients.QueryResult {
+	res := &clients.QueryResult{PointDescriptors: []*clients.PointDescriptor{{Key: "value.count", ValueType: valueType, MetricKind: "DELTA"}}}
+	for _, values := range series {
+		d := &clients.TimeSeriesData{}
+		for _, v := range values {
+			d.PointData = append(d.PointData, &clients.PointData{Values: []*clients.QueryValue{v}})
+		}
+		res.Data = append(res.Data, d)
+	}
+	return res
+}
+
+func TestGetGoodTotalTimeSeriesQuery(t *testing.T) {
+	int64Values := func(values ...int64) []*clients.QueryValue {
+		var vs []*clients.QueryValue
+		for _, v := range values {
+			vs = append(vs, &clients.QueryValue{Int64Value: v})
+		}
+		return vs
+	}
+	for _, tt := range []struct {
+		name                string
+		results             map[string]*clients.QueryResult
+		wantGood, wantTotal int64
+		wantValueType       string
+		wantErr             string
+	}{
+		{"int64 points are added up", map[string]*clients.QueryResult{
+			"fetch good":  queryResult("INT64", int64Values(40, 20), int64Values(30)),
+			"fetch total": queryResult("INT64", int64Values(100)),
+		}, 90, 100, "INT64", ""},
+		{"double", map[string]*clients.QueryResult{
+			"fetch good":  queryResult("DOUBLE", []*clients.QueryValue{{DoubleValue: 89.5}, {DoubleValue: 0.5}}),
+			"fetch total": queryResult("DOUBLE", []*clients.QueryValue{{DoubleValue: 100}}),
+		}, 90, 100, "DOUBLE", ""},
+		{"distribution", map[string]*clients.QueryResult{
+			"fetch good":  queryResult("DISTRIBUTION", []*clients.QueryValue{{DistributionValue: &clients.QueryDistribution{Count: 90}}}),
+			"fetch total": queryResult("DISTRIBUTION", []*clients.QueryValue{{DistributionValue: &clients.QueryDistribution{Count: 100}}}),
+		}, 90, 100, "DISTRIBUTION", ""},
+		{"no good time series", map[string]*clients.QueryResult{
+			"fetch good":  queryResult("INT64"),
+			"fetch total": queryResult("INT64", int64Values(100)),
+		}, 0, 100, "INT64", ""},
+		{"several value columns", map[string]*clients.QueryResult{
+			"fetch good": &clients.QueryResult{
+				PointDescriptors: []*clients.PointDescriptor{{ValueType: "INT64"}, {ValueType: "INT64"}},
+				Data:             []*clients.TimeSeriesData{{}}},
+		}, 0, 0, "", "expected query 'fetch good' to return a single value column; got 2"},
+		{"unsupported value type", map[string]*clients.QueryResult{
+			"fetch good": queryResult("STRING", []*clients.QueryValue{{}}),
+		}, 0, 0, "", "unsupported value type STRING returned by query 'fetch good'"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().QueryTimeSeries(gomock.Any(), "metrics-project", gomock.Any()).AnyTimes().DoAndReturn(
+				func(_ context.Context, _, query string) (*clients.QueryResult, error) {
+					const within = " | within d'2015/05/09 00:00:00', d'2015/05/10 00:00:00'"
+					if !strings.HasSuffix(query, within) {
+						t.Errorf("expected query to end with %q; got %q", within, query)
+					}
+					return tt.results[strings.TrimSuffix(query, within)], nil
+				})
+
+			sli := &clients.TimeSeriesQueryRatio{Good: "fetch good", Total: "fetch total"}
+			slo := &clients.SLO{Name: "s1", SLI: &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{TimeSeriesQuery: sli}}}
+			cfg := &Config{Project: "project", MetricsProject: "metrics-project"}
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			good, total, valueType, err := getGoodTotal(context.Background(), cfg, slo, start, start.AddDate(0, 0, 1), sd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("getGoodTotal() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getGoodTotal() unexpected error: %v", err)
+			}
+			if good != tt.wantGood || total != tt.wantTotal {
+				t.Errorf("expected %d good and %d total events; got %d and %d", tt.wantGood, tt.wantTotal, good, total)
+			}
+			if valueType != tt.wantValueType {
+				t.Errorf("expected value type %q; got %q", tt.wantValueType, valueType)
+			}
+		})
+	}
+}
+
+func TestGetGoodTotalLabelRatio(t *testing.T) {
+	values := map[string]int64{
+		`metric.type="requests"`: 100,
+		`metric.type="requests" AND metric.label.code = one_of("200", "300")`: 90,
+		`metric.type="requests" AND metric.label.code = one_of("500")`:        4,
+	}
+	for _, tt := range []struct {
+		name                string
+		ratio               LabelRatio
+		wantGood, wantTotal int64
+	}{
+		{"good and bad", LabelRatio{Filter: `metric.type="requests"`, Label: "metric.label.code", Good: []string{"200", "300"}, Bad: []string{"500"}}, 90, 94},
+		{"good only", LabelRatio{Filter: `metric.type="requests"`, Label: "metric.label.code", Good: []string{"200", "300"}}, 90, 100},
+		{"bad only", LabelRatio{Filter: `metric.type="requests"`, Label: "metric.label.code", Bad: []string{"500"}}, 96, 100},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					v, ok := values[req.Filter]
+					if !ok {
+						t.Errorf("unexpected filter: %s", req.Filter)
+					}
+					return []*monitoringpb.TimeSeries{int64Series(v)}, nil
+				})
+
+			// The label ratio takes precedence over the SLI of the SLO.
+			slo := &clients.SLO{Name: "projects/project/services/svc1/serviceLevelObjectives/slo1",
+				SLI: &clients.SLI{WindowsBasedSLI: &clients.WindowsBasedSLI{WindowPeriod: "300s"}}}
+			cfg := &Config{Project: "project", LabelRatios: map[string]LabelRatio{"svc1/slo1": tt.ratio}}
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			good, total, _, err := getGoodTotal(context.Background(), cfg, slo, start, start.AddDate(0, 0, 1), sd)
+			if err != nil {
+				t.Fatalf("getGoodTotal() unexpected error: %v", err)
+			}
+			if good != tt.wantGood || total != tt.wantTotal {
+				t.Errorf("expected %d good and %d total events; got %d and %d", tt.wantGood, tt.wantTotal, good, total)
+			}
+		})
+	}
+}
+
+func TestGetGoodTotalMetricsProject(t *testing.T) {
+	ratio := &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}}}
+	cut := &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{
+		DistributionCut: &clients.DistributionCut{DistributionFilter: "latency", Range: &clients.Range{Min: 0, Max: 300}}}}
+	windows := &clients.SLI{WindowsBasedSLI: &clients.WindowsBasedSLI{WindowPeriod: "300s", GoodBadMetricFilter: "healthy"}}
+	for _, tt := range []struct {
+		name     string
+		cfg      *Config
+		sli      *clients.SLI
+		wantName string
+	}{
+		{"ratio", &Config{Project: "project"}, ratio, "projects/project"},
+		{"ratio, metrics project", &Config{Project: "project", MetricsProject: "metrics"}, ratio, "projects/metrics"},
+		{"distribution cut, metrics project", &Config{Project: "project", MetricsProject: "metrics"}, cut, "projects/metrics"},
+		// select_slo_counts can only be evaluated in the project hosting the SLO.
+		{"windows, metrics project", &Config{Project: "project", MetricsProject: "metrics"}, windows, "projects/project"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).MinTimes(1).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					if req.Name != tt.wantName {
+						t.Errorf("expected request name %s for '%s'; got %s", tt.wantName, req.Filter, req.Name)
+					}
+					switch {
+					case strings.HasPrefix(req.Filter, "select_slo_counts"):
+						return goodBadSeries(280, 8), nil
+					case req.Filter == "latency":
+						return []*monitoringpb.TimeSeries{distributionSeries(0)}, nil
+					}
+					return []*monitoringpb.TimeSeries{int64Series(100)}, nil
+				})
+
+			slo := &clients.SLO{Name: "s1", SLI: tt.sli}
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			if _, _, _, err := getGoodTotal(context.Background(), tt.cfg, slo, start, start.AddDate(0, 0, 1), sd); err != nil {
+				t.Errorf("getGoodTotal() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetGoodTotalRatio(t *testing.T) {
+	for _, tt := range []struct {
+		name                string
+		sli                 *clients.GoodTotalRatioSLI
+		wantGood, wantTotal int64
+	}{
+		{"good and total", &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}, 90, 100},
+		{"good and bad", &clients.GoodTotalRatioSLI{Good: "good", Bad: "bad"}, 90, 100},
+		{"bad and total", &clients.GoodTotalRatioSLI{Bad: "bad", Total: "total"}, 90, 100},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			values := map[string]int64{"good": 90, "bad": 10, "total": 100}
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					return []*monitoringpb.TimeSeries{
+						&monitoringpb.TimeSeries{
+							ValueType: metricpb.MetricDescriptor_INT64, Points: []*monitoringpb.Point{
+								&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: values[req.Filter]}}}}},
+					}, nil
+				})
+
+			slo := &clients.SLO{Name: "s1", SLI: &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: tt.sli}}}
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			good, total, _, err := getGoodTotal(context.Background(), &Config{Project: "project"}, slo, start, start.AddDate(0, 0, 1), sd)
+			if err != nil {
+				t.Errorf("getGoodTotal() unexpected error: %v", err)
+			}
+			if good != tt.wantGood || total != tt.wantTotal {
+				t.Errorf("expected %d good and %d total events; got %d and %d", tt.wantGood, tt.wantTotal, good, total)
+			}
+		})
+	}
+}
+
+func TestGetGoodTotalRatioNoTimeSeries(t *testing.T) {
+	goodTotal := &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}
+	goodBad := &clients.GoodTotalRatioSLI{Good: "good", Bad: "bad"}
+	badTotal := &clients.GoodTotalRatioSLI{Bad: "bad", Total: "total"}
+	for _, tt := range []struct {
+		name                string
+		sli                 *clients.GoodTotalRatioSLI
+		values              map[string]int64
+		wantGood, wantTotal int64
+		wantWarning         bool
+		wantErr             error
+	}{
+		{"good/total: no good events", goodTotal, map[string]int64{"total": 100}, 0, 100, true, nil},
+		{"good/total: no total events", goodTotal, map[string]int64{"good": 90}, 90, 90, false, nil},
+		{"good/total: zero total events", goodTotal, map[string]int64{"total": 0}, 0, 0, false, nil},
+		{"good/total: no events at all", goodTotal, map[string]int64{}, 0, 0, false, errNoTimeSeries},
+		{"good/bad: no good events", goodBad, map[string]int64{"bad": 10}, 0, 10, true, nil},
+		{"good/bad: no bad events", goodBad, map[string]int64{"good": 90}, 90, 90, false, nil},
+		{"good/bad: no events at all", goodBad, map[string]int64{}, 0, 0, false, errNoTimeSeries},
+		{"bad/total: no bad events", badTotal, map[string]int64{"total": 100}, 100, 100, false, nil},
+		{"bad/total: no total events", badTotal, map[string]int64{"bad": 10}, 0, 10, false, nil},
+		{"bad/total: no events at all", badTotal, map[string]int64{}, 0, 0, false, errNoTimeSeries},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					if v, ok := tt.values[req.Filter]; ok {
+						return []*monitoringpb.TimeSeries{int64Series(v)}, nil
+					}
+					return nil, nil
+				})
+
+			var out bytes.Buffer
+			defer func(w io.Writer) { logOutput = w }(logOutput)
+			logOutput = &out
+
+			slo := &clients.SLO{Name: "s1", SLI: &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: tt.sli}}}
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			cfg := &Config{Project: "project", LogFormat: logFormatJSON}
+			good, total, _, err := getGoodTotal(context.Background(), cfg, slo, start, start.AddDate(0, 0, 1), sd)
+			if err != tt.wantErr {
+				t.Errorf("getGoodTotal() returned error %v; want %v", err, tt.wantErr)
+			}
+			if good != tt.wantGood || total != tt.wantTotal {
+				t.Errorf("expected %d good and %d total events; got %d and %d", tt.wantGood, tt.wantTotal, good, total)
+			}
+			if gotWarning := strings.Contains(out.String(), "No time series match good filter"); gotWarning != tt.wantWarning {
+				t.Errorf("getGoodTotal() logged warning = %v; want %v (log: %s)", gotWarning, tt.wantWarning, out.String())
+			}
+		})
+	}
+}
+
+func TestSyncAllServicesEmptyDays(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+
+	// Time series returned by select_slo_counts for an SLO without traffic.
+	var zeroSeries []*monitoringpb.TimeSeries
+	for _, eventType := range []string{"good", "bad"} {
+		zeroSeries = append(zeroSeries, &monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": eventType}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE,
+			Points:    []*monitoringpb.Point{&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 0}}}},
+		})
+	}
+	zeroRow := func(valueType string, c bigquery.NullFloat64) []*clients.BQRow {
+		return []*clients.BQRow{londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1",
+			Date: "2015-05-09", Target: 0.99, ValueType: valueType, EmptyCompliance: c})}
+	}
+
+	for _, tt := range []struct {
+		name               string
+		skipEmptyDays      bool
+		emptyDayCompliance string
+		series             []*monitoringpb.TimeSeries
+		wantRows           []*clients.BQRow
+	}{
+		{"zero row", false, "", nil, zeroRow("", bigquery.NullFloat64{})},
+		{"skipped row", true, "", nil, nil},
+		{"skipped zero row", false, "skip", zeroSeries, nil},
+		{"skipped zero row without series", false, "skip", nil, nil},
+		{"compliant zero row", false, "hundred", zeroSeries, zeroRow("DOUBLE", bigquery.NullFloat64{Float64: 1, Valid: true})},
+		{"compliant zero row without series", false, "hundred", nil, zeroRow("", bigquery.NullFloat64{Float64: 1, Valid: true})},
+		{"non-compliant zero row", false, "zero", zeroSeries, zeroRow("DOUBLE", bigquery.NullFloat64{Float64: 0, Valid: true})},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+			bq.EXPECT().Put(gomock.Any(), "datasetname", "data", tt.wantRows).Return(nil)
+
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(tt.series, nil).AnyTimes()
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1,
+				SkipEmptyDays: tt.skipEmptyDays, EmptyDayCompliance: tt.emptyDayCompliance}
+			res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+			if err != nil {
+				t.Errorf("syncAllServices() unexpected error: %v", err)
+			}
+			if res.RowsWritten != len(tt.wantRows) {
+				t.Errorf("expected %d rows to be written; got %+v", len(tt.wantRows), res)
+			}
+		})
+	}
+}
+
+func TestPruneOldRows(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	for _, tt := range []struct {
+		name          string
+		cfg           *Config
+		wantOlderThan time.Time
+	}{
+		{"disabled", &Config{clock: clock}, time.Time{}},
+		{"enabled", &Config{clock: clock, RetentionDays: 100}, time.Date(2015, time.January, 30, 0, 0, 0, 0, time.UTC)},
+		// It is already May 11 in Tokyo.
+		{"time zone", &Config{clock: clock, RetentionDays: 100, TimeZone: "Asia/Tokyo"}, time.Date(2015, time.January, 30, 15, 0, 0, 0, time.UTC)},
+		{"dry run", &Config{clock: clock, RetentionDays: 100, DryRun: true}, time.Time{}},
+		{"backfill range", &Config{clock: clock, RetentionDays: 100, BackfillStart: "2015-05-01", BackfillEnd: "2015-05-02"}, time.Time{}},
+		{"replay", &Config{clock: clock, RetentionDays: 100, Replay: []ReplayCell{{Service: "svc", SLO: "slo", Date: "2015-05-01"}}}, time.Time{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			if !tt.wantOlderThan.IsZero() {
+				bq.EXPECT().PruneOldRows(gomock.Any(), "datasetname", "data", gomock.Any()).Do(
+					func(_ context.Context, _, _ string, olderThan time.Time) {
+						if !olderThan.Equal(tt.wantOlderThan) {
+							t.Errorf("expected rows older than %v to be pruned; got %v", tt.wantOlderThan, olderThan)
+						}
+					}).Return(nil)
+			}
+
+			tt.cfg.Dataset = "datasetname"
+			if err := pruneOldRows(context.Background(), tt.cfg, bq); err != nil {
+				t.Errorf("pruneOldRows() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewRecordsBackfillDays(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		name         string
+		backfillDays int
+		wantFirst    string
+		wantLast     string
+		wantLen      int
+	}{
+		{"default", 0, "2015-05-09", "2015-03-31", 40},
+		{"three days", 3, "2015-05-09", "2015-05-07", 3},
+		{"one day", 1, "2015-05-09", "2015-05-09", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{clock: clock, Project: "project", TimeZone: "Europe/London", BackfillDays: tt.backfillDays}
+			svc := &clients.Service{Name: "s1", DisplayName: "svc1"}
+			slo := &clients.SLO{Name: "s1", DisplayName: "slo1"}
+			recs, err := newRecords(cfg, svc, slo, bqMap{})
+			if err != nil {
+				t.Fatalf("newRecords() unexpected error: %v", err)
+			}
+			if len(recs) != tt.wantLen {
+				t.Fatalf("expected %d records; got %d", tt.wantLen, len(recs))
+			}
+			first, last := recs[0].row.Date, recs[len(recs)-1].row.Date
+			if first != tt.wantFirst || last != tt.wantLast {
+				t.Errorf("expected records from %s to %s; got %s to %s", tt.wantFirst, tt.wantLast, first, last)
+			}
+		})
+	}
+}
+
+func TestGetCounter(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		series      []*monitoringpb.TimeSeries
+		want        int64
+		wantTypes   string
+		wantWarning bool
+		wantErr     string
+	}{
+		{"no series", nil, 0, "", false, "no time series found"},
+		{"one series", []*monitoringpb.TimeSeries{int64Series(10)}, 10, "INT64", false, ""},
+		{"two series with one point each", []*monitoringpb.TimeSeries{int64Series(10), int64Series(32)}, 42, "INT64", false, ""},
+		{"two points in a series", []*monitoringpb.TimeSeries{int64Series(10, 32)}, 42, "INT64", false, ""},
+		{"series without points", []*monitoringpb.TimeSeries{int64Series(10), int64Series()}, 0, "", false, "expected to get 1 point"},
+		{"double series", []*monitoringpb.TimeSeries{doubleSeries(10.5), doubleSeries(31.5)}, 42, "DOUBLE", true, ""},
+		{"whole double series", []*monitoringpb.TimeSeries{doubleSeries(10), doubleSeries(32)}, 42, "DOUBLE", false, ""},
+		{"distribution series", []*monitoringpb.TimeSeries{distributionSeries(40), int64Series(2)}, 42, "DISTRIBUTION,INT64", false, ""},
+		{"bool series", []*monitoringpb.TimeSeries{boolSeries(true), boolSeries(false), boolSeries(true)}, 2, "BOOL", false, ""},
+		{"string series", []*monitoringpb.TimeSeries{&monitoringpb.TimeSeries{
+			Metric: &metricpb.Metric{Type: "custom.googleapis.com/version"}, MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_STRING,
+			Points: []*monitoringpb.Point{&monitoringpb.Point{Value: &monitoringpb.TypedValue{}}}}},
+			0, "", false, "unsupported value type STRING of metric custom.googleapis.com/version (kind GAUGE) for filter 'filter'"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(tt.series, nil)
+
+			var out bytes.Buffer
+			defer func(w io.Writer) { logOutput = w }(logOutput)
+			logOutput = &out
+
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			got, types, err := getCounter(context.Background(), &Config{Project: "project", LogFormat: logFormatJSON}, "filter", start, start.AddDate(0, 0, 1), sd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("getCounter() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("getCounter() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getCounter() = %d; want %d", got, tt.want)
+			}
+			if types.String() != tt.wantTypes {
+				t.Errorf("getCounter() value types = %q; want %q", types.String(), tt.wantTypes)
+			}
+			if gotWarning := strings.Contains(out.String(), "non-integer DOUBLE values"); gotWarning != tt.wantWarning {
+				t.Errorf("getCounter() logged warning = %v; want %v (log: %s)", gotWarning, tt.wantWarning, out.String())
+			}
+		})
+	}
+}
+
+func TestGetCounterDST(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		now        time.Time
+		tz         string
+		wantPeriod int64
+	}{
+		{"2015-03-29 in London is 23hr long", time.Date(2015, time.March, 30, 15, 0, 0, 0, time.UTC), "Europe/London", 23 * 3600},
+		{"2015-10-25 in London is 25hr long", time.Date(2015, time.October, 26, 15, 0, 0, 0, time.UTC), "Europe/London", 25 * 3600},
+		{"2015-10-04 in Lord Howe is 23h30m long", time.Date(2015, time.October, 5, 1, 0, 0, 0, time.UTC), "Australia/Lord_Howe", 23*3600 + 1800},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.tz)
+			if err != nil {
+				t.Fatalf("could not load location %s: %v", tt.tz, err)
+			}
+			start := daysAgoMidnightTimestamp(tt.now, loc, 1)
+			end := daysAgoMidnightTimestamp(tt.now, loc, 0)
+
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					if got := req.Aggregation.AlignmentPeriod.Seconds; got != tt.wantPeriod {
+						t.Errorf("expected alignment period of %ds; got %ds", tt.wantPeriod, got)
+					}
+					if req.Interval.StartTime.Seconds != start.Unix() || req.Interval.EndTime.Seconds != end.Unix() {
+						t.Errorf("expected interval from %v to %v; got %v", start, end, req.Interval)
+					}
+					return []*monitoringpb.TimeSeries{int64Series(42)}, nil
+				})
+
+			got, _, err := getCounter(context.Background(), &Config{Project: "project"}, "filter", start, end, sd)
+			if err != nil {
+				t.Errorf("getCounter() unexpected error: %v", err)
+			}
+			if got != 42 {
+				t.Errorf("getCounter() = %d; want 42", got)
+			}
+		})
+	}
+}
+
+func TestGetSubIntervalCounter(t *testing.T) {
+	// 2015-10-25 in London is 25hr long.
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("could not load location: %v", err)
+	}
+	now := time.Date(2015, time.October, 26, 15, 0, 0, 0, time.UTC)
+	start, end := daysAgoMidnightTimestamp(now, loc, 1), daysAgoMidnightTimestamp(now, loc, 0)
+
+	for _, tt := range []struct {
+		name         string
+		subIntervals int
+		end          time.Time
+		// values are counts returned for consecutive sub-intervals; -1 means no time series.
+		values      []int64
+		wantPeriods []int64
+		want        int64
+		wantErr     string
+	}{
+		{"default", 0, end, []int64{42}, []int64{25 * 3600}, 42, ""},
+		{"four sub-intervals", 4, end, []int64{1, 2, 3, 4},
+			[]int64{6*3600 + 900, 6*3600 + 900, 6*3600 + 900, 6*3600 + 900}, 10, ""},
+		{"uneven sub-intervals", 7, end, []int64{1, 1, 1, 1, 1, 1, 1},
+			[]int64{12857, 12857, 12857, 12857, 12857, 12857, 12858}, 7, ""},
+		{"sub-interval without series", 4, end, []int64{1, -1, 3, 4},
+			[]int64{6*3600 + 900, 6*3600 + 900, 6*3600 + 900, 6*3600 + 900}, 8, ""},
+		{"no series", 2, end, []int64{-1, -1}, []int64{12*3600 + 1800, 12*3600 + 1800}, 0, "no time series found"},
+		{"short interval", 4, start.Add(150 * time.Second), []int64{1, 2}, []int64{75, 75}, 3, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			var periods []int64
+			next := start
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(len(tt.values)).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					// Sub-intervals should be contiguous.
+					if req.Interval.StartTime.Seconds != next.Unix() {
+						t.Errorf("expected sub-interval to start at %v; got %v", next, req.Interval)
+					}
+					next = time.Unix(req.Interval.EndTime.Seconds, 0)
+					periods = append(periods, req.Aggregation.AlignmentPeriod.Seconds)
+					if v := tt.values[len(periods)-1]; v >= 0 {
+						return []*monitoringpb.TimeSeries{int64Series(v)}, nil
+					}
+					return nil, nil
+				})
+
+			cfg := &Config{Project: "project", SubIntervals: tt.subIntervals}
+			got, _, err := getSubIntervalCounter(context.Background(), cfg, "filter", start, tt.end, sd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("getSubIntervalCounter() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Errorf("getSubIntervalCounter() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getSubIntervalCounter() = %d; want %d", got, tt.want)
+			}
+			if !next.Equal(tt.end) {
+				t.Errorf("expected sub-intervals to end at %v; got %v", tt.end, next)
+			}
+			if !reflect.DeepEqual(periods, tt.wantPeriods) {
+				t.Errorf("expected alignment periods %v; got %v", tt.wantPeriods, periods)
+			}
+		})
+	}
+}
+
+func TestGetCounterAggregation(t *testing.T) {
+	aggregations := map[string]Aggregation{
+		"gauge":        Aggregation{Aligner: "ALIGN_COUNT"},
+		"mean":         Aggregation{Aligner: "ALIGN_MEAN", Reducer: "REDUCE_MEAN"},
+		"bool":         Aggregation{Aligner: "ALIGN_COUNT_TRUE"},
+		"reduction":    Aggregation{Reducer: "REDUCE_MAX"},
+		"rate":         Aggregation{Rate: true},
+		"counter rate": Aggregation{Aligner: "ALIGN_RATE", Rate: true},
+	}
+	for _, tt := range []struct {
+		filter      string
+		wantAligner monitoringpb.Aggregation_Aligner
+		wantReducer monitoringpb.Aggregation_Reducer
+	}{
+		{"counter", monitoringpb.Aggregation_ALIGN_DELTA, monitoringpb.Aggregation_REDUCE_SUM},
+		{"gauge", monitoringpb.Aggregation_ALIGN_COUNT, monitoringpb.Aggregation_REDUCE_SUM},
+		{"mean", monitoringpb.Aggregation_ALIGN_MEAN, monitoringpb.Aggregation_REDUCE_MEAN},
+		{"bool", monitoringpb.Aggregation_ALIGN_COUNT_TRUE, monitoringpb.Aggregation_REDUCE_SUM},
+		{"reduction", monitoringpb.Aggregation_ALIGN_DELTA, monitoringpb.Aggregation_REDUCE_MAX},
+		{"rate", monitoringpb.Aggregation_ALIGN_MEAN, monitoringpb.Aggregation_REDUCE_SUM},
+		{"counter rate", monitoringpb.Aggregation_ALIGN_RATE, monitoringpb.Aggregation_REDUCE_SUM},
+	} {
+		t.Run(tt.filter, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					if req.Aggregation.PerSeriesAligner != tt.wantAligner || req.Aggregation.CrossSeriesReducer != tt.wantReducer {
+						t.Errorf("expected %v and %v; got %v and %v", tt.wantAligner, tt.wantReducer,
+							req.Aggregation.PerSeriesAligner, req.Aggregation.CrossSeriesReducer)
+					}
+					return []*monitoringpb.TimeSeries{int64Series(42)}, nil
+				})
+
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			cfg := &Config{Project: "project", Aggregations: aggregations}
+			if _, _, err := getCounter(context.Background(), cfg, tt.filter, start, start.AddDate(0, 0, 1), sd); err != nil {
+				t.Errorf("getCounter() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetCounterMultiplePoints(t *testing.T) {
+	twoDistributionPoints := distributionSeries(40)
+	twoDistributionPoints.Points = append(twoDistributionPoints.Points, distributionSeries(2).Points...)
+	twoDoublePoints := doubleSeries(10)
+	twoDoublePoints.Points = append(twoDoublePoints.Points, doubleSeries(32).Points...)
+	for _, tt := range []struct {
+		name    string
+		aligner string
+		series  []*monitoringpb.TimeSeries
+		want    int64
+		wantErr string
+	}{
+		{"delta int64", "", []*monitoringpb.TimeSeries{int64Series(10, 32)}, 42, ""},
+		{"delta double", "", []*monitoringpb.TimeSeries{twoDoublePoints}, 42, ""},
+		{"delta distribution", "", []*monitoringpb.TimeSeries{twoDistributionPoints}, 42, ""},
+		{"delta in several series", "", []*monitoringpb.TimeSeries{int64Series(10, 30), int64Series(2)}, 42, ""},
+		{"delta without points", "", []*monitoringpb.TimeSeries{int64Series(42), int64Series()}, 0, "got 0"},
+		{"mean", "ALIGN_MEAN", []*monitoringpb.TimeSeries{int64Series(10, 32)}, 0, "got 2"},
+		{"count", "ALIGN_COUNT", []*monitoringpb.TimeSeries{int64Series(10, 32)}, 0, "got 2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(tt.series, nil)
+
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			cfg := &Config{Project: "project", Aggregations: map[string]Aggregation{"filter": Aggregation{Aligner: tt.aligner}}}
+			got, _, err := getCounter(context.Background(), cfg, "filter", start, start.AddDate(0, 0, 1), sd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("getCounter() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("getCounter() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getCounter() = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDistributionCutMultiplePoints(t *testing.T) {
+	point := func(counts ...int64) *monitoringpb.Point {
+		var count int64
+		for _, c := range counts {
+			count += c
+		}
+		return &monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{
+			DistributionValue: &distributionpb.Distribution{
+				Count: count,
+				// Buckets: (-inf, 0), [0, 100), [100, +inf).
+				BucketOptions: &distributionpb.Distribution_BucketOptions{Options: &distributionpb.Distribution_BucketOptions_LinearBuckets{
+					LinearBuckets: &distributionpb.Distribution_BucketOptions_Linear{NumFiniteBuckets: 1, Width: 100, Offset: 0}}},
+				BucketCounts: counts,
+			}}}}
+	}
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return([]*monitoringpb.TimeSeries{
+		&monitoringpb.TimeSeries{ValueType: metricpb.MetricDescriptor_DISTRIBUTION, Points: []*monitoringpb.Point{point(0, 30, 2), point(0, 10, 0)}},
+	}, nil)
+
+	start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+	good, total, err := getDistributionCut(context.Background(), &Config{Project: "project"},
+		&clients.DistributionCut{DistributionFilter: "latency", Range: &clients.Range{Min: 0, Max: 100}}, start, start.AddDate(0, 0, 1), sd)
+	if err != nil {
+		t.Errorf("getDistributionCut() unexpected error: %v", err)
+	}
+	if good != 40 || total != 42 {
+		t.Errorf("expected 40 good and 42 total events; got %d and %d", good, total)
+	}
+}
+
+func TestGetCounterScale(t *testing.T) {
+	scales := map[string]float64{"milli": 0.001, "kilo": 1000}
+	for _, tt := range []struct {
+		name   string
+		filter string
+		series []*monitoringpb.TimeSeries
+		want   int64
+	}{
+		{"no scale", "counter", []*monitoringpb.TimeSeries{doubleSeries(42.9)}, 42},
+		{"0.001", "milli", []*monitoringpb.TimeSeries{int64Series(1234567)}, 1235},
+		{"0.001 of several series", "milli", []*monitoringpb.TimeSeries{int64Series(1500), int64Series(1500)}, 3},
+		{"0.001 rounded down", "milli", []*monitoringpb.TimeSeries{int64Series(2499)}, 2},
+		{"1000", "kilo", []*monitoringpb.TimeSeries{int64Series(42)}, 42000},
+		// 1.001*1000 is 1000.9999999999999 in floating point.
+		{"1000 of a double", "kilo", []*monitoringpb.TimeSeries{doubleSeries(1.001)}, 1001},
+		{"1000 of a distribution", "kilo", []*monitoringpb.TimeSeries{distributionSeries(7)}, 7000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(tt.series, nil)
+
+			start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+			cfg := &Config{Project: "project", Scales: scales}
+			got, _, err := getCounter(context.Background(), cfg, tt.filter, start, start.AddDate(0, 0, 1), sd)
+			if err != nil {
+				t.Fatalf("getCounter() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getCounter() = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCounterRate(t *testing.T) {
+	aggregations := map[string]Aggregation{"rate": {Rate: true}, "scaled rate": {Rate: true}}
+	scales := map[string]float64{"scaled rate": 0.001}
+	start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name   string
+		filter string
+		end    time.Time
+		series []*monitoringpb.TimeSeries
+		want   int64
+	}{
+		{"not a rate", "counter", start.AddDate(0, 0, 1), []*monitoringpb.TimeSeries{doubleSeries(2.5)}, 2},
+		{"day", "rate", start.AddDate(0, 0, 1), []*monitoringpb.TimeSeries{doubleSeries(2.5)}, 216000},
+		{"hour", "rate", start.Add(time.Hour), []*monitoringpb.TimeSeries{doubleSeries(2.5)}, 9000},
+		{"several series", "rate", start.AddDate(0, 0, 1), []*monitoringpb.TimeSeries{doubleSeries(1.5), doubleSeries(1)}, 216000},
+		{"int64 rate", "rate", start.Add(time.Hour), []*monitoringpb.TimeSeries{int64Series(3)}, 10800},
+		// 0.0001*86400 is 8.64 events, which is rounded to the nearest integer.
+		{"rounded", "rate", start.AddDate(0, 0, 1), []*monitoringpb.TimeSeries{doubleSeries(0.0001)}, 9},
+		{"scaled", "scaled rate", start.AddDate(0, 0, 1), []*monitoringpb.TimeSeries{doubleSeries(2.5)}, 216},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(tt.series, nil)
+
+			cfg := &Config{Project: "project", Aggregations: aggregations, Scales: scales}
+			got, _, err := getCounter(context.Background(), cfg, tt.filter, start, tt.end, sd)
+			if err != nil {
+				t.Fatalf("getCounter() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getCounter() = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// int64Series returns an INT64 time series with given point values.
+func int64Series(values ...int64) *monitoringpb.TimeSeries {
+	s := &monitoringpb.TimeSeries{ValueType: metricpb.MetricDescriptor_INT64}
+	for _, v := range values {
+		s.Points = append(s.Points, &monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: v}}})
+	}
+	return s
+}
+
+// goodBadSeries returns DOUBLE time series of good and bad events, as returned for select_slo_counts.
+func goodBadSeries(good, bad float64) []*monitoringpb.TimeSeries {
+	series := func(eventType string, v float64) *monitoringpb.TimeSeries {
+		return &monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": eventType}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}}}}}
+	}
+	return []*monitoringpb.TimeSeries{series("good", good), series("bad", bad)}
+}
+
+func doubleSeries(v float64) *monitoringpb.TimeSeries {
+	return &monitoringpb.TimeSeries{ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+		&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}}}}}
+}
+
+func distributionSeries(count int64) *monitoringpb.TimeSeries {
+	return &monitoringpb.TimeSeries{ValueType: metricpb.MetricDescriptor_DISTRIBUTION, Points: []*monitoringpb.Point{
+		&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{
+			DistributionValue: &distributionpb.Distribution{Count: count}}}}}}
+}
+
+func boolSeries(v bool) *monitoringpb.TimeSeries {
+	return &monitoringpb.TimeSeries{ValueType: metricpb.MetricDescriptor_BOOL, Points: []*monitoringpb.Point{
+		&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_BoolValue{BoolValue: v}}}}}
+}
+
+func TestFillRecordsConcurrency(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	sd := mocks.NewMockMetricClient(mockCtrl)
+
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(20).DoAndReturn(
+		func(context.Context, *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil, nil
+		})
+
+	var recs []*record
+	for i := 0; i < 20; i++ {
+		recs = append(recs, &record{slo: &clients.SLO{Name: "s1", DisplayName: "slo1"}, row: &clients.BQRow{Date: fmt.Sprint(i)}})
+	}
+
+	var got []string
+	cfg := &Config{Project: "project", Concurrency: 3}
+	err := fillRecords(context.Background(), cfg, recs, sd, func(r *record) error {
+		got = append(got, r.row.Date)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("fillRecords() unexpected error: %v", err)
+	}
+	if maxInFlight > 3 || maxInFlight < 2 {
+		t.Errorf("expected 2 to 3 concurrent queries; got %d", maxInFlight)
+	}
+	for i, d := range got {
+		if d != fmt.Sprint(i) {
+			t.Fatalf("expected records to be returned in order; got %v", got)
+		}
+	}
+	if len(got) != 20 {
+		t.Errorf("expected 20 records; got %d", len(got))
+	}
+}
+
+func TestFillRecordsError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).MaxTimes(20).DoAndReturn(
+		func(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			if req.Interval.StartTime.Seconds == 5 {
+				return nil, fmt.Errorf("myerror")
+			}
+			return nil, ctx.Err()
+		})
+
+	var recs []*record
+	for i := 0; i < 20; i++ {
+		recs = append(recs, &record{slo: &clients.SLO{Name: "s1", DisplayName: "slo1"}, start: time.Unix(int64(i), 0), row: &clients.BQRow{}})
+	}
+
+	var done int
+	err := fillRecords(context.Background(), &Config{Project: "project", Concurrency: 2}, recs, sd, func(r *record) error {
+		done++
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "myerror") {
+		t.Errorf("fillRecords() expected error to contain 'myerror'; got %v", err)
+	}
+	if done > 5 {
+		t.Errorf("expected at most 5 records to be done before the failed one; got %d", done)
+	}
+}
+
+func TestCounterErrors(t *testing.T) {
+	stringSeries := &monitoringpb.TimeSeries{Metric: &metricpb.Metric{Type: "custom.googleapis.com/version"}, MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType: metricpb.MetricDescriptor_STRING, Points: []*monitoringpb.Point{&monitoringpb.Point{Value: &monitoringpb.TypedValue{}}}}
+	sloFilter := `select_slo_counts("slo1")`
+	for _, tt := range []struct {
+		name   string
+		count  func(sd clients.MetricClient) error
+		series []*monitoringpb.TimeSeries
+		want   *CounterError
+	}{
+		{"counter with two mean points", func(sd clients.MetricClient) error {
+			cfg := &Config{Project: "project", Aggregations: map[string]Aggregation{"filter": Aggregation{Aligner: "ALIGN_MEAN"}}}
+			_, _, err := getCounter(context.Background(), cfg, "filter", time.Unix(0, 0), time.Unix(86400, 0), sd)
+			return err
+		}, []*monitoringpb.TimeSeries{int64Series(10, 32)},
+			&CounterError{Filter: "filter", Reason: CounterPointCount, SeriesCount: 1, PointCount: 2}},
+		{"counter without points", countWith(getCounter), []*monitoringpb.TimeSeries{int64Series(10), int64Series()},
+			&CounterError{Filter: "filter", Reason: CounterPointCount, SeriesCount: 2, PointCount: 0}},
+		{"counter with string value", countWith(getCounter), []*monitoringpb.TimeSeries{stringSeries},
+			&CounterError{Filter: "filter", Reason: CounterValueType, SeriesCount: 1, Detail: "STRING of metric custom.googleapis.com/version (kind GAUGE)"}},
+		{"distribution cut with int64 value", func(sd clients.MetricClient) error {
+			_, _, err := getDistributionCut(context.Background(), &Config{Project: "project"},
+				&clients.DistributionCut{DistributionFilter: "filter", Range: &clients.Range{Max: 10}}, time.Unix(0, 0), time.Unix(86400, 0), sd)
+			return err
+		}, []*monitoringpb.TimeSeries{int64Series(10)},
+			&CounterError{Filter: "filter", Reason: CounterValueType, SeriesCount: 1, Detail: "INT64"}},
+		{"slo counts with one series", countSLO, goodBadSeries(10, 1)[:1],
+			&CounterError{Filter: sloFilter, Reason: CounterSeriesCount, SeriesCount: 1, Detail: "good and bad time series"}},
+		{"slo counts without points", countSLO, func() []*monitoringpb.TimeSeries {
+			series := goodBadSeries(10, 1)
+			series[1].Points = nil
+			return series
+		}(),
+			&CounterError{Filter: sloFilter, Reason: CounterPointCount, SeriesCount: 2, PointCount: 0}},
+		{"slo counts with int64 values", countSLO, []*monitoringpb.TimeSeries{int64Series(10), int64Series(1)},
+			&CounterError{Filter: sloFilter, Reason: CounterValueType, SeriesCount: 2, Detail: "INT64"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(tt.series, nil)
+
+			err := tt.count(sd)
+			got, ok := err.(*CounterError)
+			if !ok {
+				t.Fatalf("expected a *CounterError; got %T: %v", err, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected error %+v; got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// countWith returns a function counting events matching "filter" on a single day using a given counterFunc.
+func countWith(count counterFunc) func(clients.MetricClient) error {
+	return func(sd clients.MetricClient) error {
+		_, _, err := count(context.Background(), &Config{Project: "project"}, "filter", time.Unix(0, 0), time.Unix(86400, 0), sd)
+		return err
+	}
+}
+
+// countSLO counts events of slo1 on a single day using select_slo_counts.
+func countSLO(sd clients.MetricClient) error {
+	_, _, err := getSLOCounts(context.Background(), &Config{Project: "project"}, &clients.SLO{Name: "slo1"}, time.Unix(0, 0), time.Unix(86400, 0), sd)
+	return err
+}
+
+func TestFillRecordsMisconfiguredSLI(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		continueOnError bool
+	}{
+		{"sync aborted", false},
+		{"other SLOs synced", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).MinTimes(1).MaxTimes(2).DoAndReturn(
+				func(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					if strings.Contains(req.Filter, "s1") {
+						return []*monitoringpb.TimeSeries{int64Series(10), int64Series(1)}, nil
+					}
+					return goodBadSeries(10, 1), nil
+				})
+
+			recs := []*record{
+				&record{slo: &clients.SLO{Name: "s1"}, start: time.Unix(0, 0), end: time.Unix(86400, 0), row: &clients.BQRow{}},
+				&record{slo: &clients.SLO{Name: "s2"}, start: time.Unix(0, 0), end: time.Unix(86400, 0), row: &clients.BQRow{}},
+			}
+			// A misconfigured SLI only fails the records of its SLO with ContinueOnError.
+			cfg := &Config{Project: "project", Concurrency: 1, ContinueOnError: tt.continueOnError}
+			err := fillRecords(context.Background(), cfg, recs, sd, func(r *record) error { return nil })
+			if !tt.continueOnError {
+				if ce, ok := err.(*CounterError); !ok || ce.Reason != CounterValueType {
+					t.Errorf("fillRecords() expected a value type error; got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("fillRecords() unexpected error: %v", err)
+			}
+			if ce, ok := recs[0].err.(*CounterError); !ok || ce.Reason != CounterValueType {
+				t.Errorf("expected record of s1 to have a value type error; got %v", recs[0].err)
+			}
+			if recs[1].err != nil || recs[1].row.Total != 11 {
+				t.Errorf("expected record of s2 to have 11 total events; got %d (error: %v)", recs[1].row.Total, recs[1].err)
+			}
+		})
+	}
+}
+
+func TestSyncAllServicesContinueOnError(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+	svc1 := &clients.Service{Name: "s1", DisplayName: "svc1"}
+	svc2 := &clients.Service{Name: "s2", DisplayName: "svc2"}
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{svc1, svc2}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), svc1).Return([]*clients.SLO{
+		&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99},
+		&clients.SLO{Name: "s2", DisplayName: "broken", Goal: 0.99},
+	}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), svc2).Return(nil, fmt.Errorf("cannot list SLOs"))
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(4).DoAndReturn(
+		func(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			if strings.Contains(req.Filter, `"s2"`) {
+				return nil, fmt.Errorf("malformed filter")
+			}
+			return []*monitoringpb.TimeSeries{
+				&monitoringpb.TimeSeries{
+					Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "good"}},
+					ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+						&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 100}}}}},
+				&monitoringpb.TimeSeries{
+					Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "bad"}},
+					ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+						&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 11}}}}},
+			}, nil
+		})
+
+	// Rows of the healthy SLO should still be written.
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Do(
+		func(_ context.Context, _, _ string, rows []*clients.BQRow) {
+			for _, r := range rows {
+				if r.SLO != "slo1" {
+					t.Errorf("unexpected row written: %+v", r)
+				}
+			}
+			if len(rows) != 2 {
+				t.Errorf("expected 2 rows to be written; got %d", len(rows))
+			}
+		})
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2, ContinueOnError: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	for _, want := range []string{"1 SLOs and 1 services failed", "SLO 'broken': ", "malformed filter", "Service 'svc2': cannot list SLOs"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("syncAllServices() expected error to contain '%s'; got %v", want, err)
+		}
+	}
+	if res.SLOsProcessed != 2 || res.SLOsFailed != 1 || res.RowsWritten != 2 {
+		t.Errorf("unexpected sync result: %+v", res)
+	}
+}
+
+func TestSyncAllServicesCancelled(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	for _, tt := range []struct {
+		name            string
+		continueOnError bool
+	}{
+		{"abort on error", false},
+		{"continue on error", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			// Mocks ignore context cancellation, so no calls to Stackdriver or bq.Put are expected.
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).AnyTimes().Return([]*clients.BQRow{}, nil)
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).AnyTimes().Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).AnyTimes().Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1"}}, nil)
+			sd := mocks.NewMockMetricClient(mockCtrl)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2, ContinueOnError: tt.continueOnError}
+			_, err := syncAllServices(ctx, cfg, sd, sloc, bq, nil)
+			if err != context.Canceled {
+				t.Errorf("syncAllServices() expected error %v; got %v", context.Canceled, err)
+			}
+		})
+	}
+}
+
+func TestSyncAllServicesCancelledFlushesRows(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+
+	for _, tt := range []struct {
+		name          string
+		backfillStart string
+		backfillEnd   string
+		lease         *bqLease
+		wantPut       bool
+	}{
+		{"incremental sync", "", "", nil, true},
+		{"backfill range", "2015-05-07", "2015-05-09", nil, false},
+		// Another process holding the lease may be writing the same rows.
+		{"lease lost", "", "", &bqLease{isLost: true}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).AnyTimes().Return([]*clients.BQRow{}, nil)
+			if tt.wantPut {
+				// Only the row computed before cancellation should be written, using a context that is not cancelled.
+				bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).DoAndReturn(
+					func(ctx context.Context, _, _ string, rows []*clients.BQRow) error {
+						if ctx.Err() != nil {
+							t.Errorf("expected Put() context not to be cancelled; got %v", ctx.Err())
+						}
+						if len(rows) != 1 || rows[0].Date != "2015-05-09" {
+							t.Errorf("expected a single row for 2015-05-09; got %+v", rows)
+						}
+						return nil
+					})
+			}
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1"}}, nil)
+
+			// The sync gets cancelled while the second day is being queried.
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var calls int
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).DoAndReturn(
+				func(context.Context, *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					if calls++; calls == 2 {
+						cancel()
+						return nil, context.Canceled
+					}
+					return nil, nil
+				})
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 3, Concurrency: 1,
+				BackfillStart: tt.backfillStart, BackfillEnd: tt.backfillEnd, lease: tt.lease}
+			_, err := syncAllServices(ctx, cfg, sd, sloc, bq, nil)
+			if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+				t.Errorf("syncAllServices() expected error to contain '%v'; got %v", context.Canceled, err)
+			}
+		})
+	}
+}
+
+func TestFillRecordsCancelled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	sd := mocks.NewMockMetricClient(mockCtrl)
+
+	var recs []*record
+	for i := 0; i < 5; i++ {
+		recs = append(recs, &record{slo: &clients.SLO{Name: "s1", DisplayName: "slo1"}, row: &clients.BQRow{}})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := fillRecords(ctx, &Config{Project: "project", ContinueOnError: true}, recs, sd, func(r *record) error {
+		t.Errorf("unexpected record done: %+v", r)
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("fillRecords() expected error %v; got %v", context.Canceled, err)
+	}
+}
+
+func TestSyncAllServicesLoadJob(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n, m int) { bqBatchSize, loadJobThreshold = n, m }(bqBatchSize, loadJobThreshold)
+	bqBatchSize, loadJobThreshold = 100, 2
+
+	for _, tt := range []struct {
+		name         string
+		backfillDays int
+		wantLoads    []int
+		wantPuts     []int
+	}{
+		{"small sync uses streaming inserts", 1, nil, []int{1}},
+		{"large backfill uses load jobs", 3, []int{2, 1}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, nil)
+
+			var loads, puts []int
+			bq.EXPECT().Load(gomock.Any(), "datasetname", "data", gomock.Any()).AnyTimes().Do(
+				func(_ context.Context, _, _ string, rows []*clients.BQRow) { loads = append(loads, len(rows)) })
+			bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).AnyTimes().Do(
+				func(_ context.Context, _, _ string, rows []*clients.BQRow) { puts = append(puts, len(rows)) })
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: tt.backfillDays}
+			if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err != nil {
+				t.Errorf("syncAllServices() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(loads, tt.wantLoads) || !reflect.DeepEqual(puts, tt.wantPuts) {
+				t.Errorf("expected loads of %v rows and puts of %v rows; got %v and %v", tt.wantLoads, tt.wantPuts, loads, puts)
+			}
+		})
+	}
+}
+
+func TestSyncDays(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("could not load location: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		cfg  *Config
+		want []string
+	}{
+		{"backfill days", &Config{clock: clock, BackfillDays: 3}, []string{"2015-05-09", "2015-05-08", "2015-05-07"}},
+		{"backfill range", &Config{clock: clock, BackfillDays: 3, BackfillStart: "2015-04-29", BackfillEnd: "2015-05-01"},
+			[]string{"2015-05-01", "2015-04-30", "2015-04-29"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range syncDays(tt.cfg, loc) {
+				if d[1].Sub(d[0]) != 24*time.Hour {
+					t.Errorf("expected day %v to be 24 hours long; got %v", d[0], d[1].Sub(d[0]))
+				}
+				got = append(got, d[0].Format("2006-01-02"))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("syncDays() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncDaysBackfillRangeDST(t *testing.T) {
+	for _, tt := range []struct {
+		tz         string
+		start, end string
+		now        time.Time
+	}{
+		// Clocks move from midnight to 1:00 on 2015-03-08.
+		{"America/Havana", "2015-03-07", "2015-03-09", time.Date(2015, time.March, 10, 15, 0, 0, 0, time.UTC)},
+		// Clocks move from midnight back to 23:00 on 2016-05-15, so midnight occurs twice.
+		{"America/Santiago", "2016-05-14", "2016-05-16", time.Date(2016, time.May, 17, 15, 0, 0, 0, time.UTC)},
+	} {
+		t.Run(tt.tz, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.tz)
+			if err != nil {
+				t.Fatalf("could not load location: %v", err)
+			}
+			// A backfill range covers the same days as backfilling the same number of recent days.
+			want := syncDays(&Config{clock: fixedClock(tt.now), BackfillDays: 3}, loc)
+			got := syncDays(&Config{clock: fixedClock(tt.now), BackfillDays: 3, BackfillStart: tt.start, BackfillEnd: tt.end}, loc)
+			if len(got) != len(want) {
+				t.Fatalf("syncDays() = %v; want %v", got, want)
+			}
+			for i := range got {
+				if !got[i][0].Equal(want[i][0]) || !got[i][1].Equal(want[i][1]) {
+					t.Errorf("syncDays() returned day %v - %v; want %v - %v", got[i][0], got[i][1], want[i][0], want[i][1])
+				}
+			}
+		})
+	}
+}
+
+func TestSyncAllServicesBackfillRange(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 1
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	// Existing rows are not read, since all rows in the range are replaced.
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).Return([]*monitoringpb.TimeSeries{
+		&monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "good"}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 100}}}}},
+		&monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "bad"}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 0}}}}},
+	}, nil)
+
+	// Rows are deleted once all new data has been computed, and are then written in a single batch.
+	gomock.InOrder(
+		bq.EXPECT().DeleteRows(gomock.Any(), "datasetname", "data",
+			`date BETWEEN DATE '2015-05-01' AND DATE '2015-05-02' AND IFNULL(project, 'project') = 'project' `+
+				`AND hour IS NULL AND ((serviceid, sloid) IN (("s1", "s1")) OR (serviceid IS NULL AND (service, slo) IN (("svc1", "slo1"))))`).Return(nil),
+		bq.EXPECT().Put(gomock.Any(), "datasetname", "data", []*clients.BQRow{
+			londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-02", Target: 0.99, Good: 100, Total: 100,
+				ErrorBudget: errorBudget(100, 0.99), ValueType: "DOUBLE"}),
+			londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-01", Target: 0.99, Good: 100, Total: 100,
+				ErrorBudget: errorBudget(100, 0.99), ValueType: "DOUBLE"}),
+		}).Return(nil),
+	)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillStart: "2015-05-01", BackfillEnd: "2015-05-02"}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	if res.RowsWritten != 2 {
+		t.Errorf("expected 2 rows to be written; got %+v", res)
+	}
+}
+
+func TestSyncAllServicesBackfillRangeErrors(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	// Rows should not be written if existing rows could not be deleted.
+	bq.EXPECT().DeleteRows(gomock.Any(), "datasetname", "data", gomock.Any()).Return(fmt.Errorf("streaming buffer"))
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillStart: "2015-05-01", BackfillEnd: "2015-05-01"}
+	_, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err == nil || !strings.Contains(err.Error(), "streaming buffer") {
+		t.Errorf("syncAllServices() expected error to contain 'streaming buffer'; got %v", err)
+	}
+}
+
+func TestSyncAllServicesDryRun(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: "2015-05-08"},
+	}, nil)
+	// No calls to bq.Put are expected.
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 3, DryRun: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	if !res.DryRun || res.RowsWritten != 2 {
+		t.Errorf("expected a dry run with 2 rows; got %+v", res)
+	}
+}
+
+func TestSyncAllServicesSkipMalformedRows(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: "2015-05-08"},
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: ""},
+	}, nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 3, DryRun: true,
+		SkipMalformedExistingRows: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	if res.MalformedRowsSkipped != 1 || res.RowsWritten != 2 {
+		t.Errorf("expected 1 skipped row and 2 new rows; got %+v", res)
+	}
+}
+
+func TestNewRecordsProjects(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	// Another project having the same service and SLO names should not prevent data from being synced.
+	existing := make(bqMap)
+	existing.Add(&clients.BQRow{Project: "project1", Service: "svc1", SLO: "slo1", Date: "2015-05-09", Good: 90, Total: 100})
+	existing.Add(&clients.BQRow{Project: "project2", Service: "svc1", SLO: "slo1", Date: "2015-05-08", Good: 90, Total: 100})
+
+	cfg := &Config{clock: clock, Project: "project1", TimeZone: "Europe/London", BackfillDays: 2}
+	recs, err := newRecords(cfg, &clients.Service{Name: "s1", DisplayName: "svc1"}, &clients.SLO{Name: "s1", DisplayName: "slo1"}, existing)
+	if err != nil {
+		t.Fatalf("newRecords() unexpected error: %v", err)
+	}
+	if len(recs) != 1 || recs[0].row.Date != "2015-05-08" || recs[0].row.Project != "project1" {
+		t.Errorf("expected a single record for project1 on 2015-05-08; got %+v", recs)
+	}
+}
+
+func TestHourlyIntervals(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		now          time.Time
+		tz           string
+		wantCount    int
+		wantLastSize time.Duration
+	}{
+		{"2015-05-01 in London", time.Date(2015, time.May, 2, 15, 0, 0, 0, time.UTC), "Europe/London", 24, time.Hour},
+		{"2015-03-29 in London", time.Date(2015, time.March, 30, 15, 0, 0, 0, time.UTC), "Europe/London", 23, time.Hour},
+		{"2015-10-25 in London", time.Date(2015, time.October, 26, 15, 0, 0, 0, time.UTC), "Europe/London", 25, time.Hour},
+		{"2015-10-04 in Lord Howe", time.Date(2015, time.October, 5, 1, 0, 0, 0, time.UTC), "Australia/Lord_Howe", 24, 30 * time.Minute},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.tz)
+			if err != nil {
+				t.Fatalf("could not load location %s: %v", tt.tz, err)
+			}
+			start := daysAgoMidnightTimestamp(tt.now, loc, 1)
+			end := daysAgoMidnightTimestamp(tt.now, loc, 0)
+
+			got := hourlyIntervals(start, end)
+			if len(got) != tt.wantCount {
+				t.Fatalf("expected %d intervals; got %d", tt.wantCount, len(got))
+			}
+			if !got[0][0].Equal(start) || !got[len(got)-1][1].Equal(end) {
+				t.Errorf("expected intervals to cover %v to %v; got %v", start, end, got)
+			}
+			for i := 1; i < len(got); i++ {
+				if !got[i][0].Equal(got[i-1][1]) {
+					t.Errorf("expected interval %d to start at the end of the previous one; got %v", i, got[i])
+				}
+			}
+			if last := got[len(got)-1]; last[1].Sub(last[0]) != tt.wantLastSize {
+				t.Errorf("expected last interval to be %v long; got %v", tt.wantLastSize, last[1].Sub(last[0]))
+			}
+		})
+	}
+}
+
+func TestNewRecordsInterval(t *testing.T) {
+	// Clocks go back on 2015-10-25 in London, so the day is 25 hours long.
+	clock := fixedClock(time.Date(2015, time.October, 27, 15, 0, 0, 0, time.UTC))
+
+	cfg := &Config{clock: clock, Project: "project", TimeZone: "Europe/London", BackfillDays: 2}
+	recs, err := newRecords(cfg, &clients.Service{Name: "s1", DisplayName: "svc1"}, &clients.SLO{Name: "s1", DisplayName: "slo1"}, make(bqMap))
+	if err != nil {
+		t.Fatalf("newRecords() unexpected error: %v", err)
+	}
+	for i, want := range []struct {
+		date       string
+		start, end time.Time
+	}{
+		{"2015-10-26", time.Date(2015, time.October, 26, 0, 0, 0, 0, time.UTC), time.Date(2015, time.October, 27, 0, 0, 0, 0, time.UTC)},
+		{"2015-10-25", time.Date(2015, time.October, 24, 23, 0, 0, 0, time.UTC), time.Date(2015, time.October, 26, 0, 0, 0, 0, time.UTC)},
+	} {
+		row := recs[i].row
+		if row.Date != want.date || !row.IntervalStart.Equal(want.start) || !row.IntervalEnd.Equal(want.end) {
+			t.Errorf("expected row for %s to cover %v to %v; got %s from %v to %v", want.date, want.start, want.end, row.Date, row.IntervalStart, row.IntervalEnd)
+		}
+		// The recorded interval is the one that is queried.
+		if !row.IntervalStart.Equal(recs[i].start) || !row.IntervalEnd.Equal(recs[i].end) {
+			t.Errorf("expected row interval to match the queried interval %v to %v; got %v to %v", recs[i].start, recs[i].end, row.IntervalStart, row.IntervalEnd)
+		}
+	}
+	if d := recs[1].row.IntervalEnd.Sub(recs[1].row.IntervalStart); d != 25*time.Hour {
+		t.Errorf("expected 2015-10-25 to be queried as 25 hours; got %v", d)
+	}
+}
+
+func TestNewRecordsHourly(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.March, 30, 15, 0, 0, 0, time.UTC))
+
+	existing := make(bqMap)
+	existing.Add(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: "2015-03-29",
+		Hour: bigquery.NullInt64{Int64: 5, Valid: true}, Good: 90, Total: 100})
+
+	cfg := &Config{clock: clock, Project: "project", TimeZone: "Europe/London", BackfillDays: 1, Granularity: "hourly"}
+	recs, err := newRecords(cfg, &clients.Service{Name: "s1", DisplayName: "svc1"}, &clients.SLO{Name: "s1", DisplayName: "slo1"}, existing)
+	if err != nil {
+		t.Fatalf("newRecords() unexpected error: %v", err)
+	}
+	// 2015-03-29 is 23 hours long in London, and one of the hours already exists.
+	if len(recs) != 22 {
+		t.Fatalf("expected 22 records; got %d", len(recs))
+	}
+	for _, r := range recs {
+		if r.row.Date != "2015-03-29" || !r.row.Hour.Valid || r.row.Hour.Int64 == 5 {
+			t.Errorf("unexpected row %+v", r.row)
+		}
+		if r.end.Sub(r.start) != time.Hour {
+			t.Errorf("expected record to be 1 hour long; got %v to %v", r.start, r.end)
+		}
+	}
+	// Clocks go forward from 01:00 GMT to 02:00 BST, so hour 1 starts at 02:00 local time.
+	if want := time.Date(2015, time.March, 29, 1, 0, 0, 0, time.UTC); !recs[1].start.Equal(want) {
+		t.Errorf("expected hour %d to start at %v; got %v", recs[1].row.Hour.Int64, want, recs[1].start)
+	}
+
+	// Requests for hourly records should use the interval length as the alignment period.
+	req := newTimeSeriesRequest(cfg, "filter", recs[0].start, recs[0].end)
+	if got := req.Aggregation.AlignmentPeriod.Seconds; got != 3600 {
+		t.Errorf("expected alignment period of 3600s; got %ds", got)
+	}
+}
+
+func TestNewTimeSeriesRequest(t *testing.T) {
+	start := time.Date(2015, time.May, 9, 0, 0, 0, 0, time.UTC)
+	req := newTimeSeriesRequest(&Config{Project: "project"}, "filter", start, start.AddDate(0, 0, 1))
+	// Points are read from the response, so time series headers alone are not enough.
+	if req.View != monitoringpb.ListTimeSeriesRequest_FULL {
+		t.Errorf("expected %v view; got %v", monitoringpb.ListTimeSeriesRequest_FULL, req.View)
+	}
+	// A single aligned point per time series is requested.
+	if got := req.Aggregation.AlignmentPeriod.Seconds; got != 86400 {
+		t.Errorf("expected alignment period of 86400s; got %ds", got)
+	}
+	if got := req.Aggregation.PerSeriesAligner; got != monitoringpb.Aggregation_ALIGN_DELTA {
+		t.Errorf("expected %v aligner; got %v", monitoringpb.Aggregation_ALIGN_DELTA, got)
+	}
+}
+
+func TestNameMatches(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		include []string
+		exclude []string
+		want    bool
+	}{
+		{"frontend", nil, nil, true},
+		{"frontend", []string{"front*"}, nil, true},
+		{"frontend", []string{"backend", "front?nd"}, nil, true},
+		{"frontend", []string{"backend"}, nil, false},
+		{"frontend", nil, []string{"*end"}, false},
+		{"frontend", nil, []string{"backend"}, true},
+		{"frontend", []string{"front*"}, []string{"frontend"}, false},
+		{"istio-canonical-svc", []string{"*"}, []string{"istio-*"}, false},
+	} {
+		if got := nameMatches(tt.name, tt.include, tt.exclude); got != tt.want {
+			t.Errorf("nameMatches(%q, %q, %q) = %v; want %v", tt.name, tt.include, tt.exclude, got, tt.want)
+		}
+	}
+}
+
+func TestSyncAllServicesFilters(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+	svc1 := &clients.Service{Name: "s1", DisplayName: "svc1"}
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{svc1, &clients.Service{Name: "s2", DisplayName: "istio-svc2"}}, nil)
+	// SLOs of the excluded service should not be listed.
+	sloc.EXPECT().SLOs(gomock.Any(), svc1).Return([]*clients.SLO{
+		&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99},
+		&clients.SLO{Name: "s2", DisplayName: "canary-slo", Goal: 0.99},
+	}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1, DryRun: true,
+		ServiceExclude: []string{"istio-*"}, SLOExclude: []string{"canary-*"}}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	want := &SyncResult{
+		ServicesSeen:  2,
+		SLOsProcessed: 1,
+		Skipped: map[string]string{
+			"project/istio-svc2":      "excluded by ServiceInclude/ServiceExclude",
+			"project/svc1/canary-slo": "excluded by SLOInclude/SLOExclude",
+		},
+		RowsWritten: 1,
+		RowsPerSLO:  map[string]int{"project/svc1/slo1": 1},
+		DryRun:      true,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("expected sync result %+v; got %+v", want, res)
+	}
+}
+
+func TestSyncAllServicesProbeInactiveSLOs(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := []*monitoringpb.TimeSeries{
+		&monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "good"}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 100}}}}},
+		&monitoringpb.TimeSeries{
+			Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": "bad"}},
+			ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+				&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 11}}}}},
+	}
+	for _, tt := range []struct {
+		name          string
+		series        []*monitoringpb.TimeSeries
+		skipEmptyDays bool
+		// wantCalls is the number of ListTimeSeries calls, including the probe.
+		wantCalls int
+		wantRows  int
+		wantTotal int64
+	}{
+		{"active", series, false, 3, 2, 222},
+		{"inactive", nil, false, 1, 2, 0},
+		{"inactive skipping empty days", nil, true, 1, 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "slo1", Goal: 0.99}}, nil)
+
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			// The probe covers both synced days.
+			sd.EXPECT().ListTimeSeries(gomock.Any(), newTimeSeriesRequest(&Config{Project: "project"}, `select_slo_counts("slo1")`,
+				time.Date(2015, time.May, 8, 0, 0, 0, 0, london), time.Date(2015, time.May, 10, 0, 0, 0, 0, london))).Return(tt.series, nil)
+			if tt.wantCalls > 1 {
+				sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(tt.wantCalls-1).Return(tt.series, nil)
+			}
+
+			var total int64
+			bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Do(func(_ context.Context, _, _ string, rows []*clients.BQRow) {
+				for _, r := range rows {
+					total += r.Total
+				}
+			}).AnyTimes()
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2,
+				ProbeInactiveSLOs: true, SkipEmptyDays: tt.skipEmptyDays}
+			res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+			if err != nil {
+				t.Errorf("syncAllServices() unexpected error: %v", err)
+			}
+			if res.RowsWritten != tt.wantRows {
+				t.Errorf("syncAllServices() expected %d rows written; got %d", tt.wantRows, res.RowsWritten)
+			}
+			if total != tt.wantTotal {
+				t.Errorf("syncAllServices() expected %d total events written; got %d", tt.wantTotal, total)
+			}
+		})
+	}
+}
+
+// memoryExistingData is an existingDataSource returning a fixed list of rows.
+type memoryExistingData []*clients.BQRow
+
+func (m memoryExistingData) readExisting(ctx context.Context, cfg *Config) (bqMap, int, error) {
+	return newBQMap(cfg, m)
+}
+
+func TestSyncAllServicesExistingDataSource(t *testing.T) {
+	defer func(f func(*Config, clients.BigQueryClient) existingDataSource) { newExistingDataSource = f }(newExistingDataSource)
+	newExistingDataSource = func(cfg *Config, bq clients.BigQueryClient) existingDataSource {
+		return memoryExistingData{&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: "2015-05-09"}}
+	}
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	// Existing rows are not read from BigQuery.
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	// Only the day without an existing row is synced.
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(goodBadSeries(10, 1), nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2, DryRun: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	want := &SyncResult{ServicesSeen: 1, SLOsProcessed: 1, RowsWritten: 1, RowsPerSLO: map[string]int{"project/svc1/slo1": 1}, DryRun: true}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("expected sync result %+v; got %+v", want, res)
+	}
+}
+
+func TestSyncAllServicesUnparseableNames(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+	svc1 := &clients.Service{Name: "projects/project/services/svc1"}
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	// SLOs of the service with a malformed name should not be listed.
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{svc1, &clients.Service{Name: "projects/project/services/"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), svc1).Return([]*clients.SLO{
+		&clients.SLO{Name: "projects/project/services/svc1/serviceLevelObjectives/slo1", Goal: 0.99},
+		&clients.SLO{Name: "", Goal: 0.99},
+		&clients.SLO{Name: "projects/project/services/svc1/slo2", Goal: 0.99},
+	}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1, DryRun: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	want := &SyncResult{
+		ServicesSeen:  2,
+		SLOsProcessed: 1,
+		Skipped: map[string]string{
+			"project/projects/project/services/":               "unparseable name",
+			"project/svc1/":                                    "unparseable name",
+			"project/svc1/projects/project/services/svc1/slo2": "unparseable name",
+		},
+		RowsWritten: 1,
+		RowsPerSLO:  map[string]int{"project/svc1/slo1": 1},
+		DryRun:      true,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("expected sync result %+v; got %+v", want, res)
+	}
+}
+
+func TestSyncAllServicesDuplicateNames(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	for _, tt := range []struct {
+		name    string
+		fail    bool
+		wantErr string
+	}{
+		{"warning", false, ""},
+		{"failure", true, "Service 'frontend' SLO 'latency' is the name of both s1/o1 and s2/o1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+			svc1 := &clients.Service{Name: "projects/project/services/s1", DisplayName: "frontend"}
+			svc2 := &clients.Service{Name: "projects/project/services/s2", DisplayName: "frontend"}
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{svc1, svc2}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), svc1).Return([]*clients.SLO{
+				&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o1", DisplayName: "latency", Goal: 0.99},
+				&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o2", DisplayName: "availability", Goal: 0.99},
+			}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), svc2).Return([]*clients.SLO{
+				&clients.SLO{Name: "projects/project/services/s2/serviceLevelObjectives/o1", DisplayName: "latency", Goal: 0.99},
+			}, nil)
+
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, nil)
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1, DryRun: true,
+				FailOnDuplicateNames: tt.fail}
+			res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("syncAllServices() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncAllServices() unexpected error: %v", err)
+			}
+			// Both SLOs are still synced, and their rows are merged under the same names.
+			if res.SLOsProcessed != 3 || res.RowsPerSLO["project/frontend/latency"] != 2 {
+				t.Errorf("expected 3 SLOs processed with 2 rows of frontend/latency; got %+v", res)
+			}
+		})
+	}
+}
+
+func TestCheckDuplicateName(t *testing.T) {
+	cfg := &Config{FailOnDuplicateNames: true}
+	names := make(map[[2]string]string)
+	for _, tt := range []struct {
+		svc     *clients.Service
+		sloName string
+		wantErr bool
+	}{
+		{&clients.Service{Name: "s1", DisplayName: "svc"}, "o1", false},
+		// The same SLO may be checked again, e.g. when syncing several projects with the same services.
+		{&clients.Service{Name: "s1", DisplayName: "svc"}, "o1", false},
+		{&clients.Service{Name: "s1", DisplayName: "svc"}, "o2", false},
+		// Names are compared as pairs, so "svc-a"/"b" and "svc"/"a-b" don't clash.
+		{&clients.Service{Name: "s2", DisplayName: "svc-a"}, "b", false},
+		{&clients.Service{Name: "s3", DisplayName: "svc"}, "a-b", false},
+		{&clients.Service{Name: "s3", DisplayName: "svc"}, "o1", true},
+	} {
+		slo := &clients.SLO{Name: tt.sloName}
+		err := checkDuplicateName(cfg, names, tt.svc, slo)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkDuplicateName(%s, %s) = %v; want error: %v", tt.svc.Name, tt.sloName, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSyncAllServicesCustomTable(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), queryContains("FROM `datasetname.data_prod`")).Return([]*clients.BQRow{}, nil)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data_prod", gomock.Any()).Return(nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", Table: "data_prod", TimeZone: "Europe/London", BackfillDays: 1}
+	if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+}
+
+func TestSyncAllServicesGCSExport(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Return(nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+	written := make(map[string][]*clients.BQRow)
+	gcs := mocks.NewMockGCSClient(mockCtrl)
+	gcs.EXPECT().WriteRows(gomock.Any(), "bucket", gomock.Any(), gomock.Any()).Times(2).DoAndReturn(
+		func(_ context.Context, _, object string, rows []*clients.BQRow) error {
+			written[object] = rows
+			return nil
+		})
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2,
+		GCSExport: &GCSExport{Bucket: "bucket", Prefix: "/slo/"}}
+	if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, gcs); err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	for _, date := range []string{"2015-05-08", "2015-05-09"} {
+		object := "slo/" + date + "/project-1431270000.json"
+		if rows := written[object]; len(rows) != 1 || rows[0].Date != date || rows[0].SLO != "slo1" {
+			t.Errorf("expected a single row for %s in %s; got %+v", date, object, rows)
+		}
+	}
+}
+
+func TestSyncAllServicesGCSExportError(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Return(nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	gcs := mocks.NewMockGCSClient(mockCtrl)
+	gcs.EXPECT().WriteRows(gomock.Any(), "bucket", "2015-05-09/project-1431270000.json", gomock.Any()).Return(fmt.Errorf("access denied"))
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1,
+		GCSExport: &GCSExport{Bucket: "bucket"}}
+	_, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, gcs)
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("syncAllServices() expected error to contain 'access denied'; got %v", err)
+	}
+}
+
+func TestGoalChange(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 23, 30, 0, 0, time.UTC))
+	svc := &clients.Service{Name: "projects/p1/services/svc1", DisplayName: "Service 1"}
+	slo := &clients.SLO{Name: "projects/p1/services/svc1/serviceLevelObjectives/slo1", DisplayName: "SLO 1", Goal: 0.999}
+	cfg := &Config{clock: clock, Project: "p1", TimeZone: "Europe/London"}
+
+	for _, tt := range []struct {
+		name    string
+		targets map[bqMapKey]sloTarget
+		want    *clients.GoalChange
+	}{
+		{"no rows", map[bqMapKey]sloTarget{}, nil},
+		{"same goal", map[bqMapKey]sloTarget{bqMapKey{Project: "p1", Service: "svc1", SLO: "slo1"}: sloTarget{Date: "2015-05-09", Target: 0.999}}, nil},
+		{"changed goal", map[bqMapKey]sloTarget{bqMapKey{Project: "p1", Service: "svc1", SLO: "slo1"}: sloTarget{Date: "2015-05-09", Target: 0.99}},
+			&clients.GoalChange{Project: "p1", Service: "Service 1", SLO: "SLO 1", ServiceID: "svc1", SLOID: "slo1", Date: "2015-05-11",
+				OldTarget: 0.99, NewTarget: 0.999}},
+		{"changed goal in legacy row", map[bqMapKey]sloTarget{bqMapKey{Project: "p1", Service: "Service 1", SLO: "SLO 1"}: sloTarget{Date: "2015-05-09", Target: 0.99}},
+			&clients.GoalChange{Project: "p1", Service: "Service 1", SLO: "SLO 1", ServiceID: "svc1", SLOID: "slo1", Date: "2015-05-11",
+				OldTarget: 0.99, NewTarget: 0.999}},
+		{"other SLO changed", map[bqMapKey]sloTarget{bqMapKey{Project: "p1", Service: "svc1", SLO: "slo2"}: sloTarget{Date: "2015-05-09", Target: 0.99}}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := goalChange(cfg, svc, slo, tt.targets); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("goalChange() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSLOTimeZoneOverride(t *testing.T) {
+	// It's already 2015-05-11 in London, but still 2015-05-10 in New York.
+	clock := fixedClock(time.Date(2015, time.May, 10, 23, 30, 0, 0, time.UTC))
+	svc := &clients.Service{Name: "projects/p1/services/svc1", DisplayName: "Service 1"}
+	slo := &clients.SLO{Name: "projects/p1/services/svc1/serviceLevelObjectives/slo1", DisplayName: "SLO 1", Goal: 0.999, CalendarPeriod: "DAY"}
+	targets := map[bqMapKey]sloTarget{bqMapKey{Project: "p1", Service: "svc1", SLO: "slo1"}: sloTarget{Date: "2015-05-09", Target: 0.99}}
+
+	for _, tt := range []struct {
+		name      string
+		overrides map[string]string
+		wantDate  string
+		wantStart time.Time
+	}{
+		{"default time zone", nil, "2015-05-11", time.Date(2015, time.May, 10, 23, 0, 0, 0, time.UTC)},
+		{"overridden time zone", map[string]string{"svc1/slo1": "America/New_York"}, "2015-05-10", time.Date(2015, time.May, 10, 4, 0, 0, 0, time.UTC)},
+		{"other SLO overridden", map[string]string{"svc1/slo2": "America/New_York"}, "2015-05-11", time.Date(2015, time.May, 10, 23, 0, 0, 0, time.UTC)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{clock: clock, Project: "p1", TimeZone: "Europe/London", SLOTimeZones: tt.overrides}
+			if c := goalChange(cfg, svc, slo, targets); c == nil || c.Date != tt.wantDate {
+				t.Errorf("goalChange() = %+v; want date %s", c, tt.wantDate)
+			}
+			if d := sloDefinition(cfg, svc, slo); d.Date != tt.wantDate {
+				t.Errorf("sloDefinition() returned date %s; want %s", d.Date, tt.wantDate)
+			}
+			r := periodRecord(cfg, svc, slo)
+			if r == nil {
+				t.Fatalf("periodRecord() returned nil")
+			}
+			if r.row.Date != tt.wantDate || !r.start.Equal(tt.wantStart) {
+				t.Errorf("periodRecord() returned date %s starting at %v; want %s starting at %v", r.row.Date, r.start.UTC(), tt.wantDate, tt.wantStart)
+			}
+		})
+	}
+}
+
+func TestCheckGoal(t *testing.T) {
+	svc := &clients.Service{Name: "projects/p1/services/svc1", DisplayName: "Service 1"}
+
+	for _, tt := range []struct {
+		name      string
+		goal      float64
+		normalize bool
+		want      float64
+		wantErr   string
+	}{
+		{"fraction", 0.99, false, 0.99, ""},
+		{"normalized fraction", 0.99, true, 0.99, ""},
+		{"percentage", 99, false, 99, ""},
+		{"normalized percentage", 99, true, 0.99, ""},
+		{"out of range", 150, false, 150, ""},
+		{"normalized out of range", 150, true, 0, "goal 150 of Service 'Service 1' SLO 'SLO 1' is out of range"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			slo := &clients.SLO{Name: "projects/p1/services/svc1/serviceLevelObjectives/slo1", DisplayName: "SLO 1", Goal: tt.goal}
+			got, err := checkGoal(&Config{NormalizeGoals: tt.normalize}, svc, slo)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("checkGoal() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkGoal() unexpected error: %v", err)
+			}
+			if got.Goal != tt.want {
+				t.Errorf("checkGoal() returned goal %v; want %v", got.Goal, tt.want)
+			}
+			if slo.Goal != tt.goal {
+				t.Errorf("checkGoal() modified the goal of the SLO to %v", slo.Goal)
+			}
+		})
+	}
+}
+
+func TestSyncAllServicesNormalizeGoals(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return(nil, nil)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Do(
+		func(_ context.Context, _, _ string, rows []*clients.BQRow) {
+			for _, r := range rows {
+				if r.SLO != "slo1" || r.Target != 0.99 {
+					t.Errorf("unexpected row written: %+v", r)
+				}
+			}
+			if len(rows) != 2 {
+				t.Errorf("expected 2 rows to be written; got %d", len(rows))
+			}
+		})
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "projects/project/services/s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{
+		&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o1", DisplayName: "slo1", Goal: 99},
+		&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o2", DisplayName: "slo2", Goal: 150},
+	}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2,
+		NormalizeGoals: true, ContinueOnError: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err == nil || !strings.Contains(err.Error(), "goal 150 of Service 'svc1' SLO 'slo2' is out of range") {
+		t.Errorf("syncAllServices() expected error about the out of range goal; got %v", err)
+	}
+	if res.SLOsProcessed != 1 || res.SLOsFailed != 1 {
+		t.Errorf("unexpected sync result: %+v", res)
+	}
+}
+
+func TestSyncAllServicesGoalChanges(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-05-09", Target: 0.99},
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo2", ServiceID: "s1", SLOID: "o2", Date: "2015-05-09", Target: 0.5},
+	}, nil)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).AnyTimes().Return(nil)
+	bq.EXPECT().WriteGoalChanges(gomock.Any(), "datasetname", "slo_changes", []*clients.GoalChange{
+		&clients.GoalChange{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-05-10",
+			OldTarget: 0.99, NewTarget: 0.999},
+	}).Return(nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "projects/project/services/s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{
+		&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o1", DisplayName: "slo1", Goal: 0.999},
+		&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o2", DisplayName: "slo2", Goal: 0.5},
+	}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2, RecordGoalChanges: true}
+	if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+}
+
+func TestSyncAllServicesArchiveDefinitions(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	raw := `{"name": "projects/project/services/s1/serviceLevelObjectives/o1", "displayName": "slo1", "goal": 0.999, ` +
+		`"serviceLevelIndicator": {"requestBased": {"goodTotalRatio": {"goodServiceFilter": "good", "totalServiceFilter": "total"}}}, ` +
+		`"rollingPeriod": "2419200s", "userLabels": {"team": "frontend"}}`
+	var slo clients.SLO
+	if err := json.Unmarshal([]byte(raw), &slo); err != nil {
+		t.Fatalf("json.Unmarshal() unexpected error: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		cfg      *Config
+		wantDefs bool
+	}{
+		{"disabled", &Config{clock: clock}, false},
+		{"enabled", &Config{clock: clock, ArchiveDefinitions: true}, true},
+		{"dry run", &Config{clock: clock, ArchiveDefinitions: true, DryRun: true}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+			bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).AnyTimes().Return(nil)
+			if tt.wantDefs {
+				bq.EXPECT().WriteSLODefinitions(gomock.Any(), "datasetname", "slo_definitions", gomock.Any()).Do(
+					func(_ context.Context, _, _ string, defs []*clients.SLODefinition) {
+						if len(defs) != 1 {
+							t.Fatalf("expected 1 SLO definition; got %v", defs)
+						}
+						want := clients.SLODefinition{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1",
+							Date: "2015-05-10", Goal: 0.999, Definition: raw}
+						if *defs[0] != want {
+							t.Errorf("expected SLO definition %+v; got %+v", want, defs[0])
+						}
+						// The archived definition should decode to the SLO that has been synced.
+						var archived clients.SLO
+						if err := json.Unmarshal([]byte(defs[0].Definition), &archived); err != nil {
+							t.Fatalf("could not decode archived definition: %v", err)
+						}
+						if !reflect.DeepEqual(&archived, &slo) {
+							t.Errorf("archived definition decodes to %+v; want %+v", archived, slo)
+						}
+					}).Return(nil)
+			}
+
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "projects/project/services/s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&slo}, nil)
+
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, nil)
+
+			cfg := tt.cfg
+			cfg.Project, cfg.Dataset, cfg.TimeZone, cfg.BackfillDays = "project", "datasetname", "Europe/London", 1
+			if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err != nil {
+				t.Errorf("syncAllServices() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewRecordsSLOTimeZones(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	cfg := &Config{clock: clock, Project: "project", TimeZone: "Europe/London", BackfillDays: 1,
+		SLOTimeZones: map[string]string{"s1/tokyo": "Asia/Tokyo"}}
+	svc := &clients.Service{Name: "projects/project/services/s1"}
+
+	for _, tt := range []struct {
+		slo        string
+		date       string
+		start, end time.Time
+	}{
+		{"london", "2015-05-09", time.Date(2015, time.May, 8, 23, 0, 0, 0, time.UTC), time.Date(2015, time.May, 9, 23, 0, 0, 0, time.UTC)},
+		// It is already May 11 in Tokyo, so the previous day is May 10.
+		{"tokyo", "2015-05-10", time.Date(2015, time.May, 9, 15, 0, 0, 0, time.UTC), time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC)},
+	} {
+		slo := &clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/" + tt.slo}
+		recs, err := newRecords(cfg, svc, slo, make(bqMap))
+		if err != nil {
+			t.Fatalf("newRecords() unexpected error: %v", err)
+		}
+		if len(recs) != 1 {
+			t.Fatalf("expected 1 record for SLO %s; got %d", tt.slo, len(recs))
+		}
+		row := recs[0].row
+		if row.Date != tt.date || !recs[0].start.Equal(tt.start) || !recs[0].end.Equal(tt.end) {
+			t.Errorf("expected SLO %s to sync %s from %v to %v; got %s from %v to %v", tt.slo, tt.date, tt.start, tt.end, row.Date, recs[0].start, recs[0].end)
+		}
+	}
+}
+
+func TestNewRecordsLabels(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	slo := &clients.SLO{Name: "s1", DisplayName: "slo1", UserLabels: map[string]string{"team": "frontend", "tier": "1", "oncall": "alice"}}
+
+	for _, tt := range []struct {
+		name   string
+		labels []string
+		want   map[string]string
+	}{
+		{"not configured", nil, nil},
+		{"configured", []string{"team", "tier"}, map[string]string{"team": "frontend", "tier": "1"}},
+		{"partially present", []string{"team", "cost_center"}, map[string]string{"team": "frontend"}},
+		{"absent", []string{"cost_center"}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{clock: clock, Project: "project", TimeZone: "Europe/London", BackfillDays: 2, Granularity: "hourly", SLOLabels: tt.labels}
+			recs, err := newRecords(cfg, &clients.Service{Name: "s1", DisplayName: "svc1"}, slo, make(bqMap))
+			if err != nil {
+				t.Fatalf("newRecords() unexpected error: %v", err)
+			}
+			if len(recs) == 0 {
+				t.Fatalf("newRecords() returned no records")
+			}
+			for _, r := range recs {
+				if !reflect.DeepEqual(r.row.Labels, tt.want) {
+					t.Errorf("expected labels %v for %s hour %v; got %v", tt.want, r.row.Date, r.row.Hour, r.row.Labels)
+				}
+			}
+		})
+	}
+}
+
+func TestSLODefinitionWithoutRaw(t *testing.T) {
+	cfg := &Config{Project: "project", TimeZone: "Asia/Tokyo", clock: fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))}
+	svc := &clients.Service{Name: "projects/project/services/s1"}
+	slo := &clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o1", Goal: 0.99, CalendarPeriod: "MONTH"}
+
+	got := sloDefinition(cfg, svc, slo)
+	// It is already May 11 in Tokyo.
+	if got.Date != "2015-05-11" || got.Service != "s1" || got.SLO != "o1" || got.Goal != 0.99 {
+		t.Errorf("sloDefinition() = %+v", got)
+	}
+	var decoded clients.SLO
+	if err := json.Unmarshal([]byte(got.Definition), &decoded); err != nil {
+		t.Fatalf("could not decode definition %s: %v", got.Definition, err)
+	}
+	if decoded.Name != slo.Name || decoded.Goal != slo.Goal || decoded.CalendarPeriod != slo.CalendarPeriod {
+		t.Errorf("definition %s does not match %+v", got.Definition, slo)
+	}
+}
+
+func TestCalendarPeriodStart(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("LoadLocation() unexpected error: %v", err)
+	}
+	// 2015-05-10 is a Sunday.
+	now := time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		period string
+		now    time.Time
+		want   time.Time
+		wantOK bool
+	}{
+		{"DAY", now, time.Date(2015, time.May, 9, 23, 0, 0, 0, time.UTC), true},
+		{"WEEK", now, time.Date(2015, time.May, 3, 23, 0, 0, 0, time.UTC), true},
+		{"WEEK", time.Date(2015, time.May, 4, 15, 0, 0, 0, time.UTC), time.Date(2015, time.May, 3, 23, 0, 0, 0, time.UTC), true},
+		{"MONTH", now, time.Date(2015, time.April, 30, 23, 0, 0, 0, time.UTC), true},
+		// The month started before clocks went forward on 2015-03-29.
+		{"MONTH", time.Date(2015, time.March, 30, 15, 0, 0, 0, time.UTC), time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC), true},
+		{"QUARTER", now, time.Date(2015, time.March, 31, 23, 0, 0, 0, time.UTC), true},
+		{"HALF", time.Date(2015, time.November, 10, 15, 0, 0, 0, time.UTC), time.Date(2015, time.June, 30, 23, 0, 0, 0, time.UTC), true},
+		{"YEAR", now, time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC), true},
+		{"FORTNIGHT", now, time.Time{}, false},
+	} {
+		t.Run(tt.period+" "+tt.now.Format("2006-01-02"), func(t *testing.T) {
+			got, ok := calendarPeriodStart(tt.now, london, tt.period)
+			if !got.Equal(tt.want) || ok != tt.wantOK {
+				t.Errorf("calendarPeriodStart() = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSyncAllServicesPeriodToDate(t *testing.T) {
+	now := time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC)
+	// May started at midnight BST.
+	periodStart := time.Date(2015, time.April, 30, 23, 0, 0, 0, time.UTC)
+	sli := &clients.SLI{RequestBasedSLI: &clients.RequestBasedSLI{GoodTotalRatioSLI: &clients.GoodTotalRatioSLI{Good: "good", Total: "total"}}}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).AnyTimes().Return(nil)
+	bq.EXPECT().EnsureTable(gomock.Any(), "datasetname", "period_to_date").Return(nil)
+	bq.EXPECT().Load(gomock.Any(), "datasetname", "period_to_date", []*clients.BQRow{
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "monthly", ServiceID: "s1", SLOID: "monthly", Date: "2015-05-10",
+			Good: 990, Total: 1000, BadEvents: 10, ErrorBudget: errorBudget(1000, 0.99), Target: 0.99, Period: "calendar MONTH",
+			IntervalStart: periodStart, IntervalEnd: now, PeriodStart: periodStart, ValueType: "INT64"},
+	}).Return(nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "projects/project/services/s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{
+		&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/monthly", Goal: 0.99, SLI: sli, CalendarPeriod: "MONTH"},
+		&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/rolling", Goal: 0.99, SLI: sli, RollingPeriod: "2419200s"},
+		&clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/fortnightly", Goal: 0.99, SLI: sli, CalendarPeriod: "FORTNIGHT"},
+	}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+		func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			// Only the monthly SLO gets the whole period queried, while all SLOs get daily rows.
+			values := map[string]int64{"good": 99, "total": 100}
+			if req.Interval.StartTime.Seconds == periodStart.Unix() {
+				if req.Interval.EndTime.Seconds != now.Unix() {
+					t.Errorf("expected period-to-date interval to end at %v; got %v", now, req.Interval)
+				}
+				values = map[string]int64{"good": 990, "total": 1000}
+			}
+			return []*monitoringpb.TimeSeries{int64Series(values[req.Filter])}, nil
+		})
+
+	cfg := &Config{clock: fixedClock(now), Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1, PeriodToDate: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Errorf("syncAllServices() unexpected error: %v", err)
+	}
+	// Period-to-date rows are not counted as rows of the data table.
+	if res.RowsWritten != 3 {
+		t.Errorf("expected 3 rows to be written; got %+v", res)
+	}
+}
+
+func TestSyncResultAdd(t *testing.T) {
+	res := &SyncResult{DryRun: true}
+	res.add(&SyncResult{ServicesSeen: 1, SLOsProcessed: 2, RowsWritten: 3, RowsPerSLO: map[string]int{"p1/svc1/slo1": 3}})
+	res.add(&SyncResult{ServicesSeen: 2, SLOsProcessed: 1, SLOsFailed: 1, Skipped: map[string]string{"p2/svc2": "excluded"},
+		RowsWritten: 1, RowsPerSLO: map[string]int{"p2/svc1/slo1": 1}, MalformedRowsSkipped: 2})
+
+	want := &SyncResult{
+		ServicesSeen:         3,
+		SLOsProcessed:        3,
+		Skipped:              map[string]string{"p2/svc2": "excluded"},
+		RowsWritten:          4,
+		RowsPerSLO:           map[string]int{"p1/svc1/slo1": 3, "p2/svc1/slo1": 1},
+		SLOsFailed:           1,
+		DryRun:               true,
+		MalformedRowsSkipped: 2,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("expected sync result %+v; got %+v", want, res)
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	for _, tt := range []struct {
+		total  int64
+		target float64
+		want   float64
+	}{
+		{1000, 0.99, 10},
+		{1000, 0.5, 500},
+		{1000, 1, 0},
+		{0, 0.99, 0},
+	} {
+		if got := errorBudget(tt.total, tt.target); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("errorBudget(%d, %v) = %v; want %v", tt.total, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestSyncAllServicesRefreshZeroRows(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 1
+	streamingBuffer := &bigquery.Error{Reason: "invalidQuery",
+		Message: "UPDATE or DELETE statement over table project.datasetname.data would affect rows in the streaming buffer, which is not supported"}
+
+	for _, tt := range []struct {
+		name      string
+		deleteErr error
+		wantRows  int
+		wantErr   string
+	}{
+		{"zero row replaced", nil, 1, ""},
+		// The zero row is kept, and refreshed again by the next sync.
+		{"zero row in streaming buffer", streamingBuffer, 0, ""},
+		{"delete fails", fmt.Errorf("access denied"), 0, "access denied"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{
+				&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-08"},
+				&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-09"},
+			}, nil)
+
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+			// 2015-05-09 now has events, while 2015-05-08 still has none. Days are queried in order with a
+			// concurrency of 1.
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			series := func(good float64) []*monitoringpb.TimeSeries {
+				var ts []*monitoringpb.TimeSeries
+				for eventType, v := range map[string]float64{"good": good, "bad": 0} {
+					ts = append(ts, &monitoringpb.TimeSeries{
+						Metric:    &metricpb.Metric{Labels: map[string]string{"event_type": eventType}},
+						ValueType: metricpb.MetricDescriptor_DOUBLE, Points: []*monitoringpb.Point{
+							&monitoringpb.Point{Value: &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}}}}})
+				}
+				return ts
+			}
+			gomock.InOrder(
+				sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(series(100), nil),
+				sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(series(0), nil),
+			)
+
+			// Only the zero row of the day that now has events is deleted, before the new row is written.
+			bq.EXPECT().DeleteRows(gomock.Any(), "datasetname", "data", "NOT IFNULL(partial, FALSE) AND total = 0 AND "+
+				"IFNULL(project, 'project') = 'project' AND ((date, IFNULL(hour, -1), serviceid, sloid) IN "+
+				`((DATE '2015-05-09', -1, "s1", "s1")) OR (serviceid IS NULL AND (date, IFNULL(hour, -1), service, slo) IN `+
+				`((DATE '2015-05-09', -1, "svc1", "slo1"))))`).Return(tt.deleteErr)
+			if tt.wantRows > 0 {
+				bq.EXPECT().Put(gomock.Any(), "datasetname", "data", []*clients.BQRow{
+					londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-09",
+						Target: 0.99, Good: 100, Total: 100, ErrorBudget: errorBudget(100, 0.99), ValueType: "DOUBLE"}),
+				})
+			}
+			if tt.wantErr == "" {
+				bq.EXPECT().Put(gomock.Any(), "datasetname", "data", nil) // final Put with no rows.
+			}
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2, Concurrency: 1, RefreshZeroRows: true}
+			res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("syncAllServices() expected error to contain '%s'; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("syncAllServices() unexpected error: %v", err)
+			}
+			if res.RowsWritten != tt.wantRows {
+				t.Errorf("expected %d rows to be written; got %+v", tt.wantRows, res)
+			}
+		})
+	}
+}
+
+func TestNewRecordsRefreshZeroRows(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	existing := make(bqMap)
+	existing.Add(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: "2015-05-09"})
+	existing.Add(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", Date: "2015-05-08", Good: 90, Total: 100})
+
+	for _, tt := range []struct {
+		name      string
+		refresh   bool
+		wantDates []string
+	}{
+		{"zero rows are kept by default", false, []string{"2015-05-07"}},
+		{"zero rows are re-synced", true, []string{"2015-05-09", "2015-05-07"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{clock: clock, Project: "project", TimeZone: "Europe/London", BackfillDays: 3, RefreshZeroRows: tt.refresh}
+			recs, err := newRecords(cfg, &clients.Service{Name: "s1", DisplayName: "svc1"}, &clients.SLO{Name: "s1", DisplayName: "slo1"}, existing)
+			if err != nil {
+				t.Fatalf("newRecords() unexpected error: %v", err)
+			}
+			var dates []string
+			for _, r := range recs {
+				dates = append(dates, r.row.Date)
+			}
+			if !reflect.DeepEqual(dates, tt.wantDates) {
+				t.Errorf("expected records for %v; got %v", tt.wantDates, dates)
+			}
+		})
+	}
+}
+
+func TestNewRecordsIncludeToday(t *testing.T) {
+	// 16:00:30 in London.
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 30, 0, time.UTC))
+
+	svc, slo := &clients.Service{Name: "s1", DisplayName: "svc1"}, &clients.SLO{Name: "s1", DisplayName: "slo1"}
+	cfg := &Config{clock: clock, Project: "project", TimeZone: "Europe/London", BackfillDays: 1, IncludeToday: true}
+	recs, err := newRecords(cfg, svc, slo, make(bqMap))
+	if err != nil {
+		t.Fatalf("newRecords() unexpected error: %v", err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected records for today and yesterday; got %d", len(recs))
+	}
+	today, yesterday := recs[0].row, recs[1].row
+	if !today.Partial || today.Date != "2015-05-10" || !today.IntervalEnd.Equal(clock()) {
+		t.Errorf("expected a partial row for 2015-05-10 ending at %v; got %+v", clock(), today)
+	}
+	if yesterday.Partial || yesterday.Date != "2015-05-09" {
+		t.Errorf("expected a complete row for 2015-05-09; got %+v", yesterday)
+	}
+
+	// Only hours at least a minute long are synced, so the current hour is skipped.
+	cfg.Granularity = granularityHourly
+	recs, err = newRecords(cfg, svc, slo, make(bqMap))
+	if err != nil {
+		t.Fatalf("newRecords() unexpected error: %v", err)
+	}
+	var partial int
+	for _, r := range recs {
+		if r.row.Partial {
+			partial++
+		}
+	}
+	if partial != 16 {
+		t.Errorf("expected 16 partial hourly rows; got %d", partial)
+	}
+
+	// Today is not synced when recomputing a date range.
+	cfg = &Config{clock: clock, Project: "project", TimeZone: "Europe/London", IncludeToday: true, BackfillStart: "2015-05-08", BackfillEnd: "2015-05-08"}
+	if recs, _ := newRecords(cfg, svc, slo, make(bqMap)); len(recs) != 1 || recs[0].row.Partial {
+		t.Errorf("expected a single complete record; got %d records", len(recs))
+	}
+}
+
+func TestSyncAllServicesIncludeToday(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).Return(goodBadSeries(100, 0), nil)
+
+	// There are no partial rows to delete yet. The partial row is written using a load job, so that
+	// it can be deleted by the next sync.
+	today := londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-10",
+		Target: 0.99, Good: 100, Total: 100, ErrorBudget: errorBudget(100, 0.99), Partial: true, ValueType: "DOUBLE"})
+	today.IntervalEnd = clock()
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", []*clients.BQRow{
+		londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-09",
+			Target: 0.99, Good: 100, Total: 100, ErrorBudget: errorBudget(100, 0.99), ValueType: "DOUBLE"}),
+	}).Return(nil)
+	bq.EXPECT().Load(gomock.Any(), "datasetname", "data", []*clients.BQRow{today}).Return(nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1, IncludeToday: true}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Fatalf("syncAllServices() unexpected error: %v", err)
+	}
+	if res.RowsWritten != 2 {
+		t.Errorf("expected 2 rows to be written; got %+v", res)
+	}
+}
+
+func TestSyncAllServicesReplacesPartialRows(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 11, 9, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	// The previous sync ran on 2015-05-10, and an earlier sync today already wrote a partial row.
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-10", Good: 50, Total: 50, Partial: true},
+		&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-11", Good: 5, Total: 5, Partial: true},
+	}, nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "s1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(2).Return(goodBadSeries(100, 0), nil)
+
+	// Both partial rows are deleted, then 2015-05-10 is written as a complete row, and today as a new partial one.
+	today := londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-11",
+		Target: 0.99, Good: 100, Total: 100, ErrorBudget: errorBudget(100, 0.99), Partial: true, ValueType: "DOUBLE"})
+	today.IntervalEnd = clock()
+	gomock.InOrder(
+		bq.EXPECT().DeleteRows(gomock.Any(), "datasetname", "data",
+			`partial AND IFNULL(project, 'project') = 'project' AND hour IS NULL AND `+
+				`((date, serviceid, sloid) IN ((DATE '2015-05-11', "s1", "s1"), (DATE '2015-05-10', "s1", "s1")) OR `+
+				`(serviceid IS NULL AND (date, service, slo) IN ((DATE '2015-05-11', "svc1", "slo1"), (DATE '2015-05-10', "svc1", "slo1"))))`).Return(nil),
+		bq.EXPECT().Put(gomock.Any(), "datasetname", "data", []*clients.BQRow{
+			londonDay(&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "s1", Date: "2015-05-10",
+				Target: 0.99, Good: 100, Total: 100, ErrorBudget: errorBudget(100, 0.99), ValueType: "DOUBLE"}),
+		}).Return(nil),
+		bq.EXPECT().Load(gomock.Any(), "datasetname", "data", []*clients.BQRow{today}).Return(nil),
+	)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 1, IncludeToday: true}
+	if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err != nil {
+		t.Fatalf("syncAllServices() unexpected error: %v", err)
+	}
+}
+
+func TestSyncAllServicesFastPath(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	defer func(n int) { bqBatchSize = n }(bqBatchSize)
+	bqBatchSize = 100
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+	bq.EXPECT().ReadKnownSLOs(gomock.Any(), "datasetname", knownSLOsTableName, "project").Return([]*clients.KnownSLO{
+		&clients.KnownSLO{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1"},
+	}, nil)
+
+	svc := &clients.Service{Name: "s1", DisplayName: "svc1"}
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{svc}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), svc).Return([]*clients.SLO{
+		&clients.SLO{Name: "o1", DisplayName: "slo1", Goal: 0.99},
+		&clients.SLO{Name: "o2", DisplayName: "slo2", Goal: 0.99},
+	}, nil)
+
+	// The known SLO only gets the last day synced, while the new one is backfilled for 3 days.
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Times(4).Return(goodBadSeries(100, 0), nil)
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Return(nil)
+	bq.EXPECT().WriteKnownSLOs(gomock.Any(), "datasetname", knownSLOsTableName, []*clients.KnownSLO{
+		&clients.KnownSLO{Project: "project", Service: "svc1", SLO: "slo2", ServiceID: "s1", SLOID: "o2", FirstSeen: clock()},
+	}).Return(nil)
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 3, FastPathDays: 1}
+	res, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil)
+	if err != nil {
+		t.Fatalf("syncAllServices() unexpected error: %v", err)
+	}
+	want := map[string]int{"project/svc1/slo1": 1, "project/svc1/slo2": 3}
+	if !reflect.DeepEqual(res.RowsPerSLO, want) {
+		t.Errorf("expected rows per SLO to be %v; got %v", want, res.RowsPerSLO)
+	}
+}
+
+func TestSyncAllServicesFastPathFailedBackfill(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	// The known SLOs table does not exist yet, and the new SLO fails to backfill, so nothing is recorded
+	// as known, and the next sync backfills it again.
+	bq := mocks.NewMockBigQueryClient(mockCtrl)
+	bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{}, nil)
+	bq.EXPECT().ReadKnownSLOs(gomock.Any(), "datasetname", knownSLOsTableName, "project").Return(nil, nil)
+
+	sloc := mocks.NewMockSLOClient(mockCtrl)
+	sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "s1", DisplayName: "svc1"}}, nil)
+	sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return([]*clients.SLO{&clients.SLO{Name: "o1", DisplayName: "slo1", Goal: 0.99}}, nil)
+
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("quota exceeded")).AnyTimes()
+	bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).Return(nil).AnyTimes()
+
+	cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 3, FastPathDays: 1, ContinueOnError: true}
+	if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("syncAllServices() expected error to contain 'quota exceeded'; got %v", err)
+	}
+}
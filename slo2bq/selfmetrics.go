@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"slo2bq/clients"
+	"time"
+
+	googlepb "github.com/golang/protobuf/ptypes/timestamp"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Default prefix of metric types written when Config.SelfMetrics is set.
+const defaultSelfMetricsPrefix = "custom.googleapis.com/slo2bq/"
+
+// selfMetricsPrefix returns the prefix of metric types written when SelfMetrics is set.
+func (c *Config) selfMetricsPrefix() string {
+	if c.SelfMetricsPrefix == "" {
+		return defaultSelfMetricsPrefix
+	}
+	return c.SelfMetricsPrefix
+}
+
+// writeSelfMetrics writes gauge metrics describing a completed sync run to Stackdriver, allowing
+// to alert on a sync that stops producing data. Time series are written to cfg.Project and are
+// labelled with the dataset name.
+func writeSelfMetrics(ctx context.Context, cfg *Config, sd clients.MetricClient, res *SyncResult, duration time.Duration) error {
+	now := &monitoringpb.TimeInterval{EndTime: &googlepb.Timestamp{Seconds: cfg.now().Unix()}}
+	series := func(name string, value *monitoringpb.TypedValue, valueType metricpb.MetricDescriptor_ValueType) *monitoringpb.TimeSeries {
+		return &monitoringpb.TimeSeries{
+			Metric: &metricpb.Metric{
+				Type:   cfg.selfMetricsPrefix() + name,
+				Labels: map[string]string{"dataset": cfg.Dataset},
+			},
+			Resource: &monitoredrespb.MonitoredResource{
+				Type:   "global",
+				Labels: map[string]string{"project_id": cfg.Project},
+			},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  valueType,
+			Points:     []*monitoringpb.Point{&monitoringpb.Point{Interval: now, Value: value}},
+		}
+	}
+	int64Value := func(v int) *monitoringpb.TypedValue {
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: int64(v)}}
+	}
+
+	req := &monitoringpb.CreateTimeSeriesRequest{
+		Name: fmt.Sprintf("projects/%s", cfg.Project),
+		TimeSeries: []*monitoringpb.TimeSeries{
+			series("rows_written", int64Value(res.RowsWritten), metricpb.MetricDescriptor_INT64),
+			series("slos_processed", int64Value(res.SLOsProcessed), metricpb.MetricDescriptor_INT64),
+			series("slos_skipped", int64Value(len(res.Skipped)), metricpb.MetricDescriptor_INT64),
+			series("run_duration_seconds", &monitoringpb.TypedValue{
+				Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: duration.Seconds()}}, metricpb.MetricDescriptor_DOUBLE),
+		},
+	}
+	if err := sd.CreateTimeSeries(ctx, req); err != nil {
+		return fmt.Errorf("CreateTimeSeries (%v) error: %v", req, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slo2bq/clients/mocks"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestWriteSelfMetrics(t *testing.T) {
+	clock := fixedClock(time.Unix(1431270000, 0))
+
+	for _, tt := range []struct {
+		name       string
+		prefix     string
+		wantPrefix string
+	}{
+		{"default prefix", "", "custom.googleapis.com/slo2bq/"},
+		{"custom prefix", "custom.googleapis.com/myprefix/", "custom.googleapis.com/myprefix/"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			sd := mocks.NewMockMetricClient(mockCtrl)
+
+			var req *monitoringpb.CreateTimeSeriesRequest
+			sd.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, r *monitoringpb.CreateTimeSeriesRequest) error {
+					req = r
+					return nil
+				})
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", SelfMetrics: true, SelfMetricsPrefix: tt.prefix}
+			res := &SyncResult{SLOsProcessed: 3, RowsWritten: 10, Skipped: map[string]string{"project/svc1": "excluded"}}
+			if err := writeSelfMetrics(context.Background(), cfg, sd, res, 1500*time.Millisecond); err != nil {
+				t.Fatalf("writeSelfMetrics() unexpected error: %v", err)
+			}
+
+			if req.Name != "projects/project" {
+				t.Errorf("expected time series to be written to projects/project; got %s", req.Name)
+			}
+			got := make(map[string]interface{})
+			for _, s := range req.TimeSeries {
+				if !reflect.DeepEqual(s.Metric.Labels, map[string]string{"dataset": "datasetname"}) {
+					t.Errorf("unexpected labels in %v: %v", s.Metric.Type, s.Metric.Labels)
+				}
+				if s.MetricKind != metricpb.MetricDescriptor_GAUGE || len(s.Points) != 1 || s.Points[0].Interval.EndTime.Seconds != 1431270000 {
+					t.Errorf("expected a single gauge point at the current time in %v; got %v", s.Metric.Type, s)
+				}
+				v := s.Points[0].Value
+				if s.ValueType == metricpb.MetricDescriptor_DOUBLE {
+					got[s.Metric.Type] = v.GetDoubleValue()
+				} else {
+					got[s.Metric.Type] = v.GetInt64Value()
+				}
+			}
+			want := map[string]interface{}{
+				tt.wantPrefix + "rows_written":         int64(10),
+				tt.wantPrefix + "slos_processed":       int64(3),
+				tt.wantPrefix + "slos_skipped":         int64(1),
+				tt.wantPrefix + "run_duration_seconds": 1.5,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected metrics %v; got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestWriteSelfMetricsError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	sd := mocks.NewMockMetricClient(mockCtrl)
+	sd.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(fmt.Errorf("myerror"))
+
+	err := writeSelfMetrics(context.Background(), &Config{Project: "project"}, sd, &SyncResult{}, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "myerror") {
+		t.Errorf("writeSelfMetrics() expected error to contain 'myerror'; got %v", err)
+	}
+}
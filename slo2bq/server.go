@@ -0,0 +1,68 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout limits the time Serve waits for in-flight syncs to flush their rows and release the
+// lease once it's asked to stop. Cloud Run kills the process 10 seconds after sending SIGTERM anyway.
+const shutdownTimeout = 30 * time.Second
+
+// Serve runs an HTTP server on a given listener, for use when the sync runs in a long-lived process (e.g.
+// on Cloud Run) rather than as a Cloud Function. Syncs are triggered by requests to / (as handled by
+// SyncSloPerformanceHTTP), and Prometheus metrics are exposed at /metrics. Once ctx is done (e.g. when the
+// process gets SIGTERM), in-flight syncs are cancelled, which makes them write rows computed so far and
+// release the lease, and Serve returns after they have finished.
+func Serve(ctx context.Context, l net.Listener) error {
+	// syncs is cancelled on shutdown, which cancels contexts of all in-flight sync requests.
+	syncs, cancelSyncs := context.WithCancel(context.Background())
+	defer cancelSyncs()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-syncs.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		SyncSloPerformanceHTTP(w, r.WithContext(ctx))
+	})
+
+	srv := &http.Server{Handler: mux}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(l) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down; cancelling in-flight syncs")
+	cancelSyncs()
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(sctx)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slo2bq/clients"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestServeShutdown(t *testing.T) {
+	defer func() { runSync = run }()
+	defer func(f func(context.Context, *Config) (clients.BigQueryClient, error)) { datasetLabelsBQClient = f }(datasetLabelsBQClient)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDatasetLabels(mockCtrl, nil)
+	started := make(chan struct{})
+	runSync = func(ctx context.Context, cfg *Config) (*SyncResult, error) {
+		close(started)
+		// A real sync writes rows computed so far and releases the lease once cancelled.
+		<-ctx.Done()
+		return &SyncResult{RowsWritten: 3}, ctx.Err()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, l) }()
+
+	type response struct {
+		status int
+		body   httpResponse
+		err    error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/?Project=p1&Dataset=ds")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		r := response{status: resp.StatusCode}
+		r.err = json.NewDecoder(resp.Body).Decode(&r.body)
+		responses <- r
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected sync to start")
+	}
+	// Shutting down the server cancels the in-flight sync, which still gets to respond.
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve() unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Serve() to return after shutdown")
+	}
+	r := <-responses
+	if r.err != nil {
+		t.Fatalf("unexpected error getting a response: %v", r.err)
+	}
+	if r.status != http.StatusInternalServerError || r.body.Error != context.Canceled.Error() || r.body.SyncResult.RowsWritten != 3 {
+		t.Errorf("expected a cancelled sync with 3 rows written; got status %d and %+v", r.status, r.body)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"slo2bq/clients"
+	"sort"
+	"time"
+)
+
+// sloInventory tracks services and SLOs returned by the Service Monitoring API during a sync, to detect
+// deleted SLOs (see Config.TombstoneDeletedSLOs). Services and SLOs are tracked by both IDs and names,
+// since rows written before ID columns were added are keyed by names.
+type sloInventory struct {
+	// services contains all services.
+	services map[string]bool
+	// listed contains services whose SLOs have been listed.
+	listed map[string]bool
+	// slos contains [service, SLO] pairs of all listed SLOs.
+	slos map[[2]string]bool
+}
+
+// newSLOInventory returns an sloInventory of given services, without any SLOs.
+func newSLOInventory(svcs []*clients.Service) *sloInventory {
+	inv := &sloInventory{make(map[string]bool), make(map[string]bool), make(map[[2]string]bool)}
+	for _, svc := range svcs {
+		inv.services[svc.ID()] = true
+		inv.services[svc.HumanName()] = true
+	}
+	return inv
+}
+
+// addSLOs records all SLOs of a service, including those that are not synced.
+func (inv *sloInventory) addSLOs(svc *clients.Service, slos []*clients.SLO) {
+	inv.listed[svc.ID()] = true
+	inv.listed[svc.HumanName()] = true
+	for _, slo := range slos {
+		inv.slos[[2]string{svc.ID(), slo.ID()}] = true
+		inv.slos[[2]string{svc.HumanName(), slo.HumanName()}] = true
+	}
+}
+
+// deleted returns whether an SLO identified like a key of the data table has been deleted: either its
+// service does not exist anymore, or SLOs of its service have been listed without it. SLOs of services
+// whose SLOs have not been listed (e.g. because of ServiceInclude) are never considered deleted.
+func (inv *sloInventory) deleted(service, slo string) bool {
+	if inv.slos[[2]string{service, slo}] {
+		return false
+	}
+	return inv.listed[service] || !inv.services[service]
+}
+
+// sloStateChanges returns SLOStates of SLOs with recent rows (as in `targets`) which have been deleted, and of
+// SLOs recorded as deleted which exist again. SLOs already recorded as deleted are not returned again.
+func sloStateChanges(ctx context.Context, cfg *Config, bq clients.BigQueryClient, targets map[bqMapKey]sloTarget, inv *sloInventory) ([]*clients.SLOState, error) {
+	states, err := bq.ReadSLOStates(ctx, cfg.Dataset, sloStateTableName, cfg.Project)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[[2]string]*clients.SLOState)
+	for _, s := range states {
+		k := [2]string{s.Service, s.SLO}
+		if l, ok := latest[k]; !ok || s.Recorded.After(l.Recorded) {
+			latest[k] = s
+		}
+	}
+
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now := cfg.now()
+	var changes []*clients.SLOState
+	add := func(k [2]string, deleted bool) {
+		changes = append(changes, &clients.SLOState{Project: cfg.Project, Service: k[0], SLO: k[1],
+			Date: now.In(loc).Format("2006-01-02"), Deleted: deleted, Recorded: now})
+	}
+	for key := range targets {
+		k := [2]string{key.Service, key.SLO}
+		if key.Project != cfg.Project || !inv.deleted(k[0], k[1]) {
+			continue
+		}
+		if l, ok := latest[k]; !ok || !l.Deleted {
+			add(k, true)
+		}
+	}
+	for k, l := range latest {
+		if l.Deleted && inv.slos[k] {
+			add(k, false)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Service != changes[j].Service {
+			return changes[i].Service < changes[j].Service
+		}
+		return changes[i].SLO < changes[j].SLO
+	})
+	return changes, nil
+}
+
+// recordSLOStates writes changes of SLO states to the sloStateTableName table, see sloStateChanges.
+func recordSLOStates(ctx context.Context, cfg *Config, bq clients.BigQueryClient, targets map[bqMapKey]sloTarget, inv *sloInventory) error {
+	changes, err := sloStateChanges(ctx, cfg, bq, targets, inv)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	for _, s := range changes {
+		fields := logFields{"service": s.Service, "slo": s.SLO, "date": s.Date}
+		if s.Deleted {
+			logEntry(cfg, severityInfo, fields, "Service '%s' SLO '%s' has been deleted", s.Service, s.SLO)
+		} else {
+			logEntry(cfg, severityInfo, fields, "Service '%s' SLO '%s' exists again after being deleted", s.Service, s.SLO)
+		}
+	}
+	if cfg.DryRun {
+		return nil
+	}
+	return bq.WriteSLOStates(ctx, cfg.Dataset, sloStateTableName, changes)
+}
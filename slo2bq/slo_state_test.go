@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slo2bq
+
+import (
+	"context"
+	"slo2bq/clients"
+	"slo2bq/clients/mocks"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestSLOInventoryDeleted(t *testing.T) {
+	svc1 := &clients.Service{Name: "projects/p1/services/s1", DisplayName: "svc1"}
+	svc2 := &clients.Service{Name: "projects/p1/services/s2", DisplayName: "svc2"}
+	inv := newSLOInventory([]*clients.Service{svc1, svc2})
+	inv.addSLOs(svc1, []*clients.SLO{{Name: "projects/p1/services/s1/serviceLevelObjectives/o1", DisplayName: "slo1"}})
+
+	for _, tt := range []struct {
+		service, slo string
+		want         bool
+	}{
+		{"s1", "o1", false},
+		{"svc1", "slo1", false},
+		{"s1", "o2", true},
+		{"svc1", "slo2", true},
+		{"s2", "o3", false},
+		{"s3", "o4", true},
+	} {
+		if got := inv.deleted(tt.service, tt.slo); got != tt.want {
+			t.Errorf("deleted(%q, %q) = %v; want %v", tt.service, tt.slo, got, tt.want)
+		}
+	}
+}
+
+func TestSyncAllServicesTombstoneDeletedSLOs(t *testing.T) {
+	clock := fixedClock(time.Date(2015, time.May, 10, 15, 0, 0, 0, time.UTC))
+	earlier := time.Date(2015, time.May, 1, 15, 0, 0, 0, time.UTC)
+	slo1 := &clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o1", DisplayName: "slo1", Goal: 0.99}
+	slo2 := &clients.SLO{Name: "projects/project/services/s1/serviceLevelObjectives/o2", DisplayName: "slo2", Goal: 0.99}
+
+	for _, tt := range []struct {
+		name           string
+		slos           []*clients.SLO
+		serviceInclude []string
+		states         []*clients.SLOState
+		dryRun         bool
+		want           []*clients.SLOState
+	}{
+		{"deleted since yesterday", []*clients.SLO{slo1}, nil, nil, false, []*clients.SLOState{
+			{Project: "project", Service: "s1", SLO: "o2", Date: "2015-05-10", Deleted: true, Recorded: clock()}}},
+		{"already recorded", []*clients.SLO{slo1}, nil, []*clients.SLOState{
+			{Project: "project", Service: "s1", SLO: "o2", Date: "2015-05-09", Deleted: true, Recorded: earlier}}, false, nil},
+		{"exists again", []*clients.SLO{slo1, slo2}, nil, []*clients.SLOState{
+			{Project: "project", Service: "s1", SLO: "o2", Date: "2015-05-01", Deleted: true, Recorded: earlier}}, false, []*clients.SLOState{
+			{Project: "project", Service: "s1", SLO: "o2", Date: "2015-05-10", Deleted: false, Recorded: clock()}}},
+		{"all present", []*clients.SLO{slo1, slo2}, nil, nil, false, nil},
+		{"service not listed", nil, []string{"other"}, nil, false, nil},
+		{"dry run", []*clients.SLO{slo1}, nil, nil, true, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			bq := mocks.NewMockBigQueryClient(mockCtrl)
+			bq.EXPECT().Query(gomock.Any(), gomock.Any()).Return([]*clients.BQRow{
+				&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo1", ServiceID: "s1", SLOID: "o1", Date: "2015-05-09", Target: 0.99},
+				&clients.BQRow{Project: "project", Service: "svc1", SLO: "slo2", ServiceID: "s1", SLOID: "o2", Date: "2015-05-09", Target: 0.99},
+			}, nil)
+			bq.EXPECT().Put(gomock.Any(), "datasetname", "data", gomock.Any()).AnyTimes().Return(nil)
+			bq.EXPECT().ReadSLOStates(gomock.Any(), "datasetname", "slo_state", "project").Return(tt.states, nil)
+			if tt.want != nil {
+				bq.EXPECT().WriteSLOStates(gomock.Any(), "datasetname", "slo_state", tt.want).Return(nil)
+			}
+
+			sloc := mocks.NewMockSLOClient(mockCtrl)
+			sloc.EXPECT().Services(gomock.Any()).Return([]*clients.Service{&clients.Service{Name: "projects/project/services/s1", DisplayName: "svc1"}}, nil)
+			sloc.EXPECT().SLOs(gomock.Any(), gomock.Any()).Return(tt.slos, nil).AnyTimes()
+
+			sd := mocks.NewMockMetricClient(mockCtrl)
+			sd.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, nil)
+
+			cfg := &Config{clock: clock, Project: "project", Dataset: "datasetname", TimeZone: "Europe/London", BackfillDays: 2,
+				TombstoneDeletedSLOs: true, ServiceInclude: tt.serviceInclude, DryRun: tt.dryRun}
+			if _, err := syncAllServices(context.Background(), cfg, sd, sloc, bq, nil); err != nil {
+				t.Errorf("syncAllServices() unexpected error: %v", err)
+			}
+		})
+	}
+}